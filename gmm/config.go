@@ -2,6 +2,8 @@ package gmm
 
 import (
 	"os"
+	"strconv"
+	"strings"
 )
 
 // Config represents application configuration
@@ -9,7 +11,43 @@ type Config struct {
 	MirrorBaseDir        string
 	MirrorUpdateInterval string
 	ManagerAddr          string
-	DistDir              string
+	AdminToken           string
+	ArchiveCacheDir      string
+	ArchiveCacheSize     string
+	MaxBlobSize          string
+	MaxBundleSize        string
+	AllowedSchemes       string
+	AllowedHosts         string
+	DeniedHosts          string
+	BlockPrivateNetworks string
+	CredentialsDir       string
+	KeyringDir           string
+	AllowedSigners       string
+	SigningKey           string
+	MaintenanceInterval  string
+	FsckInterval         string
+	BundleInterval       string
+	Quota                string
+	NamespaceQuotas      string
+	MinFreeSpace         string
+	EvictAfterDays       string
+	EvictionAction       string
+	EvictionInterval     string
+	MirrorsFile          string
+	MirrorsFileInterval  string
+	DiscoveryFile        string
+	DiscoveryInterval    string
+	WebhookURLs          string
+	WebhookSecret        string
+	WebhookEvents        string
+	WebhookRetries       string
+	SMTPAddr             string
+	SMTPUsername         string
+	SMTPPassword         string
+	SMTPFrom             string
+	SMTPTo               string
+	DigestEvents         string
+	DigestInterval       string
 }
 
 // NewConfig creates application config from environment variables
@@ -22,9 +60,74 @@ func NewConfig() *Config {
 		return val
 	}
 	return &Config{
-		DistDir:              envOrDefault("GIT_MIRROR_DISTDIR", "/opt/data/dist"),
+		ArchiveCacheDir:      envOrDefault("GIT_MIRROR_ARCHIVE_CACHE_DIR", "/opt/data/archive-cache"),
+		ArchiveCacheSize:     envOrDefault("GIT_MIRROR_ARCHIVE_CACHE_SIZE", "1G"),
+		MaxBlobSize:          envOrDefault("GIT_MIRROR_MAX_BLOB_SIZE", "10M"),
+		MaxBundleSize:        envOrDefault("GIT_MIRROR_MAX_BUNDLE_SIZE", "10G"),
 		MirrorBaseDir:        envOrDefault("GIT_MIRROR_BASEDIR", "/opt/data/mirrors"),
 		MirrorUpdateInterval: envOrDefault("GIT_MIRROR_UPDATE_INTERVAL", "0 0 * * *"),
 		ManagerAddr:          envOrDefault("GIT_MIRROR_MANAGER_ADDR", ":8080"),
+		AdminToken:           envOrDefault("GIT_MIRROR_ADMIN_TOKEN", ""),
+		AllowedSchemes:       envOrDefault("GIT_MIRROR_ALLOWED_SCHEMES", "https,ssh,git"),
+		AllowedHosts:         envOrDefault("GIT_MIRROR_ALLOWED_HOSTS", ""),
+		DeniedHosts:          envOrDefault("GIT_MIRROR_DENIED_HOSTS", ""),
+		BlockPrivateNetworks: envOrDefault("GIT_MIRROR_BLOCK_PRIVATE_NETWORKS", "true"),
+		CredentialsDir:       envOrDefault("GIT_MIRROR_CREDENTIALS_DIR", "/opt/data/credentials"),
+		KeyringDir:           envOrDefault("GIT_MIRROR_KEYRING_DIR", ""),
+		AllowedSigners:       envOrDefault("GIT_MIRROR_ALLOWED_SIGNERS", ""),
+		SigningKey:           envOrDefault("GIT_MIRROR_SIGNING_KEY", ""),
+		MaintenanceInterval:  envOrDefault("GIT_MIRROR_MAINTENANCE_INTERVAL", "@daily"),
+		FsckInterval:         envOrDefault("GIT_MIRROR_FSCK_INTERVAL", "@weekly"),
+		BundleInterval:       envOrDefault("GIT_MIRROR_BUNDLE_INTERVAL", "false"),
+		Quota:                envOrDefault("GIT_MIRROR_QUOTA", ""),
+		NamespaceQuotas:      envOrDefault("GIT_MIRROR_NAMESPACE_QUOTAS", ""),
+		MinFreeSpace:         envOrDefault("GIT_MIRROR_MIN_FREE_SPACE", "1G"),
+		EvictAfterDays:       envOrDefault("GIT_MIRROR_EVICT_AFTER_DAYS", "0"),
+		EvictionAction:       envOrDefault("GIT_MIRROR_EVICTION_ACTION", "suspend"),
+		EvictionInterval:     envOrDefault("GIT_MIRROR_EVICTION_INTERVAL", "@daily"),
+		MirrorsFile:          envOrDefault("GIT_MIRROR_MIRRORS_FILE", ""),
+		MirrorsFileInterval:  envOrDefault("GIT_MIRROR_MIRRORS_FILE_INTERVAL", "@every 1m"),
+		DiscoveryFile:        envOrDefault("GIT_MIRROR_DISCOVERY_FILE", ""),
+		DiscoveryInterval:    envOrDefault("GIT_MIRROR_DISCOVERY_INTERVAL", "@hourly"),
+		WebhookURLs:          envOrDefault("GIT_MIRROR_WEBHOOK_URLS", ""),
+		WebhookSecret:        envOrDefault("GIT_MIRROR_WEBHOOK_SECRET", ""),
+		WebhookEvents:        envOrDefault("GIT_MIRROR_WEBHOOK_EVENTS", ""),
+		WebhookRetries:       envOrDefault("GIT_MIRROR_WEBHOOK_RETRIES", "5"),
+		SMTPAddr:             envOrDefault("GIT_MIRROR_SMTP_ADDR", ""),
+		SMTPUsername:         envOrDefault("GIT_MIRROR_SMTP_USERNAME", ""),
+		SMTPPassword:         envOrDefault("GIT_MIRROR_SMTP_PASSWORD", ""),
+		SMTPFrom:             envOrDefault("GIT_MIRROR_SMTP_FROM", "git-mirror-manager@localhost"),
+		SMTPTo:               envOrDefault("GIT_MIRROR_SMTP_TO", ""),
+		DigestEvents:         envOrDefault("GIT_MIRROR_DIGEST_EVENTS", "mirror.update_failed"),
+		DigestInterval:       envOrDefault("GIT_MIRROR_DIGEST_INTERVAL", "@hourly"),
 	}
 }
+
+// SplitList splits a comma separated config value, dropping empty items
+func SplitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ParseSize parses a number of bytes with an optional K, M, G or T suffix (powers of 1024), an empty value is zero
+func ParseSize(value string) (int64, ApplicationError) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	if i := strings.Index("KMGT", value[len(value)-1:]); i != -1 {
+		multiplier = int64(1) << (10 * uint(i+1))
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, NewError("invalid size '"+value+"'", ErrUser)
+	}
+	return size * multiplier, nil
+}
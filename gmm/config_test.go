@@ -12,10 +12,46 @@ var defaultsTests = []struct {
 	customValue  string
 	envKey       string
 }{
-	{"DistDir", "/opt/data/dist", "/opt/data/distSomethingElse", "GIT_MIRROR_DISTDIR"},
+	{"ArchiveCacheDir", "/opt/data/archive-cache", "/opt/data/archive-cacheSomethingElse", "GIT_MIRROR_ARCHIVE_CACHE_DIR"},
+	{"ArchiveCacheSize", "1G", "10G", "GIT_MIRROR_ARCHIVE_CACHE_SIZE"},
+	{"MaxBlobSize", "10M", "1G", "GIT_MIRROR_MAX_BLOB_SIZE"},
+	{"MaxBundleSize", "10G", "1T", "GIT_MIRROR_MAX_BUNDLE_SIZE"},
 	{"MirrorBaseDir", "/opt/data/mirrors", "/opt/data/mirrorsSomethingElse", "GIT_MIRROR_BASEDIR"},
 	{"MirrorUpdateInterval", "0 * * * *", "5 * * * *", "GIT_MIRROR_UPDATE_INTERVAL"},
 	{"ManagerAddr", ":8080", ":555", "GIT_MIRROR_MANAGER_ADDR"},
+	{"AdminToken", "", "s3cret", "GIT_MIRROR_ADMIN_TOKEN"},
+	{"AllowedSchemes", "https,ssh,git", "https", "GIT_MIRROR_ALLOWED_SCHEMES"},
+	{"AllowedHosts", "", "github.com,*.example.com", "GIT_MIRROR_ALLOWED_HOSTS"},
+	{"DeniedHosts", "", "*.internal", "GIT_MIRROR_DENIED_HOSTS"},
+	{"BlockPrivateNetworks", "true", "false", "GIT_MIRROR_BLOCK_PRIVATE_NETWORKS"},
+	{"CredentialsDir", "/opt/data/credentials", "/run/secrets/gmm", "GIT_MIRROR_CREDENTIALS_DIR"},
+	{"KeyringDir", "", "/opt/data/keyring", "GIT_MIRROR_KEYRING_DIR"},
+	{"AllowedSigners", "", "/opt/data/allowed_signers", "GIT_MIRROR_ALLOWED_SIGNERS"},
+	{"SigningKey", "", "releases@example.com", "GIT_MIRROR_SIGNING_KEY"},
+	{"MaintenanceInterval", "@daily", "0 30 3 * * *", "GIT_MIRROR_MAINTENANCE_INTERVAL"},
+	{"FsckInterval", "@weekly", "false", "GIT_MIRROR_FSCK_INTERVAL"},
+	{"BundleInterval", "false", "@daily", "GIT_MIRROR_BUNDLE_INTERVAL"},
+	{"Quota", "", "500G", "GIT_MIRROR_QUOTA"},
+	{"NamespaceQuotas", "", "*=10G,big=100G", "GIT_MIRROR_NAMESPACE_QUOTAS"},
+	{"MinFreeSpace", "1G", "10G", "GIT_MIRROR_MIN_FREE_SPACE"},
+	{"EvictAfterDays", "0", "30", "GIT_MIRROR_EVICT_AFTER_DAYS"},
+	{"EvictionAction", "suspend", "delete", "GIT_MIRROR_EVICTION_ACTION"},
+	{"EvictionInterval", "@daily", "false", "GIT_MIRROR_EVICTION_INTERVAL"},
+	{"MirrorsFile", "", "/etc/mirrors.yaml", "GIT_MIRROR_MIRRORS_FILE"},
+	{"MirrorsFileInterval", "@every 1m", "false", "GIT_MIRROR_MIRRORS_FILE_INTERVAL"},
+	{"DiscoveryFile", "", "/etc/discovery.yaml", "GIT_MIRROR_DISCOVERY_FILE"},
+	{"DiscoveryInterval", "@hourly", "false", "GIT_MIRROR_DISCOVERY_INTERVAL"},
+	{"WebhookURLs", "", "https://hooks.example.com/gmm", "GIT_MIRROR_WEBHOOK_URLS"},
+	{"WebhookSecret", "", "s3cr3t", "GIT_MIRROR_WEBHOOK_SECRET"},
+	{"WebhookEvents", "", "mirror.update_failed", "GIT_MIRROR_WEBHOOK_EVENTS"},
+	{"WebhookRetries", "5", "3", "GIT_MIRROR_WEBHOOK_RETRIES"},
+	{"SMTPAddr", "", "smtp.example.com:587", "GIT_MIRROR_SMTP_ADDR"},
+	{"SMTPUsername", "", "gmm", "GIT_MIRROR_SMTP_USERNAME"},
+	{"SMTPPassword", "", "secret", "GIT_MIRROR_SMTP_PASSWORD"},
+	{"SMTPFrom", "git-mirror-manager@localhost", "gmm@example.com", "GIT_MIRROR_SMTP_FROM"},
+	{"SMTPTo", "", "team@example.com", "GIT_MIRROR_SMTP_TO"},
+	{"DigestEvents", "mirror.update_failed", "mirror.update_failed,mirror.removed", "GIT_MIRROR_DIGEST_EVENTS"},
+	{"DigestInterval", "@hourly", "@daily", "GIT_MIRROR_DIGEST_INTERVAL"},
 }
 
 func TestNewConfigReadsEnv(t *testing.T) {
@@ -48,3 +84,42 @@ func TestNewConfigDefaults(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitList(t *testing.T) {
+	list := SplitList(" a, b,,c ")
+	if !reflect.DeepEqual(list, []string{"a", "b", "c"}) {
+		t.Errorf("got %q", list)
+	}
+	if SplitList("") != nil {
+		t.Error("expected nil for empty value")
+	}
+}
+
+var parseSizeTests = []struct {
+	value string
+	size  int64
+	valid bool
+}{
+	{"", 0, true},
+	{"512", 512, true},
+	{"10k", 10240, true},
+	{"1G", 1 << 30, true},
+	{"2T", 2 << 40, true},
+	{"G", 0, false},
+	{"-1M", 0, false},
+	{"1.5G", 0, false},
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range parseSizeTests {
+		t.Run(tt.value, func(t *testing.T) {
+			size, err := ParseSize(tt.value)
+			if (err == nil) != tt.valid {
+				t.Errorf("got error %v, want valid %v", err, tt.valid)
+			}
+			if size != tt.size {
+				t.Errorf("got %d, want %d", size, tt.size)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package credentials
+
+import (
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/policy"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// TypeSSH authenticates using a private (deploy) key
+	TypeSSH = "ssh"
+	// TypeToken authenticates HTTPS requests using a username and token
+	TypeToken = "token"
+)
+
+// credentialHelper answers git's "get" requests with the variables injected by Env
+const credentialHelper = `!f() { test "$1" = get && echo "username=${GMM_CREDENTIAL_USERNAME}" && echo "password=${GMM_CREDENTIAL_SECRET}"; }; f`
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// Credential authenticates against upstreams matching one of its host patterns, only for the mirrors matching
+// one of its mirror name patterns when given
+type Credential struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Username string   `json:"username,omitempty"`
+	Secret   string   `json:"secret,omitempty"`
+	Hosts    []string `json:"hosts,omitempty"`
+	Mirrors  []string `json:"mirrors,omitempty"`
+}
+
+// Vault keeps credentials and provides them to git invocations
+type Vault interface {
+	Load() gmm.ApplicationError
+	Add(credential *Credential) gmm.ApplicationError
+	Remove(name string) gmm.ApplicationError
+	List() []*Credential
+	AddKnownHosts(entries string) gmm.ApplicationError
+	Env(uri string, mirror string) []string
+	Token(uri string) string
+	Redact(text string) string
+}
+
+// DirectoryVault stores credentials as files in a directory.
+// Each credential is a "<name>.json" file, SSH keys are written to "<name>.key" for ssh to use,
+// and "known_hosts" is used for all SSH connections.
+type DirectoryVault struct {
+	dir         string
+	mutex       sync.RWMutex
+	credentials map[string]*Credential
+}
+
+// NewDirectoryVault creates a new DirectoryVault
+func NewDirectoryVault(dir string) *DirectoryVault {
+	return &DirectoryVault{dir: dir, credentials: make(map[string]*Credential)}
+}
+
+// Load reads all credentials from the directory, which is created if it doesn't exist yet
+func (v *DirectoryVault) Load() gmm.ApplicationError {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if err := os.MkdirAll(v.dir, 0700); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	files, err := ioutil.ReadDir(v.dir)
+	if err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	for _, f := range files {
+		if f.IsDir() || path.Ext(f.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(v.dir, f.Name()))
+		if err != nil {
+			return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+		}
+		credential := &Credential{}
+		if err := json.Unmarshal(data, credential); err != nil {
+			return gmm.NewError("invalid credential file '"+f.Name()+"': "+err.Error(), gmm.ErrFilesystem)
+		}
+		credential.Name = strings.TrimSuffix(f.Name(), ".json")
+		if err := v.validate(credential); err != nil {
+			return err
+		}
+		// Key files are derived from the credential, and may be missing or stale after a restore
+		if err := v.writeKey(credential); err != nil {
+			return err
+		}
+		v.credentials[credential.Name] = credential
+	}
+	return nil
+}
+
+// Add validates and stores a credential, replacing any credential with the same name
+func (v *DirectoryVault) Add(credential *Credential) gmm.ApplicationError {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if err := v.validate(credential); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(v.dir, 0700); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	if err := ioutil.WriteFile(v.file(credential.Name, ".json"), data, 0600); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	if err := v.writeKey(credential); err != nil {
+		return err
+	}
+	v.credentials[credential.Name] = credential
+	return nil
+}
+
+// writeKey writes the secret of an SSH credential to its key file for ssh to use
+func (v *DirectoryVault) writeKey(credential *Credential) gmm.ApplicationError {
+	if credential.Type != TypeSSH || credential.Secret == "" {
+		return nil
+	}
+	if err := ioutil.WriteFile(v.file(credential.Name, ".key"), []byte(strings.TrimSpace(credential.Secret)+"\n"), 0600); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	return nil
+}
+
+// Remove deletes a credential and its key file
+func (v *DirectoryVault) Remove(name string) gmm.ApplicationError {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if _, ok := v.credentials[name]; !ok {
+		return gmm.NewError("credential '"+name+"' does not exist", gmm.ErrNotFound)
+	}
+	for _, ext := range []string{".json", ".key"} {
+		if err := os.Remove(v.file(name, ext)); err != nil && !os.IsNotExist(err) {
+			return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+		}
+	}
+	delete(v.credentials, name)
+	return nil
+}
+
+// List returns all credentials sorted by name, without their secrets
+func (v *DirectoryVault) List() []*Credential {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	list := []*Credential{}
+	for _, credential := range v.credentials {
+		c := *credential
+		c.Secret = ""
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// AddKnownHosts appends lines in known_hosts format to the managed known_hosts file
+func (v *DirectoryVault) AddKnownHosts(entries string) gmm.ApplicationError {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if err := os.MkdirAll(v.dir, 0700); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	var lines []string
+	for _, line := range strings.Split(entries, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(strings.Fields(line)) < 3 {
+			return gmm.NewError("invalid known_hosts entry '"+line+"'", gmm.ErrUser)
+		}
+		lines = append(lines, line)
+	}
+	f, err := os.OpenFile(v.knownHostsFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	defer f.Close()
+	for _, line := range lines {
+		if _, err := f.WriteString(line + "\n"); err != nil {
+			return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+		}
+	}
+	return nil
+}
+
+// Env returns environment variables for a git invocation talking to uri on behalf of mirror
+func (v *DirectoryVault) Env(uri string, mirror string) []string {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	scheme, host, err := policy.ParseURI(uri)
+	if err != nil {
+		return env
+	}
+
+	switch scheme {
+	case "ssh", "ssh+git", "git+ssh":
+		sshCommand := "ssh -o UserKnownHostsFile=" + quote(v.knownHostsFile()) + " -o StrictHostKeyChecking=accept-new"
+		if credential := v.match(TypeSSH, host, mirror); credential != nil {
+			sshCommand += " -o IdentitiesOnly=yes -i " + quote(v.file(credential.Name, ".key"))
+		}
+		env = append(env, "GIT_SSH_COMMAND="+sshCommand)
+	case "http", "https":
+		if credential := v.match(TypeToken, host, mirror); credential != nil {
+			username := credential.Username
+			if username == "" {
+				username = "git"
+			}
+			env = append(
+				env,
+				"GIT_CONFIG_COUNT=2",
+				"GIT_CONFIG_KEY_0=credential.helper",
+				"GIT_CONFIG_VALUE_0=",
+				"GIT_CONFIG_KEY_1=credential.helper",
+				"GIT_CONFIG_VALUE_1="+credentialHelper,
+				"GMM_CREDENTIAL_USERNAME="+username,
+				"GMM_CREDENTIAL_SECRET="+credential.Secret,
+			)
+		}
+	}
+	return env
+}
+
+// Token returns the secret of the token credential for the host of uri, or an empty string.
+// It authenticates API requests, rather than git invocations.
+func (v *DirectoryVault) Token(uri string) string {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	_, host, err := policy.ParseURI(uri)
+	if err != nil {
+		return ""
+	}
+	if credential := v.match(TypeToken, host, ""); credential != nil {
+		return credential.Secret
+	}
+	return ""
+}
+
+// Redact masks all known secrets in text
+func (v *DirectoryVault) Redact(text string) string {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	for _, credential := range v.credentials {
+		if credential.Secret != "" {
+			text = strings.Replace(text, credential.Secret, "********", -1)
+		}
+	}
+	return text
+}
+
+// match finds the credential of given type bound to host and mirror, or failing that, to host for any mirror.
+// Mirror names are derived from URIs, so credentials are never given to a host they are not bound to.
+func (v *DirectoryVault) match(credentialType string, host string, mirror string) *Credential {
+	var names []string
+	for name := range v.credentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var hostMatch *Credential
+	for _, name := range names {
+		credential := v.credentials[name]
+		if credential.Type != credentialType || !matchAny(credential.Hosts, host) {
+			continue
+		}
+		if matchAny(credential.Mirrors, mirror) {
+			return credential
+		}
+		if hostMatch == nil && len(credential.Mirrors) == 0 {
+			hostMatch = credential
+		}
+	}
+	return hostMatch
+}
+
+func (v *DirectoryVault) validate(credential *Credential) gmm.ApplicationError {
+	if !validName.MatchString(credential.Name) {
+		return gmm.NewError("credential name '"+credential.Name+"' is invalid", gmm.ErrUser)
+	}
+	if len(credential.Hosts) == 0 {
+		return gmm.NewError("credential '"+credential.Name+"' must be bound to hosts", gmm.ErrUser)
+	}
+	switch credential.Type {
+	case TypeToken:
+		if credential.Secret == "" {
+			return gmm.NewError("credential '"+credential.Name+"' requires a secret", gmm.ErrUser)
+		}
+	case TypeSSH:
+		if _, err := os.Stat(v.file(credential.Name, ".key")); credential.Secret == "" && err != nil {
+			return gmm.NewError("credential '"+credential.Name+"' requires a secret or key file", gmm.ErrUser)
+		}
+	default:
+		return gmm.NewError("credential type '"+credential.Type+"' is not supported", gmm.ErrUser)
+	}
+	return nil
+}
+
+func (v *DirectoryVault) file(name string, ext string) string {
+	return path.Join(v.dir, name+ext)
+}
+
+func (v *DirectoryVault) knownHostsFile() string {
+	return path.Join(v.dir, "known_hosts")
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func quote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
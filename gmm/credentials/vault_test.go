@@ -0,0 +1,185 @@
+package credentials_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/credentials"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestVault(t *testing.T) (*credentials.DirectoryVault, string) {
+	dir, err := ioutil.TempDir(os.TempDir(), "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return credentials.NewDirectoryVault(dir), dir
+}
+
+func envValue(env []string, key string) string {
+	for _, item := range env {
+		if strings.HasPrefix(item, key+"=") {
+			return strings.TrimPrefix(item, key+"=")
+		}
+	}
+	return ""
+}
+
+func TestAddPersistsCredential(t *testing.T) {
+	vault, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	assertions := assert.New(t)
+
+	assertions.Nil(vault.Add(&credentials.Credential{
+		Name: "deploy", Type: credentials.TypeSSH, Secret: "PRIVATE KEY", Hosts: []string{"github.com"}, Mirrors: []string{"ns/*"},
+	}))
+
+	info, err := os.Stat(dir + "/deploy.key")
+	assertions.Nil(err)
+	assertions.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	reloaded := credentials.NewDirectoryVault(dir)
+	assertions.Nil(reloaded.Load())
+	assertions.Len(reloaded.List(), 1)
+	assertions.Equal("deploy", reloaded.List()[0].Name)
+}
+
+func TestLoadRestoresKeyFiles(t *testing.T) {
+	vault, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	assertions := assert.New(t)
+	assertions.Nil(vault.Add(&credentials.Credential{Name: "deploy", Type: credentials.TypeSSH, Secret: "PRIVATE KEY", Hosts: []string{"github.com"}}))
+	assertions.Nil(vault.Add(&credentials.Credential{Name: "stale", Type: credentials.TypeSSH, Secret: "NEW KEY", Hosts: []string{"gitlab.com"}}))
+	assertions.Nil(os.Remove(dir + "/deploy.key"))
+	assertions.Nil(ioutil.WriteFile(dir+"/stale.key", []byte("OLD KEY\n"), 0600))
+
+	assertions.Nil(credentials.NewDirectoryVault(dir).Load())
+	for name, secret := range map[string]string{"deploy": "PRIVATE KEY", "stale": "NEW KEY"} {
+		key, err := ioutil.ReadFile(dir + "/" + name + ".key")
+		assertions.Nil(err)
+		assertions.Equal(secret+"\n", string(key))
+	}
+}
+
+func TestListOmitsSecrets(t *testing.T) {
+	vault, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	vault.Add(&credentials.Credential{Name: "gh", Type: credentials.TypeToken, Secret: "t0k3n", Hosts: []string{"github.com"}})
+	assert.New(t).Equal("", vault.List()[0].Secret)
+}
+
+var invalidCredentialTestData = []struct {
+	name       string
+	credential *credentials.Credential
+}{
+	{"path traversal", &credentials.Credential{Name: "../x", Type: credentials.TypeToken, Secret: "s", Hosts: []string{"*"}}},
+	{"unbound", &credentials.Credential{Name: "x", Type: credentials.TypeToken, Secret: "s"}},
+	{"no hosts", &credentials.Credential{Name: "x", Type: credentials.TypeToken, Secret: "s", Mirrors: []string{"ns/*"}}},
+	{"no token", &credentials.Credential{Name: "x", Type: credentials.TypeToken, Hosts: []string{"*"}}},
+	{"no key", &credentials.Credential{Name: "x", Type: credentials.TypeSSH, Hosts: []string{"*"}}},
+	{"unknown type", &credentials.Credential{Name: "x", Type: "password", Secret: "s", Hosts: []string{"*"}}},
+}
+
+func TestAddRejectsInvalidCredentials(t *testing.T) {
+	vault, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	for _, tt := range invalidCredentialTestData {
+		t.Run(tt.name, func(t *testing.T) {
+			err := vault.Add(tt.credential)
+			if assert.New(t).Error(err) {
+				assert.New(t).Equal(gmm.ErrUser, err.Code())
+			}
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	vault, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	assertions := assert.New(t)
+	vault.Add(&credentials.Credential{Name: "deploy", Type: credentials.TypeSSH, Secret: "KEY", Hosts: []string{"*"}})
+	assertions.Nil(vault.Remove("deploy"))
+	assertions.Len(vault.List(), 0)
+	_, err := os.Stat(dir + "/deploy.key")
+	assertions.True(os.IsNotExist(err))
+	assertions.Equal(gmm.ErrNotFound, vault.Remove("deploy").Code())
+}
+
+func TestEnvForSSH(t *testing.T) {
+	vault, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	assertions := assert.New(t)
+	vault.Add(&credentials.Credential{Name: "host", Type: credentials.TypeSSH, Secret: "KEY", Hosts: []string{"github.com"}})
+	vault.Add(&credentials.Credential{Name: "mirror", Type: credentials.TypeSSH, Secret: "KEY", Hosts: []string{"github.com"}, Mirrors: []string{"ns/special"}})
+
+	sshCommand := envValue(vault.Env("git@github.com:ns/special.git", "ns/special"), "GIT_SSH_COMMAND")
+	assertions.Contains(sshCommand, "-i '"+dir+"/mirror.key'")
+	assertions.Contains(sshCommand, "UserKnownHostsFile='"+dir+"/known_hosts'")
+
+	sshCommand = envValue(vault.Env("ssh://git@github.com/ns/other.git", "ns/other"), "GIT_SSH_COMMAND")
+	assertions.Contains(sshCommand, "-i '"+dir+"/host.key'")
+
+	sshCommand = envValue(vault.Env("ssh://git@gitlab.com/ns/other.git", "ns/other"), "GIT_SSH_COMMAND")
+	assertions.NotContains(sshCommand, "-i ")
+	assertions.Contains(sshCommand, "UserKnownHostsFile")
+
+	// Another host with a repository of the same name does not get the key
+	sshCommand = envValue(vault.Env("ssh://git@evil.example/ns/special.git", "ns/special"), "GIT_SSH_COMMAND")
+	assertions.NotContains(sshCommand, "-i ")
+}
+
+func TestEnvForMirrorTokenOnlyOnItsHosts(t *testing.T) {
+	vault, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	assertions := assert.New(t)
+	vault.Add(&credentials.Credential{Name: "app", Type: credentials.TypeToken, Secret: "t0k3n", Hosts: []string{"github.com"}, Mirrors: []string{"acme/app"}})
+
+	assertions.Equal("t0k3n", envValue(vault.Env("https://github.com/acme/app.git", "acme/app"), "GMM_CREDENTIAL_SECRET"))
+	assertions.Equal("", envValue(vault.Env("https://github.com/acme/other.git", "acme/other"), "GMM_CREDENTIAL_SECRET"))
+	assertions.Equal("", envValue(vault.Env("https://evil.example/acme/app.git", "acme/app"), "GMM_CREDENTIAL_SECRET"))
+}
+
+func TestEnvForToken(t *testing.T) {
+	vault, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	assertions := assert.New(t)
+	vault.Add(&credentials.Credential{Name: "gh", Type: credentials.TypeToken, Secret: "t0k3n", Hosts: []string{"*.github.com", "github.com"}})
+
+	env := vault.Env("https://github.com/ns/name", "ns/name")
+	assertions.Equal("t0k3n", envValue(env, "GMM_CREDENTIAL_SECRET"))
+	assertions.Equal("git", envValue(env, "GMM_CREDENTIAL_USERNAME"))
+	assertions.Equal("credential.helper", envValue(env, "GIT_CONFIG_KEY_1"))
+	assertions.NotContains(envValue(env, "GIT_CONFIG_VALUE_1"), "t0k3n")
+
+	env = vault.Env("https://gitlab.com/ns/name", "ns/name")
+	assertions.Equal([]string{"GIT_TERMINAL_PROMPT=0"}, env)
+}
+
+func TestToken(t *testing.T) {
+	vault, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	vault.Add(&credentials.Credential{Name: "api", Type: credentials.TypeToken, Secret: "t0k3n", Hosts: []string{"api.github.com"}})
+	vault.Add(&credentials.Credential{Name: "deploy", Type: credentials.TypeSSH, Secret: "KEY", Hosts: []string{"*"}})
+	assertions := assert.New(t)
+	assertions.Equal("t0k3n", vault.Token("https://api.github.com/orgs/x/repos"))
+	assertions.Equal("", vault.Token("https://gitlab.com/api/v4/groups/x/projects"))
+}
+
+func TestAddKnownHosts(t *testing.T) {
+	vault, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	assertions := assert.New(t)
+	assertions.Nil(vault.AddKnownHosts("# comment\ngithub.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5\n"))
+	assertions.Error(vault.AddKnownHosts("garbage"))
+	data, _ := ioutil.ReadFile(dir + "/known_hosts")
+	assertions.Equal("github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5\n", string(data))
+}
+
+func TestRedact(t *testing.T) {
+	vault, dir := newTestVault(t)
+	defer os.RemoveAll(dir)
+	vault.Add(&credentials.Credential{Name: "gh", Type: credentials.TypeToken, Secret: "t0k3n", Hosts: []string{"*"}})
+	assert.New(t).Equal("auth failed for ********", vault.Redact("auth failed for t0k3n"))
+}
@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxPages stops paging through an API that keeps returning a next page
+const maxPages = 1000
+
+var nextLink = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="next"`)
+
+// TokenSource returns the API token for uri, or an empty string
+type TokenSource func(uri string) string
+
+// Client lists repositories using the APIs of forges
+type Client struct {
+	HTTP  *http.Client
+	Token TokenSource
+}
+
+// NewClient creates a new Client, token may be nil
+func NewClient(token TokenSource) *Client {
+	return &Client{HTTP: &http.Client{Timeout: 30 * time.Second}, Token: token}
+}
+
+// Discover lists the repositories of source that pass its filters
+func (c *Client) Discover(source *Source) ([]*Repository, gmm.ApplicationError) {
+	var (
+		repositories []*Repository
+		err          gmm.ApplicationError
+	)
+	switch source.Forge {
+	case ForgeGitHub:
+		repositories, err = c.listGitHub(source)
+	case ForgeGitLab:
+		repositories, err = c.listGitLab(source)
+	case ForgeGitea:
+		repositories, err = c.listGitea(source)
+	default:
+		return nil, gmm.NewError("forge '"+source.Forge+"' is not supported", gmm.ErrUser)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	matching := []*Repository{}
+	for _, repository := range repositories {
+		if source.Matches(repository) {
+			matching = append(matching, repository)
+		}
+	}
+	log.Infof("Discovered %d of %d repositories of source '%s'", len(matching), len(repositories), source.Name)
+	return matching, nil
+}
+
+// pages requests uri and the next pages it links to, passing the JSON decoder of each page's body to decodePage.
+// Requests are authorized with the token for the server of source, so next pages must be on the same host.
+// It fails when there are more than maxPages, as an incomplete listing would have mirrors pruned.
+func (c *Client) pages(source *Source, uri string, authorize func(request *http.Request, token string), decodePage func(decoder *json.Decoder) error) gmm.ApplicationError {
+	token := ""
+	if c.Token != nil {
+		token = c.Token(source.ServerURL())
+	}
+	host := ""
+	for i := 0; uri != "" && i < maxPages; i++ {
+		request, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			return gmm.NewErrorUsingError(err, gmm.ErrUser)
+		}
+		if host == "" {
+			host = request.URL.Host
+		} else if request.URL.Host != host {
+			return gmm.NewError("next page '"+uri+"' is not on '"+host+"'", gmm.ErrNet)
+		}
+		request.Header.Set("Accept", "application/json")
+		if token != "" {
+			authorize(request, token)
+		}
+		response, err := c.HTTP.Do(request)
+		if err != nil {
+			return gmm.NewErrorUsingError(err, gmm.ErrNet)
+		}
+		err = decode(response, decodePage)
+		response.Body.Close()
+		if err != nil {
+			return gmm.NewError("listing '"+request.URL.Path+"' failed: "+err.Error(), gmm.ErrNet)
+		}
+		uri = next(response)
+	}
+	if uri != "" {
+		return gmm.NewError("listing stopped after "+fmt.Sprint(maxPages)+" pages, next page '"+uri+"'", gmm.ErrNet)
+	}
+	return nil
+}
+
+func decode(response *http.Response, decodePage func(decoder *json.Decoder) error) error {
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return decodePage(json.NewDecoder(response.Body))
+}
+
+// next returns the URI of the next page from the Link header, which all supported forges send
+func next(response *http.Response) string {
+	for _, link := range response.Header["Link"] {
+		if match := nextLink.FindStringSubmatch(link); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// baseURL returns the URL of the forge without trailing slash
+func baseURL(source *Source, fallback string) string {
+	if source.URL == "" {
+		return fallback
+	}
+	return strings.TrimSuffix(source.URL, "/")
+}
@@ -0,0 +1,150 @@
+package discovery_test
+
+import (
+	"fmt"
+	"github.com/kleijnweb/git-mirror-manager/gmm/discovery"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newStubForge serves two pages of repositories at path, linking the first to the second,
+// and records the requests it received
+func newStubForge(path string, pages ...string) (*httptest.Server, *[]*http.Request) {
+	var requests []*http.Request
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.URL.EscapedPath() != path {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+			return
+		}
+		page := 0
+		if r.URL.Query().Get("page") == "2" {
+			page = 1
+		} else if len(pages) > 1 {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=2>; rel="next", <%s%s?page=2>; rel="last"`, server.URL, path, server.URL, path))
+		}
+		fmt.Fprint(w, pages[page])
+	}))
+	return server, &requests
+}
+
+func TestDiscoverGitHub(t *testing.T) {
+	server, requests := newStubForge(
+		"/orgs/some-org/repos",
+		`[{"name": "a", "clone_url": "https://github.com/some-org/a.git", "ssh_url": "git@github.com:some-org/a.git", "visibility": "public", "topics": ["go"]},
+		  {"name": "old", "clone_url": "https://github.com/some-org/old.git", "archived": true}]`,
+		`[{"name": "b", "clone_url": "https://github.com/some-org/b.git", "private": true}]`,
+	)
+	defer server.Close()
+	client := discovery.NewClient(func(uri string) string { return "t0k3n" })
+	assertions := assert.New(t)
+
+	repositories, err := client.Discover(&discovery.Source{Name: "gh", Forge: discovery.ForgeGitHub, URL: server.URL, Owner: "some-org"})
+	assertions.Nil(err)
+	assertions.Equal([]*discovery.Repository{
+		{Name: "a", CloneURL: "https://github.com/some-org/a.git", SSHURL: "git@github.com:some-org/a.git", Visibility: "public", Topics: []string{"go"}},
+		{Name: "b", CloneURL: "https://github.com/some-org/b.git", Visibility: "private"},
+	}, repositories)
+	if assertions.Len(*requests, 2) {
+		assertions.Equal("token t0k3n", (*requests)[0].Header.Get("Authorization"))
+		assertions.Equal("token t0k3n", (*requests)[1].Header.Get("Authorization"))
+	}
+}
+
+func TestDiscoverGitHubUser(t *testing.T) {
+	server, requests := newStubForge("/users/someone/repos", `[]`)
+	defer server.Close()
+	client := discovery.NewClient(nil)
+	assertions := assert.New(t)
+
+	repositories, err := client.Discover(&discovery.Source{Name: "gh", Forge: discovery.ForgeGitHub, URL: server.URL, Owner: "someone", OwnerType: discovery.OwnerUser})
+	assertions.Nil(err)
+	assertions.Len(repositories, 0)
+	assertions.Equal("", (*requests)[0].Header.Get("Authorization"))
+}
+
+func TestDiscoverGitLab(t *testing.T) {
+	server, requests := newStubForge(
+		"/api/v4/groups/group%2Fsub/projects",
+		`[{"path": "a", "http_url_to_repo": "https://gitlab.local/group/sub/a.git", "ssh_url_to_repo": "git@gitlab.local:group/sub/a.git", "visibility": "internal", "tag_list": ["go"]}]`,
+		`[{"path": "b", "http_url_to_repo": "https://gitlab.local/group/sub/b.git", "visibility": "private", "topics": ["rust"]}]`,
+	)
+	defer server.Close()
+	// The token is bound to the server hosting the repositories, rather than to the API
+	client := discovery.NewClient(func(uri string) string {
+		if uri != server.URL+"/" {
+			return ""
+		}
+		return "glpat"
+	})
+	assertions := assert.New(t)
+
+	repositories, err := client.Discover(&discovery.Source{Name: "gl", Forge: discovery.ForgeGitLab, URL: server.URL + "/", Owner: "group/sub", Topics: []string{"go", "rust"}})
+	assertions.Nil(err)
+	assertions.Equal([]*discovery.Repository{
+		{Name: "a", CloneURL: "https://gitlab.local/group/sub/a.git", SSHURL: "git@gitlab.local:group/sub/a.git", Visibility: "internal", Topics: []string{"go"}},
+		{Name: "b", CloneURL: "https://gitlab.local/group/sub/b.git", Visibility: "private", Topics: []string{"rust"}},
+	}, repositories)
+	assertions.Equal("glpat", (*requests)[0].Header.Get("PRIVATE-TOKEN"))
+	assertions.Equal("true", (*requests)[0].URL.Query().Get("include_subgroups"))
+}
+
+func TestDiscoverGitea(t *testing.T) {
+	server, _ := newStubForge(
+		"/api/v1/orgs/org/repos",
+		`[{"name": "a", "clone_url": "https://gitea.local/org/a.git", "internal": true},
+		  {"name": "b", "clone_url": "https://gitea.local/org/b.git", "private": true}]`,
+	)
+	defer server.Close()
+	client := discovery.NewClient(nil)
+	assertions := assert.New(t)
+
+	repositories, err := client.Discover(&discovery.Source{Name: "tea", Forge: discovery.ForgeGitea, URL: server.URL, Owner: "org", Visibility: "internal"})
+	assertions.Nil(err)
+	assertions.Equal([]*discovery.Repository{
+		{Name: "a", CloneURL: "https://gitea.local/org/a.git", Visibility: "internal"},
+	}, repositories)
+}
+
+func TestDiscoverFailsOnErrorResponse(t *testing.T) {
+	server, _ := newStubForge("/orgs/other/repos", `[]`)
+	defer server.Close()
+	_, err := discovery.NewClient(nil).Discover(&discovery.Source{Name: "gh", Forge: discovery.ForgeGitHub, URL: server.URL, Owner: "some-org"})
+	if assert.New(t).Error(err) {
+		assert.New(t).Contains(err.Error(), "404")
+	}
+}
+
+func TestDiscoverDoesNotFollowLinksToOtherHosts(t *testing.T) {
+	other, otherRequests := newStubForge("/orgs/some-org/repos", `[]`)
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "<"+other.URL+"/orgs/some-org/repos?page=2>; rel=\"next\"")
+		fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+
+	client := discovery.NewClient(func(uri string) string { return "t0k3n" })
+	_, err := client.Discover(&discovery.Source{Name: "gh", Forge: discovery.ForgeGitHub, URL: server.URL, Owner: "some-org"})
+	assertions := assert.New(t)
+	assertions.Error(err)
+	assertions.Len(*otherRequests, 0)
+}
+
+func TestDiscoverFailsOnEndlessPages(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "<"+server.URL+"/orgs/some-org/repos?page=n>; rel=\"next\"")
+		fmt.Fprint(w, `[{"name": "repo", "full_name": "some-org/repo", "clone_url": "https://example.com/some-org/repo.git"}]`)
+	}))
+	defer server.Close()
+
+	_, err := discovery.NewClient(nil).Discover(&discovery.Source{Name: "gh", Forge: discovery.ForgeGitHub, URL: server.URL, Owner: "some-org"})
+	if assert.New(t).Error(err) {
+		assert.New(t).Contains(err.Error(), "1000 pages")
+	}
+}
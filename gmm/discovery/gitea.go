@@ -0,0 +1,56 @@
+package discovery
+
+import (
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"net/http"
+	"net/url"
+)
+
+type giteaRepository struct {
+	Name     string   `json:"name"`
+	CloneURL string   `json:"clone_url"`
+	SSHURL   string   `json:"ssh_url"`
+	Archived bool     `json:"archived"`
+	Private  bool     `json:"private"`
+	Internal bool     `json:"internal"`
+	Topics   []string `json:"topics"`
+}
+
+func (r *giteaRepository) repository() *Repository {
+	visibility := "public"
+	if r.Private {
+		visibility = "private"
+	} else if r.Internal {
+		visibility = "internal"
+	}
+	return &Repository{r.Name, r.CloneURL, r.SSHURL, r.Archived, visibility, r.Topics}
+}
+
+func (c *Client) listGitea(source *Source) ([]*Repository, gmm.ApplicationError) {
+	uri := baseURL(source, "") + "/api/v1"
+	if source.OwnerType == OwnerUser {
+		uri += "/users/" + url.PathEscape(source.Owner) + "/repos?limit=50"
+	} else {
+		uri += "/orgs/" + url.PathEscape(source.Owner) + "/repos?limit=50"
+	}
+	var repositories []*Repository
+	err := c.pages(
+		source,
+		uri,
+		func(request *http.Request, token string) {
+			request.Header.Set("Authorization", "token "+token)
+		},
+		func(decoder *json.Decoder) error {
+			var page []*giteaRepository
+			if err := decoder.Decode(&page); err != nil {
+				return err
+			}
+			for _, r := range page {
+				repositories = append(repositories, r.repository())
+			}
+			return nil
+		},
+	)
+	return repositories, err
+}
@@ -0,0 +1,57 @@
+package discovery
+
+import (
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"net/http"
+	"net/url"
+)
+
+type githubRepository struct {
+	Name       string   `json:"name"`
+	CloneURL   string   `json:"clone_url"`
+	SSHURL     string   `json:"ssh_url"`
+	Archived   bool     `json:"archived"`
+	Private    bool     `json:"private"`
+	Visibility string   `json:"visibility"`
+	Topics     []string `json:"topics"`
+}
+
+func (r *githubRepository) repository() *Repository {
+	visibility := r.Visibility
+	if visibility == "" {
+		visibility = "public"
+		if r.Private {
+			visibility = "private"
+		}
+	}
+	return &Repository{r.Name, r.CloneURL, r.SSHURL, r.Archived, visibility, r.Topics}
+}
+
+func (c *Client) listGitHub(source *Source) ([]*Repository, gmm.ApplicationError) {
+	uri := baseURL(source, "https://api.github.com")
+	if source.OwnerType == OwnerUser {
+		uri += "/users/" + url.PathEscape(source.Owner) + "/repos?type=owner&per_page=100"
+	} else {
+		uri += "/orgs/" + url.PathEscape(source.Owner) + "/repos?type=all&per_page=100"
+	}
+	var repositories []*Repository
+	err := c.pages(
+		source,
+		uri,
+		func(request *http.Request, token string) {
+			request.Header.Set("Authorization", "token "+token)
+		},
+		func(decoder *json.Decoder) error {
+			var page []*githubRepository
+			if err := decoder.Decode(&page); err != nil {
+				return err
+			}
+			for _, r := range page {
+				repositories = append(repositories, r.repository())
+			}
+			return nil
+		},
+	)
+	return repositories, err
+}
@@ -0,0 +1,51 @@
+package discovery
+
+import (
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"net/http"
+	"net/url"
+)
+
+type gitlabProject struct {
+	Path       string   `json:"path"`
+	CloneURL   string   `json:"http_url_to_repo"`
+	SSHURL     string   `json:"ssh_url_to_repo"`
+	Archived   bool     `json:"archived"`
+	Visibility string   `json:"visibility"`
+	Topics     []string `json:"topics"`
+	// TagList holds the topics before GitLab 14.5
+	TagList []string `json:"tag_list"`
+}
+
+func (p *gitlabProject) repository() *Repository {
+	return &Repository{p.Path, p.CloneURL, p.SSHURL, p.Archived, p.Visibility, append(p.Topics, p.TagList...)}
+}
+
+func (c *Client) listGitLab(source *Source) ([]*Repository, gmm.ApplicationError) {
+	uri := baseURL(source, "https://gitlab.com") + "/api/v4"
+	if source.OwnerType == OwnerUser {
+		uri += "/users/" + url.PathEscape(source.Owner) + "/projects?per_page=100"
+	} else {
+		uri += "/groups/" + url.PathEscape(source.Owner) + "/projects?include_subgroups=true&per_page=100"
+	}
+	var repositories []*Repository
+	err := c.pages(
+		source,
+		uri,
+		func(request *http.Request, token string) {
+			request.Header.Set("PRIVATE-TOKEN", token)
+		},
+		func(decoder *json.Decoder) error {
+			var page []*gitlabProject
+			if err := decoder.Decode(&page); err != nil {
+				return err
+			}
+			for _, p := range page {
+				repositories = append(repositories, p.repository())
+			}
+			return nil
+		},
+	)
+	return repositories, err
+}
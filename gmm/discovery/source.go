@@ -0,0 +1,157 @@
+package discovery
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// ForgeGitHub discovers repositories of a GitHub organization or user
+	ForgeGitHub = "github"
+	// ForgeGitLab discovers projects of a GitLab group (including subgroups) or user
+	ForgeGitLab = "gitlab"
+	// ForgeGitea discovers repositories of a Gitea (or Forgejo) organization or user
+	ForgeGitea = "gitea"
+)
+
+const (
+	// OwnerOrganization is an organization on GitHub or Gitea, or a group on GitLab
+	OwnerOrganization = "org"
+	// OwnerUser is a user account
+	OwnerUser = "user"
+)
+
+var validSourceName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// Source describes which repositories of a forge account to mirror
+type Source struct {
+	// Name identifies the source, mirrors it added are marked with it
+	Name string `json:"name"`
+	// Forge is one of the Forge constants
+	Forge string `json:"forge"`
+	// URL of the GitLab or Gitea server, or the API of GitHub Enterprise, eg. "https://ghe.example.com/api/v3".
+	// Defaults to gitlab.com and github.com.
+	URL string `json:"url,omitempty"`
+	// Owner is the organization, group or user, eg. "some-org" or "some-group/subgroup"
+	Owner string `json:"owner"`
+	// OwnerType is one of the Owner constants, an organization or group if empty
+	OwnerType string `json:"ownerType,omitempty"`
+	// Include limits the repositories to those of which the name matches one of these patterns, eg. "service-*"
+	Include []string `json:"include,omitempty"`
+	// Exclude skips repositories of which the name matches one of these patterns
+	Exclude []string `json:"exclude,omitempty"`
+	// Archived includes archived repositories, which are skipped by default
+	Archived bool `json:"archived,omitempty"`
+	// Visibility limits the repositories to "public", "internal" or "private" ones, if not empty
+	Visibility string `json:"visibility,omitempty"`
+	// Topics limits the repositories to those having at least one of these topics
+	Topics []string `json:"topics,omitempty"`
+	// SSH mirrors the SSH clone URLs instead of the HTTPS ones
+	SSH bool `json:"ssh,omitempty"`
+	// Prune removes mirrors added by this source when their repository is no longer discovered
+	Prune bool `json:"prune,omitempty"`
+	// Options are the settings of the mirrors added by this source
+	Options *git.Options `json:"options,omitempty"`
+}
+
+// Validate rejects incomplete sources
+func (s *Source) Validate() gmm.ApplicationError {
+	if !validSourceName.MatchString(s.Name) {
+		return gmm.NewError("source name '"+s.Name+"' is invalid", gmm.ErrUser)
+	}
+	switch s.Forge {
+	case ForgeGitHub, ForgeGitLab:
+	case ForgeGitea:
+		if s.URL == "" {
+			return gmm.NewError("source '"+s.Name+"' requires the url of the Gitea server", gmm.ErrUser)
+		}
+	default:
+		return gmm.NewError("forge '"+s.Forge+"' of source '"+s.Name+"' is not supported", gmm.ErrUser)
+	}
+	if s.Owner == "" {
+		return gmm.NewError("source '"+s.Name+"' requires an owner", gmm.ErrUser)
+	}
+	if s.OwnerType != "" && s.OwnerType != OwnerOrganization && s.OwnerType != OwnerUser {
+		return gmm.NewError("owner type '"+s.OwnerType+"' of source '"+s.Name+"' is not supported", gmm.ErrUser)
+	}
+	switch s.Visibility {
+	case "", "public", "internal", "private":
+	default:
+		return gmm.NewError("visibility '"+s.Visibility+"' of source '"+s.Name+"' is not supported", gmm.ErrUser)
+	}
+	for _, pattern := range append(s.Include, s.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return gmm.NewError("pattern '"+pattern+"' of source '"+s.Name+"' is invalid", gmm.ErrUser)
+		}
+	}
+	return nil
+}
+
+// Repository is a repository found on a forge
+type Repository struct {
+	Name       string
+	CloneURL   string
+	SSHURL     string
+	Archived   bool
+	Visibility string
+	Topics     []string
+}
+
+// URI returns the URI to mirror the repository from
+func (s *Source) URI(repository *Repository) string {
+	if s.SSH {
+		return repository.SSHURL
+	}
+	return repository.CloneURL
+}
+
+// ServerURL returns the URL of the server hosting the repositories of the source, which the API token is bound to
+func (s *Source) ServerURL() string {
+	switch {
+	case s.URL != "":
+		return s.URL
+	case s.Forge == ForgeGitLab:
+		return "https://gitlab.com"
+	default:
+		return "https://github.com"
+	}
+}
+
+// Matches tells whether repository passes the filters of the source
+func (s *Source) Matches(repository *Repository) bool {
+	if repository.Archived && !s.Archived {
+		return false
+	}
+	if s.Visibility != "" && s.Visibility != repository.Visibility {
+		return false
+	}
+	if len(s.Include) > 0 && !matchAny(s.Include, repository.Name) {
+		return false
+	}
+	if matchAny(s.Exclude, repository.Name) {
+		return false
+	}
+	if len(s.Topics) == 0 {
+		return true
+	}
+	for _, topic := range repository.Topics {
+		for _, wanted := range s.Topics {
+			if strings.EqualFold(topic, wanted) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package discovery_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm/discovery"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	assertions := assert.New(t)
+	assertions.Nil((&discovery.Source{Name: "gh", Forge: discovery.ForgeGitHub, Owner: "org"}).Validate())
+	assertions.Nil((&discovery.Source{Name: "tea", Forge: discovery.ForgeGitea, URL: "https://gitea.local", Owner: "me", OwnerType: discovery.OwnerUser}).Validate())
+
+	for _, source := range []*discovery.Source{
+		{Name: "../x", Forge: discovery.ForgeGitHub, Owner: "org"},
+		{Name: "x", Forge: "bitbucket", Owner: "org"},
+		{Name: "x", Forge: discovery.ForgeGitea, Owner: "org"},
+		{Name: "x", Forge: discovery.ForgeGitHub},
+		{Name: "x", Forge: discovery.ForgeGitHub, Owner: "org", OwnerType: "team"},
+		{Name: "x", Forge: discovery.ForgeGitHub, Owner: "org", Visibility: "secret"},
+		{Name: "x", Forge: discovery.ForgeGitHub, Owner: "org", Include: []string{"["}},
+	} {
+		assertions.Error(source.Validate(), source.Name+" "+source.Forge)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	repository := &discovery.Repository{Name: "Service-A", Visibility: "private", Topics: []string{"Mirror"}}
+	archived := &discovery.Repository{Name: "service-b", Visibility: "public", Archived: true}
+
+	tests := []struct {
+		source   *discovery.Source
+		expected bool
+	}{
+		{&discovery.Source{}, true},
+		{&discovery.Source{Include: []string{"service-*"}}, true},
+		{&discovery.Source{Include: []string{"lib-*"}}, false},
+		{&discovery.Source{Exclude: []string{"*-a"}}, false},
+		{&discovery.Source{Visibility: "private"}, true},
+		{&discovery.Source{Visibility: "public"}, false},
+		{&discovery.Source{Topics: []string{"other", "mirror"}}, true},
+		{&discovery.Source{Topics: []string{"other"}}, false},
+	}
+	assertions := assert.New(t)
+	for i, tt := range tests {
+		assertions.Equal(tt.expected, tt.source.Matches(repository), i)
+	}
+	assertions.False((&discovery.Source{}).Matches(archived))
+	assertions.True((&discovery.Source{Archived: true}).Matches(archived))
+}
+
+func TestURI(t *testing.T) {
+	repository := &discovery.Repository{CloneURL: "https://example.com/org/a.git", SSHURL: "git@example.com:org/a.git"}
+	assertions := assert.New(t)
+	assertions.Equal("https://example.com/org/a.git", (&discovery.Source{}).URI(repository))
+	assertions.Equal("git@example.com:org/a.git", (&discovery.Source{SSH: true}).URI(repository))
+}
+
+func TestServerURL(t *testing.T) {
+	assertions := assert.New(t)
+	assertions.Equal("https://github.com", (&discovery.Source{Forge: discovery.ForgeGitHub}).ServerURL())
+	assertions.Equal("https://gitlab.com", (&discovery.Source{Forge: discovery.ForgeGitLab}).ServerURL())
+	assertions.Equal("https://ghe.example.com/api/v3", (&discovery.Source{Forge: discovery.ForgeGitHub, URL: "https://ghe.example.com/api/v3"}).ServerURL())
+}
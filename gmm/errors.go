@@ -18,6 +18,14 @@ const (
 	ErrUser = iota
 	// ErrNotFound requested resource was not found
 	ErrNotFound = iota
+	// ErrDiskSpace not enough free disk space
+	ErrDiskSpace = iota
+	// ErrQuota disk quota exceeded
+	ErrQuota = iota
+	// ErrCorrupt a repository is corrupt
+	ErrCorrupt = iota
+	// ErrConflict the state of a resource does not allow the request
+	ErrConflict = iota
 )
 
 // ApplicationError some application error
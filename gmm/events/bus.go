@@ -0,0 +1,93 @@
+package events
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// queueSize is the number of events buffered per subscription, further events are dropped
+const queueSize = 256
+
+// Publisher accepts events
+type Publisher interface {
+	Publish(event *Event)
+}
+
+// Sink receives the events of a subscription, one at a time
+type Sink interface {
+	Send(event *Event)
+}
+
+// Bus delivers published events to the sinks subscribed to their type, without blocking the publisher
+type Bus struct {
+	mutex         sync.RWMutex
+	subscriptions []*subscription
+}
+
+type subscription struct {
+	sink  Sink
+	types []string
+	queue chan *Event
+}
+
+// NewBus creates a new Bus
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe delivers events of given types to sink, or all events when no types are given
+func (b *Bus) Subscribe(sink Sink, types ...string) {
+	s := &subscription{sink: sink, types: types, queue: make(chan *Event, queueSize)}
+	go func() {
+		for event := range s.queue {
+			s.sink.Send(event)
+		}
+	}()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscriptions = append(b.subscriptions, s)
+}
+
+// Unsubscribe stops delivering events to sink, it must be comparable
+func (b *Bus) Unsubscribe(sink Sink) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	kept := b.subscriptions[:0]
+	for _, s := range b.subscriptions {
+		if s.sink == sink {
+			close(s.queue)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	b.subscriptions = kept
+}
+
+// Publish queues event for the subscribed sinks, dropping it for sinks that fell too far behind
+func (b *Bus) Publish(event *Event) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for _, s := range b.subscriptions {
+		if !s.accepts(event.Type) {
+			continue
+		}
+		select {
+		case s.queue <- event:
+		default:
+			log.Warnf("Dropping event '%s' of '%s', sink is not keeping up", event.Type, event.Mirror)
+		}
+	}
+}
+
+func (s *subscription) accepts(eventType string) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, t := range s.types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
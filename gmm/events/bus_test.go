@@ -0,0 +1,65 @@
+package events_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type channelSink chan *events.Event
+
+func (s channelSink) Send(event *events.Event) {
+	s <- event
+}
+
+func receive(t *testing.T, sink channelSink) *events.Event {
+	select {
+	case event := <-sink:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func TestBusDeliversSubscribedTypes(t *testing.T) {
+	bus := events.NewBus()
+	all := make(channelSink, 10)
+	failures := make(channelSink, 10)
+	bus.Subscribe(all)
+	bus.Subscribe(failures, events.MirrorUpdateFailed)
+
+	bus.Publish(events.NewEvent(events.MirrorAdded, "ns/a"))
+	bus.Publish(events.NewEvent(events.MirrorUpdateFailed, "ns/a"))
+
+	assertions := assert.New(t)
+	assertions.Equal(events.MirrorAdded, receive(t, all).Type)
+	assertions.Equal(events.MirrorUpdateFailed, receive(t, all).Type)
+	assertions.Equal(events.MirrorUpdateFailed, receive(t, failures).Type)
+	assertions.Len(failures, 0)
+}
+
+func TestBusStopsDeliveringToUnsubscribedSinks(t *testing.T) {
+	bus := events.NewBus()
+	kept := make(channelSink, 10)
+	removed := make(channelSink, 10)
+	bus.Subscribe(kept)
+	bus.Subscribe(removed)
+	bus.Unsubscribe(removed)
+
+	bus.Publish(events.NewEvent(events.MirrorAdded, "ns/a"))
+
+	assertions := assert.New(t)
+	assertions.Equal(events.MirrorAdded, receive(t, kept).Type)
+	assertions.Len(removed, 0)
+}
+
+func TestNewEvent(t *testing.T) {
+	a := events.NewEvent(events.MirrorAdded, "ns/a")
+	b := events.NewEvent(events.MirrorAdded, "ns/a")
+	assertions := assert.New(t)
+	assertions.Len(a.ID, 32)
+	assertions.NotEqual(a.ID, b.ID)
+	assertions.WithinDuration(time.Now(), a.Time, time.Minute)
+}
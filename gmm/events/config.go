@@ -0,0 +1,45 @@
+package events
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+)
+
+// NewBusFromConfig creates a Bus with the webhook and SMTP digest sinks configured in config,
+// starting the schedule of digests
+func NewBusFromConfig(config *gmm.Config) (*Bus, gmm.ApplicationError) {
+	bus := NewBus()
+
+	urls := gmm.SplitList(config.WebhookURLs)
+	if len(urls) > 0 {
+		retries, err := strconv.Atoi(config.WebhookRetries)
+		if err != nil || retries < 0 {
+			return nil, gmm.NewError("invalid number of retries '"+config.WebhookRetries+"'", gmm.ErrUser)
+		}
+		types := gmm.SplitList(config.WebhookEvents)
+		if len(types) == 0 {
+			types = Notifications
+		}
+		for _, url := range urls {
+			log.Infof("Sending events to webhook '%s'", url)
+			bus.Subscribe(NewWebhookSink(url, config.WebhookSecret, retries), types...)
+		}
+	}
+
+	if config.SMTPAddr != "" {
+		to := gmm.SplitList(config.SMTPTo)
+		if len(to) == 0 {
+			return nil, gmm.NewError("sending event digests requires recipients", gmm.ErrUser)
+		}
+		sink := NewDigestSink(config.SMTPAddr, config.SMTPUsername, config.SMTPPassword, config.SMTPFrom, to)
+		digestCron, err := CreateDigestCron(sink, config.DigestInterval)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Mailing event digests to '%s'", config.SMTPTo)
+		bus.Subscribe(sink, gmm.SplitList(config.DigestEvents)...)
+		digestCron.Start()
+	}
+	return bus, nil
+}
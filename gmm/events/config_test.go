@@ -0,0 +1,22 @@
+package events_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewBusFromConfig(t *testing.T) {
+	assertions := assert.New(t)
+	bus, err := events.NewBusFromConfig(&gmm.Config{})
+	assertions.Nil(err)
+	assertions.NotNil(bus)
+
+	_, err = events.NewBusFromConfig(&gmm.Config{WebhookURLs: "https://hooks.example.com", WebhookRetries: "many"})
+	assertions.Error(err)
+	_, err = events.NewBusFromConfig(&gmm.Config{SMTPAddr: "smtp.example.com:25", DigestInterval: "@hourly"})
+	assertions.Error(err)
+	_, err = events.NewBusFromConfig(&gmm.Config{SMTPAddr: "smtp.example.com:25", SMTPTo: "team@example.com", DigestInterval: "often"})
+	assertions.Error(err)
+}
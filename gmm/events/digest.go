@@ -0,0 +1,115 @@
+package events
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/robfig/cron"
+	log "github.com/sirupsen/logrus"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailSender sends a message, like smtp.SendMail
+type MailSender func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+
+// DigestSink collects events and mails them as a single digest when flushed
+type DigestSink struct {
+	Addr   string
+	Auth   smtp.Auth
+	From   string
+	To     []string
+	Sender MailSender
+	mutex  sync.Mutex
+	events []*Event
+}
+
+// NewDigestSink creates a DigestSink sending mail using the SMTP server at addr ("host:port"),
+// authenticating if username is not empty
+func NewDigestSink(addr string, username string, password string, from string, to []string) *DigestSink {
+	var auth smtp.Auth
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i != -1 {
+			host = addr[:i]
+		}
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &DigestSink{Addr: addr, Auth: auth, From: from, To: to, Sender: smtp.SendMail}
+}
+
+// Send adds event to the next digest
+func (s *DigestSink) Send(event *Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, event)
+}
+
+// Flush mails the events collected since the last digest, if any.
+// When sending fails, the events are kept for the next digest.
+func (s *DigestSink) Flush() error {
+	s.mutex.Lock()
+	events := s.events
+	s.events = nil
+	s.mutex.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+
+	if err := s.Sender(s.Addr, s.Auth, s.From, s.To, s.message(events)); err != nil {
+		s.mutex.Lock()
+		s.events = append(events, s.events...)
+		s.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *DigestSink) message(events []*Event) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&b, "Subject: Git mirror manager: %d events\r\n", len(events))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, event := range events {
+		fmt.Fprintf(&b, "%s %s %s", event.Time.Format(time.RFC3339), event.Type, event.Mirror)
+		if event.Error != "" {
+			fmt.Fprintf(&b, ": %s", strings.Replace(event.Error, "\n", " ", -1))
+		}
+		if event.Archive != "" {
+			fmt.Fprintf(&b, ": %s", event.Archive)
+		}
+		b.WriteString("\r\n")
+		for _, change := range event.Refs {
+			fmt.Fprintf(&b, "    %s %s..%s\r\n", change.Ref, abbreviate(change.Old), abbreviate(change.New))
+		}
+	}
+	return b.Bytes()
+}
+
+func abbreviate(sha string) string {
+	if sha == "" {
+		return "0000000"
+	}
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// CreateDigestCron creates a Cron that flushes sink on schedule
+func CreateDigestCron(sink *DigestSink, interval string) (*cron.Cron, gmm.ApplicationError) {
+	c := cron.New()
+	err := c.AddFunc(interval, func() {
+		if err := sink.Flush(); err != nil {
+			log.Errorf("Sending event digest failed: %s", err)
+		}
+	})
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrCron)
+	}
+	return c, nil
+}
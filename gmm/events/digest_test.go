@@ -0,0 +1,65 @@
+package events_test
+
+import (
+	"errors"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/stretchr/testify/assert"
+	"net/smtp"
+	"testing"
+)
+
+type sentMail struct {
+	addr string
+	from string
+	to   []string
+	msg  string
+}
+
+func newTestDigestSink(err error) (*events.DigestSink, *[]*sentMail) {
+	var sent []*sentMail
+	sink := events.NewDigestSink("smtp.example.com:25", "", "", "gmm@example.com", []string{"a@example.com", "b@example.com"})
+	sink.Sender = func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		sent = append(sent, &sentMail{addr, from, to, string(msg)})
+		return err
+	}
+	return sink, &sent
+}
+
+func TestDigestSinkMailsCollectedEvents(t *testing.T) {
+	sink, sent := newTestDigestSink(nil)
+	failed := events.NewEvent(events.MirrorUpdateFailed, "ns/a")
+	failed.Error = "repository not found"
+	updated := events.NewEvent(events.MirrorUpdated, "ns/b")
+	updated.Refs = []*events.RefChange{{Ref: "refs/heads/master", Old: "0123456789", New: "abcdef0123"}}
+	sink.Send(failed)
+	sink.Send(updated)
+	assertions := assert.New(t)
+
+	assertions.Nil(sink.Flush())
+	if assertions.Len(*sent, 1) {
+		mail := (*sent)[0]
+		assertions.Equal("smtp.example.com:25", mail.addr)
+		assertions.Equal("gmm@example.com", mail.from)
+		assertions.Equal([]string{"a@example.com", "b@example.com"}, mail.to)
+		assertions.Contains(mail.msg, "To: a@example.com, b@example.com\r\n")
+		assertions.Contains(mail.msg, "Subject: Git mirror manager: 2 events\r\n")
+		assertions.Contains(mail.msg, "mirror.update_failed ns/a: repository not found\r\n")
+		assertions.Contains(mail.msg, "mirror.updated ns/b\r\n    refs/heads/master 0123456..abcdef0\r\n")
+	}
+
+	assertions.Nil(sink.Flush())
+	assertions.Len(*sent, 1)
+}
+
+func TestDigestSinkKeepsEventsWhenSendingFails(t *testing.T) {
+	sink, sent := newTestDigestSink(errors.New("connection refused"))
+	sink.Send(events.NewEvent(events.MirrorAdded, "ns/a"))
+	assertions := assert.New(t)
+
+	assertions.Error(sink.Flush())
+	sink.Send(events.NewEvent(events.MirrorRemoved, "ns/a"))
+	assertions.Error(sink.Flush())
+	if assertions.Len(*sent, 2) {
+		assertions.Contains((*sent)[1].msg, "2 events")
+	}
+}
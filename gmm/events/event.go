@@ -0,0 +1,80 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// MirrorAdded is emitted when a mirror is added
+	MirrorAdded = "mirror.added"
+	// MirrorRemoved is emitted when a mirror is removed
+	MirrorRemoved = "mirror.removed"
+	// MirrorUpdated is emitted when a clone or update changed refs
+	MirrorUpdated = "mirror.updated"
+	// MirrorUpdateFailed is emitted when a mirror could not be cloned or fetched from any upstream
+	MirrorUpdateFailed = "mirror.update_failed"
+	// ArchiveCreated is emitted when an archive of a tag was built
+	ArchiveCreated = "archive.created"
+	// BundleCreated is emitted when a bundle of a mirror was created
+	BundleCreated = "bundle.created"
+	// MirrorCloneStarted is emitted when cloning a mirror starts
+	MirrorCloneStarted = "mirror.clone_started"
+	// MirrorCloneProgress is emitted while cloning, with the progress git reports
+	MirrorCloneProgress = "mirror.clone_progress"
+	// MirrorCloneFinished is emitted when a mirror was cloned
+	MirrorCloneFinished = "mirror.clone_finished"
+	// MirrorFetched is emitted when a mirror was fetched, whether or not refs changed
+	MirrorFetched = "mirror.fetched"
+)
+
+// Notifications are the types of events worth notifying about, the others report activity as it happens
+var Notifications = []string{MirrorAdded, MirrorRemoved, MirrorUpdated, MirrorUpdateFailed, ArchiveCreated, BundleCreated}
+
+// Event describes something that happened to a mirror
+type Event struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Mirror string    `json:"mirror"`
+	// Refs are the refs changed by an update
+	Refs []*RefChange `json:"refs,omitempty"`
+	// Error describes why an update failed
+	Error string `json:"error,omitempty"`
+	// Archive is the path of a created archive
+	Archive string `json:"archive,omitempty"`
+	// Bundle is the id of a created bundle
+	Bundle string `json:"bundle,omitempty"`
+	// Upstream is the URI a mirror was cloned or fetched from
+	Upstream string `json:"upstream,omitempty"`
+	// Progress is a line of progress reported while cloning
+	Progress string `json:"progress,omitempty"`
+}
+
+const (
+	// RefCreated is a ref that did not exist before
+	RefCreated = "created"
+	// RefUpdated is a ref that moved forward
+	RefUpdated = "updated"
+	// RefForced is a ref that moved to a commit not descending from its old one, by a force-push
+	RefForced = "forced"
+	// RefDeleted is a ref that no longer exists
+	RefDeleted = "deleted"
+)
+
+// RefChange is a ref that was created (empty Old), deleted (empty New) or moved
+type RefChange struct {
+	Ref string `json:"ref"`
+	// Kind is one of the Ref constants
+	Kind string `json:"kind"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// NewEvent creates an Event of given type for a mirror, with a unique ID
+func NewEvent(eventType string, mirror string) *Event {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &Event{ID: hex.EncodeToString(id), Type: eventType, Time: time.Now().UTC(), Mirror: mirror}
+}
@@ -0,0 +1,39 @@
+package events
+
+import (
+	"sync"
+)
+
+// History is a Sink keeping the latest events, to replay them to clients that missed them
+type History struct {
+	mutex  sync.Mutex
+	size   int
+	events []*Event
+}
+
+// NewHistory creates a new History keeping up to size events
+func NewHistory(size int) *History {
+	return &History{size: size}
+}
+
+// Send keeps event, forgetting the oldest event when full
+func (h *History) Send(event *Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.events = append(h.events, event)
+	if len(h.events) > h.size {
+		h.events = append([]*Event(nil), h.events[len(h.events)-h.size:]...)
+	}
+}
+
+// Since returns the events kept after the event with given ID, or all kept events if it is no longer kept
+func (h *History) Since(id string) []*Event {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i := len(h.events) - 1; i >= 0; i-- {
+		if h.events[i].ID == id {
+			return append([]*Event(nil), h.events[i+1:]...)
+		}
+	}
+	return append([]*Event(nil), h.events...)
+}
@@ -0,0 +1,24 @@
+package events_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHistoryReplaysEventsSinceID(t *testing.T) {
+	history := events.NewHistory(2)
+	a := events.NewEvent(events.MirrorAdded, "ns/a")
+	b := events.NewEvent(events.MirrorAdded, "ns/b")
+	c := events.NewEvent(events.MirrorAdded, "ns/c")
+	history.Send(a)
+	history.Send(b)
+
+	assertions := assert.New(t)
+	assertions.Equal([]*events.Event{b}, history.Since(a.ID))
+	assertions.Len(history.Since(b.ID), 0)
+
+	history.Send(c)
+	assertions.Equal([]*events.Event{b, c}, history.Since(a.ID), "all kept events when the ID was forgotten")
+	assertions.Equal([]*events.Event{c}, history.Since(b.ID))
+}
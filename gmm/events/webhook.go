@@ -0,0 +1,86 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// WebhookSink POSTs events as JSON to a URL, retrying failed deliveries with exponential backoff.
+// When Secret is set, the body is signed in the X-GMM-Signature header, see Sign.
+type WebhookSink struct {
+	URL     string
+	Secret  string
+	Client  *http.Client
+	Retries int
+	Backoff time.Duration
+}
+
+// NewWebhookSink creates a new WebhookSink
+func NewWebhookSink(url string, secret string, retries int) *WebhookSink {
+	return &WebhookSink{
+		URL:     url,
+		Secret:  secret,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		Retries: retries,
+		Backoff: time.Second,
+	}
+}
+
+// Sign returns the signature of body, "sha256=" followed by the hex encoded HMAC-SHA256 of body keyed with secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send delivers event, giving up after the configured number of retries
+func (s *WebhookSink) Send(event *Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	backoff := s.Backoff
+	for attempt := 0; ; attempt++ {
+		err := s.deliver(event, body)
+		if err == nil {
+			return
+		}
+		if attempt >= s.Retries {
+			log.Errorf("Delivering event '%s' to '%s' failed, giving up: %s", event.ID, s.URL, err)
+			return
+		}
+		log.Warnf("Delivering event '%s' to '%s' failed, retrying in %s: %s", event.ID, s.URL, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *WebhookSink) deliver(event *Event, body []byte) error {
+	request, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-GMM-Event", event.Type)
+	request.Header.Set("X-GMM-Delivery", event.ID)
+	if s.Secret != "" {
+		request.Header.Set("X-GMM-Signature", Sign(s.Secret, body))
+	}
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected response '%s'", response.Status)
+	}
+	return nil
+}
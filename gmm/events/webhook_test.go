@@ -0,0 +1,63 @@
+package events_test
+
+import (
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	assert.New(t).Equal(
+		"sha256=77325902caca812dc259733aacd046b73817372c777b8d95b402647474516e13",
+		events.Sign("secret", []byte("{}")),
+	)
+}
+
+func TestWebhookSinkRetriesAndSigns(t *testing.T) {
+	var bodies [][]byte
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		headers = append(headers, r.Header)
+		if len(bodies) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	sink := events.NewWebhookSink(server.URL, "s3cr3t", 5)
+	sink.Backoff = time.Millisecond
+	event := events.NewEvent(events.MirrorUpdateFailed, "ns/a")
+	event.Error = "repository not found"
+	sink.Send(event)
+
+	assertions := assert.New(t)
+	if assertions.Len(bodies, 3) {
+		received := &events.Event{}
+		assertions.Nil(json.Unmarshal(bodies[2], received))
+		assertions.Equal("repository not found", received.Error)
+		assertions.Equal(events.MirrorUpdateFailed, headers[2].Get("X-GMM-Event"))
+		assertions.Equal(event.ID, headers[2].Get("X-GMM-Delivery"))
+		assertions.Equal(events.Sign("s3cr3t", bodies[2]), headers[2].Get("X-GMM-Signature"))
+	}
+}
+
+func TestWebhookSinkGivesUp(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	sink := events.NewWebhookSink(server.URL, "", 2)
+	sink.Backoff = time.Millisecond
+	sink.Send(events.NewEvent(events.MirrorAdded, "ns/a"))
+	assert.New(t).Equal(3, requests)
+}
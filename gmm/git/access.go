@@ -0,0 +1,80 @@
+package git
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// lastAccessConfigKey is the git config key under which the last access time is stored in the bare repository
+const lastAccessConfigKey = "gmm.lastAccess"
+
+// lastAccessSaveInterval limits how often the last access time is written to the repository config
+const lastAccessSaveInterval = time.Hour
+
+// RecordAccess notes that the mirror was served. A suspended mirror is resumed and updated in the background.
+func (m *Mirror) RecordAccess() {
+	now := time.Now()
+	m.mutex.Lock()
+	save := m.lastAccessSaved == nil || now.Sub(*m.lastAccessSaved) >= lastAccessSaveInterval
+	m.lastAccess = &now
+	if save {
+		m.lastAccessSaved = &now
+	}
+	m.mutex.Unlock()
+
+	if save {
+		if err := m.cmd.SetConfig(m.path, lastAccessConfigKey, now.Format(time.RFC3339)); err != nil {
+			log.Errorf("Saving last access of '%s' failed: %s", m.Name, err)
+		}
+	}
+
+	if options := m.Options(); options.Suspended {
+		log.Infof("Resuming '%s'", m.Name)
+		options.Suspended = false
+		if err := m.SetOptions(options); err != nil {
+			log.Error(err)
+			return
+		}
+		go func() {
+			if err := m.Update(); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+}
+
+// LastAccess returns when the mirror was last served, or when access tracking started for it
+func (m *Mirror) LastAccess() time.Time {
+	m.mutex.Lock()
+	lastAccess := m.lastAccess
+	m.mutex.Unlock()
+	if lastAccess != nil {
+		return *lastAccess
+	}
+
+	loaded, err := m.loadLastAccess()
+	if err != nil {
+		log.Errorf("Loading last access of '%s' failed: %s", m.Name, err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.lastAccess == nil {
+		m.lastAccess = &loaded
+		m.lastAccessSaved = &loaded
+	}
+	return *m.lastAccess
+}
+
+// loadLastAccess reads the last access time from the repository config, starting tracking now if there is none
+func (m *Mirror) loadLastAccess() (time.Time, gmm.ApplicationError) {
+	value, err := m.cmd.GetConfig(m.path, lastAccessConfigKey)
+	if err != nil {
+		return time.Now(), err
+	}
+	if lastAccess, err := time.Parse(time.RFC3339, value); err == nil {
+		return lastAccess, nil
+	}
+	now := time.Now()
+	return now, m.cmd.SetConfig(m.path, lastAccessConfigKey, now.Format(time.RFC3339))
+}
@@ -0,0 +1,52 @@
+package git_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func TestLastAccessIsLoadedFromConfig(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", nil)
+	cmd.On("GetConfig", "/path/ns/repo", "gmm.lastAccess").Return("2020-01-02T03:04:05Z", nil)
+	assert.New(t).Equal("2020-01-02T03:04:05Z", mirror.LastAccess().UTC().Format(time.RFC3339))
+}
+
+func TestLastAccessStartsTracking(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", nil)
+	cmd.On("GetConfig", "/path/ns/repo", "gmm.lastAccess").Return("", nil)
+	cmd.On("SetConfig", "/path/ns/repo", "gmm.lastAccess", mock.Anything).Return(nil)
+
+	assertions := assert.New(t)
+	assertions.WithinDuration(time.Now(), mirror.LastAccess(), time.Minute)
+	cmd.AssertCalled(t, "SetConfig", "/path/ns/repo", "gmm.lastAccess", mock.Anything)
+}
+
+func TestRecordAccessSavesAtMostHourly(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", nil)
+	cmd.On("SetConfig", "/path/ns/repo", "gmm.lastAccess", mock.Anything).Return(nil)
+
+	mirror.RecordAccess()
+	mirror.RecordAccess()
+	assertions := assert.New(t)
+	assertions.WithinDuration(time.Now(), mirror.LastAccess(), time.Minute)
+	cmd.AssertNumberOfCalls(t, "SetConfig", 1)
+	cmd.AssertNotCalled(t, "GetConfig", "/path/ns/repo", "gmm.lastAccess")
+}
+
+func TestRecordAccessResumesSuspendedMirror(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", &git.Options{Suspended: true})
+	cmd.On("SetConfig", "/path/ns/repo", "gmm.lastAccess", mock.Anything).Return(nil)
+	cmd.On("ListRefs", "/path/ns/repo").Return("", nil)
+	cmd.On("FetchPrune", "/path/ns/repo", "http://example.com/ns/repo", mock.Anything).Return(nil)
+
+	assertions := assert.New(t)
+	assertions.Nil(mirror.Update())
+	cmd.AssertNotCalled(t, "FetchPrune", mock.Anything, mock.Anything, mock.Anything)
+
+	mirror.RecordAccess()
+	assertions.False(mirror.Options().Suspended)
+	cmd.AssertCalled(t, "SetConfig", "/path/ns/repo", "gmm.options", "{}")
+}
@@ -0,0 +1,269 @@
+package git
+
+import (
+	"container/list"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveSource is the tree of a revision of a mirror that archives are generated from on demand
+type ArchiveSource struct {
+	// Tree is the id of the tree, including the content of submodules when the options say so
+	Tree       string
+	mirror     *Mirror
+	alternates []string
+}
+
+// ArchiveSource resolves revision, a ref or commit id, to the tree archives of it are generated from,
+// or fails with ErrNotFound
+func (m *Mirror) ArchiveSource(revision string) (*ArchiveSource, gmm.ApplicationError) {
+	commit, err := m.resolveCommit(revision)
+	if err != nil {
+		return nil, err
+	}
+	treeish, alternates := commit, []string(nil)
+	if m.Options().ArchiveSubmodules {
+		if treeish, alternates, err = m.submoduleTree(commit); err != nil {
+			return nil, err
+		}
+	}
+	tree, err := m.cmd.ResolveRevision(m.path, treeish+"^{tree}")
+	if err != nil {
+		return nil, err
+	}
+	return &ArchiveSource{Tree: tree, mirror: m, alternates: alternates}, nil
+}
+
+// resolveCommit returns the id of the commit revision, a ref or commit id, names, or fails with ErrNotFound
+func (m *Mirror) resolveCommit(revision string) (string, gmm.ApplicationError) {
+	if revision == "" || strings.HasPrefix(revision, "-") {
+		return "", gmm.NewError("invalid revision '"+revision+"'", gmm.ErrUser)
+	}
+	commit, err := m.cmd.ResolveRevision(m.path, revision+"^{commit}")
+	if err != nil {
+		if err.Code() == gmm.ErrNotFound {
+			return "", gmm.NewError("revision '"+revision+"' of '"+m.Name+"' does not exist", gmm.ErrNotFound)
+		}
+		return "", err
+	}
+	return commit, nil
+}
+
+// Key identifies the archive of the source in format, archives with the same key hold the same files
+func (s *ArchiveSource) Key(format string) string {
+	return s.Tree + "." + format
+}
+
+// Write generates the archive of the source in format, writing it to w
+func (s *ArchiveSource) Write(format string, w io.Writer) gmm.ApplicationError {
+	return s.mirror.cmd.WriteArchive(s.mirror.path, s.Tree, format, s.alternates, w)
+}
+
+const (
+	// cachedArchiveSuffix is appended to the key of an archive to get the name of its file in the cache, so that the
+	// cache never takes other files in its directory for archives
+	cachedArchiveSuffix = ".cached"
+	// partialArchiveSuffix is appended to the key of an archive to get the name of its file while it is generated
+	partialArchiveSuffix = ".partial"
+)
+
+// ArchiveCache keeps archives generated on demand in a directory by key, removing the least recently used
+// ones when their total size exceeds a limit
+type ArchiveCache struct {
+	dir     string
+	maxSize int64
+	mutex   sync.Mutex
+	size    int64
+	// entries are the cached archives, most recently used first
+	entries *list.List
+	index   map[string]*list.Element
+	pending map[string]*pendingArchive
+}
+
+type cachedArchive struct {
+	key  string
+	size int64
+}
+
+// pendingArchive is an archive being generated, done is closed when it is cached or failed with err
+type pendingArchive struct {
+	done chan struct{}
+	err  gmm.ApplicationError
+}
+
+// NewArchiveCache creates an ArchiveCache in dir holding up to maxSize bytes, keeping the archives cached there
+// before, ordered by the time they were last used. Files the cache did not write are left alone.
+func NewArchiveCache(dir string, maxSize int64) (*ArchiveCache, gmm.ApplicationError) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	c := &ArchiveCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: list.New(),
+		index:   make(map[string]*list.Element),
+		pending: make(map[string]*pendingArchive),
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		// Partial archives were being generated when the process stopped
+		if strings.HasSuffix(file.Name(), partialArchiveSuffix) {
+			if err := os.Remove(path.Join(dir, file.Name())); err != nil {
+				log.Error(err)
+			}
+			continue
+		}
+		if key := strings.TrimSuffix(file.Name(), cachedArchiveSuffix); key != file.Name() {
+			c.index[key] = c.entries.PushBack(&cachedArchive{key: key, size: file.Size()})
+			c.size += file.Size()
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.evict("")
+	return c, nil
+}
+
+// Open opens the archive cached by key. An archive that is not cached is generated by generate, and written to
+// stream while it is, in which case no file is returned. Requests for an archive while it is being generated wait
+// for it to be cached.
+func (c *ArchiveCache) Open(key string, stream io.Writer, generate func(w io.Writer) gmm.ApplicationError) (*os.File, gmm.ApplicationError) {
+	if strings.HasPrefix(key, ".") || strings.Contains(key, "/") {
+		return nil, gmm.NewError("invalid archive key '"+key+"'", gmm.ErrUser)
+	}
+	c.mutex.Lock()
+	for {
+		if element, ok := c.index[key]; ok {
+			defer c.mutex.Unlock()
+			return c.open(element)
+		}
+		pending, ok := c.pending[key]
+		if !ok {
+			break
+		}
+		c.mutex.Unlock()
+		<-pending.done
+		if pending.err != nil {
+			return nil, pending.err
+		}
+		// Evicted again already when other archives were cached meanwhile, in which case it is generated again
+		c.mutex.Lock()
+	}
+	pending := &pendingArchive{done: make(chan struct{})}
+	c.pending[key] = pending
+	c.mutex.Unlock()
+
+	pending.err = c.generate(key, stream, generate)
+	c.mutex.Lock()
+	delete(c.pending, key)
+	c.mutex.Unlock()
+	close(pending.done)
+	return nil, pending.err
+}
+
+// generate writes an archive aside while streaming it, and caches it when complete
+func (c *ArchiveCache) generate(key string, stream io.Writer, generate func(w io.Writer) gmm.ApplicationError) gmm.ApplicationError {
+	temporary := path.Join(c.dir, key+partialArchiveSuffix)
+	file, err := os.Create(temporary)
+	if err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	writer := &teeWriter{file: file, stream: stream}
+	generateErr := generate(writer)
+	if err := file.Close(); err != nil && generateErr == nil {
+		generateErr = gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	if generateErr == nil {
+		if err := os.Rename(temporary, c.file(key)); err != nil {
+			generateErr = gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+		}
+	}
+	if generateErr != nil {
+		if err := os.Remove(temporary); err != nil && !os.IsNotExist(err) {
+			log.Error(err)
+		}
+		return generateErr
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.index[key] = c.entries.PushFront(&cachedArchive{key: key, size: writer.size})
+	c.size += writer.size
+	c.evict(key)
+	return nil
+}
+
+// open opens a cached archive, making it the most recently used one
+func (c *ArchiveCache) open(element *list.Element) (*os.File, gmm.ApplicationError) {
+	file := c.file(element.Value.(*cachedArchive).key)
+	c.entries.MoveToFront(element)
+	// The modification time orders the archives when the cache is created again
+	now := time.Now()
+	if err := os.Chtimes(file, now, now); err != nil {
+		log.Error(err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	return f, nil
+}
+
+// evict removes the least recently used archives other than the one by key while the cache exceeds its size
+func (c *ArchiveCache) evict(key string) {
+	for element := c.entries.Back(); element != nil && c.size > c.maxSize; {
+		previous := element.Prev()
+		archive := element.Value.(*cachedArchive)
+		if archive.key != key {
+			if err := os.Remove(c.file(archive.key)); err != nil && !os.IsNotExist(err) {
+				log.Error(err)
+			}
+			c.entries.Remove(element)
+			delete(c.index, archive.key)
+			c.size -= archive.size
+		}
+		element = previous
+	}
+}
+
+// file returns the file of the archive cached by key
+func (c *ArchiveCache) file(key string) string {
+	return path.Join(c.dir, key+cachedArchiveSuffix)
+}
+
+// teeWriter writes to a file and a stream, continuing with the file when writing to the stream fails,
+// as when a client stops reading
+type teeWriter struct {
+	file   *os.File
+	stream io.Writer
+	size   int64
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.file.Write(p)
+	t.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if t.stream != nil {
+		if _, err := t.stream.Write(p); err != nil {
+			t.stream = nil
+		}
+	}
+	return n, nil
+}
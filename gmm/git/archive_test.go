@@ -0,0 +1,204 @@
+package git_test
+
+import (
+	"bytes"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func newTestArchiveCache(t *testing.T, maxSize int64) (*git.ArchiveCache, string) {
+	dir, err := ioutil.TempDir("", "gmm-archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, appErr := git.NewArchiveCache(dir, maxSize)
+	if appErr != nil {
+		t.Fatal(appErr)
+	}
+	return cache, dir
+}
+
+// generator generates archives holding content, counting how often it is called
+func generator(content string, calls *int) func(w io.Writer) gmm.ApplicationError {
+	return func(w io.Writer) gmm.ApplicationError {
+		*calls++
+		_, err := io.WriteString(w, content)
+		if err != nil {
+			return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+		}
+		return nil
+	}
+}
+
+func readArchive(t *testing.T, file *os.File) string {
+	if file == nil {
+		t.Fatal("archive was not cached")
+	}
+	defer file.Close()
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestArchiveSource(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	cmd.On("ResolveRevision", mock.Anything, "feature/x^{commit}").Return("aaa", nil)
+	cmd.On("ResolveRevision", mock.Anything, "aaa^{tree}").Return("bbb", nil)
+	cmd.On("ResolveRevision", mock.Anything, "gone^{commit}").Return("", gmm.NewError("gone", gmm.ErrNotFound))
+	var w bytes.Buffer
+	cmd.On("WriteArchive", mock.Anything, "bbb", "tar.gz", []string(nil), &w).Return(nil)
+	assertions := assert.New(t)
+
+	source, err := mirror.ArchiveSource("feature/x")
+	if assertions.Nil(err) {
+		assertions.Equal("bbb", source.Tree)
+		assertions.Equal("bbb.tar.gz", source.Key("tar.gz"))
+		assertions.Nil(source.Write("tar.gz", &w))
+	}
+	_, err = mirror.ArchiveSource("gone")
+	assertions.Equal(gmm.ErrNotFound, err.Code())
+	_, err = mirror.ArchiveSource("--output=/tmp/x")
+	assertions.Equal(gmm.ErrUser, err.Code())
+}
+
+func TestArchiveCacheStreamsThenServesCachedArchives(t *testing.T) {
+	cache, dir := newTestArchiveCache(t, 1024)
+	defer os.RemoveAll(dir)
+	assertions := assert.New(t)
+	calls := 0
+
+	var stream bytes.Buffer
+	file, err := cache.Open("aaa.zip", &stream, generator("archive", &calls))
+	assertions.Nil(err)
+	assertions.Nil(file)
+	assertions.Equal("archive", stream.String())
+
+	stream.Reset()
+	file, err = cache.Open("aaa.zip", &stream, generator("other", &calls))
+	assertions.Nil(err)
+	assertions.Equal("archive", readArchive(t, file))
+	assertions.Empty(stream.String())
+	assertions.Equal(1, calls)
+
+	// Archives cached before are kept
+	cache, err = git.NewArchiveCache(dir, 1024)
+	assertions.Nil(err)
+	file, err = cache.Open("aaa.zip", nil, generator("other", &calls))
+	assertions.Nil(err)
+	assertions.Equal("archive", readArchive(t, file))
+	assertions.Equal(1, calls)
+}
+
+func TestArchiveCacheLeavesOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmm-archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{".hidden", "other.zip", "a.zip.partial"} {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte("some content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertions := assert.New(t)
+
+	_, appErr := git.NewArchiveCache(dir, 1)
+	assertions.Nil(appErr)
+	for _, name := range []string{".hidden", "other.zip"} {
+		_, err := os.Stat(dir + "/" + name)
+		assertions.Nil(err, name)
+	}
+	_, err = os.Stat(dir + "/a.zip.partial")
+	assertions.True(os.IsNotExist(err))
+}
+
+func TestArchiveCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, dir := newTestArchiveCache(t, 10)
+	defer os.RemoveAll(dir)
+	assertions := assert.New(t)
+	calls := 0
+
+	cache.Open("a.zip", nil, generator("aaaa", &calls))
+	cache.Open("b.zip", nil, generator("bbbb", &calls))
+	file, _ := cache.Open("a.zip", nil, generator("aaaa", &calls))
+	readArchive(t, file)
+	cache.Open("c.zip", nil, generator("cccc", &calls))
+	assertions.Equal(3, calls)
+
+	file, _ = cache.Open("a.zip", nil, generator("aaaa", &calls))
+	readArchive(t, file)
+	_, err := os.Stat(dir + "/b.zip.cached")
+	assertions.True(os.IsNotExist(err))
+	cache.Open("b.zip", nil, generator("bbbb", &calls))
+	assertions.Equal(4, calls)
+}
+
+func TestArchiveCacheDoesNotCacheFailures(t *testing.T) {
+	cache, dir := newTestArchiveCache(t, 1024)
+	defer os.RemoveAll(dir)
+	assertions := assert.New(t)
+
+	_, err := cache.Open("a.zip", nil, func(w io.Writer) gmm.ApplicationError {
+		io.WriteString(w, "partial")
+		return gmm.NewError("failed", gmm.ErrGitCommand)
+	})
+	assertions.Equal(gmm.ErrGitCommand, err.Code())
+	files, _ := ioutil.ReadDir(dir)
+	assertions.Empty(files)
+
+	calls := 0
+	cache.Open("a.zip", nil, generator("archive", &calls))
+	assertions.Equal(1, calls)
+	_, err = cache.Open("../a.zip", nil, generator("archive", &calls))
+	assertions.Equal(gmm.ErrUser, err.Code())
+}
+
+func TestArchiveCacheCoalescesRequests(t *testing.T) {
+	cache, dir := newTestArchiveCache(t, 1024)
+	defer os.RemoveAll(dir)
+	assertions := assert.New(t)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	calls := 0
+	var generated sync.WaitGroup
+	generated.Add(1)
+	go func() {
+		defer generated.Done()
+		cache.Open("a.zip", nil, func(w io.Writer) gmm.ApplicationError {
+			close(started)
+			<-release
+			return generator("archive", &calls)(w)
+		})
+	}()
+	<-started
+
+	var waiting sync.WaitGroup
+	contents := make([]string, 3)
+	for i := range contents {
+		waiting.Add(1)
+		go func(i int) {
+			defer waiting.Done()
+			file, err := cache.Open("a.zip", nil, generator("other", &calls))
+			if assertions.Nil(err) && assertions.NotNil(file) {
+				content, _ := ioutil.ReadAll(file)
+				file.Close()
+				contents[i] = string(content)
+			}
+		}(i)
+	}
+	close(release)
+	generated.Wait()
+	waiting.Wait()
+	assertions.Equal(1, calls)
+	assertions.Equal([]string{"archive", "archive", "archive"}, contents)
+}
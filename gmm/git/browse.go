@@ -0,0 +1,138 @@
+package git
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// TreeEntry is a file, directory or submodule in a tree of a mirror
+type TreeEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Type is "blob" for files, "tree" for directories and "commit" for submodules
+	Type   string `json:"type"`
+	Mode   string `json:"mode"`
+	Object string `json:"object"`
+	// Size is the size of blobs in bytes
+	Size int64 `json:"size,omitempty"`
+}
+
+// Tree lists the entries of a directory at a commit of a mirror
+type Tree struct {
+	Commit  string       `json:"commit"`
+	Path    string       `json:"path"`
+	Entries []*TreeEntry `json:"entries"`
+}
+
+// Tree lists the directory named by revisionPath, a branch, tag or commit followed by the path of the directory,
+// eg. "feature/x/src". It fails with ErrNotFound when there is no such directory.
+func (m *Mirror) Tree(revisionPath string) (*Tree, gmm.ApplicationError) {
+	if err := m.assertBrowsable(); err != nil {
+		return nil, err
+	}
+	commit, dir, err := m.resolvePath(revisionPath)
+	if err != nil {
+		return nil, err
+	}
+	spec := dir
+	if spec != "" {
+		spec += "/"
+	}
+	output, err := m.cmd.ListTreeEntries(m.path, commit, spec)
+	if err != nil {
+		return nil, err
+	}
+	entries := parseTreeEntries(output)
+	// Git has no empty directories, so no entries means no directory
+	if dir != "" && len(entries) == 0 {
+		return nil, gmm.NewError("directory '"+dir+"' of '"+m.Name+"' does not exist", gmm.ErrNotFound)
+	}
+	return &Tree{Commit: commit, Path: dir, Entries: entries}, nil
+}
+
+// Blob describes the file named by revisionPath, a branch, tag or commit followed by the path of the file,
+// eg. "v1.2/composer.json". It fails with ErrNotFound when there is no such file.
+func (m *Mirror) Blob(revisionPath string) (*TreeEntry, gmm.ApplicationError) {
+	if err := m.assertBrowsable(); err != nil {
+		return nil, err
+	}
+	commit, file, err := m.resolvePath(revisionPath)
+	if err != nil {
+		return nil, err
+	}
+	if file != "" {
+		output, err := m.cmd.ListTreeEntries(m.path, commit, file)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range parseTreeEntries(output) {
+			if entry.Path == file && entry.Type == "blob" {
+				return entry, nil
+			}
+		}
+	}
+	return nil, gmm.NewError("file '"+file+"' of '"+m.Name+"' does not exist", gmm.ErrNotFound)
+}
+
+// WriteBlob writes the content of a file described by Blob to w
+func (m *Mirror) WriteBlob(entry *TreeEntry, w io.Writer) gmm.ApplicationError {
+	return m.cmd.ReadBlob(m.path, entry.Object, w)
+}
+
+// assertBrowsable fails with ErrConflict for partial mirrors, as listing their trees or reading their files would
+// fetch the objects they lack from the upstream
+func (m *Mirror) assertBrowsable() gmm.ApplicationError {
+	if mode := m.Options().Mode(); mode == CloneModeBlobless || mode == CloneModeTreeless {
+		return gmm.NewError("files of "+mode+" mirror '"+m.Name+"' cannot be browsed", gmm.ErrConflict)
+	}
+	return nil
+}
+
+// resolvePath splits revisionPath into the commit of the longest branch or tag it starts with, or of its first
+// segment otherwise, and the path following it
+func (m *Mirror) resolvePath(revisionPath string) (string, string, gmm.ApplicationError) {
+	segments := strings.Split(strings.Trim(revisionPath, "/"), "/")
+	for _, segment := range segments {
+		if segment == "." || segment == ".." {
+			return "", "", gmm.NewError("invalid path '"+revisionPath+"'", gmm.ErrUser)
+		}
+	}
+	refs := m.snapshotRefs()
+	revision, rest := segments[0], segments[1:]
+	for i := len(segments); i > 0; i-- {
+		name := strings.Join(segments[:i], "/")
+		if _, ok := refs["refs/heads/"+name]; ok {
+			revision, rest = "refs/heads/"+name, segments[i:]
+			break
+		}
+		if _, ok := refs["refs/tags/"+name]; ok {
+			revision, rest = "refs/tags/"+name, segments[i:]
+			break
+		}
+	}
+	commit, err := m.resolveCommit(revision)
+	if err != nil {
+		return "", "", err
+	}
+	return commit, path.Join(rest...), nil
+}
+
+// parseTreeEntries parses "git ls-tree -l -z" output
+func parseTreeEntries(output string) []*TreeEntry {
+	entries := []*TreeEntry{}
+	for _, line := range strings.Split(output, "\x00") {
+		// "<mode> <type> <object> <size>\t<path>", the size is "-" for trees and submodules
+		fields := strings.SplitN(line, "\t", 2)
+		meta := strings.Fields(fields[0])
+		if len(fields) != 2 || len(meta) != 4 {
+			continue
+		}
+		entry := &TreeEntry{Name: path.Base(fields[1]), Path: fields[1], Type: meta[1], Mode: meta[0], Object: meta[2]}
+		entry.Size, _ = strconv.ParseInt(meta[3], 10, 64)
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,77 @@
+package git_test
+
+import (
+	"bytes"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+)
+
+func TestTreeResolvesBranchesWithSlashes(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	cmd.On("ListRefs", mock.Anything).Return("aaa refs/heads/feature/x\nbbb refs/tags/v1", nil)
+	cmd.On("ResolveRevision", mock.Anything, "refs/heads/feature/x^{commit}").Return("aaa", nil)
+	cmd.On("ListTreeEntries", mock.Anything, "aaa", "src/").Return(
+		"040000 tree ccc       -\tsrc/lib\x00100644 blob ddd      42\tsrc/main.go\x00", nil,
+	)
+	cmd.On("ListTreeEntries", mock.Anything, "aaa", "docs/").Return("", nil)
+	assertions := assert.New(t)
+
+	tree, err := mirror.Tree("feature/x/src")
+	if assertions.Nil(err) {
+		assertions.Equal("aaa", tree.Commit)
+		assertions.Equal("src", tree.Path)
+		assertions.Equal([]*git.TreeEntry{
+			{Name: "lib", Path: "src/lib", Type: "tree", Mode: "040000", Object: "ccc"},
+			{Name: "main.go", Path: "src/main.go", Type: "blob", Mode: "100644", Object: "ddd", Size: 42},
+		}, tree.Entries)
+	}
+	_, err = mirror.Tree("feature/x/docs")
+	assertions.Equal(gmm.ErrNotFound, err.Code())
+	_, err = mirror.Tree("feature/x/../../etc")
+	assertions.Equal(gmm.ErrUser, err.Code())
+}
+
+func TestBlob(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	cmd.On("ListRefs", mock.Anything).Return("bbb refs/tags/v1", nil)
+	cmd.On("ResolveRevision", mock.Anything, "refs/tags/v1^{commit}").Return("aaa", nil)
+	cmd.On("ResolveRevision", mock.Anything, "0123abc^{commit}").Return("0123abcdef", nil)
+	cmd.On("ListTreeEntries", mock.Anything, "aaa", "go.mod").Return("100644 blob ddd      42\tgo.mod\x00", nil)
+	cmd.On("ListTreeEntries", mock.Anything, "0123abcdef", "src").Return("040000 tree ccc       -\tsrc\x00", nil)
+	var w bytes.Buffer
+	cmd.On("ReadBlob", mock.Anything, "ddd", &w).Return(nil)
+	assertions := assert.New(t)
+
+	blob, err := mirror.Blob("v1/go.mod")
+	if assertions.Nil(err) {
+		assertions.Equal(int64(42), blob.Size)
+		assertions.Nil(mirror.WriteBlob(blob, &w))
+	}
+	_, err = mirror.Blob("0123abc/src")
+	assertions.Equal(gmm.ErrNotFound, err.Code())
+	_, err = mirror.Blob("v1")
+	assertions.Equal(gmm.ErrNotFound, err.Code())
+}
+
+func TestPartialMirrorsCannotBeBrowsed(t *testing.T) {
+	mirror, _, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+
+	for _, mode := range []string{git.CloneModeBlobless, git.CloneModeTreeless} {
+		assertions.Nil(mirror.SetOptions(&git.Options{CloneMode: mode}))
+		_, err := mirror.Tree("v1/src")
+		if assertions.NotNil(err) {
+			assertions.Equal(gmm.ErrConflict, err.Code())
+		}
+		_, err = mirror.Blob("v1/go.mod")
+		if assertions.NotNil(err) {
+			assertions.Equal(gmm.ErrConflict, err.Code())
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package git
+
+import (
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// bundlesSuffix is appended to the path of a mirror to get the directory its bundles are kept in. Like the
+	// ref history, bundles are kept next to the bare repository, see refHistorySuffix.
+	bundlesSuffix = ".bundles"
+	// bundleIDFormat is the time a bundle was created, the ids of bundles sort by it
+	bundleIDFormat = "20060102T150405.000Z"
+	// bundleUpstream is recorded as the upstream of refs imported from a bundle
+	bundleUpstream = "bundle"
+)
+
+// bundlesPath returns the directory of the bundles of the mirror at mirrorPath, eg. "/base/ns/.repo.bundles"
+func bundlesPath(mirrorPath string) string {
+	return hiddenPath(mirrorPath, bundlesSuffix)
+}
+
+// Bundle describes a git bundle of a mirror, stored as "<id>.bundle" with its description in "<id>.json"
+type Bundle struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Incremental bundles lack the commits of Base or before Since, which the repository importing them must have
+	Incremental bool       `json:"incremental"`
+	Base        string     `json:"base,omitempty"`
+	Since       *time.Time `json:"since,omitempty"`
+	// Refs are all refs of the mirror when the bundle was created, which bundles based on it exclude
+	Refs   map[string]string `json:"refs"`
+	Size   int64             `json:"size"`
+	SHA256 string            `json:"sha256"`
+}
+
+// Bundles lists the bundles of the mirror, oldest first
+func (m *Mirror) Bundles() ([]*Bundle, gmm.ApplicationError) {
+	files, err := ioutil.ReadDir(bundlesPath(m.path))
+	if os.IsNotExist(err) {
+		return []*Bundle{}, nil
+	}
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	bundles := []*Bundle{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		bundle, err := m.Bundle(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			log.Warnf("Skipping bundle '%s' of '%s': %s", file.Name(), m.Name, err)
+			continue
+		}
+		bundles = append(bundles, bundle)
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].ID < bundles[j].ID })
+	return bundles, nil
+}
+
+// Bundle describes a bundle of the mirror by id, or fails with ErrNotFound
+func (m *Mirror) Bundle(id string) (*Bundle, gmm.ApplicationError) {
+	if _, err := time.Parse(bundleIDFormat, id); err != nil {
+		return nil, gmm.NewError("bundle '"+id+"' of '"+m.Name+"' does not exist", gmm.ErrNotFound)
+	}
+	data, err := ioutil.ReadFile(m.bundleFile(id, ".json"))
+	if os.IsNotExist(err) {
+		return nil, gmm.NewError("bundle '"+id+"' of '"+m.Name+"' does not exist", gmm.ErrNotFound)
+	}
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	bundle := &Bundle{}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return nil, gmm.NewError("invalid bundle '"+id+"' of '"+m.Name+"': "+err.Error(), gmm.ErrFilesystem)
+	}
+	return bundle, nil
+}
+
+// OpenBundle opens the file of a bundle of the mirror by id, or fails with ErrNotFound
+func (m *Mirror) OpenBundle(id string) (*os.File, *Bundle, gmm.ApplicationError) {
+	bundle, err := m.Bundle(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, openErr := os.Open(m.bundleFile(id, ".bundle"))
+	if openErr != nil {
+		return nil, nil, gmm.NewErrorUsingError(openErr, gmm.ErrFilesystem)
+	}
+	return file, bundle, nil
+}
+
+// CreateBundle bundles the mirror. The bundle is full unless base or since are given, in which case it only
+// contains the commits the bundle base did not reach, or those committed after since.
+// When nothing changed since, no bundle is created and nil returned.
+func (m *Mirror) CreateBundle(base string, since *time.Time) (*Bundle, gmm.ApplicationError) {
+	m.operation.Lock()
+	defer m.operation.Unlock()
+	return m.createBundle(base, since)
+}
+
+// CreateScheduledBundle creates a bundle as configured by the options, then removes the bundles exceeding BundleKeep.
+// Incremental bundles are based on the previous bundle, until BundleKeep bundles depend on the last full bundle,
+// when a full bundle is created instead, so that the older bundles can be removed.
+func (m *Mirror) CreateScheduledBundle() gmm.ApplicationError {
+	m.operation.Lock()
+	defer m.operation.Unlock()
+
+	options := m.Options()
+	base := ""
+	if options.BundleIncremental {
+		bundles, err := m.Bundles()
+		if err != nil {
+			return err
+		}
+		if len(bundles) > 0 && (options.BundleKeep == 0 || len(bundleChain(bundles, bundles[len(bundles)-1])) < options.BundleKeep) {
+			base = bundles[len(bundles)-1].ID
+		}
+	}
+	if _, err := m.createBundle(base, nil); err != nil {
+		return err
+	}
+	if options.BundleKeep > 0 {
+		return m.expireBundles(options.BundleKeep)
+	}
+	return nil
+}
+
+// RemoveBundle removes a bundle of the mirror by id, or fails with ErrNotFound
+func (m *Mirror) RemoveBundle(id string) gmm.ApplicationError {
+	if _, err := m.Bundle(id); err != nil {
+		return err
+	}
+	return m.removeBundle(id)
+}
+
+// ImportBundle updates the mirror from a bundle file, like an update from an upstream would
+func (m *Mirror) ImportBundle(file string) gmm.ApplicationError {
+	m.operation.Lock()
+	defer m.operation.Unlock()
+
+	log.Printf("Importing bundle into '%s'", m.Name)
+	before := m.snapshotRefs()
+	if err := m.cmd.FetchBundle(m.path, file); err != nil {
+		return err
+	}
+	changes := m.recordUpdate(before, bundleUpstream)
+	if m.Options().Preserve {
+		m.preserveRefs(changes)
+	}
+	m.createDists(changes)
+	log.Printf("Importing bundle into '%s' completed", m.Name)
+	m.updated()
+	return nil
+}
+
+// cloneBundle creates the repository from the bundle named by the options, recording its refs like a clone does
+func (m *Mirror) cloneBundle() gmm.ApplicationError {
+	options := *m.options
+	file := options.FromBundle
+	options.FromBundle = ""
+	m.options = &options
+
+	before, historyErr := m.history.Refs()
+	if historyErr != nil {
+		log.Errorf("Reading ref history of '%s' failed: %s", m.Name, historyErr)
+	}
+	log.Infof("Creating '%s' from bundle", m.Name)
+	if err := m.cmd.CloneBundle(file, m.path); err != nil {
+		return err
+	}
+	if err := m.cmd.SetConfig(m.path, "remote.origin.url", m.uri); err != nil {
+		return err
+	}
+	m.recordUpdate(before, bundleUpstream)
+	m.archiveTags()
+	return nil
+}
+
+func (m *Mirror) createBundle(base string, since *time.Time) (*Bundle, gmm.ApplicationError) {
+	now := time.Now().UTC()
+	bundle := &Bundle{ID: now.Format(bundleIDFormat), Time: now, Base: base, Since: since}
+	var revisions []string
+	if base != "" {
+		previous, err := m.Bundle(base)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, "--not")
+		for _, object := range previous.Refs {
+			revisions = append(revisions, object)
+		}
+	}
+	if since != nil {
+		revisions = append([]string{"--since=" + strconv.FormatInt(since.Unix(), 10)}, revisions...)
+	}
+	bundle.Incremental = len(revisions) > 0
+
+	refs := m.snapshotRefs()
+	if refs == nil {
+		return nil, gmm.NewError("listing the refs of '"+m.Name+"' failed", gmm.ErrFilesystem)
+	}
+	bundle.Refs = refs
+	if err := os.MkdirAll(bundlesPath(m.path), 0700); err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+
+	log.Printf("Bundling '%s'", m.Name)
+	file := m.bundleFile(bundle.ID, ".bundle")
+	created, err := m.cmd.CreateBundle(m.path, file, revisions...)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		log.Printf("Not bundling '%s', nothing changed", m.Name)
+		return nil, nil
+	}
+	if err := bundle.measure(file); err != nil {
+		return nil, err
+	}
+	data, marshalErr := json.Marshal(bundle)
+	if marshalErr != nil {
+		return nil, gmm.NewErrorUsingError(marshalErr, gmm.ErrFilesystem)
+	}
+	if err := ioutil.WriteFile(m.bundleFile(bundle.ID, ".json"), data, 0600); err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	log.Printf("Bundling '%s' completed", m.Name)
+	m.publishBundleCreated(bundle.ID)
+	m.measureDiskUsage()
+	return bundle, nil
+}
+
+// expireBundles removes all but the newest keep bundles, and the bundles they are based on, without which
+// they could not be imported
+func (m *Mirror) expireBundles(keep int) gmm.ApplicationError {
+	bundles, err := m.Bundles()
+	if err != nil {
+		return err
+	}
+	kept := map[string]bool{}
+	for i := len(bundles) - 1; i >= 0 && i >= len(bundles)-keep; i-- {
+		for _, bundle := range bundleChain(bundles, bundles[i]) {
+			kept[bundle.ID] = true
+		}
+	}
+	for _, bundle := range bundles {
+		if kept[bundle.ID] {
+			continue
+		}
+		log.Infof("Removing bundle '%s' of '%s'", bundle.ID, m.Name)
+		if err := m.removeBundle(bundle.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleChain returns bundle and those of bundles it is based on, newest first
+func bundleChain(bundles []*Bundle, bundle *Bundle) []*Bundle {
+	byID := map[string]*Bundle{}
+	for _, b := range bundles {
+		byID[b.ID] = b
+	}
+	chain := []*Bundle{bundle}
+	// Bases are older than the bundles based on them, which a corrupt description could contradict
+	for base := byID[bundle.Base]; base != nil && len(chain) <= len(bundles); base = byID[base.Base] {
+		chain = append(chain, base)
+	}
+	return chain
+}
+
+// removeBundle removes the description of a bundle first, so a partially removed bundle is no longer listed
+func (m *Mirror) removeBundle(id string) gmm.ApplicationError {
+	for _, extension := range []string{".json", ".bundle"} {
+		if err := os.Remove(m.bundleFile(id, extension)); err != nil && !os.IsNotExist(err) {
+			return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+		}
+	}
+	return nil
+}
+
+func (m *Mirror) bundleFile(id string, extension string) string {
+	return bundlesPath(m.path) + "/" + id + extension
+}
+
+// measure records the size and SHA-256 checksum of the bundle file
+func (b *Bundle) measure(file string) gmm.ApplicationError {
+	size, checksum, err := measureFile(file)
+	if err != nil {
+		return err
+	}
+	b.Size, b.SHA256 = size, checksum
+	return nil
+}
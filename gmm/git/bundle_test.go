@@ -0,0 +1,226 @@
+package git_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/gmm/util"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// expectBundle makes the next bundle created with revisions contain content
+func expectBundle(cmd *mocks.CommandRunner, content string, revisions ...interface{}) {
+	args := append([]interface{}{mock.Anything, mock.Anything}, revisions...)
+	cmd.On("CreateBundle", args...).Run(func(args mock.Arguments) {
+		if err := ioutil.WriteFile(args.String(1), []byte(content), 0600); err != nil {
+			panic(err)
+		}
+		// Bundle ids have millisecond precision
+		time.Sleep(2 * time.Millisecond)
+	}).Return(true, nil).Once()
+}
+
+func TestCreateIncrementalBundles(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+
+	cmd.On("ListRefs", mock.Anything).Return("aaa refs/heads/main\nzzz refs/gmm/preserved/20240102T030405.000Z/refs/heads/main", nil).Once()
+	expectBundle(cmd, "full")
+	full, err := mirror.CreateBundle("", nil)
+	assertions.Nil(err)
+	checksum := sha256.Sum256([]byte("full"))
+	assertions.False(full.Incremental)
+	assertions.Equal(map[string]string{"refs/heads/main": "aaa"}, full.Refs)
+	assertions.Equal(int64(4), full.Size)
+	assertions.Equal(hex.EncodeToString(checksum[:]), full.SHA256)
+
+	cmd.On("ListRefs", mock.Anything).Return("bbb refs/heads/main", nil).Once()
+	expectBundle(cmd, "incremental", "--not", "aaa")
+	incremental, err := mirror.CreateBundle(full.ID, nil)
+	assertions.Nil(err)
+	assertions.True(incremental.Incremental)
+	assertions.Equal(full.ID, incremental.Base)
+
+	cmd.On("ListRefs", mock.Anything).Return("bbb refs/heads/main", nil).Once()
+	cmd.On("CreateBundle", mock.Anything, mock.Anything, "--not", "bbb").Return(false, nil).Once()
+	unchanged, err := mirror.CreateBundle(incremental.ID, nil)
+	assertions.Nil(err)
+	assertions.Nil(unchanged)
+
+	bundles, err := mirror.Bundles()
+	assertions.Nil(err)
+	assertions.Equal([]*git.Bundle{full, incremental}, bundles)
+	file, bundle, err := mirror.OpenBundle(incremental.ID)
+	if assertions.Nil(err) {
+		defer file.Close()
+		content, _ := ioutil.ReadAll(file)
+		assertions.Equal("incremental", string(content))
+		assertions.Equal(incremental, bundle)
+	}
+
+	_, err = mirror.CreateBundle("20200101T000000.000Z", nil)
+	assertions.Equal(gmm.ErrNotFound, err.Code())
+	_, _, err = mirror.OpenBundle("../../ns/repo")
+	assertions.Equal(gmm.ErrNotFound, err.Code())
+}
+
+func TestCreateBundleSinceTime(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	since := time.Unix(1700000000, 0)
+	cmd.On("ListRefs", mock.Anything).Return("aaa refs/heads/main", nil)
+	expectBundle(cmd, "since", "--since=1700000000")
+
+	bundle, err := mirror.CreateBundle("", &since)
+	assertions := assert.New(t)
+	assertions.Nil(err)
+	assertions.True(bundle.Incremental)
+	assertions.Equal(since.Unix(), bundle.Since.Unix())
+}
+
+func TestScheduledBundlesAreIncrementalAndExpire(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	assertions.Nil(mirror.SetOptions(&git.Options{BundleIncremental: true, BundleKeep: 2}))
+	cmd.On("ListRefs", mock.Anything).Return("aaa refs/heads/main", nil).Once()
+	expectBundle(cmd, "full")
+	cmd.On("ListRefs", mock.Anything).Return("bbb refs/heads/main", nil).Once()
+	expectBundle(cmd, "incremental", "--not", "aaa")
+	cmd.On("ListRefs", mock.Anything).Return("ccc refs/heads/main", nil).Once()
+	expectBundle(cmd, "full again")
+	cmd.On("ListRefs", mock.Anything).Return("ddd refs/heads/main", nil).Once()
+	expectBundle(cmd, "incremental again", "--not", "ccc")
+
+	assertions.Nil(mirror.CreateScheduledBundle())
+	assertions.Nil(mirror.CreateScheduledBundle())
+	bundles, err := mirror.Bundles()
+	assertions.Nil(err)
+	assertions.Len(bundles, 2)
+
+	// The full bundle the kept incremental bundle is based on is kept too
+	assertions.Nil(mirror.CreateScheduledBundle())
+	bundles, _ = mirror.Bundles()
+	if assertions.Len(bundles, 3) {
+		assertions.False(bundles[2].Incremental)
+	}
+
+	assertions.Nil(mirror.CreateScheduledBundle())
+	bundles, _ = mirror.Bundles()
+	if assertions.Len(bundles, 2) {
+		assertions.False(bundles[0].Incremental)
+		assertions.Equal(bundles[0].ID, bundles[1].Base)
+		assertions.Nil(mirror.RemoveBundle(bundles[0].ID))
+	}
+	bundles, _ = mirror.Bundles()
+	assertions.Len(bundles, 1)
+}
+
+func TestExpiredBundlesLeaveBundlesThatCanBeImported(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "gmm-bundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream, baseDir := path.Join(dir, "upstream", "ns", "repo"), path.Join(dir, "mirrors")
+	runGit(t, dir, "init", "-q", upstream)
+	runGit(t, upstream, "commit", "-q", "--allow-empty", "-m", "initial")
+	runGit(t, dir, "clone", "-q", "--mirror", upstream, path.Join(baseDir, "ns", "repo"))
+	cmd := &git.DefaultCommandRunner{Fs: &util.OsFileSystemUtil{}, Executor: &util.OsCommandExecutor{}}
+	mirror, appErr := git.NewMirror(
+		upstream, &git.Options{BundleIncremental: true, BundleKeep: 2},
+		baseDir, updateInterval, cmd, &util.OsFileSystemUtil{}, updateCronFactoryStub, nil, nil,
+	)
+	if appErr != nil {
+		t.Fatal(appErr)
+	}
+	assertions := assert.New(t)
+
+	for i := 0; i < 5; i++ {
+		runGit(t, upstream, "commit", "-q", "--allow-empty", "-m", "change")
+		runGit(t, path.Join(baseDir, "ns", "repo"), "fetch", "-q")
+		assertions.Nil(mirror.CreateScheduledBundle())
+		// Bundle ids have millisecond precision
+		time.Sleep(2 * time.Millisecond)
+
+		bundles, err := mirror.Bundles()
+		assertions.Nil(err)
+		clone := path.Join(dir, "clone", strconv.Itoa(i))
+		for j, bundle := range bundles {
+			file, _, err := mirror.OpenBundle(bundle.ID)
+			if !assertions.Nil(err) {
+				return
+			}
+			file.Close()
+			if j == 0 {
+				runGit(t, dir, "clone", "-q", "--mirror", file.Name(), clone)
+			} else {
+				runGit(t, clone, "fetch", "-q", file.Name(), "+refs/*:refs/*")
+			}
+		}
+		assertions.Equal(runGit(t, upstream, "rev-parse", "HEAD"), runGit(t, clone, "rev-parse", "HEAD"))
+	}
+}
+
+func TestImportBundleRecordsRefHistory(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	expectRefs(cmd, "aaa refs/heads/main", "aaa refs/heads/main\nbbb refs/heads/feature")
+	cmd.On("FetchBundle", mock.Anything, "/some/file.bundle").Return(nil)
+	assertions := assert.New(t)
+
+	assertions.Nil(mirror.ImportBundle("/some/file.bundle"))
+	updates, err := mirror.RefHistory(time.Time{})
+	assertions.Nil(err)
+	if assertions.Len(updates, 1) {
+		assertions.Equal("bundle", updates[0].Upstream)
+		assertions.Equal("refs/heads/feature", updates[0].Refs[0].Ref)
+	}
+}
+
+func TestNewMirrorFromBundle(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "gmm-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	if err := os.Mkdir(path.Join(baseDir, "ns"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := &mocks.CommandRunner{}
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(false)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	mirrorPath := path.Join(baseDir, "ns/repo")
+	cmd.On("CloneBundle", "/some/file.bundle", mirrorPath).Return(nil)
+	cmd.On("SetConfig", mirrorPath, "remote.origin.url", "http://example.com/ns/repo").Return(nil)
+	cmd.On("SetConfig", mirrorPath, "gmm.options", `{"pinned":true}`).Return(nil)
+	cmd.On("ListRefs", mirrorPath).Return("aaa refs/heads/main", nil)
+
+	mirror, appErr := git.NewMirror(
+		"http://example.com/ns/repo", &git.Options{Pinned: true, FromBundle: "/some/file.bundle"},
+		baseDir, updateInterval, cmd, fs, updateCronFactoryStub, nil, nil,
+	)
+	assertions := assert.New(t)
+	if assertions.Nil(appErr) {
+		assertions.Equal(&git.Options{Pinned: true}, mirror.Options())
+		updates, _ := mirror.RefHistory(time.Time{})
+		assertions.Len(updates, 1)
+	}
+	cmd.AssertNotCalled(t, "LsRemoteTags", mock.Anything)
+	cmd.AssertNotCalled(t, "CreateMirror", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
@@ -1,10 +1,20 @@
 package git
 
 import (
+	"fmt"
 	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/credentials"
 	"github.com/kleijnweb/git-mirror-manager/gmm/util"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
 	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // CommandError represents an error executing a Git command
@@ -12,13 +22,44 @@ type CommandError interface {
 	gmm.ApplicationError
 }
 
+// Progress receives the lines git reports progress with, it may be nil
+type Progress func(line string)
+
 // CommandRunner invokes the Git CLI
 type CommandRunner interface {
 	GetRemote(directory string) (string, CommandError)
+	GetConfig(directory string, key string) (string, CommandError)
+	ListRefs(directory string) (string, CommandError)
+	DescribeRefs(directory string, contains string) (string, CommandError)
+	Log(directory string, commit string, since time.Time, skip int, limit int) (string, CommandError)
+	SetConfig(directory string, key string, value string) CommandError
+	LsRemote(uri string) (string, CommandError)
 	LsRemoteTags(uri string) (string, CommandError)
-	FetchPrune(directory string) CommandError
-	CreateMirror(uri string, dirPath string) CommandError
-	CreateTagArchive(tag string, dirPath string) CommandError
+	FetchPrune(directory string, uri string, options *Options) CommandError
+	CreateMirror(uri string, dirPath string, options *Options, progress Progress) CommandError
+	DeleteRef(directory string, ref string) CommandError
+	UpdateRef(directory string, ref string, object string) CommandError
+	CopyRefs(source string, directory string, prefix string) CommandError
+	IsAncestor(directory string, ancestor string, commit string) (bool, CommandError)
+	FetchLFS(directory string, uri string) CommandError
+	GetSubmoduleURLs(directory string, commit string) (string, CommandError)
+	Maintain(directory string) CommandError
+	Fsck(directory string) CommandError
+	Push(directory string, uri string, refspec string) CommandError
+	CreateArchive(directory string, treeish string, format string, prefix string, file string, alternates []string) CommandError
+	WriteArchive(directory string, treeish string, format string, alternates []string, w io.Writer) CommandError
+	ResolveRevision(directory string, revision string) (string, CommandError)
+	VerifySignature(directory string, object string) CommandError
+	SignFile(file string, signature string) (bool, CommandError)
+	GetSubmodules(directory string, commit string) (string, CommandError)
+	ListTree(directory string, treeish string) (string, CommandError)
+	ListTreeEntries(directory string, commit string, path string) (string, CommandError)
+	ReadBlob(directory string, object string, w io.Writer) CommandError
+	ReplaceGitlinks(directory string, commit string, trees map[string]string, alternates []string) (string, CommandError)
+	CreateBundle(directory string, file string, revisions ...string) (bool, CommandError)
+	ListBundleRefs(file string) (string, CommandError)
+	CloneBundle(file string, dirPath string) CommandError
+	FetchBundle(directory string, file string) CommandError
 	Exec(directory string, args ...string) (string, CommandError)
 }
 
@@ -26,6 +67,18 @@ type CommandRunner interface {
 type DefaultCommandRunner struct {
 	Fs       util.FileSystemUtil
 	Executor util.CommandExecutor
+	// Protocols are the only transports git may use, when not empty
+	Protocols []string
+	// Credentials are injected into invocations talking to a remote, when not nil
+	Credentials credentials.Vault
+	// MinFreeSpace is the free disk space in bytes required to clone or fetch, zero disables the check
+	MinFreeSpace uint64
+	// KeyringDir is the GnuPG home directory holding the keys signatures are verified and made with, when not empty
+	KeyringDir string
+	// AllowedSigners is the file listing the SSH keys signatures are verified against, when not empty
+	AllowedSigners string
+	// SigningKey is the GnuPG key files are signed with, when not empty
+	SigningKey string
 }
 
 // GetRemote fetches the URI for the default remote at given path
@@ -33,43 +86,477 @@ func (m *DefaultCommandRunner) GetRemote(directory string) (string, CommandError
 	return m.Exec(directory, "config", "--get", "remote.origin.url")
 }
 
+// GetConfig reads a config value of the repository at given path, which is empty if not set
+func (m *DefaultCommandRunner) GetConfig(directory string, key string) (string, CommandError) {
+	return m.Exec(directory, "config", "--default", "", "--get", key)
+}
+
+// SetConfig writes a config value of the repository at given path
+func (m *DefaultCommandRunner) SetConfig(directory string, key string, value string) CommandError {
+	_, err := m.Exec(directory, "config", key, value)
+	return err
+}
+
+// ListRefs lists all refs in a local repository, like ls-remote does for remotes
+func (m *DefaultCommandRunner) ListRefs(directory string) (string, CommandError) {
+	return m.Exec(directory, "for-each-ref", "--format=%(objectname) %(refname)")
+}
+
+// DescribeRefs lists the branches and tags in a local repository, limited to those containing the commit contains
+// if not empty. Each line holds the ref, its object, the commit an annotated tag points to, and the unix time it
+// was created at, separated by NUL characters.
+func (m *DefaultCommandRunner) DescribeRefs(directory string, contains string) (string, CommandError) {
+	args := []string{"for-each-ref", "--format=%(refname)%00%(objectname)%00%(*objectname)%00%(creatordate:unix)"}
+	if contains != "" {
+		args = append(args, "--contains="+contains)
+	}
+	return m.Exec(directory, append(args, "refs/heads", "refs/tags")...)
+}
+
+// logFormat separates the fields of a commit by unit separators: the id, parents, author name, email and unix time,
+// committer name, email and unix time, subject and body
+const logFormat = "%H%x1f%P%x1f%an%x1f%ae%x1f%at%x1f%cn%x1f%ce%x1f%ct%x1f%s%x1f%b"
+
+// Log lists up to limit commits reachable from commit after skipping skip of them, newest first, NUL separated.
+// Only commits committed after since are listed when it is not zero. See logFormat for the fields of each commit.
+func (m *DefaultCommandRunner) Log(directory string, commit string, since time.Time, skip int, limit int) (string, CommandError) {
+	args := []string{"log", "-z", "--format=" + logFormat, "--skip=" + strconv.Itoa(skip), "--max-count=" + strconv.Itoa(limit)}
+	if !since.IsZero() {
+		args = append(args, "--since="+strconv.FormatInt(since.Unix(), 10))
+	}
+	return m.Exec(directory, append(args, commit, "--")...)
+}
+
+// LsRemote lists all refs in a remote repository
+func (m *DefaultCommandRunner) LsRemote(uri string) (string, CommandError) {
+	return m.execRemote(uri, "", "ls-remote", "--", uri)
+}
+
 // LsRemoteTags lists the tags in a remote repository
 func (m *DefaultCommandRunner) LsRemoteTags(uri string) (string, CommandError) {
-	return m.Exec("", "ls-remote", "--tags", uri)
+	return m.execRemote(uri, "", "ls-remote", "--tags", "--", uri)
+}
+
+// FetchPrune updates the refs of a local repository matching the ref filters from uri,
+// removing refs that no longer exist. Fetching never collects garbage, so the objects of removed and
+// force-pushed refs are kept until maintenance, which allows preserving them.
+func (m *DefaultCommandRunner) FetchPrune(directory string, uri string, options *Options) CommandError {
+	return m.fetchPrune(directory, uri, options, nil)
 }
 
-// FetchPrune updates a local repository with the default remote
-func (m *DefaultCommandRunner) FetchPrune(directory string) CommandError {
-	_, err := m.Exec(directory, "fetch", "--prune")
+func (m *DefaultCommandRunner) fetchPrune(directory string, uri string, options *Options, progress Progress) CommandError {
+	if err := m.assertFreeSpace(directory); err != nil {
+		return err
+	}
+	args := append([]string{"-c", "gc.auto=0", "-c", "maintenance.auto=false", "fetch", "--prune"}, options.ModeArgs()...)
+	args = append(append(args, "--", uri), options.Refspecs()...)
+	_, err := m.execRemoteProgress(uri, directory, progress, args...)
 	return err
 }
 
-// CreateMirror creates a Git mirror on the filesystem
-func (m *DefaultCommandRunner) CreateMirror(uri string, dirPath string) CommandError {
+// CreateMirror creates a Git mirror on the filesystem, using the clone mode of options.
+// When refs are filtered, the bare repository is initialized and fetched into instead of cloned.
+// The progress of receiving objects is reported to progress, when not nil.
+func (m *DefaultCommandRunner) CreateMirror(uri string, dirPath string, options *Options, progress Progress) CommandError {
+	if err := m.assertFreeSpace(dirPath); err != nil {
+		return err
+	}
 	if err := m.Fs.Mkdir(path.Dir(dirPath)); err != nil {
 		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
 	}
-	_, err := m.Exec("", "clone", "--mirror", "--bare", uri, dirPath)
+	if !options.FiltersRefs() {
+		args := append([]string{"clone", "--mirror", "--bare"}, options.ModeArgs()...)
+		_, err := m.execRemoteProgress(uri, "", progress, append(args, "--", uri, dirPath)...)
+		return err
+	}
+	if err := m.createFilteredMirror(uri, dirPath, options, progress); err != nil {
+		if err := m.Fs.RemoveAll(dirPath); err != nil {
+			log.Error(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// FetchLFS downloads the LFS objects referenced by any ref of the repository at directory from uri
+func (m *DefaultCommandRunner) FetchLFS(directory string, uri string) CommandError {
+	if err := m.assertFreeSpace(directory); err != nil {
+		return err
+	}
+	_, err := m.execRemote(uri, directory, "lfs", "fetch", "--all", "--", uri)
+	return err
+}
+
+// GetSubmoduleURLs reads the submodule URLs from .gitmodules at commit, as NUL separated key and value pairs
+func (m *DefaultCommandRunner) GetSubmoduleURLs(directory string, commit string) (string, CommandError) {
+	return m.Exec(directory, "config", "-z", "--blob", commit+":.gitmodules", "--get-regexp", `^submodule\..*\.url$`)
+}
+
+// Maintain garbage collects and repacks the repository at directory, and updates its commit-graph
+func (m *DefaultCommandRunner) Maintain(directory string) CommandError {
+	_, err := m.Exec(directory, "maintenance", "run", "--task=gc", "--task=commit-graph")
+	return err
+}
+
+// Fsck verifies the connectivity and validity of the objects in the repository at directory.
+// It fails with ErrCorrupt when git found errors, rather than failed to check the repository at all.
+func (m *DefaultCommandRunner) Fsck(directory string) CommandError {
+	output, err := m.Executor.Exec("git", directory, append(m.protocolArgs(), "fsck", "--no-progress", "--no-dangling")...)
+	if _, cmdErr := m.result(output, err); cmdErr == nil || !foundErrors(err) {
+		return cmdErr
+	}
+	return gmm.NewErrorUsingError(err, gmm.ErrCorrupt)
+}
+
+// foundErrors tells whether fsck exited with the flags of the kinds of errors it found, rather than with 128 when it
+// could not run, or by a signal
+func foundErrors(err error) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Exited() && status.ExitStatus() > 0 && status.ExitStatus() < 128
+}
+
+// DeleteRef removes a ref from a local repository
+func (m *DefaultCommandRunner) DeleteRef(directory string, ref string) CommandError {
+	_, err := m.Exec(directory, "update-ref", "-d", ref)
+	return err
+}
+
+// UpdateRef points ref of a local repository to object, creating it if needed
+func (m *DefaultCommandRunner) UpdateRef(directory string, ref string, object string) CommandError {
+	_, err := m.Exec(directory, "update-ref", ref, object)
+	return err
+}
+
+// IsAncestor tells whether ancestor can be reached from commit, in which case moving a ref from ancestor
+// to commit was a fast-forward. Unlike merge-base --is-ancestor, unrelated histories are no error.
+func (m *DefaultCommandRunner) IsAncestor(directory string, ancestor string, commit string) (bool, CommandError) {
+	output, err := m.Exec(directory, "rev-list", "--count", commit+".."+ancestor)
+	if err != nil {
+		return false, err
+	}
+	return output == "0", nil
+}
+
+// Push replicates a local repository to a downstream remote, pushing all refs but the managed ones and removing
+// refs gone from it, unless refspec is given
+func (m *DefaultCommandRunner) Push(directory string, uri string, refspec string) CommandError {
+	args := []string{"push", "--prune", "--", uri, "+refs/*:refs/*", "^" + managedRefPrefix + "*"}
+	if refspec != "" {
+		args = []string{"push", "--", uri, refspec}
+	}
+	_, err := m.execRemote(uri, directory, args...)
+	return err
+}
+
+// CreateArchive writes treeish of the repository at directory to file, in format "zip", "tar.gz" or "tar.zst",
+// with paths prefixed by prefix. Objects are also looked up in the repositories at alternates.
+// Paths with the export-ignore attribute are left out.
+func (m *DefaultCommandRunner) CreateArchive(directory string, treeish string, format string, prefix string, file string, alternates []string) CommandError {
+	if err := m.Fs.Mkdir(path.Dir(file)); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	args := []string{"-c", "tar.tar.zst.command=zstd -c", "archive", "--format=" + format, "--prefix=" + prefix, "-o", file, treeish}
+	_, err := m.execEnv(directory, alternatesEnv(alternates), args...)
 	return err
 }
 
-// CreateTagArchive builds a ZIP file for a given tag
-func (m *DefaultCommandRunner) CreateTagArchive(tag string, dirPath string) CommandError {
-	if err := m.Fs.Mkdir(dirPath + "/dist/"); err != nil {
+// WriteArchive writes an archive of treeish in format to w as git generates it, reading objects from the repositories
+// at alternates too
+func (m *DefaultCommandRunner) WriteArchive(directory string, treeish string, format string, alternates []string, w io.Writer) CommandError {
+	args := append(m.protocolArgs(), "-c", "tar.tar.zst.command=zstd -c", "archive", "--format="+format, treeish)
+	if err := m.Executor.ExecWriter("git", directory, alternatesEnv(alternates), w, args...); err != nil {
+		log.Warn("Git said: " + err.Error())
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	return nil
+}
+
+// ResolveRevision returns the id of the object revision names, or fails with ErrNotFound when there is none
+func (m *DefaultCommandRunner) ResolveRevision(directory string, revision string) (string, CommandError) {
+	object, err := m.Exec(directory, "rev-parse", "--verify", "--quiet", "--end-of-options", revision)
+	if err != nil {
+		return "", gmm.NewError("revision '"+revision+"' does not exist", gmm.ErrNotFound)
+	}
+	return object, nil
+}
+
+// VerifySignature verifies the GPG or SSH signature of a tag object, or of a commit, failing when it is missing or
+// not made by a key in the keyring or allowed signers
+func (m *DefaultCommandRunner) VerifySignature(directory string, object string) CommandError {
+	kind, err := m.Exec(directory, "cat-file", "-t", object)
+	if err != nil {
+		return err
+	}
+	command := "verify-commit"
+	if kind == "tag" {
+		command = "verify-tag"
+	}
+	var args []string
+	if m.AllowedSigners != "" {
+		args = append(args, "-c", "gpg.ssh.allowedSignersFile="+m.AllowedSigners)
+	}
+	_, err = m.execEnv(directory, m.keyringEnv(), append(args, command, object)...)
+	return err
+}
+
+// SignFile writes an ASCII armored, detached GPG signature of file made with SigningKey to signature.
+// It returns false without signing when there is no SigningKey.
+func (m *DefaultCommandRunner) SignFile(file string, signature string) (bool, CommandError) {
+	if m.SigningKey == "" {
+		return false, nil
+	}
+	output, err := m.Executor.ExecEnv(
+		"gpg", "", m.keyringEnv(),
+		"--batch", "--yes", "--local-user", m.SigningKey, "--armor", "--output", signature, "--detach-sign", file,
+	)
+	if _, err := m.result(output, err); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetSubmodules reads the submodule paths and URLs from .gitmodules at commit, as NUL separated key and value pairs
+func (m *DefaultCommandRunner) GetSubmodules(directory string, commit string) (string, CommandError) {
+	return m.Exec(directory, "config", "-z", "--blob", commit+":.gitmodules", "--get-regexp", `^submodule\..*\.(path|url)$`)
+}
+
+// ListTree lists the entries of treeish recursively, NUL separated
+func (m *DefaultCommandRunner) ListTree(directory string, treeish string) (string, CommandError) {
+	return m.Exec(directory, "ls-tree", "-r", "-z", treeish)
+}
+
+// ListTreeEntries lists the entry at path in commit with its size, NUL separated, or the entries in it when path
+// ends in a slash. The root of commit is listed when path is empty. Paths are taken literally, not as patterns.
+func (m *DefaultCommandRunner) ListTreeEntries(directory string, commit string, path string) (string, CommandError) {
+	args := []string{"ls-tree", "-l", "-z", commit}
+	if path != "" {
+		args = append(args, "--", path)
+	}
+	return m.execEnv(directory, []string{"GIT_LITERAL_PATHSPECS=1"}, args...)
+}
+
+// ReadBlob writes the content of a blob to w as git reads it
+func (m *DefaultCommandRunner) ReadBlob(directory string, object string, w io.Writer) CommandError {
+	args := append(m.protocolArgs(), "cat-file", "blob", object)
+	if err := m.Executor.ExecWriter("git", directory, nil, w, args...); err != nil {
+		log.Warn("Git said: " + err.Error())
 		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
 	}
-	_, err := m.Exec(dirPath, "archive", tag, "-o", dirPath+"/dist/"+tag+".zip")
+	return nil
+}
+
+// ReplaceGitlinks writes a tree of commit in which the gitlinks at the paths in trees are replaced by the
+// trees of the commits they map to, found in the repositories at alternates, and returns its id.
+// The tree is composed in a temporary index, as a bare repository has none.
+func (m *DefaultCommandRunner) ReplaceGitlinks(directory string, commit string, trees map[string]string, alternates []string) (string, CommandError) {
+	workTree, err := ioutil.TempDir("", "gmm-tree")
+	if err != nil {
+		return "", gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	defer os.RemoveAll(workTree)
+	env := append(alternatesEnv(alternates), "GIT_WORK_TREE="+workTree, "GIT_INDEX_FILE="+path.Join(workTree, ".index"))
+
+	if _, err := m.execEnv(directory, env, "read-tree", commit); err != nil {
+		return "", err
+	}
+	for gitlink, submoduleCommit := range trees {
+		if _, err := m.execEnv(directory, env, "update-index", "--force-remove", gitlink); err != nil {
+			return "", err
+		}
+		if _, err := m.execEnv(directory, env, "read-tree", "--prefix="+gitlink+"/", submoduleCommit); err != nil {
+			return "", err
+		}
+	}
+	return m.execEnv(directory, env, "write-tree")
+}
+
+// CreateBundle bundles the refs of the repository at directory, but those managed by the mirror itself, into file.
+// revisions limit the commits bundled, eg. "--since=..." or "--not" followed by objects, which need not exist.
+// When no commits are selected no file is created, and false returned.
+func (m *DefaultCommandRunner) CreateBundle(directory string, file string, revisions ...string) (bool, CommandError) {
+	args := append([]string{"--ignore-missing", "--exclude=" + managedRefPrefix + "*", "--all"}, revisions...)
+	count, err := m.Exec(directory, append([]string{"rev-list", "--count"}, args...)...)
+	if err != nil || count == "0" {
+		return false, err
+	}
+	if _, err := m.Exec(directory, append([]string{"bundle", "create", file}, args...)...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ListBundleRefs lists the refs in a bundle file, like ls-remote does for remotes
+func (m *DefaultCommandRunner) ListBundleRefs(file string) (string, CommandError) {
+	return m.Exec("", "bundle", "list-heads", file)
+}
+
+// CloneBundle creates a Git mirror on the filesystem from a bundle file
+func (m *DefaultCommandRunner) CloneBundle(file string, dirPath string) CommandError {
+	if err := m.assertFreeSpace(dirPath); err != nil {
+		return err
+	}
+	if err := m.Fs.Mkdir(path.Dir(dirPath)); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	_, err := m.execBundle("", "clone", "--mirror", "--bare", file, dirPath)
 	return err
 }
 
+// FetchBundle updates the refs of a local repository from a bundle file, which fails when the repository
+// lacks the commits an incremental bundle requires. Refs not in the bundle are kept.
+func (m *DefaultCommandRunner) FetchBundle(directory string, file string) CommandError {
+	if err := m.assertFreeSpace(directory); err != nil {
+		return err
+	}
+	_, err := m.execBundle(directory, "fetch", file, "+refs/*:refs/*", "^"+managedRefPrefix+"*")
+	return err
+}
+
+// CopyRefs copies the refs starting with prefix, and their objects, from the local repository at source to the one
+// at directory, including refs source hides from clients
+func (m *DefaultCommandRunner) CopyRefs(source string, directory string, prefix string) CommandError {
+	// Configuration given to fetch does not reach upload-pack for local repositories, so it is given to upload-pack
+	uploadPack := "git -c transfer.hideRefs=!" + prefix + " upload-pack"
+	_, err := m.execBundle(directory, "fetch", "--no-tags", "--upload-pack="+uploadPack, source, "+"+prefix+"*:"+prefix+"*")
+	return err
+}
+
+func (m *DefaultCommandRunner) createFilteredMirror(uri string, dirPath string, options *Options, progress Progress) CommandError {
+	if _, err := m.Exec("", "init", "--bare", dirPath); err != nil {
+		return err
+	}
+	if err := m.SetConfig(dirPath, "remote.origin.url", uri); err != nil {
+		return err
+	}
+	if err := m.SetConfig(dirPath, "remote.origin.mirror", "true"); err != nil {
+		return err
+	}
+	if filter := options.PartialCloneFilter(); filter != "" {
+		if err := m.SetConfig(dirPath, "remote.origin.promisor", "true"); err != nil {
+			return err
+		}
+		if err := m.SetConfig(dirPath, "remote.origin.partialclonefilter", filter); err != nil {
+			return err
+		}
+	}
+	output, err := m.execRemote(uri, "", "ls-remote", "--symref", "--", uri, "HEAD")
+	if err != nil {
+		return err
+	}
+	if fields := strings.Fields(output); len(fields) > 2 && fields[0] == "ref:" {
+		if _, err := m.Exec(dirPath, "symbolic-ref", "HEAD", fields[1]); err != nil {
+			return err
+		}
+	}
+	return m.fetchPrune(dirPath, uri, options, progress)
+}
+
 // Exec executes "git" binary commands
 func (m *DefaultCommandRunner) Exec(directory string, args ...string) (string, CommandError) {
-	stringOutput, err := m.Executor.Exec("git", directory, args...)
+	stringOutput, err := m.Executor.Exec("git", directory, append(m.protocolArgs(), args...)...)
+	return m.result(stringOutput, err)
+}
+
+// execEnv executes "git" binary commands with env added to the environment
+func (m *DefaultCommandRunner) execEnv(directory string, env []string, args ...string) (string, CommandError) {
+	stringOutput, err := m.Executor.ExecEnv("git", directory, env, append(m.protocolArgs(), args...)...)
+	return m.result(stringOutput, err)
+}
+
+// execRemote executes "git" binary commands talking to uri, injecting credentials
+func (m *DefaultCommandRunner) execRemote(uri string, directory string, args ...string) (string, CommandError) {
+	var env []string
+	if m.Credentials != nil {
+		env = m.Credentials.Env(uri, MirrorNameFromURI(uri))
+	}
+	stringOutput, err := m.Executor.ExecEnv("git", directory, env, append(m.protocolArgs(), args...)...)
+	return m.result(stringOutput, err)
+}
+
+// execBundle executes "git" binary commands reading from a bundle file, which needs the file protocol
+// even when Protocols doesn't allow it for remotes
+func (m *DefaultCommandRunner) execBundle(directory string, args ...string) (string, CommandError) {
+	return m.Exec(directory, append([]string{"-c", "protocol.file.allow=always"}, args...)...)
+}
+
+// execRemoteProgress is like execRemote, making git report its progress to progress when not nil.
+// args must start with a git subcommand accepting --progress.
+func (m *DefaultCommandRunner) execRemoteProgress(uri string, directory string, progress Progress, args ...string) (string, CommandError) {
+	if progress == nil {
+		return m.execRemote(uri, directory, args...)
+	}
+	var env []string
+	if m.Credentials != nil {
+		env = m.Credentials.Env(uri, MirrorNameFromURI(uri))
+	}
+	args = append([]string{args[0], "--progress"}, args[1:]...)
+	stringOutput, err := m.Executor.ExecProgress("git", directory, env, func(line string) {
+		if m.Credentials != nil {
+			line = m.Credentials.Redact(line)
+		}
+		progress(line)
+	}, append(m.protocolArgs(), args...)...)
+	return m.result(stringOutput, err)
+}
 
+func (m *DefaultCommandRunner) result(stringOutput string, err error) (string, CommandError) {
 	if err != nil {
+		if m.Credentials != nil {
+			stringOutput = m.Credentials.Redact(stringOutput)
+		}
 		log.Warn("Git said: " + stringOutput)
 		return "", gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
 	}
 
 	return stringOutput, nil
 }
+
+// assertFreeSpace fails with ErrDiskSpace when less than MinFreeSpace is available at path
+func (m *DefaultCommandRunner) assertFreeSpace(path string) CommandError {
+	if m.MinFreeSpace == 0 {
+		return nil
+	}
+	free, err := m.Fs.FreeSpace(path)
+	if err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	if free < m.MinFreeSpace {
+		return gmm.NewError(fmt.Sprintf("only %d bytes free for '%s', %d required", free, path, m.MinFreeSpace), gmm.ErrDiskSpace)
+	}
+	return nil
+}
+
+// keyringEnv points GnuPG to KeyringDir, if any
+func (m *DefaultCommandRunner) keyringEnv() []string {
+	if m.KeyringDir == "" {
+		return nil
+	}
+	return []string{"GNUPGHOME=" + m.KeyringDir}
+}
+
+// alternatesEnv makes git look up objects in the repositories at alternates too, when not empty
+func alternatesEnv(alternates []string) []string {
+	if len(alternates) == 0 {
+		return nil
+	}
+	objects := make([]string, len(alternates))
+	for i, alternate := range alternates {
+		objects[i] = path.Join(alternate, "objects")
+	}
+	return []string{"GIT_ALTERNATE_OBJECT_DIRECTORIES=" + strings.Join(objects, ":")}
+}
+
+func (m *DefaultCommandRunner) protocolArgs() []string {
+	if len(m.Protocols) == 0 {
+		return nil
+	}
+	args := []string{"-c", "protocol.allow=never"}
+	for _, protocol := range m.Protocols {
+		args = append(args, "-c", "protocol."+protocol+".allow=always")
+	}
+	return args
+}
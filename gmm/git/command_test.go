@@ -1,12 +1,21 @@
 package git_test
 
 import (
+	"bytes"
 	"errors"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
 	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/gmm/util"
 	"github.com/kleijnweb/git-mirror-manager/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 func factory() (*git.DefaultCommandRunner, *mocks.FileSystemUtil, *mocks.CommandExecutor) {
@@ -36,43 +45,189 @@ func TestGitExec(t *testing.T) {
 	}
 }
 
+func TestGitExecRestrictsProtocols(t *testing.T) {
+	cmd, _, mockExec := factory()
+	cmd.Protocols = []string{"https", "ssh"}
+
+	path := "/some/fauxpath"
+
+	mockExec.On(
+		"Exec", "git", path,
+		"-c", "protocol.allow=never",
+		"-c", "protocol.https.allow=always",
+		"-c", "protocol.ssh.allow=always",
+		"fetch", "--prune",
+	).Return("", nil)
+
+	if _, err := cmd.Exec(path, "fetch", "--prune"); err != nil {
+		t.Errorf("unexpected errors: %s", err)
+	}
+}
+
 func TestGitCreateMirror(t *testing.T) {
 	cmd, _, mockExec := factory()
 
 	uri := "https://github.com/sirupsen/logrus"
 	path := "/some/fauxpath"
 
-	mockExec.On("Exec", "git", "", "clone", "--mirror", "--bare", uri, path).Return("", nil)
+	mockExec.On("ExecEnv", "git", "", []string(nil), "clone", "--mirror", "--bare", "--", uri, path).Return("", nil)
 
-	if err := cmd.CreateMirror(uri, path); err != nil {
+	if err := cmd.CreateMirror(uri, path, &git.Options{}, nil); err != nil {
 		t.Errorf("unexpected errors: %s", err)
 	}
 
 	path = "/some/other/fauxpath"
 
-	mockExec.On("Exec", "git", "", "clone", "--mirror", "--bare", uri, path).Return("stderr output", errors.New("errors message"))
+	mockExec.On("ExecEnv", "git", "", []string(nil), "clone", "--mirror", "--bare", "--", uri, path).Return("stderr output", errors.New("errors message"))
 
-	if err := cmd.CreateMirror(uri, path); err == nil {
+	if err := cmd.CreateMirror(uri, path, &git.Options{}, nil); err == nil {
 		t.Errorf("expected errors")
 	}
 }
 
-func TestGitCreateTagArchive(t *testing.T) {
+func TestGitCreateMirrorUsesCloneMode(t *testing.T) {
 	cmd, _, mockExec := factory()
+	uri := "https://github.com/sirupsen/logrus"
 	path := "/some/fauxpath"
-	tag := "v1.0.0"
-	mockExec.On("Exec", "git", path, "archive", tag, "-o", path+"/dist/"+tag+".zip").Return("", nil)
-	if err := cmd.CreateTagArchive(tag, path); err != nil {
+	mockExec.On("ExecEnv", "git", "", []string(nil), "clone", "--mirror", "--bare", "--filter=blob:none", "--", uri, path).Return("", nil)
+	assert.New(t).Nil(cmd.CreateMirror(uri, path, &git.Options{CloneMode: git.CloneModeBlobless}, nil))
+}
+
+func TestGitCreateMirrorReportsProgress(t *testing.T) {
+	cmd, _, mockExec := factory()
+	uri := "https://github.com/sirupsen/logrus"
+	path := "/some/fauxpath"
+	mockExec.On("ExecProgress", "git", "", []string(nil), mock.Anything, "clone", "--progress", "--mirror", "--bare", "--", uri, path).
+		Run(func(args mock.Arguments) {
+			args.Get(3).(func(string))("Receiving objects: 100% (10/10), done.")
+		}).
+		Return("", nil)
+
+	var lines []string
+	assertions := assert.New(t)
+	assertions.Nil(cmd.CreateMirror(uri, path, &git.Options{}, func(line string) {
+		lines = append(lines, line)
+	}))
+	assertions.Equal([]string{"Receiving objects: 100% (10/10), done."}, lines)
+}
+
+func TestGitCreateArchive(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	file := path + "/dist/repo-v1.0.0.tar.zst"
+	mockExec.On(
+		"ExecEnv", "git", path, []string{"GIT_ALTERNATE_OBJECT_DIRECTORIES=/base/ns/sub/objects"},
+		"-c", "tar.tar.zst.command=zstd -c", "archive", "--format=tar.zst", "--prefix=repo-v1.0.0/", "-o", file, "abc",
+	).Return("", nil)
+	if err := cmd.CreateArchive(path, "abc", "tar.zst", "repo-v1.0.0/", file, []string{"/base/ns/sub"}); err != nil {
 		t.Errorf("unexpected errors: %s", err)
 	}
 }
 
+func TestGitWriteArchive(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	var w bytes.Buffer
+	mockExec.On(
+		"ExecWriter", "git", path, []string(nil), &w,
+		"-c", "tar.tar.zst.command=zstd -c", "archive", "--format=tar.gz", "abc",
+	).Return(nil)
+	if err := cmd.WriteArchive(path, "abc", "tar.gz", nil, &w); err != nil {
+		t.Errorf("unexpected errors: %s", err)
+	}
+}
+
+func TestGitResolveRevision(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	mockExec.On("Exec", "git", path, "rev-parse", "--verify", "--quiet", "--end-of-options", "main^{commit}").Return("abc", nil)
+	mockExec.On("Exec", "git", path, "rev-parse", "--verify", "--quiet", "--end-of-options", "gone^{commit}").Return("", errors.New("exit status 1"))
+
+	assertions := assert.New(t)
+	object, err := cmd.ResolveRevision(path, "main^{commit}")
+	assertions.Nil(err)
+	assertions.Equal("abc", object)
+	_, err = cmd.ResolveRevision(path, "gone^{commit}")
+	assertions.Equal(gmm.ErrNotFound, err.Code())
+}
+
+func TestGitVerifySignature(t *testing.T) {
+	cmd, _, mockExec := factory()
+	cmd.KeyringDir, cmd.AllowedSigners = "/keyring", "/allowed_signers"
+	path := "/some/fauxpath"
+	mockExec.On("Exec", "git", path, "cat-file", "-t", "refs/tags/v1").Return("tag", nil)
+	mockExec.On("Exec", "git", path, "cat-file", "-t", "refs/tags/v2").Return("commit", nil)
+	mockExec.On("ExecEnv", "git", path, []string{"GNUPGHOME=/keyring"}, "-c", "gpg.ssh.allowedSignersFile=/allowed_signers", "verify-tag", "refs/tags/v1").Return("", nil)
+	mockExec.On("ExecEnv", "git", path, []string{"GNUPGHOME=/keyring"}, "-c", "gpg.ssh.allowedSignersFile=/allowed_signers", "verify-commit", "refs/tags/v2").Return("", errors.New("exit status 1"))
+
+	assertions := assert.New(t)
+	assertions.Nil(cmd.VerifySignature(path, "refs/tags/v1"))
+	assertions.Error(cmd.VerifySignature(path, "refs/tags/v2"))
+}
+
+func TestGitSignFile(t *testing.T) {
+	cmd, _, mockExec := factory()
+	assertions := assert.New(t)
+	signed, err := cmd.SignFile("/dist/a.zip", "/dist/a.zip.asc")
+	assertions.Nil(err)
+	assertions.False(signed)
+
+	cmd.SigningKey = "releases@example.com"
+	mockExec.On(
+		"ExecEnv", "gpg", "", []string(nil),
+		"--batch", "--yes", "--local-user", "releases@example.com", "--armor", "--output", "/dist/a.zip.asc", "--detach-sign", "/dist/a.zip",
+	).Return("", nil)
+	signed, err = cmd.SignFile("/dist/a.zip", "/dist/a.zip.asc")
+	assertions.Nil(err)
+	assertions.True(signed)
+}
+
+func TestGitListTreeEntries(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	env := []string{"GIT_LITERAL_PATHSPECS=1"}
+	mockExec.On("ExecEnv", "git", path, env, "ls-tree", "-l", "-z", "abc").Return("root", nil)
+	mockExec.On("ExecEnv", "git", path, env, "ls-tree", "-l", "-z", "abc", "--", "src/").Return("src", nil)
+
+	assertions := assert.New(t)
+	output, err := cmd.ListTreeEntries(path, "abc", "")
+	assertions.Nil(err)
+	assertions.Equal("root", output)
+	output, err = cmd.ListTreeEntries(path, "abc", "src/")
+	assertions.Nil(err)
+	assertions.Equal("src", output)
+}
+
+func TestGitDescribeRefs(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	format := "--format=%(refname)%00%(objectname)%00%(*objectname)%00%(creatordate:unix)"
+	mockExec.On("Exec", "git", path, "for-each-ref", format, "--contains=abc", "refs/heads", "refs/tags").Return("refs", nil)
+
+	output, err := cmd.DescribeRefs(path, "abc")
+	assertions := assert.New(t)
+	assertions.Nil(err)
+	assertions.Equal("refs", output)
+}
+
+func TestGitLog(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	format := "--format=%H%x1f%P%x1f%an%x1f%ae%x1f%at%x1f%cn%x1f%ce%x1f%ct%x1f%s%x1f%b"
+	mockExec.On("Exec", "git", path, "log", "-z", format, "--skip=30", "--max-count=31", "--since=1700000000", "abc", "--").Return("log", nil)
+
+	output, err := cmd.Log(path, "abc", time.Unix(1700000000, 0), 30, 31)
+	assertions := assert.New(t)
+	assertions.Nil(err)
+	assertions.Equal("log", output)
+}
+
 func TestGitLsRemoteTags(t *testing.T) {
   cmd, _, mockExec := factory()
   expected := "lklk"
 
   uri := "https://github.com/sirupsen/logrus"
-  mockExec.On("Exec", "git", "", "ls-remote", "--tags", uri).Return(expected, nil)
+  mockExec.On("ExecEnv", "git", "", []string(nil), "ls-remote", "--tags", "--", uri).Return(expected, nil)
   output, err := cmd.LsRemoteTags(uri)
   if err != nil {
     t.Errorf("unexpected errors: %s", err)
@@ -81,6 +236,66 @@ func TestGitLsRemoteTags(t *testing.T) {
   assert.New(t).Equal(expected, output, "they should be equal")
 }
 
+func TestGitListRefs(t *testing.T) {
+	cmd, _, mockExec := factory()
+	directory := "/some/path"
+	mockExec.On("Exec", "git", directory, "for-each-ref", "--format=%(objectname) %(refname)").Return("sha refs/heads/main", nil)
+	output, err := cmd.ListRefs(directory)
+	assertions := assert.New(t)
+	assertions.Nil(err)
+	assertions.Equal("sha refs/heads/main", output)
+}
+
+func TestGitIsAncestor(t *testing.T) {
+	cmd, _, mockExec := factory()
+	directory := "/some/path"
+	mockExec.On("Exec", "git", directory, "rev-list", "--count", "bbb..aaa").Return("0", nil)
+	mockExec.On("Exec", "git", directory, "rev-list", "--count", "ccc..aaa").Return("2", nil)
+	assertions := assert.New(t)
+
+	fastForward, err := cmd.IsAncestor(directory, "aaa", "bbb")
+	assertions.Nil(err)
+	assertions.True(fastForward)
+	fastForward, err = cmd.IsAncestor(directory, "aaa", "ccc")
+	assertions.Nil(err)
+	assertions.False(fastForward)
+}
+
+func TestGitCreateBundle(t *testing.T) {
+	cmd, _, mockExec := factory()
+	directory := "/some/path"
+	mockExec.On("Exec", "git", directory, "rev-list", "--count", "--ignore-missing", "--exclude=refs/gmm/*", "--all", "--not", "aaa").Return("3", nil)
+	mockExec.On("Exec", "git", directory, "bundle", "create", "/some/file.bundle", "--ignore-missing", "--exclude=refs/gmm/*", "--all", "--not", "aaa").Return("", nil)
+	mockExec.On("Exec", "git", directory, "rev-list", "--count", "--ignore-missing", "--exclude=refs/gmm/*", "--all", "--not", "bbb").Return("0", nil)
+	assertions := assert.New(t)
+
+	created, err := cmd.CreateBundle(directory, "/some/file.bundle", "--not", "aaa")
+	assertions.Nil(err)
+	assertions.True(created)
+	created, err = cmd.CreateBundle(directory, "/some/empty.bundle", "--not", "bbb")
+	assertions.Nil(err)
+	assertions.False(created)
+	mockExec.AssertNumberOfCalls(t, "Exec", 3)
+}
+
+func TestGitFetchBundle(t *testing.T) {
+	cmd, _, mockExec := factory()
+	directory := "/some/path"
+	mockExec.On("Exec", "git", directory, "-c", "protocol.file.allow=always", "fetch", "/some/file.bundle", "+refs/*:refs/*", "^refs/gmm/*").Return("", nil)
+
+	assert.New(t).Nil(cmd.FetchBundle(directory, "/some/file.bundle"))
+}
+
+func TestGitLsRemote(t *testing.T) {
+	cmd, _, mockExec := factory()
+	uri := "https://github.com/sirupsen/logrus"
+	mockExec.On("ExecEnv", "git", "", []string(nil), "ls-remote", "--", uri).Return("sha\tHEAD", nil)
+	output, err := cmd.LsRemote(uri)
+	assertions := assert.New(t)
+	assertions.Nil(err)
+	assertions.Equal("sha\tHEAD", output)
+}
+
 func TestGitGetRemote(t *testing.T) {
   cmd, _, mockExec := factory()
   expected := "lklk"
@@ -95,11 +310,243 @@ func TestGitGetRemote(t *testing.T) {
   assert.New(t).Equal(expected, output, "they should be equal")
 }
 
+func TestGitGetConfig(t *testing.T) {
+	cmd, _, mockExec := factory()
+	directory := "/some/path"
+	mockExec.On("Exec", "git", directory, "config", "--default", "", "--get", "gmm.options").Return("{}", nil)
+	output, err := cmd.GetConfig(directory, "gmm.options")
+	assertions := assert.New(t)
+	assertions.Nil(err)
+	assertions.Equal("{}", output)
+}
+
+func TestGitSetConfig(t *testing.T) {
+	cmd, _, mockExec := factory()
+	directory := "/some/path"
+	mockExec.On("Exec", "git", directory, "config", "gmm.options", "{}").Return("", nil)
+	assert.New(t).Nil(cmd.SetConfig(directory, "gmm.options", "{}"))
+}
+
+func TestGitPush(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	uri := "https://gitea.example.com/ns/name"
+	mockExec.On("ExecEnv", "git", path, []string(nil), "push", "--prune", "--", uri, "+refs/*:refs/*", "^refs/gmm/*").Return("", nil)
+	mockExec.On("ExecEnv", "git", path, []string(nil), "push", "--", uri, "+refs/heads/*:refs/heads/*").Return("", nil)
+	assertions := assert.New(t)
+	assertions.Nil(cmd.Push(path, uri, ""))
+	assertions.Nil(cmd.Push(path, uri, "+refs/heads/*:refs/heads/*"))
+}
+
 func TestGitFetchPrune(t *testing.T) {
 	cmd, _, mockExec := factory()
 	path := "/some/fauxpath"
-	mockExec.On("Exec", "git", path, "fetch", "--prune").Return("", nil)
-	if err := cmd.FetchPrune(path); err != nil {
+	uri := "https://github.com/sirupsen/logrus"
+	mockExec.On("ExecEnv", "git", path, []string(nil), "-c", "gc.auto=0", "-c", "maintenance.auto=false", "fetch", "--prune", "--", uri, "+refs/*:refs/*", "^refs/gmm/*").Return("", nil)
+	if err := cmd.FetchPrune(path, uri, &git.Options{}); err != nil {
 		t.Errorf("unexpected errors: %s", err)
 	}
 }
+
+func TestGitFetchPruneUsesCloneMode(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	uri := "https://github.com/sirupsen/logrus"
+	mockExec.On("ExecEnv", "git", path, []string(nil), "-c", "gc.auto=0", "-c", "maintenance.auto=false", "fetch", "--prune", "--depth=1", "--", uri, "+refs/*:refs/*", "^refs/gmm/*").Return("", nil)
+	assert.New(t).Nil(cmd.FetchPrune(path, uri, &git.Options{CloneMode: git.CloneModeShallow, Depth: 1}))
+}
+
+func TestGitFetchPruneFiltersRefs(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	uri := "https://github.com/sirupsen/logrus"
+	options := &git.Options{IncludeRefs: []string{"refs/heads/*", "refs/tags/v*"}, ExcludeRefs: []string{"refs/heads/wip-*"}}
+	mockExec.On(
+		"ExecEnv", "git", path, []string(nil),
+		"-c", "gc.auto=0", "-c", "maintenance.auto=false", "fetch", "--prune", "--", uri, "+refs/heads/*:refs/heads/*", "+refs/tags/v*:refs/tags/v*", "^refs/gmm/*", "^refs/heads/wip-*",
+	).Return("", nil)
+	if err := cmd.FetchPrune(path, uri, options); err != nil {
+		t.Errorf("unexpected errors: %s", err)
+	}
+}
+
+func TestGitCreateFilteredMirror(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	uri := "https://github.com/sirupsen/logrus"
+	options := &git.Options{ExcludeRefs: []string{"refs/pull/*"}}
+	mockExec.On("Exec", "git", "", "init", "--bare", path).Return("", nil)
+	mockExec.On("Exec", "git", path, "config", "remote.origin.url", uri).Return("", nil)
+	mockExec.On("Exec", "git", path, "config", "remote.origin.mirror", "true").Return("", nil)
+	mockExec.On("ExecEnv", "git", "", []string(nil), "ls-remote", "--symref", "--", uri, "HEAD").Return("ref: refs/heads/main\tHEAD\naaa\tHEAD", nil)
+	mockExec.On("Exec", "git", path, "symbolic-ref", "HEAD", "refs/heads/main").Return("", nil)
+	mockExec.On("ExecEnv", "git", path, []string(nil), "-c", "gc.auto=0", "-c", "maintenance.auto=false", "fetch", "--prune", "--", uri, "+refs/*:refs/*", "^refs/gmm/*", "^refs/pull/*").Return("", nil)
+
+	if err := cmd.CreateMirror(uri, path, options, nil); err != nil {
+		t.Errorf("unexpected errors: %s", err)
+	}
+	mockExec.AssertCalled(t, "Exec", "git", path, "symbolic-ref", "HEAD", "refs/heads/main")
+}
+
+func TestGitCreateFilteredPartialMirror(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	uri := "https://github.com/sirupsen/logrus"
+	options := &git.Options{ExcludeRefs: []string{"refs/pull/*"}, CloneMode: git.CloneModeTreeless}
+	mockExec.On("Exec", "git", "", "init", "--bare", path).Return("", nil)
+	mockExec.On("Exec", "git", path, "config", mock.Anything, mock.Anything).Return("", nil)
+	mockExec.On("ExecEnv", "git", "", []string(nil), "ls-remote", "--symref", "--", uri, "HEAD").Return("", nil)
+	mockExec.On("ExecEnv", "git", path, []string(nil), "-c", "gc.auto=0", "-c", "maintenance.auto=false", "fetch", "--prune", "--filter=tree:0", "--", uri, "+refs/*:refs/*", "^refs/gmm/*", "^refs/pull/*").Return("", nil)
+
+	assert.New(t).Nil(cmd.CreateMirror(uri, path, options, nil))
+	mockExec.AssertCalled(t, "Exec", "git", path, "config", "remote.origin.promisor", "true")
+	mockExec.AssertCalled(t, "Exec", "git", path, "config", "remote.origin.partialclonefilter", "tree:0")
+}
+
+func TestGitCreateFilteredMirrorCleansUpOnFailure(t *testing.T) {
+	cmd, mockFs, mockExec := factory()
+	path := "/some/fauxpath"
+	uri := "https://github.com/sirupsen/logrus"
+	mockExec.On("Exec", "git", "", "init", "--bare", path).Return("", errors.New("exit status 128"))
+	mockFs.On("RemoveAll", path).Return(nil)
+
+	if err := cmd.CreateMirror(uri, path, &git.Options{IncludeRefs: []string{"refs/heads/*"}}, nil); err == nil {
+		t.Errorf("expected errors")
+	}
+	mockFs.AssertCalled(t, "RemoveAll", path)
+}
+
+func TestGitFetchLFS(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	uri := "https://github.com/sirupsen/logrus"
+	mockExec.On("ExecEnv", "git", path, []string(nil), "lfs", "fetch", "--all", "--", uri).Return("", nil)
+	assert.New(t).Nil(cmd.FetchLFS(path, uri))
+}
+
+func TestGitMaintainAndFsck(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	mockExec.On("Exec", "git", path, "maintenance", "run", "--task=gc", "--task=commit-graph").Return("", nil)
+	mockExec.On("Exec", "git", path, "fsck", "--no-progress", "--no-dangling").Return("", errors.New("exit status 4"))
+	assertions := assert.New(t)
+	assertions.Nil(cmd.Maintain(path))
+	err := cmd.Fsck(path)
+	if assertions.Error(err) {
+		assertions.Equal(gmm.ErrFilesystem, err.Code())
+	}
+}
+
+func TestGitCopyRefs(t *testing.T) {
+	cmd, _, mockExec := factory()
+	mockExec.On("Exec", "git", "/some/fresh", "-c", "protocol.file.allow=always", "fetch", "--no-tags",
+		"--upload-pack=git -c transfer.hideRefs=!refs/gmm/ upload-pack", "/some/corrupt", "+refs/gmm/*:refs/gmm/*").Return("", nil)
+	assert.New(t).Nil(cmd.CopyRefs("/some/corrupt", "/some/fresh", "refs/gmm/"))
+}
+
+func TestGitFsckReportsCorruption(t *testing.T) {
+	cmd, _, mockExec := factory()
+	corrupt, died := "/some/corrupt", "/some/locked"
+	mockExec.On("Exec", "git", corrupt, "fsck", "--no-progress", "--no-dangling").Return("", exec.Command("sh", "-c", "exit 4").Run())
+	mockExec.On("Exec", "git", died, "fsck", "--no-progress", "--no-dangling").Return("", exec.Command("sh", "-c", "exit 128").Run())
+	assertions := assert.New(t)
+
+	err := cmd.Fsck(corrupt)
+	if assertions.Error(err) {
+		assertions.Equal(gmm.ErrCorrupt, err.Code())
+	}
+	err = cmd.Fsck(died)
+	if assertions.Error(err) {
+		assertions.Equal(gmm.ErrFilesystem, err.Code())
+	}
+}
+
+func TestGitFetchRequiresFreeSpace(t *testing.T) {
+	cmd, mockFs, mockExec := factory()
+	cmd.MinFreeSpace = 1024
+	mockFs.On("FreeSpace", "/some/fauxpath").Return(uint64(512), nil)
+
+	err := cmd.FetchPrune("/some/fauxpath", "https://github.com/sirupsen/logrus", &git.Options{})
+	if assert.New(t).Error(err) {
+		assert.New(t).Equal(gmm.ErrDiskSpace, err.Code())
+	}
+	err = cmd.CreateMirror("https://github.com/sirupsen/logrus", "/some/fauxpath", &git.Options{}, nil)
+	if assert.New(t).Error(err) {
+		assert.New(t).Equal(gmm.ErrDiskSpace, err.Code())
+	}
+	mockExec.AssertNumberOfCalls(t, "ExecEnv", 0)
+}
+
+func TestGitDeleteRef(t *testing.T) {
+	cmd, _, mockExec := factory()
+	path := "/some/fauxpath"
+	mockExec.On("Exec", "git", path, "update-ref", "-d", "refs/pull/1/head").Return("", nil)
+	assert.New(t).Nil(cmd.DeleteRef(path, "refs/pull/1/head"))
+}
+
+func TestGitRemoteCommandsUseCredentials(t *testing.T) {
+	cmd, _, mockExec := factory()
+	vault := &mocks.Vault{}
+	cmd.Credentials = vault
+
+	uri := "https://github.com/sirupsen/logrus"
+	env := []string{"GMM_CREDENTIAL_SECRET=s3cr3t"}
+	vault.On("Env", uri, "sirupsen/logrus").Return(env)
+	vault.On("Redact", "fatal: s3cr3t rejected").Return("fatal: ******** rejected")
+	mockExec.On("ExecEnv", "git", "", env, "ls-remote", "--tags", "--", uri).Return("fatal: s3cr3t rejected", errors.New("exit status 128"))
+
+	_, err := cmd.LsRemoteTags(uri)
+	assert.New(t).Error(err)
+	vault.AssertCalled(t, "Redact", "fatal: s3cr3t rejected")
+}
+
+// runGit runs git in directory for tests needing real repositories, failing the test when it fails
+func runGit(t *testing.T, directory string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = directory
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s: %s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestFetchPruneKeepsObjectsOfRemovedRefs(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "gmm-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream, mirror := path.Join(dir, "upstream"), path.Join(dir, "ns", "repo")
+	runGit(t, dir, "init", "-q", upstream)
+	runGit(t, upstream, "commit", "-q", "--allow-empty", "-m", "initial")
+	runGit(t, upstream, "checkout", "-q", "-b", "feature")
+	runGit(t, upstream, "commit", "-q", "--allow-empty", "-m", "removed upstream")
+	removed := runGit(t, upstream, "rev-parse", "HEAD")
+	runGit(t, upstream, "checkout", "-q", "-")
+
+	cmd := &git.DefaultCommandRunner{Fs: &util.OsFileSystemUtil{}, Executor: &util.OsCommandExecutor{}}
+	if err := cmd.CreateMirror(upstream, mirror, &git.Options{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Fetching any object adds a pack, and a second pack would have unreachable objects garbage collected right away
+	for key, value := range map[string]string{
+		"transfer.unpackLimit":   "1",
+		"gc.autoPackLimit":       "1",
+		"gc.pruneExpire":         "now",
+		"gc.autoDetach":          "false",
+		"maintenance.autoDetach": "false",
+	} {
+		runGit(t, mirror, "config", key, value)
+	}
+	runGit(t, mirror, "repack", "-q", "-a", "-d")
+	runGit(t, upstream, "branch", "-q", "-D", "feature")
+	runGit(t, upstream, "commit", "-q", "--allow-empty", "-m", "update")
+
+	assertions := assert.New(t)
+	assertions.Nil(cmd.FetchPrune(mirror, upstream, &git.Options{}))
+	assertions.Equal("commit", runGit(t, mirror, "cat-file", "-t", removed))
+}
@@ -36,3 +36,51 @@ func CreateUpdateCron(mirror *Mirror, interval string) (Cron, gmm.ApplicationErr
 
 	return c, nil
 }
+
+// CreateBundleCron creates a Cron that bundles a mirror, or nil when interval is "false"
+func CreateBundleCron(mirror *Mirror, interval string) (Cron, gmm.ApplicationError) {
+	if strings.ToLower(interval) == "false" {
+		return nil, nil
+	}
+	c := cron.New()
+	err := c.AddFunc(interval, func() {
+		if err := mirror.CreateScheduledBundle(); err != nil {
+			log.Error(err)
+		}
+	})
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrCron)
+	}
+	return c, nil
+}
+
+// MaintenanceCronFactory creates a Cron that maintains and checks the integrity of a mirror
+type MaintenanceCronFactory func(mirror *Mirror, interval string, fsckInterval string) (Cron, gmm.ApplicationError)
+
+// CreateMaintenanceCron creates a Cron that maintains and checks the integrity of a mirror.
+// Either interval can be "false" to disable it, nil is returned when both are.
+func CreateMaintenanceCron(mirror *Mirror, interval string, fsckInterval string) (Cron, gmm.ApplicationError) {
+	c := cron.New()
+	scheduled := false
+	for _, job := range []struct {
+		spec string
+		run  func() gmm.ApplicationError
+	}{{interval, mirror.Maintain}, {fsckInterval, mirror.CheckIntegrity}} {
+		if strings.ToLower(job.spec) == "false" {
+			continue
+		}
+		run := job.run
+		if err := c.AddFunc(job.spec, func() {
+			if err := run(); err != nil {
+				log.Error(err)
+			}
+		}); err != nil {
+			return nil, gmm.NewErrorUsingError(err, gmm.ErrCron)
+		}
+		scheduled = true
+	}
+	if !scheduled {
+		return nil, nil
+	}
+	return c, nil
+}
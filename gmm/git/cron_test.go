@@ -3,6 +3,7 @@ package git_test
 import (
   "github.com/kleijnweb/git-mirror-manager/gmm/git"
   "github.com/robfig/cron"
+  "github.com/stretchr/testify/mock"
   "github.com/stretchr/testify/assert"
   "testing"
   "time"
@@ -26,9 +27,26 @@ func TestCreateUpdateCanCreateCron(t *testing.T) {
 }
 
 func TestUpdateCronIsRunnable(t *testing.T) {
-  gitCommandRunnerMock.On("FetchPrune", "/some/path/ns/a").Return(nil)
+  gitCommandRunnerMock.On("FetchPrune", "/some/path/ns/a", "http://example.com/ns/a", mock.Anything).Return(nil)
   c, _ := git.CreateUpdateCron(NewTestMirror("http://example.com/ns/a", "/some/path"), "* * * * *")
   c.Start()
   time.Sleep(time.Second)
   c.Stop()
 }
+
+func TestCreateMaintenanceCronReturnsNilWhenDisabled(t *testing.T) {
+  c, err := git.CreateMaintenanceCron(&git.Mirror{}, "false", "false")
+  assert.Nil(t, err)
+  assert.Nil(t, c)
+}
+
+func TestCreateMaintenanceCronCanError(t *testing.T) {
+  _, err := git.CreateMaintenanceCron(&git.Mirror{}, "@daily", "invalid")
+  assert.Error(t, err)
+}
+
+func TestCreateMaintenanceCronCanCreateCron(t *testing.T) {
+  c, err := git.CreateMaintenanceCron(&git.Mirror{}, "@daily", "false")
+  assert.Nil(t, err)
+  assert.IsType(t, &cron.Cron{}, c)
+}
@@ -0,0 +1,535 @@
+package git
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveFormats are the supported formats of dist archives
+var ArchiveFormats = []string{"zip", "tar.gz", "tar.zst"}
+
+const (
+	// distSuffix is appended to the path of a mirror to get the directory its dist archives are kept in, next to the
+	// bare repository so that they survive replacing it, see bundlesSuffix
+	distSuffix = ".dist"
+	// distManifestFile lists the dist archives of a mirror, in its dist directory
+	distManifestFile = "manifest.json"
+	// checksumSuffix is appended to the name of an archive to get that of its checksum file, in sha256sum format
+	checksumSuffix = ".sha256"
+	// signatureSuffix is appended to the name of an archive to get that of its detached GPG signature
+	signatureSuffix = ".asc"
+)
+
+// Archive is a dist archive of a tag
+type Archive struct {
+	Tag    string    `json:"tag"`
+	Format string    `json:"format"`
+	File   string    `json:"file"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Time   time.Time `json:"time"`
+	// Verified reports whether the signature of the tag is valid, if the options made it verified
+	Verified *bool `json:"verified,omitempty"`
+	// Signature is the file holding the detached signature of the archive, if signed
+	Signature string `json:"signature,omitempty"`
+}
+
+// DistManifest lists the dist archives of a mirror, ordered by tag and format
+type DistManifest struct {
+	Mirror   string     `json:"mirror"`
+	Archives []*Archive `json:"archives"`
+}
+
+// Dists reads the manifest of the dist archives of the mirror
+func (m *Mirror) Dists() (*DistManifest, gmm.ApplicationError) {
+	manifest := &DistManifest{Mirror: m.Name, Archives: []*Archive{}}
+	data, err := ioutil.ReadFile(m.distFile(distManifestFile))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, gmm.NewError("invalid dist manifest of '"+m.Name+"': "+err.Error(), gmm.ErrFilesystem)
+	}
+	return manifest, nil
+}
+
+// OpenDist opens a dist archive, checksum or signature file of the mirror listed in its manifest, or fails with ErrNotFound
+func (m *Mirror) OpenDist(file string) (*os.File, *Archive, gmm.ApplicationError) {
+	manifest, err := m.Dists()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, archive := range manifest.Archives {
+		if file != archive.File && file != archive.File+checksumSuffix && (archive.Signature == "" || file != archive.Signature) {
+			continue
+		}
+		f, openErr := os.Open(m.distFile(file))
+		if openErr != nil {
+			return nil, nil, gmm.NewErrorUsingError(openErr, gmm.ErrFilesystem)
+		}
+		return f, archive, nil
+	}
+	return nil, nil, gmm.NewError("dist '"+file+"' of '"+m.Name+"' does not exist", gmm.ErrNotFound)
+}
+
+// CreateDist archives tag in the formats of the options, replacing earlier archives of the tag.
+// Archives default to zip when no formats are configured, and are signed when a signing key is.
+func (m *Mirror) CreateDist(tag string) ([]*Archive, gmm.ApplicationError) {
+	m.operation.Lock()
+	defer m.operation.Unlock()
+	archives, err := m.createDist(tag)
+	if err != nil {
+		return nil, err
+	}
+	m.expireDists(m.Options(), time.Now())
+	return archives, nil
+}
+
+// ArchiveTags archives the tags that have no archives yet, as when the mirror starts archiving them, see archiveTags
+func (m *Mirror) ArchiveTags() {
+	m.operation.Lock()
+	defer m.operation.Unlock()
+	m.archiveTags()
+}
+
+// archiveTags archives the tags that have no archives yet if the options say so, when among the newest DistKeep tags
+// if limited, then removes the archives the retention options no longer keep
+func (m *Mirror) archiveTags() {
+	options := m.Options()
+	if len(options.ArchiveFormats) == 0 {
+		return
+	}
+	manifest, err := m.Dists()
+	if err != nil {
+		log.Errorf("Reading dist manifest of '%s' failed: %s", m.Name, err)
+		return
+	}
+	archived := make(map[string]bool)
+	for _, archive := range manifest.Archives {
+		archived[archive.Tag] = true
+	}
+	var tags []string
+	for ref := range m.snapshotRefs() {
+		tag := strings.TrimPrefix(ref, "refs/tags/")
+		if tag != ref && (!options.DistReleasesOnly || isRelease(tag)) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	if options.DistKeep > 0 && len(tags) > options.DistKeep {
+		m.rankTags(tags)
+		tags = tags[:options.DistKeep]
+	}
+	for _, tag := range tags {
+		if archived[tag] {
+			continue
+		}
+		if _, err := m.createDist(tag); err != nil {
+			log.Errorf("Archiving '%s' of '%s' failed: %s", tag, m.Name, err)
+		}
+	}
+	m.expireDists(options, time.Now())
+}
+
+// createDists archives the tags created or moved by an update if the options say so, then removes the archives
+// the retention options no longer keep, including those of deleted tags
+func (m *Mirror) createDists(changes []*events.RefChange) {
+	options := m.Options()
+	for _, change := range changes {
+		tag := strings.TrimPrefix(change.Ref, "refs/tags/")
+		if len(options.ArchiveFormats) == 0 || change.Kind == events.RefDeleted || tag == change.Ref {
+			continue
+		}
+		if options.DistReleasesOnly && !isRelease(tag) {
+			continue
+		}
+		if _, err := m.createDist(tag); err != nil {
+			log.Errorf("Archiving '%s' of '%s' failed: %s", change.Ref, m.Name, err)
+		}
+	}
+	m.expireDists(options, time.Now())
+}
+
+func (m *Mirror) createDist(tag string) ([]*Archive, gmm.ApplicationError) {
+	options := m.Options()
+	formats := options.ArchiveFormats
+	if len(formats) == 0 {
+		formats = ArchiveFormats[:1]
+	}
+	refs := m.snapshotRefs()
+	if _, ok := refs["refs/tags/"+tag]; !ok {
+		return nil, gmm.NewError("tag '"+tag+"' of '"+m.Name+"' does not exist", gmm.ErrNotFound)
+	}
+	if options.DistReleasesOnly && !isRelease(tag) {
+		return nil, gmm.NewError("tag '"+tag+"' of '"+m.Name+"' is not a release", gmm.ErrUser)
+	}
+	verified, err := m.verifyTag(tag, options.TagSignatures)
+	if err != nil {
+		return nil, err
+	}
+
+	treeish, alternates := "refs/tags/"+tag, []string(nil)
+	if options.ArchiveSubmodules {
+		if treeish, alternates, err = m.submoduleTree(treeish); err != nil {
+			return nil, err
+		}
+	}
+	name := path.Base(m.Name)
+	prefix := strings.NewReplacer("{name}", name, "{tag}", tag).Replace(options.ArchivePrefix)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	log.Printf("Archiving '%s' of '%s'", tag, m.Name)
+	var archives []*Archive
+	for _, format := range formats {
+		archive := &Archive{
+			Tag:      tag,
+			Format:   format,
+			File:     name + "-" + strings.Replace(tag, "/", "-", -1) + "." + format,
+			Time:     time.Now().UTC(),
+			Verified: verified,
+		}
+		file := m.distFile(archive.File)
+		if err := m.cmd.CreateArchive(m.path, treeish, format, prefix, file, alternates); err != nil {
+			return nil, err
+		}
+		if err := archive.checksum(file); err != nil {
+			return nil, err
+		}
+		if err := m.signArchive(archive, file); err != nil {
+			return nil, err
+		}
+		archives = append(archives, archive)
+		m.publishArchiveCreated(file)
+	}
+	if err := m.addToManifest(archives); err != nil {
+		return nil, err
+	}
+	m.measureDiskUsage()
+	return archives, nil
+}
+
+// verifyTag verifies the signature of tag if mode, the TagSignatures option, says so, returning whether it is valid.
+// Tags without a valid signature fail with ErrUser when it is required.
+func (m *Mirror) verifyTag(tag string, mode string) (*bool, gmm.ApplicationError) {
+	if mode == "" {
+		return nil, nil
+	}
+	verified := true
+	if err := m.cmd.VerifySignature(m.path, "refs/tags/"+tag); err != nil {
+		if mode == TagSignaturesRequire {
+			return nil, gmm.NewError("tag '"+tag+"' of '"+m.Name+"' has no valid signature", gmm.ErrUser)
+		}
+		log.Warnf("Tag '%s' of '%s' has no valid signature: %s", tag, m.Name, err)
+		verified = false
+	}
+	return &verified, nil
+}
+
+// signArchive writes a detached signature of the archive file when a signing key is configured,
+// removing that of an earlier archive otherwise
+func (m *Mirror) signArchive(archive *Archive, file string) gmm.ApplicationError {
+	signed, err := m.cmd.SignFile(file, file+signatureSuffix)
+	if err != nil {
+		return err
+	}
+	if signed {
+		archive.Signature = archive.File + signatureSuffix
+	} else if err := os.Remove(file + signatureSuffix); err != nil && !os.IsNotExist(err) {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	return nil
+}
+
+// submoduleTree returns a tree of commit with the content of its submodules, and the repositories holding it.
+// Submodules are looked up among the mirrors next to this one, and must have been mirrored.
+func (m *Mirror) submoduleTree(commit string) (string, []string, gmm.ApplicationError) {
+	listing, err := m.cmd.ListTree(m.path, commit)
+	if err != nil {
+		return "", nil, err
+	}
+	gitlinks := make(map[string]string)
+	for _, entry := range strings.Split(listing, "\x00") {
+		// "<mode> <type> <object>\t<path>"
+		fields := strings.SplitN(entry, "\t", 2)
+		if meta := strings.Fields(fields[0]); len(fields) == 2 && len(meta) == 3 && meta[1] == "commit" {
+			gitlinks[fields[1]] = meta[2]
+		}
+	}
+	if len(gitlinks) == 0 {
+		return commit, nil, nil
+	}
+	output, err := m.cmd.GetSubmodules(m.path, commit)
+	if err != nil {
+		return "", nil, err
+	}
+
+	trees := make(map[string]string)
+	var alternates []string
+	for gitlink, url := range parseSubmodulePaths(output) {
+		submoduleCommit, ok := gitlinks[gitlink]
+		if !ok {
+			continue
+		}
+		uri, err := ResolveSubmoduleURL(m.uri, url)
+		if err != nil {
+			return "", nil, err
+		}
+		name, err := ParseMirrorName(m.baseDir(), uri)
+		if err != nil {
+			return "", nil, err
+		}
+		repository := m.baseDir() + "/" + name
+		if !m.fs.DirectoryExists(repository) {
+			return "", nil, gmm.NewError("submodule '"+uri+"' of '"+m.Name+"' is not mirrored", gmm.ErrNotFound)
+		}
+		trees[gitlink] = submoduleCommit
+		if !contains(alternates, repository) {
+			alternates = append(alternates, repository)
+		}
+	}
+	sort.Strings(alternates)
+	tree, err := m.cmd.ReplaceGitlinks(m.path, commit, trees, alternates)
+	return tree, alternates, err
+}
+
+// parseSubmodulePaths maps the paths in "git config -z --get-regexp" output of .gitmodules to their URLs
+func parseSubmodulePaths(output string) map[string]string {
+	paths, urls := make(map[string]string), make(map[string]string)
+	for _, item := range strings.Split(output, "\x00") {
+		i := strings.Index(item, "\n")
+		if i == -1 {
+			continue
+		}
+		key, value := item[:i], strings.TrimSpace(item[i+1:])
+		if strings.HasSuffix(key, ".path") {
+			paths[strings.TrimSuffix(key, ".path")] = value
+		} else if strings.HasSuffix(key, ".url") {
+			urls[strings.TrimSuffix(key, ".url")] = value
+		}
+	}
+	submodules := make(map[string]string)
+	for name, gitlink := range paths {
+		if url, ok := urls[name]; ok {
+			submodules[gitlink] = url
+		}
+	}
+	return submodules
+}
+
+// expireDists removes the archives of tags that no longer exist, of tags that aren't releases when DistReleasesOnly,
+// those older than DistDays, and those exceeding the newest DistKeep tags, see rankTags
+func (m *Mirror) expireDists(options *Options, now time.Time) {
+	manifest, err := m.Dists()
+	if err != nil {
+		log.Errorf("Reading dist manifest of '%s' failed: %s", m.Name, err)
+		return
+	}
+	if len(manifest.Archives) == 0 {
+		return
+	}
+	refs := m.snapshotRefs()
+	if refs == nil {
+		return
+	}
+	// The age of the archives of a tag is that of the last one
+	archived := make(map[string]time.Time)
+	var tags []string
+	for _, archive := range manifest.Archives {
+		if _, ok := archived[archive.Tag]; !ok {
+			tags = append(tags, archive.Tag)
+		}
+		if archive.Time.After(archived[archive.Tag]) {
+			archived[archive.Tag] = archive.Time
+		}
+	}
+	expired := make(map[string]bool)
+	var kept []string
+	for _, tag := range tags {
+		_, exists := refs["refs/tags/"+tag]
+		if !exists || (options.DistReleasesOnly && !isRelease(tag)) ||
+			(options.DistDays > 0 && now.Sub(archived[tag]) > time.Duration(options.DistDays)*24*time.Hour) {
+			expired[tag] = true
+			continue
+		}
+		kept = append(kept, tag)
+	}
+	if options.DistKeep > 0 && len(kept) > options.DistKeep {
+		m.rankTags(kept)
+		for _, tag := range kept[options.DistKeep:] {
+			expired[tag] = true
+		}
+	}
+
+	var remaining, removed []*Archive
+	for _, archive := range manifest.Archives {
+		if expired[archive.Tag] {
+			removed = append(removed, archive)
+		} else {
+			remaining = append(remaining, archive)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	// Removed from the manifest first, so a partially removed archive is no longer listed
+	manifest.Archives = remaining
+	if err := m.writeManifest(manifest); err != nil {
+		log.Errorf("Writing dist manifest of '%s' failed: %s", m.Name, err)
+		return
+	}
+	for _, archive := range removed {
+		log.Infof("Removing dist '%s' of '%s'", archive.File, m.Name)
+		for _, file := range archive.files() {
+			if err := os.Remove(m.distFile(file)); err != nil && !os.IsNotExist(err) {
+				log.Error(err)
+			}
+		}
+	}
+	m.measureDiskUsage()
+}
+
+// rankTags orders tags newest first: semantic versions by precedence, followed by the tags that aren't versions by
+// the date they were tagged, or committed for lightweight tags
+func (m *Mirror) rankTags(tags []string) {
+	versions := make(map[string]*semver)
+	var dates map[string]time.Time
+	for _, tag := range tags {
+		if versions[tag] = parseSemver(tag); versions[tag] == nil && dates == nil {
+			dates = m.tagDates()
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		a, b := versions[tags[i]], versions[tags[j]]
+		switch {
+		case a != nil && b != nil:
+			return compareSemver(a, b) > 0
+		case a == nil && b == nil:
+			return dates[tags[i]].After(dates[tags[j]])
+		}
+		return a != nil
+	})
+}
+
+// tagDates returns the date of each tag of the mirror by name, which is empty when listing them fails
+func (m *Mirror) tagDates() map[string]time.Time {
+	dates := make(map[string]time.Time)
+	output, err := m.cmd.DescribeRefs(m.path, "")
+	if err != nil {
+		log.Warnf("Listing the tags of '%s' failed: %s", m.Name, err)
+		return dates
+	}
+	for _, ref := range parseRefDescriptions(output) {
+		if ref.Type == RefTypeTag {
+			dates[ref.Name] = ref.Date
+		}
+	}
+	return dates
+}
+
+// addToManifest lists archives in the manifest, replacing those with the same file name
+func (m *Mirror) addToManifest(archives []*Archive) gmm.ApplicationError {
+	manifest, err := m.Dists()
+	if err != nil {
+		return err
+	}
+	added := make(map[string]bool)
+	for _, archive := range archives {
+		added[archive.File] = true
+	}
+	kept := archives
+	for _, archive := range manifest.Archives {
+		if !added[archive.File] {
+			kept = append(kept, archive)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if kept[i].Tag != kept[j].Tag {
+			return kept[i].Tag < kept[j].Tag
+		}
+		return kept[i].Format < kept[j].Format
+	})
+	manifest.Archives = kept
+	return m.writeManifest(manifest)
+}
+
+// writeManifest replaces the manifest of the mirror
+func (m *Mirror) writeManifest(manifest *DistManifest) gmm.ApplicationError {
+	if manifest.Archives == nil {
+		manifest.Archives = []*Archive{}
+	}
+	data, marshalErr := json.MarshalIndent(manifest, "", "  ")
+	if marshalErr != nil {
+		return gmm.NewErrorUsingError(marshalErr, gmm.ErrFilesystem)
+	}
+	// Written aside and renamed, so readers never see a partial manifest
+	temporary := m.distFile("." + distManifestFile)
+	if err := ioutil.WriteFile(temporary, data, 0600); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	if err := os.Rename(temporary, m.distFile(distManifestFile)); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	return nil
+}
+
+// distPath returns the directory of the dist archives of the mirror at mirrorPath, eg. "/base/ns/.repo.dist"
+func distPath(mirrorPath string) string {
+	return hiddenPath(mirrorPath, distSuffix)
+}
+
+func (m *Mirror) distFile(name string) string {
+	return distPath(m.path) + "/" + name
+}
+
+// files returns the names of the archive file and the files describing it
+func (a *Archive) files() []string {
+	files := []string{a.File, a.File + checksumSuffix}
+	if a.Signature != "" {
+		files = append(files, a.Signature)
+	}
+	return files
+}
+
+// checksum records the size and SHA-256 checksum of the archive file, and writes the checksum file next to it
+func (a *Archive) checksum(file string) gmm.ApplicationError {
+	size, checksum, err := measureFile(file)
+	if err != nil {
+		return err
+	}
+	a.Size, a.SHA256 = size, checksum
+	if err := ioutil.WriteFile(file+checksumSuffix, []byte(a.SHA256+"  "+a.File+"\n"), 0600); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	return nil
+}
+
+// measureFile returns the size and hex encoded SHA-256 checksum of file
+func measureFile(file string) (int64, string, gmm.ApplicationError) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, "", gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,311 @@
+package git_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// distDir returns the directory the dist archives of mirror are kept in
+func distDir(mirror *git.Mirror) string {
+	return path.Join(path.Dir(mirror.Path()), "."+path.Base(mirror.Path())+".dist")
+}
+
+// expectArchive makes archiving treeish in format write content to the archive file
+func expectArchive(cmd *mocks.CommandRunner, treeish string, format string, prefix string, alternates []string, content string) {
+	cmd.On("CreateArchive", mock.Anything, treeish, format, prefix, mock.Anything, alternates).Run(func(args mock.Arguments) {
+		file := args.String(4)
+		if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			panic(err)
+		}
+	}).Return(nil)
+	cmd.On("SignFile", mock.Anything, mock.Anything).Return(false, nil)
+}
+
+func TestCreateDistWritesChecksumsAndManifest(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	assertions.Nil(mirror.SetOptions(&git.Options{ArchiveFormats: []string{"tar.gz", "zip"}, ArchivePrefix: "{name}-{tag}"}))
+	cmd.On("ListRefs", mock.Anything).Return("aaa refs/heads/main\nbbb refs/tags/v1", nil)
+	expectArchive(cmd, "refs/tags/v1", "tar.gz", "repo-v1/", nil, "tgz")
+	expectArchive(cmd, "refs/tags/v1", "zip", "repo-v1/", nil, "zip")
+
+	archives, err := mirror.CreateDist("v1")
+	assertions.Nil(err)
+	if assertions.Len(archives, 2) {
+		assertions.Equal("repo-v1.tar.gz", archives[0].File)
+		assertions.Equal(int64(3), archives[0].Size)
+		assertions.Equal("repo-v1.zip", archives[1].File)
+	}
+	manifest, err := mirror.Dists()
+	assertions.Nil(err)
+	assertions.Equal("ns/repo", manifest.Mirror)
+	assertions.Equal(archives, manifest.Archives)
+
+	file, archive, err := mirror.OpenDist("repo-v1.zip.sha256")
+	if assertions.Nil(err) {
+		defer file.Close()
+		content, _ := ioutil.ReadAll(file)
+		assertions.Equal(archive.SHA256+"  repo-v1.zip\n", string(content))
+	}
+	_, _, err = mirror.OpenDist("manifest.json")
+	assertions.Equal(gmm.ErrNotFound, err.Code())
+	_, err = mirror.CreateDist("v2")
+	assertions.Equal(gmm.ErrNotFound, err.Code())
+}
+
+func TestUpdateArchivesCreatedTags(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	assertions.Nil(mirror.SetOptions(&git.Options{ArchiveFormats: []string{"tar.zst"}}))
+	expectRefs(cmd, "aaa refs/heads/main", "aaa refs/heads/main\nbbb refs/tags/v2")
+	cmd.On("ListRefs", mock.Anything).Return("aaa refs/heads/main\nbbb refs/tags/v2", nil)
+	expectArchive(cmd, "refs/tags/v2", "tar.zst", "", nil, "zst")
+
+	assertions.Nil(mirror.Update())
+	manifest, err := mirror.Dists()
+	assertions.Nil(err)
+	if assertions.Len(manifest.Archives, 1) {
+		assertions.Equal("repo-v2.tar.zst", manifest.Archives[0].File)
+	}
+}
+
+func TestArchiveTagsArchivesNewestTagsWithoutArchives(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	assertions.Nil(mirror.SetOptions(&git.Options{ArchiveFormats: []string{"zip"}, DistKeep: 2}))
+	cmd.On("ListRefs", mock.Anything).Return("a refs/heads/main\nb refs/tags/v1.0.0\nc refs/tags/v1.1.0\nd refs/tags/v2.0.0", nil)
+	for _, tag := range []string{"v1.1.0", "v2.0.0"} {
+		expectArchive(cmd, "refs/tags/"+tag, "zip", "", nil, tag)
+	}
+
+	mirror.ArchiveTags()
+	mirror.ArchiveTags()
+	manifest, err := mirror.Dists()
+	assertions.Nil(err)
+	var tags []string
+	for _, archive := range manifest.Archives {
+		tags = append(tags, archive.Tag)
+	}
+	assertions.Equal([]string{"v1.1.0", "v2.0.0"}, tags)
+	cmd.AssertNumberOfCalls(t, "CreateArchive", 2)
+}
+
+func TestCloneArchivesTags(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "gmm-dist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	repository := path.Join(baseDir, "ns/repo")
+	cmd := &mocks.CommandRunner{}
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(false)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	cmd.On("SetConfig", repository, "gmm.options", mock.Anything).Return(nil)
+	cmd.On("LsRemoteTags", "http://example.com/ns/repo").Return("", nil)
+	cmd.On("CreateMirror", "http://example.com/ns/repo", repository, mock.Anything, mock.Anything).Return(nil)
+	cmd.On("ListRefs", repository).Return("a refs/heads/main\nb refs/tags/v1", nil)
+	expectArchive(cmd, "refs/tags/v1", "tar.gz", "", nil, "v1")
+	archived := make(chan string, 1)
+	publisher := &mocks.Publisher{}
+	publisher.On("Publish", mock.Anything).Run(func(args mock.Arguments) {
+		if event := args.Get(0).(*events.Event); event.Type == events.ArchiveCreated {
+			archived <- event.Archive
+		}
+	})
+
+	_, appErr := git.NewMirror("http://example.com/ns/repo", &git.Options{ArchiveFormats: []string{"tar.gz"}}, baseDir, updateInterval, cmd, fs, updateCronFactoryStub, nil, publisher)
+	assertions := assert.New(t)
+	assertions.Nil(appErr)
+	select {
+	case file := <-archived:
+		assertions.Equal(path.Join(baseDir, "ns/.repo.dist/repo-v1.tar.gz"), file)
+	case <-time.After(5 * time.Second):
+		t.Fatal("clone did not archive the tag")
+	}
+}
+
+func TestCreateDistIncludesSubmodules(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	assertions.Nil(mirror.SetOptions(&git.Options{ArchiveSubmodules: true}))
+	submodule := path.Join(path.Dir(path.Dir(mirror.Path())), "ns/sub")
+	cmd.On("ListRefs", mock.Anything).Return("bbb refs/tags/v1", nil)
+	cmd.On("ListTree", mock.Anything, "refs/tags/v1").Return("100644 blob ccc\ta.txt\x00160000 commit ddd\tlib/sub\x00", nil)
+	cmd.On("GetSubmodules", mock.Anything, "refs/tags/v1").Return("submodule.sub.path\nlib/sub\x00submodule.sub.url\n../sub\x00", nil)
+	cmd.On("ReplaceGitlinks", mock.Anything, "refs/tags/v1", map[string]string{"lib/sub": "ddd"}, []string{submodule}).Return("eee", nil)
+	expectArchive(cmd, "eee", "zip", "", []string{submodule}, "zip")
+
+	archives, err := mirror.CreateDist("v1")
+	assertions.Nil(err)
+	assertions.Len(archives, 1)
+}
+
+func TestCreateDistVerifiesTagsAndSignsArchives(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	assertions.Nil(mirror.SetOptions(&git.Options{TagSignatures: git.TagSignaturesFlag}))
+	cmd.On("ListRefs", mock.Anything).Return("bbb refs/tags/v1\nccc refs/tags/v2", nil)
+	cmd.On("VerifySignature", mock.Anything, "refs/tags/v1").Return(nil)
+	cmd.On("VerifySignature", mock.Anything, "refs/tags/v2").Return(gmm.NewError("no signature found", gmm.ErrFilesystem))
+	cmd.On("SignFile", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		if err := ioutil.WriteFile(args.String(1), []byte("signature"), 0600); err != nil {
+			panic(err)
+		}
+	}).Return(true, nil)
+	expectArchive(cmd, "refs/tags/v1", "zip", "", nil, "v1")
+	expectArchive(cmd, "refs/tags/v2", "zip", "", nil, "v2")
+
+	archives, err := mirror.CreateDist("v1")
+	if assertions.Nil(err) {
+		assertions.True(*archives[0].Verified)
+		assertions.Equal("repo-v1.zip.asc", archives[0].Signature)
+	}
+	file, _, err := mirror.OpenDist("repo-v1.zip.asc")
+	if assertions.Nil(err) {
+		defer file.Close()
+		content, _ := ioutil.ReadAll(file)
+		assertions.Equal("signature", string(content))
+	}
+	archives, err = mirror.CreateDist("v2")
+	if assertions.Nil(err) {
+		assertions.False(*archives[0].Verified)
+	}
+
+	assertions.Nil(mirror.SetOptions(&git.Options{TagSignatures: git.TagSignaturesRequire}))
+	_, err = mirror.CreateDist("v2")
+	assertions.Equal(gmm.ErrUser, err.Code())
+}
+
+func TestExpireDistsKeepsNewestReleases(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	cmd.On("ListRefs", mock.Anything).Return("a refs/tags/v1.0.0\nb refs/tags/nightly\nc refs/tags/v1.1.0\nd refs/tags/v1.2.0", nil)
+	cmd.On("Maintain", mock.Anything).Return(nil)
+	for _, tag := range []string{"v1.0.0", "nightly", "v1.1.0", "v1.2.0"} {
+		expectArchive(cmd, "refs/tags/"+tag, "zip", "", nil, tag)
+		_, err := mirror.CreateDist(tag)
+		assertions.Nil(err)
+	}
+
+	assertions.Nil(mirror.SetOptions(&git.Options{DistKeep: 2, DistReleasesOnly: true}))
+	assertions.Nil(mirror.Maintain())
+	manifest, err := mirror.Dists()
+	assertions.Nil(err)
+	var tags []string
+	for _, archive := range manifest.Archives {
+		tags = append(tags, archive.Tag)
+	}
+	assertions.Equal([]string{"v1.1.0", "v1.2.0"}, tags)
+	for _, file := range []string{"repo-v1.0.0.zip", "repo-v1.0.0.zip.sha256", "repo-nightly.zip"} {
+		_, err := os.Stat(path.Join(distDir(mirror), file))
+		assertions.True(os.IsNotExist(err), file)
+	}
+	_, err = mirror.CreateDist("nightly")
+	assertions.Equal(gmm.ErrUser, err.Code())
+}
+
+func TestExpireDistsKeepsHighestVersions(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	cmd.On("ListRefs", mock.Anything).Return("a refs/tags/v1.10.0\nb refs/tags/v1.9.0\nc refs/tags/old\nd refs/tags/new", nil)
+	cmd.On("DescribeRefs", mock.Anything, "").Return(
+		"refs/tags/old\x00c\x00\x001500000000\nrefs/tags/new\x00d\x00\x001600000000\n", nil,
+	)
+	cmd.On("Maintain", mock.Anything).Return(nil)
+	// Archived in an order other than that of the versions and tag dates
+	for _, tag := range []string{"new", "v1.10.0", "old", "v1.9.0"} {
+		expectArchive(cmd, "refs/tags/"+tag, "zip", "", nil, tag)
+		_, err := mirror.CreateDist(tag)
+		assertions.Nil(err)
+	}
+
+	assertions.Nil(mirror.SetOptions(&git.Options{DistKeep: 3}))
+	assertions.Nil(mirror.Maintain())
+	manifest, err := mirror.Dists()
+	assertions.Nil(err)
+	var tags []string
+	for _, archive := range manifest.Archives {
+		tags = append(tags, archive.Tag)
+	}
+	assertions.Equal([]string{"new", "v1.10.0", "v1.9.0"}, tags)
+}
+
+func TestExpireDistsByAge(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	cmd.On("ListRefs", mock.Anything).Return("a refs/tags/v1", nil)
+	cmd.On("Maintain", mock.Anything).Return(nil)
+	expectArchive(cmd, "refs/tags/v1", "zip", "", nil, "v1")
+	_, err := mirror.CreateDist("v1")
+	assertions.Nil(err)
+
+	assertions.Nil(mirror.SetOptions(&git.Options{DistDays: 1}))
+	assertions.Nil(mirror.Maintain())
+	manifest, _ := mirror.Dists()
+	assertions.Len(manifest.Archives, 1)
+
+	manifestFile := path.Join(distDir(mirror), "manifest.json")
+	data, _ := ioutil.ReadFile(manifestFile)
+	old := strings.Replace(string(data), time.Now().UTC().Format("2006-01-02"), "2020-01-02", 1)
+	assertions.Nil(ioutil.WriteFile(manifestFile, []byte(old), 0600))
+	assertions.Nil(mirror.Maintain())
+	manifest, _ = mirror.Dists()
+	assertions.Empty(manifest.Archives)
+}
+
+func TestUpdateRemovesDistsOfDeletedTags(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	// Archiving lists the refs twice, then the update lists them before fetching
+	cmd.On("ListRefs", mock.Anything).Return("a refs/tags/v1", nil).Times(3)
+	cmd.On("ListRefs", mock.Anything).Return("b refs/heads/main", nil)
+	expectArchive(cmd, "refs/tags/v1", "zip", "", nil, "v1")
+	_, err := mirror.CreateDist("v1")
+	assertions.Nil(err)
+
+	assertions.Nil(mirror.Update())
+	manifest, _ := mirror.Dists()
+	assertions.Empty(manifest.Archives)
+	_, statErr := os.Stat(path.Join(distDir(mirror), "repo-v1.zip"))
+	assertions.True(os.IsNotExist(statErr))
+}
+
+func TestDestroyRemovesDists(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	cmd.On("ListRefs", mock.Anything).Return("a refs/tags/v1", nil)
+	expectArchive(cmd, "refs/tags/v1", "zip", "", nil, "v1")
+	_, err := mirror.CreateDist("v1")
+	assertions.Nil(err)
+
+	assertions.Nil(mirror.Destroy())
+	_, statErr := os.Stat(distDir(mirror))
+	assertions.True(os.IsNotExist(statErr))
+	manifest, err := mirror.Dists()
+	assertions.Nil(err)
+	assertions.Empty(manifest.Archives)
+}
@@ -0,0 +1,74 @@
+package git
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"strings"
+	"time"
+)
+
+// progressInterval is the minimum time between progress events of the same phase of a clone
+const progressInterval = time.Second
+
+func (m *Mirror) publishUpdateFailed(err error) {
+	if m.events == nil {
+		return
+	}
+	event := events.NewEvent(events.MirrorUpdateFailed, m.Name)
+	event.Error = err.Error()
+	m.events.Publish(event)
+}
+
+// publishActivity publishes an event of eventType about the mirror talking to upstream
+func (m *Mirror) publishActivity(eventType string, upstream string) {
+	if m.events == nil {
+		return
+	}
+	event := events.NewEvent(eventType, m.Name)
+	event.Upstream = upstream
+	m.events.Publish(event)
+}
+
+// cloneProgress publishes the progress git reports while cloning from upstream, or returns nil when no events
+// are published. Lines of the same phase, eg. "Receiving objects", are published at most once per
+// progressInterval, except for the line completing the phase.
+func (m *Mirror) cloneProgress(upstream string) Progress {
+	if m.events == nil {
+		return nil
+	}
+	var (
+		phase     string
+		published time.Time
+	)
+	return func(line string) {
+		current := line
+		if i := strings.Index(line, ":"); i >= 0 {
+			current = line[:i]
+		}
+		if current == phase && time.Since(published) < progressInterval && !strings.HasSuffix(line, "done.") {
+			return
+		}
+		phase, published = current, time.Now()
+		event := events.NewEvent(events.MirrorCloneProgress, m.Name)
+		event.Upstream = upstream
+		event.Progress = line
+		m.events.Publish(event)
+	}
+}
+
+func (m *Mirror) publishArchiveCreated(path string) {
+	if m.events == nil {
+		return
+	}
+	event := events.NewEvent(events.ArchiveCreated, m.Name)
+	event.Archive = path
+	m.events.Publish(event)
+}
+
+func (m *Mirror) publishBundleCreated(id string) {
+	if m.events == nil {
+		return
+	}
+	event := events.NewEvent(events.BundleCreated, m.Name)
+	event.Bundle = id
+	m.events.Publish(event)
+}
@@ -0,0 +1,173 @@
+package git_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func newPublishingTestMirror() (*git.Mirror, *mocks.CommandRunner, *[]*events.Event) {
+	cmd := &mocks.CommandRunner{}
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(true)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	cmd.On("SetConfig", mock.Anything, "gmm.options", mock.Anything).Return(nil)
+	var published []*events.Event
+	publisher := &mocks.Publisher{}
+	publisher.On("Publish", mock.Anything).Run(func(args mock.Arguments) {
+		published = append(published, args.Get(0).(*events.Event))
+	})
+	mirror, err := git.NewMirror("http://example.com/ns/repo", &git.Options{}, "/path", updateInterval, cmd, fs, updateCronFactoryStub, nil, publisher)
+	if err != nil {
+		panic(err)
+	}
+	return mirror, cmd, &published
+}
+
+func TestUpdatePublishesChangedRefs(t *testing.T) {
+	mirror, cmd, published := newPublishingTestMirror()
+	cmd.On("ListRefs", "/path/ns/repo").Return("aaa refs/heads/master\nbbb refs/heads/gone\nccc refs/tags/v1\n", nil).Once()
+	cmd.On("ListRefs", "/path/ns/repo").Return("ddd refs/heads/master\neee refs/heads/new\nccc refs/tags/v1\n", nil).Once()
+	cmd.On("FetchPrune", "/path/ns/repo", "http://example.com/ns/repo", mock.Anything).Return(nil)
+	cmd.On("IsAncestor", "/path/ns/repo", "aaa", "ddd").Return(true, nil)
+	assertions := assert.New(t)
+
+	assertions.Nil(mirror.Update())
+	if assertions.Len(*published, 2) {
+		assertions.Equal(events.MirrorFetched, (*published)[0].Type)
+		assertions.Equal("http://example.com/ns/repo", (*published)[0].Upstream)
+		event := (*published)[1]
+		assertions.Equal(events.MirrorUpdated, event.Type)
+		assertions.Equal("ns/repo", event.Mirror)
+		assertions.NotEmpty(event.ID)
+		assertions.Equal([]*events.RefChange{
+			{Ref: "refs/heads/gone", Kind: events.RefDeleted, Old: "bbb"},
+			{Ref: "refs/heads/master", Kind: events.RefUpdated, Old: "aaa", New: "ddd"},
+			{Ref: "refs/heads/new", Kind: events.RefCreated, New: "eee"},
+		}, event.Refs)
+	}
+}
+
+func TestUpdateWithoutChangesOnlyPublishesFetch(t *testing.T) {
+	mirror, cmd, published := newPublishingTestMirror()
+	cmd.On("ListRefs", "/path/ns/repo").Return("aaa refs/heads/master\n", nil)
+	cmd.On("FetchPrune", "/path/ns/repo", "http://example.com/ns/repo", mock.Anything).Return(nil)
+
+	assertions := assert.New(t)
+	assertions.Nil(mirror.Update())
+	if assertions.Len(*published, 1) {
+		assertions.Equal(events.MirrorFetched, (*published)[0].Type)
+	}
+}
+
+func TestFailedUpdateIsPublished(t *testing.T) {
+	mirror, cmd, published := newPublishingTestMirror()
+	cmd.On("ListRefs", "/path/ns/repo").Return("aaa refs/heads/master\n", nil)
+	cmd.On("FetchPrune", "/path/ns/repo", "http://example.com/ns/repo", mock.Anything).Return(gmm.NewError("repository not found", gmm.ErrGitCommand))
+	assertions := assert.New(t)
+
+	assertions.Error(mirror.Update())
+	if assertions.Len(*published, 1) {
+		assertions.Equal(events.MirrorUpdateFailed, (*published)[0].Type)
+		assertions.Contains((*published)[0].Error, "repository not found")
+	}
+}
+
+func TestCloneProgressIsThrottledPerPhase(t *testing.T) {
+	cmd := &mocks.CommandRunner{}
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(false)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	cmd.On("SetConfig", mock.Anything, "gmm.options", mock.Anything).Return(nil)
+	cmd.On("LsRemoteTags", "http://example.com/ns/repo").Return("", nil)
+	cmd.On("ListRefs", "/path/ns/repo").Return("aaa refs/heads/master\n", nil)
+	cmd.On("CreateMirror", "http://example.com/ns/repo", "/path/ns/repo", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			progress := args.Get(3).(git.Progress)
+			progress("Receiving objects:  10% (1/10)")
+			progress("Receiving objects:  50% (5/10)")
+			progress("Receiving objects: 100% (10/10), done.")
+			progress("Resolving deltas: 100% (4/4), done.")
+		}).
+		Return(nil)
+	published := make(chan *events.Event, 10)
+	publisher := &mocks.Publisher{}
+	publisher.On("Publish", mock.Anything).Run(func(args mock.Arguments) {
+		published <- args.Get(0).(*events.Event)
+	})
+
+	_, err := git.NewMirror("http://example.com/ns/repo", &git.Options{}, "/path", updateInterval, cmd, fs, updateCronFactoryStub, nil, publisher)
+	assertions := assert.New(t)
+	assertions.Nil(err)
+
+	var types, progress []string
+	for len(types) == 0 || types[len(types)-1] != events.MirrorUpdated {
+		var event *events.Event
+		select {
+		case event = <-published:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("clone did not complete, published %v", types)
+		}
+		types = append(types, event.Type)
+		if event.Type == events.MirrorCloneProgress {
+			progress = append(progress, event.Progress)
+		}
+	}
+	assertions.Equal([]string{
+		events.MirrorCloneStarted,
+		events.MirrorCloneProgress,
+		events.MirrorCloneProgress,
+		events.MirrorCloneProgress,
+		events.MirrorCloneFinished,
+		events.MirrorUpdated,
+	}, types)
+	assertions.Equal([]string{
+		"Receiving objects:  10% (1/10)",
+		"Receiving objects: 100% (10/10), done.",
+		"Resolving deltas: 100% (4/4), done.",
+	}, progress)
+}
+
+func TestCloneKeepsOptionsWhenFetchingLFSObjectsFails(t *testing.T) {
+	cmd := &mocks.CommandRunner{}
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(false)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	cmd.On("SetConfig", "/path/ns/repo", "gmm.options", mock.Anything).Return(nil)
+	cmd.On("LsRemoteTags", "http://example.com/ns/repo").Return("", nil)
+	cmd.On("ListRefs", "/path/ns/repo").Return("aaa refs/heads/master\n", nil)
+	cmd.On("CreateMirror", "http://example.com/ns/repo", "/path/ns/repo", mock.Anything, mock.Anything).Return(nil)
+	cmd.On("FetchLFS", "/path/ns/repo", "http://example.com/ns/repo").Return(gmm.NewError("smudge failed", gmm.ErrGitCommand))
+	published := make(chan *events.Event, 10)
+	publisher := &mocks.Publisher{}
+	publisher.On("Publish", mock.Anything).Run(func(args mock.Arguments) {
+		published <- args.Get(0).(*events.Event)
+	})
+
+	mirror, err := git.NewMirror("http://example.com/ns/repo", &git.Options{LFS: true}, "/path", updateInterval, cmd, fs, updateCronFactoryStub, nil, publisher)
+	assertions := assert.New(t)
+	assertions.Nil(err)
+
+	var types []string
+	for len(types) == 0 || types[len(types)-1] != events.MirrorUpdated {
+		select {
+		case event := <-published:
+			types = append(types, event.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("clone did not complete, published %v", types)
+		}
+	}
+	assertions.Equal([]string{
+		events.MirrorCloneStarted,
+		events.MirrorUpdateFailed,
+		events.MirrorCloneFinished,
+		events.MirrorUpdated,
+	}, types)
+	cmd.AssertCalled(t, "SetConfig", "/path/ns/repo", "gmm.options", mock.Anything)
+	assertions.Equal("smudge failed [2]", mirror.Status().LastFetchError)
+}
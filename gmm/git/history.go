@@ -0,0 +1,293 @@
+package git
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refHistorySuffix is appended to the path of a mirror to get that of its ref history. The history is kept
+// next to the bare repository, so it survives replacing the repository, and hidden from LoadFromDisk.
+const refHistorySuffix = ".ref-history.jsonl"
+
+// refHistoryPath returns the path of the ref history of the mirror at mirrorPath, eg. "/base/ns/.repo.ref-history.jsonl"
+func refHistoryPath(mirrorPath string) string {
+	return hiddenPath(mirrorPath, refHistorySuffix)
+}
+
+// RefUpdate is an entry of the ref history, the refs changed by a clone or update
+type RefUpdate struct {
+	Time     time.Time           `json:"time"`
+	Upstream string              `json:"upstream,omitempty"`
+	Refs     []*events.RefChange `json:"refs"`
+}
+
+// ForcePush is a ref that was force-pushed upstream
+type ForcePush struct {
+	Mirror   string    `json:"mirror"`
+	Time     time.Time `json:"time"`
+	Upstream string    `json:"upstream,omitempty"`
+	Ref      string    `json:"ref"`
+	Old      string    `json:"old"`
+	New      string    `json:"new"`
+}
+
+// RefHistory is an append-only log of RefUpdates, stored as JSON lines
+type RefHistory struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// NewRefHistory creates a new RefHistory stored at path
+func NewRefHistory(path string) *RefHistory {
+	return &RefHistory{path: path}
+}
+
+// Append adds update to the end of the history
+func (h *RefHistory) Append(update *RefUpdate) gmm.ApplicationError {
+	line, err := json.Marshal(update)
+	if err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	file, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	if err := file.Close(); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	return nil
+}
+
+// List returns the updates since given time, oldest first. A history that was never written is empty.
+func (h *RefHistory) List(since time.Time) ([]*RefUpdate, gmm.ApplicationError) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	updates := []*RefUpdate{}
+	file, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return updates, nil
+	}
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		update := &RefUpdate{}
+		if err := json.Unmarshal(scanner.Bytes(), update); err != nil {
+			// A line may be incomplete when writing it was interrupted
+			log.Warnf("Skipping invalid entry of ref history '%s': %s", h.path, err)
+			continue
+		}
+		if !update.Time.Before(since) {
+			updates = append(updates, update)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	return updates, nil
+}
+
+// Refs returns the refs as they were after the last update, by replaying the history
+func (h *RefHistory) Refs() (map[string]string, gmm.ApplicationError) {
+	updates, err := h.List(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	for _, update := range updates {
+		for _, change := range update.Refs {
+			if change.New == "" {
+				delete(refs, change.Ref)
+			} else {
+				refs[change.Ref] = change.New
+			}
+		}
+	}
+	return refs, nil
+}
+
+// Remove deletes the history
+func (h *RefHistory) Remove() gmm.ApplicationError {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := os.Remove(h.path); err != nil && !os.IsNotExist(err) {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	return nil
+}
+
+// RefHistory returns the ref updates of the mirror since given time, oldest first
+func (m *Mirror) RefHistory(since time.Time) ([]*RefUpdate, gmm.ApplicationError) {
+	return m.history.List(since)
+}
+
+// RefAt returns the object ref pointed to at given time, or an empty string when it did not exist.
+// It fails with ErrNotFound for times before the history started, when ref did not change since.
+func (m *Mirror) RefAt(ref string, at time.Time) (string, gmm.ApplicationError) {
+	updates, err := m.history.List(time.Time{})
+	if err != nil {
+		return "", err
+	}
+	if len(updates) == 0 || at.Before(updates[0].Time) {
+		// The first change after at tells what ref pointed to before it
+		for _, update := range updates {
+			if change := findRefChange(update, ref); change != nil {
+				return change.Old, nil
+			}
+		}
+		return "", gmm.NewError("ref history of '"+m.Name+"' starts after "+at.Format(time.RFC3339), gmm.ErrNotFound)
+	}
+
+	var latest *events.RefChange
+	for _, update := range updates {
+		change := findRefChange(update, ref)
+		if change == nil {
+			continue
+		}
+		if update.Time.After(at) {
+			return change.Old, nil
+		}
+		latest = change
+	}
+	if latest != nil {
+		return latest.New, nil
+	}
+	// Unchanged since the history started
+	output, cmdErr := m.cmd.ListRefs(m.path)
+	if cmdErr != nil {
+		return "", cmdErr
+	}
+	return parseRefs(output)[ref], nil
+}
+
+// ForcePushes returns the refs force-pushed since given time, oldest first
+func (m *Mirror) ForcePushes(since time.Time) ([]*ForcePush, gmm.ApplicationError) {
+	updates, err := m.history.List(since)
+	if err != nil {
+		return nil, err
+	}
+	forcePushes := []*ForcePush{}
+	for _, update := range updates {
+		for _, change := range update.Refs {
+			if change.Kind == events.RefForced {
+				forcePushes = append(forcePushes, &ForcePush{
+					Mirror:   m.Name,
+					Time:     update.Time,
+					Upstream: update.Upstream,
+					Ref:      change.Ref,
+					Old:      change.Old,
+					New:      change.New,
+				})
+			}
+		}
+	}
+	return forcePushes, nil
+}
+
+// recordUpdate adds the refs changed since before to the ref history, publishes and returns them
+func (m *Mirror) recordUpdate(before map[string]string, upstream string) []*events.RefChange {
+	if before == nil {
+		return nil
+	}
+	after := m.snapshotRefs()
+	if after == nil {
+		return nil
+	}
+	changes := changedRefs(before, after)
+	if len(changes) == 0 {
+		return nil
+	}
+	m.detectForcePushes(changes)
+	if err := m.history.Append(&RefUpdate{Time: time.Now().UTC(), Upstream: upstream, Refs: changes}); err != nil {
+		log.Errorf("Recording ref history of '%s' failed: %s", m.Name, err)
+	}
+	if m.events != nil {
+		event := events.NewEvent(events.MirrorUpdated, m.Name)
+		event.Upstream = upstream
+		event.Refs = changes
+		m.events.Publish(event)
+	}
+	return changes
+}
+
+// detectForcePushes marks the moved refs of which the old object is not an ancestor of the new one.
+// The history of shallow mirrors is incomplete, so their refs are never considered force-pushed.
+func (m *Mirror) detectForcePushes(changes []*events.RefChange) {
+	shallow := m.Options().Mode() == CloneModeShallow
+	for _, change := range changes {
+		if change.Kind != events.RefUpdated || shallow {
+			continue
+		}
+		fastForward, err := m.cmd.IsAncestor(m.path, change.Old, change.New)
+		if err != nil {
+			log.Warnf("Checking whether '%s' of '%s' was force-pushed failed: %s", change.Ref, m.Name, err)
+			continue
+		}
+		if !fastForward {
+			change.Kind = events.RefForced
+		}
+	}
+}
+
+// snapshotRefs lists the mirrored refs to compare with after an update, or returns nil when they can't be listed
+func (m *Mirror) snapshotRefs() map[string]string {
+	output, err := m.cmd.ListRefs(m.path)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	refs := parseRefs(output)
+	for ref := range refs {
+		if strings.HasPrefix(ref, managedRefPrefix) {
+			delete(refs, ref)
+		}
+	}
+	return refs
+}
+
+// changedRefs describes the refs created, deleted or moved between before and after, sorted by name.
+// Moved refs are considered updated, see detectForcePushes.
+func changedRefs(before map[string]string, after map[string]string) []*events.RefChange {
+	var changes []*events.RefChange
+	for ref, sha := range after {
+		if old, ok := before[ref]; !ok {
+			changes = append(changes, &events.RefChange{Ref: ref, Kind: events.RefCreated, New: sha})
+		} else if old != sha {
+			changes = append(changes, &events.RefChange{Ref: ref, Kind: events.RefUpdated, Old: old, New: sha})
+		}
+	}
+	for ref, sha := range before {
+		if _, ok := after[ref]; !ok {
+			changes = append(changes, &events.RefChange{Ref: ref, Kind: events.RefDeleted, Old: sha})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Ref < changes[j].Ref })
+	return changes
+}
+
+func findRefChange(update *RefUpdate, ref string) *events.RefChange {
+	for _, change := range update.Refs {
+		if change.Ref == ref {
+			return change
+		}
+	}
+	return nil
+}
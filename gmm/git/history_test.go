@@ -0,0 +1,161 @@
+package git_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func newHistoryTestMirror(t *testing.T) (*git.Mirror, *mocks.CommandRunner, func()) {
+	baseDir, err := ioutil.TempDir("", "gmm-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(baseDir, "ns"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := &mocks.CommandRunner{}
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(true)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	cmd.On("SetConfig", mock.Anything, "gmm.options", mock.Anything).Return(nil)
+	cmd.On("FetchPrune", mock.Anything, "http://example.com/ns/repo", mock.Anything).Return(nil)
+	mirror, appErr := git.NewMirror("http://example.com/ns/repo", &git.Options{}, baseDir, updateInterval, cmd, fs, updateCronFactoryStub, nil, nil)
+	if appErr != nil {
+		t.Fatal(appErr)
+	}
+	return mirror, cmd, func() { os.RemoveAll(baseDir) }
+}
+
+// expectRefs makes the next two listings of refs, before and after an update, return before and after
+func expectRefs(cmd *mocks.CommandRunner, before string, after string) {
+	cmd.On("ListRefs", mock.Anything).Return(before, nil).Once()
+	cmd.On("ListRefs", mock.Anything).Return(after, nil).Once()
+}
+
+func TestUpdateRecordsRefHistory(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	expectRefs(cmd, "aaa refs/heads/main\nbbb refs/heads/feature\nccc refs/tags/v1", "ddd refs/heads/main\neee refs/heads/feature")
+	cmd.On("IsAncestor", mock.Anything, "aaa", "ddd").Return(true, nil)
+	cmd.On("IsAncestor", mock.Anything, "bbb", "eee").Return(false, nil)
+	assertions := assert.New(t)
+
+	assertions.Nil(mirror.Update())
+	updates, err := mirror.RefHistory(time.Time{})
+	assertions.Nil(err)
+	if assertions.Len(updates, 1) {
+		assertions.Equal("http://example.com/ns/repo", updates[0].Upstream)
+		assertions.Equal([]*events.RefChange{
+			{Ref: "refs/heads/feature", Kind: events.RefForced, Old: "bbb", New: "eee"},
+			{Ref: "refs/heads/main", Kind: events.RefUpdated, Old: "aaa", New: "ddd"},
+			{Ref: "refs/tags/v1", Kind: events.RefDeleted, Old: "ccc"},
+		}, updates[0].Refs)
+	}
+
+	forcePushes, err := mirror.ForcePushes(time.Time{})
+	assertions.Nil(err)
+	if assertions.Len(forcePushes, 1) {
+		assertions.Equal("ns/repo", forcePushes[0].Mirror)
+		assertions.Equal("refs/heads/feature", forcePushes[0].Ref)
+		assertions.Equal("bbb", forcePushes[0].Old)
+		assertions.Equal("eee", forcePushes[0].New)
+	}
+	forcePushes, err = mirror.ForcePushes(time.Now().Add(time.Hour))
+	assertions.Nil(err)
+	assertions.Len(forcePushes, 0)
+}
+
+func TestShallowMirrorsAreNotCheckedForForcePushes(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	assertions.Nil(mirror.SetOptions(&git.Options{CloneMode: git.CloneModeShallow, Depth: 1}))
+	expectRefs(cmd, "aaa refs/heads/main", "bbb refs/heads/main")
+
+	assertions.Nil(mirror.Update())
+	updates, _ := mirror.RefHistory(time.Time{})
+	if assertions.Len(updates, 1) {
+		assertions.Equal(events.RefUpdated, updates[0].Refs[0].Kind)
+	}
+	cmd.AssertNotCalled(t, "IsAncestor", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRefAt(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+
+	_, err := mirror.RefAt("refs/heads/main", time.Now())
+	if assertions.Error(err) {
+		assertions.Equal(gmm.ErrNotFound, err.Code())
+	}
+
+	expectRefs(cmd, "", "aaa refs/heads/main\nccc refs/heads/stable")
+	assertions.Nil(mirror.Update())
+	time.Sleep(10 * time.Millisecond)
+	expectRefs(cmd, "aaa refs/heads/main\nccc refs/heads/stable", "bbb refs/heads/main\nccc refs/heads/stable")
+	cmd.On("IsAncestor", mock.Anything, "aaa", "bbb").Return(true, nil)
+	assertions.Nil(mirror.Update())
+	cmd.On("ListRefs", mock.Anything).Return("bbb refs/heads/main\nccc refs/heads/stable", nil)
+
+	updates, _ := mirror.RefHistory(time.Time{})
+	if !assertions.Len(updates, 2) {
+		return
+	}
+	for at, expected := range map[time.Time]string{
+		updates[0].Time.Add(-time.Second):      "",
+		updates[0].Time:                        "aaa",
+		updates[1].Time.Add(-time.Millisecond): "aaa",
+		updates[1].Time:                        "bbb",
+		time.Now():                             "bbb",
+	} {
+		object, err := mirror.RefAt("refs/heads/main", at)
+		assertions.Nil(err)
+		assertions.Equal(expected, object, "refs/heads/main at %s", at)
+	}
+
+	object, err := mirror.RefAt("refs/heads/stable", time.Now())
+	assertions.Nil(err)
+	assertions.Equal("ccc", object, "unchanged refs are looked up")
+	object, err = mirror.RefAt("refs/heads/unknown", time.Now())
+	assertions.Nil(err)
+	assertions.Equal("", object)
+}
+
+func TestRefHistoryReplaysRefs(t *testing.T) {
+	file, err := ioutil.TempFile("", "gmm-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	history := git.NewRefHistory(file.Name())
+	assertions := assert.New(t)
+
+	assertions.Nil(history.Append(&git.RefUpdate{Time: time.Now(), Refs: []*events.RefChange{
+		{Ref: "refs/heads/main", Kind: events.RefCreated, New: "aaa"},
+		{Ref: "refs/heads/old", Kind: events.RefCreated, New: "bbb"},
+	}}))
+	assertions.Nil(history.Append(&git.RefUpdate{Time: time.Now(), Refs: []*events.RefChange{
+		{Ref: "refs/heads/main", Kind: events.RefUpdated, Old: "aaa", New: "ccc"},
+		{Ref: "refs/heads/old", Kind: events.RefDeleted, Old: "bbb"},
+	}}))
+	refs, err := history.Refs()
+	assertions.Nil(err)
+	assertions.Equal(map[string]string{"refs/heads/main": "ccc"}, refs)
+
+	assertions.Nil(history.Remove())
+	updates, err := history.List(time.Time{})
+	assertions.Nil(err)
+	assertions.Len(updates, 0)
+	assertions.Nil(history.Remove(), "removing a removed history is no error")
+}
@@ -0,0 +1,17 @@
+package git
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"path"
+	"regexp"
+)
+
+var validLFSObjectID = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// LFSObjectPath returns the path of an LFS object in the mirror's local storage, which may not exist
+func (m *Mirror) LFSObjectPath(oid string) (string, gmm.ApplicationError) {
+	if !validLFSObjectID.MatchString(oid) {
+		return "", gmm.NewError("invalid LFS object id '"+oid+"'", gmm.ErrUser)
+	}
+	return path.Join(m.path, "lfs", "objects", oid[0:2], oid[2:4], oid), nil
+}
@@ -0,0 +1,211 @@
+package git
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// MaintenanceSchedule holds the default maintenance, integrity check and bundle intervals, and creates the Crons
+// running them. Bundles are not scheduled when BundleCronFactory is nil.
+type MaintenanceSchedule struct {
+	Interval          string
+	FsckInterval      string
+	CronFactory       MaintenanceCronFactory
+	BundleInterval    string
+	BundleCronFactory CronFactory
+}
+
+// Maintain runs maintenance tasks on the local repository, and expires its dist archives
+func (m *Mirror) Maintain() gmm.ApplicationError {
+	m.operation.Lock()
+	defer m.operation.Unlock()
+
+	log.Printf("Maintaining '%s'", m.Name)
+	err := m.cmd.Maintain(m.path)
+	m.mutex.Lock()
+	m.status.maintained(time.Now(), err)
+	m.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	m.expireDists(m.Options(), time.Now())
+	m.measureDiskUsage()
+	log.Printf("Maintaining '%s' completed", m.Name)
+	return nil
+}
+
+// CheckIntegrity checks the local repository using fsck, flagging the mirror as corrupt when that finds errors.
+// A corrupt repository is replaced by a fresh clone if the options say so.
+func (m *Mirror) CheckIntegrity() gmm.ApplicationError {
+	m.operation.Lock()
+	defer m.operation.Unlock()
+
+	log.Printf("Checking integrity of '%s'", m.Name)
+	err := m.cmd.Fsck(m.path)
+	corrupt := err != nil && err.Code() == gmm.ErrCorrupt
+	m.mutex.Lock()
+	m.status.checked(time.Now(), corrupt, err)
+	m.mutex.Unlock()
+	if err == nil {
+		return nil
+	}
+	if !corrupt {
+		log.Errorf("Checking integrity of '%s' failed: %s", m.Name, err)
+		return err
+	}
+	log.Errorf("Mirror '%s' is corrupt: %s", m.Name, err)
+	if !m.Options().RecloneOnCorruption {
+		return err
+	}
+	if err := m.reclone(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.status.recloned(time.Now())
+	m.mutex.Unlock()
+	return nil
+}
+
+// reclone replaces the repository by a fresh clone, keeping its preserved and restored refs. The clone is made next
+// to the repository, which is only replaced when the clone is complete and intact, so the mirror is not lost when its
+// upstreams are unavailable.
+func (m *Mirror) reclone() gmm.ApplicationError {
+	log.Warnf("Replacing corrupt mirror '%s' by a fresh clone", m.Name)
+	fresh, corrupt := hiddenPath(m.path, ".reclone"), hiddenPath(m.path, ".corrupt")
+	if err := m.fs.RemoveAll(fresh); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	before, historyErr := m.history.Refs()
+	if historyErr != nil {
+		log.Errorf("Reading ref history of '%s' failed: %s", m.Name, historyErr)
+	}
+	upstream, err := m.cloneTo(fresh)
+	if err == nil {
+		err = m.keepManagedRefs(fresh)
+	}
+	if err == nil {
+		err = m.cmd.Fsck(fresh)
+	}
+	if err != nil {
+		log.Errorf("Replacing corrupt mirror '%s' failed, keeping it: %s", m.Name, err)
+		if err := m.fs.RemoveAll(fresh); err != nil {
+			log.Error(err)
+		}
+		m.publishUpdateFailed(err)
+		return err
+	}
+	if err := os.Rename(m.path, corrupt); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	if err := os.Rename(fresh, m.path); err != nil {
+		// Puts the corrupt repository back rather than leaving no repository at all
+		if err := os.Rename(corrupt, m.path); err != nil {
+			log.Error(err)
+		}
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	if err := m.fs.RemoveAll(corrupt); err != nil {
+		log.Error(err)
+	}
+	m.cloned(before, upstream)
+	return nil
+}
+
+// keepManagedRefs copies the preserved and restored refs to a fresh clone at directory. Upstream no longer has
+// their objects, so the repository is not replaced when they cannot be copied.
+func (m *Mirror) keepManagedRefs(directory string) gmm.ApplicationError {
+	if err := m.cmd.CopyRefs(m.path, directory, managedRefPrefix); err != nil {
+		return gmm.NewError("copying preserved refs of '"+m.Name+"' failed: "+err.Error(), err.Code())
+	}
+	return m.cmd.SetConfig(directory, "transfer.hideRefs", preservedRefPrefix)
+}
+
+// scheduleMaintenance (re)creates the maintenance Cron, using the intervals of the options over the defaults
+func (m *Mirror) scheduleMaintenance() gmm.ApplicationError {
+	if m.maintenance == nil {
+		return nil
+	}
+	options := m.Options()
+	interval, fsckInterval := m.maintenance.Interval, m.maintenance.FsckInterval
+	if options.MaintenanceInterval != "" {
+		interval = options.MaintenanceInterval
+	}
+	if options.FsckInterval != "" {
+		fsckInterval = options.FsckInterval
+	}
+	c, err := m.maintenance.CronFactory(m, interval, fsckInterval)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	previous := m.maintenanceCron
+	m.maintenanceCron = c
+	m.mutex.Unlock()
+
+	if previous != nil {
+		previous.Stop()
+	}
+	if c != nil {
+		c.Start()
+	}
+	return nil
+}
+
+// scheduleBundles (re)creates the bundle Cron, using the interval of the options over the default
+func (m *Mirror) scheduleBundles() gmm.ApplicationError {
+	if m.maintenance == nil || m.maintenance.BundleCronFactory == nil {
+		return nil
+	}
+	interval := m.maintenance.BundleInterval
+	if options := m.Options(); options.BundleInterval != "" {
+		interval = options.BundleInterval
+	}
+	c, err := m.maintenance.BundleCronFactory(m, interval)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	previous := m.bundleCron
+	m.bundleCron = c
+	m.mutex.Unlock()
+
+	if previous != nil {
+		previous.Stop()
+	}
+	if c != nil {
+		c.Start()
+	}
+	return nil
+}
+
+// MeasureDiskUsage measures the disk space used by the repository, the dist archives built from it and its bundles
+func (m *Mirror) MeasureDiskUsage() (*DiskUsage, gmm.ApplicationError) {
+	repository, err := m.fs.DirectorySize(m.path)
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	dist, err := m.fs.DirectorySize(distPath(m.path))
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	bundles, err := m.fs.DirectorySize(bundlesPath(m.path))
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	usage := &DiskUsage{Repository: repository, Dist: dist, Bundles: bundles, MeasuredAt: time.Now()}
+	m.mutex.Lock()
+	m.status.DiskUsage = usage
+	m.mutex.Unlock()
+	return usage, nil
+}
+
+// measureDiskUsage is MeasureDiskUsage, logging errors
+func (m *Mirror) measureDiskUsage() {
+	if _, err := m.MeasureDiskUsage(); err != nil {
+		log.Errorf("Measuring disk usage of '%s' failed: %s", m.Name, err)
+	}
+}
@@ -0,0 +1,178 @@
+package git_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/gmm/util"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMaintainRecordsStatus(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", nil)
+	cmd.On("Maintain", "/path/ns/repo").Return(gmm.NewError("exit status 128", gmm.ErrFilesystem)).Once()
+	cmd.On("Maintain", "/path/ns/repo").Return(nil)
+	assertions := assert.New(t)
+
+	assertions.Error(mirror.Maintain())
+	assertions.Equal("exit status 128 [0]", mirror.Status().LastMaintenanceError)
+	assertions.Nil(mirror.Status().LastMaintenance)
+
+	assertions.Nil(mirror.Maintain())
+	assertions.Equal("", mirror.Status().LastMaintenanceError)
+	assertions.NotNil(mirror.Status().LastMaintenance)
+}
+
+func TestCheckIntegrityFlagsCorruption(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", nil)
+	cmd.On("Fsck", "/path/ns/repo").Return(gmm.NewError("exit status 4", gmm.ErrCorrupt))
+	assertions := assert.New(t)
+
+	assertions.Error(mirror.CheckIntegrity())
+	status := mirror.Status()
+	assertions.True(status.Corrupt)
+	assertions.Equal("exit status 4 [8]", status.LastFsckError)
+	assertions.NotNil(status.LastFsck)
+	cmd.AssertNotCalled(t, "CreateMirror", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCheckIntegrityDoesNotRecloneWhenFsckFails(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", &git.Options{RecloneOnCorruption: true})
+	cmd.On("Fsck", "/path/ns/repo").Return(gmm.NewError("signal: killed", gmm.ErrFilesystem))
+	assertions := assert.New(t)
+
+	assertions.Error(mirror.CheckIntegrity())
+	status := mirror.Status()
+	assertions.False(status.Corrupt)
+	assertions.Equal("signal: killed [0]", status.LastFsckError)
+	cmd.AssertNotCalled(t, "CreateMirror", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+// newRecloneTestMirror creates a corrupt mirror in a temporary base directory, its repository holding a "corrupt" file
+func newRecloneTestMirror(t *testing.T, options *git.Options) (*git.Mirror, *mocks.CommandRunner, string) {
+	baseDir, err := ioutil.TempDir(os.TempDir(), "reclone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository := baseDir + "/ns/repo"
+	if err := os.MkdirAll(repository, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(repository+"/corrupt", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := &mocks.CommandRunner{}
+	cmd.On("SetConfig", mock.Anything, "gmm.options", mock.Anything).Return(nil)
+	cmd.On("Fsck", repository).Return(gmm.NewError("exit status 4", gmm.ErrCorrupt))
+	cmd.On("ListRefs", repository).Return("aaa refs/heads/main", nil)
+	mirror, _ := git.NewMirror(
+		"http://example.com/ns/repo", options, baseDir, updateInterval, cmd, &util.OsFileSystemUtil{}, updateCronFactoryStub, nil, nil,
+	)
+	return mirror, cmd, baseDir
+}
+
+func TestCheckIntegrityReclonesCorruptMirror(t *testing.T) {
+	mirror, cmd, baseDir := newRecloneTestMirror(t, &git.Options{RecloneOnCorruption: true})
+	defer os.RemoveAll(baseDir)
+	fresh := baseDir + "/ns/.repo.reclone"
+	cmd.On("CreateMirror", "http://example.com/ns/repo", fresh, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		os.MkdirAll(fresh, 0700)
+		ioutil.WriteFile(fresh+"/fresh", nil, 0600)
+	}).Return(nil)
+	cmd.On("CopyRefs", baseDir+"/ns/repo", fresh, "refs/gmm/").Return(nil)
+	cmd.On("SetConfig", fresh, "transfer.hideRefs", "refs/gmm/preserved/").Return(nil)
+	cmd.On("Fsck", fresh).Return(nil)
+	assertions := assert.New(t)
+
+	assertions.Nil(mirror.CheckIntegrity())
+	status := mirror.Status()
+	assertions.False(status.Corrupt)
+	assertions.NotNil(status.LastReclone)
+	assertions.FileExists(baseDir + "/ns/repo/fresh")
+	_, err := os.Stat(baseDir + "/ns/repo/corrupt")
+	assertions.True(os.IsNotExist(err))
+	entries, _ := ioutil.ReadDir(baseDir + "/ns")
+	assertions.Len(entries, 2, "only the repository and its ref history remain")
+}
+
+func TestCheckIntegrityKeepsPreservedRefs(t *testing.T) {
+	mirror, cmd, baseDir := newRecloneTestMirror(t, &git.Options{RecloneOnCorruption: true, Preserve: true})
+	defer os.RemoveAll(baseDir)
+	fresh := baseDir + "/ns/.repo.reclone"
+	cmd.On("CreateMirror", "http://example.com/ns/repo", fresh, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		os.MkdirAll(fresh, 0700)
+	}).Return(nil)
+	// Stands in for the preserved refs, which are copied from the corrupt repository
+	cmd.On("CopyRefs", baseDir+"/ns/repo", fresh, "refs/gmm/").Run(func(args mock.Arguments) {
+		ioutil.WriteFile(fresh+"/preserved", nil, 0600)
+	}).Return(nil).Once()
+	cmd.On("SetConfig", fresh, "transfer.hideRefs", "refs/gmm/preserved/").Return(nil)
+	cmd.On("Fsck", fresh).Return(nil)
+	assertions := assert.New(t)
+
+	assertions.Nil(mirror.CheckIntegrity())
+	assertions.FileExists(baseDir + "/ns/repo/preserved")
+	cmd.AssertCalled(t, "SetConfig", fresh, "transfer.hideRefs", "refs/gmm/preserved/")
+
+	// Preserved refs that cannot be copied, as their objects are corrupt, are not given up
+	ioutil.WriteFile(baseDir+"/ns/repo/corrupt", nil, 0600)
+	cmd.On("CopyRefs", baseDir+"/ns/repo", fresh, "refs/gmm/").Return(gmm.NewError("missing object", gmm.ErrFilesystem))
+	err := mirror.CheckIntegrity()
+	if assertions.Error(err) {
+		assertions.Contains(err.Error(), "preserved refs")
+	}
+	assertions.FileExists(baseDir + "/ns/repo/corrupt")
+	assertions.FileExists(baseDir + "/ns/repo/preserved")
+}
+
+func TestCheckIntegrityKeepsCorruptMirrorWhenRecloneFails(t *testing.T) {
+	mirror, cmd, baseDir := newRecloneTestMirror(t, &git.Options{RecloneOnCorruption: true})
+	defer os.RemoveAll(baseDir)
+	fresh := baseDir + "/ns/.repo.reclone"
+	cmd.On("CreateMirror", "http://example.com/ns/repo", fresh, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		os.MkdirAll(fresh, 0700)
+	}).Return(gmm.NewError("rate limited", gmm.ErrGitCommand))
+	assertions := assert.New(t)
+
+	assertions.Error(mirror.CheckIntegrity())
+	assertions.True(mirror.Status().Corrupt)
+	assertions.Nil(mirror.Status().LastReclone)
+	assertions.FileExists(baseDir + "/ns/repo/corrupt")
+	_, err := os.Stat(fresh)
+	assertions.True(os.IsNotExist(err))
+}
+
+func TestMaintenanceIsRescheduledWhenIntervalsChange(t *testing.T) {
+	cmd := &mocks.CommandRunner{}
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(true)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	cmd.On("SetConfig", mock.Anything, "gmm.options", mock.Anything).Return(nil)
+
+	var scheduled [][]string
+	maintenanceCron := &mocks.Cron{}
+	maintenanceCron.On("Start")
+	maintenanceCron.On("Stop")
+	schedule := &git.MaintenanceSchedule{
+		Interval:     "@daily",
+		FsckInterval: "@weekly",
+		CronFactory: func(mirror *git.Mirror, interval string, fsckInterval string) (git.Cron, gmm.ApplicationError) {
+			scheduled = append(scheduled, []string{interval, fsckInterval})
+			return maintenanceCron, nil
+		},
+	}
+	mirror, _ := git.NewMirror("http://example.com/ns/repo", &git.Options{}, "/path", updateInterval, cmd, fs, updateCronFactoryStub, schedule, nil)
+	assertions := assert.New(t)
+
+	assertions.Nil(mirror.SetOptions(&git.Options{VerifyUpstreams: true}))
+	assertions.Nil(mirror.SetOptions(&git.Options{FsckInterval: "false"}))
+	assertions.Equal([][]string{{"@daily", "@weekly"}, {"@daily", "false"}}, scheduled)
+	maintenanceCron.AssertNumberOfCalls(t, "Stop", 1)
+
+	mirror.Destroy()
+	maintenanceCron.AssertNumberOfCalls(t, "Stop", 2)
+}
@@ -1,31 +1,55 @@
 package git
 
 import (
+	"encoding/json"
 	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
 	"github.com/kleijnweb/git-mirror-manager/gmm/util"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"path"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Mirror represents a Git mirror
 type Mirror struct {
-	Name string
-	Cron Cron
-	uri  string
-	path string
-	cmd  CommandRunner
-	fs   util.FileSystemUtil
+	Name    string
+	Cron    Cron
+	uri     string
+	path    string
+	options *Options
+	status  *Status
+	hooks   []UpdateHook
+	mutex   sync.Mutex
+	// operation serializes the operations on the local repository
+	operation       sync.Mutex
+	maintenance     *MaintenanceSchedule
+	maintenanceCron Cron
+	bundleCron      Cron
+	events          events.Publisher
+	history         *RefHistory
+	lastAccess      *time.Time
+	lastAccessSaved *time.Time
+	cmd             CommandRunner
+	fs              util.FileSystemUtil
 }
 
-// NewMirror creates a new Mirror struct, cloning the remote in separate subroutine
+// NewMirror creates a new Mirror struct, cloning the remote in separate subroutine.
+// When options is nil, the options stored with an existing repository are used. When options name a bundle
+// to create the mirror from, the repository is created from it before returning and the upstream isn't contacted.
+// When maintenance is nil, no maintenance is scheduled. When events is nil, no events are published.
 func NewMirror(
 	uri string,
+	options *Options,
 	baseDir string,
 	updateInterval string,
 	cmd CommandRunner,
 	fs util.FileSystemUtil,
 	updateCronFactory CronFactory,
+	maintenance *MaintenanceSchedule,
+	events events.Publisher,
 ) (*Mirror, gmm.ApplicationError) {
 
 	if uri == "" {
@@ -35,25 +59,53 @@ func NewMirror(
 	name := MirrorNameFromURI(uri)
 
 	m := &Mirror{
-		Name: name,
-		uri:  uri,
-		path: baseDir + "/" + name,
-		cmd:  cmd,
-		fs:   fs,
+		Name:        name,
+		uri:         uri,
+		path:        baseDir + "/" + name,
+		options:     options,
+		status:      &Status{},
+		maintenance: maintenance,
+		events:      events,
+		history:     NewRefHistory(refHistoryPath(baseDir + "/" + name)),
+		cmd:         cmd,
+		fs:          fs,
 	}
 
-	log.Infof("Expecting repository at '%m'", m.path)
+	log.Infof("Expecting repository at '%s'", m.path)
 
-	if !m.fs.DirectoryExists(m.path) {
-		if err := m.AssertValidRemote(m.uri); err != nil {
+	exists := m.fs.DirectoryExists(m.path)
+	if !exists && m.options != nil && m.options.FromBundle != "" {
+		if err := m.cloneBundle(); err != nil {
 			return nil, err
 		}
-		log.Infof("Repository '%m' does not exists yet", m.path)
+		exists = true
+	}
+	if !exists {
+		if m.options == nil {
+			m.options = &Options{}
+		}
+		if err := m.assertValidUpstream(); err != nil {
+			return nil, err
+		}
+		log.Infof("Repository '%s' does not exists yet", m.path)
 		go func() {
+			m.operation.Lock()
+			defer m.operation.Unlock()
 			if err := m.clone(); err != nil {
 				log.Error(err)
 			}
 		}()
+	} else {
+		if m.options == nil {
+			loaded, err := LoadOptions(m.cmd, m.path)
+			if err != nil {
+				return nil, err
+			}
+			m.options = loaded
+		} else if err := m.options.Save(m.cmd, m.path); err != nil {
+			return nil, err
+		}
+		m.measureDiskUsage()
 	}
 
 	updateCron, err := updateCronFactory(m, updateInterval)
@@ -65,6 +117,18 @@ func NewMirror(
 	m.Cron = updateCron
 	m.Cron.Start()
 
+	if err := m.scheduleMaintenance(); err != nil {
+		m.Cron.Stop()
+		return nil, err
+	}
+	if err := m.scheduleBundles(); err != nil {
+		m.Cron.Stop()
+		if m.maintenanceCron != nil {
+			m.maintenanceCron.Stop()
+		}
+		return nil, err
+	}
+
 	log.Printf("Initialized mirror '%s'", m.Name)
 
 	return m, nil
@@ -80,6 +144,15 @@ func (m *Mirror) AssertValidRemote(uri string) gmm.ApplicationError {
 	return nil
 }
 
+func (m *Mirror) assertValidUpstream() (err gmm.ApplicationError) {
+	for _, upstream := range m.Upstreams() {
+		if err = m.AssertValidRemote(upstream); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
 // MirrorNameFromURI Creates a Name from a Git uri.
 // It will panic if the uri is not in the expected format.
 func MirrorNameFromURI(uri string) (name string) {
@@ -90,9 +163,41 @@ func MirrorNameFromURI(uri string) (name string) {
 	return
 }
 
+// ParseMirrorName returns the name MirrorNameFromURI derives from uri, or fails when uri names no mirror or one
+// whose repository would not be stored in baseDir, as untrusted URLs such as those in .gitmodules may
+func ParseMirrorName(baseDir string, uri string) (string, gmm.ApplicationError) {
+	if strings.Count(uri, "/") < 2 {
+		return "", gmm.NewError("uri '"+uri+"' does not name a mirror", gmm.ErrUser)
+	}
+	name := MirrorNameFromURI(uri)
+	baseDir = path.Clean(baseDir)
+	if strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || path.Clean(baseDir+"/"+name) != baseDir+"/"+name {
+		return "", gmm.NewError("uri '"+uri+"' does not name a mirror", gmm.ErrUser)
+	}
+	return name, nil
+}
+
+// hiddenPath is the path of data kept next to the repository at mirrorPath, hidden from loading mirrors by a leading dot
+func hiddenPath(mirrorPath string, suffix string) string {
+	return path.Join(path.Dir(mirrorPath), "."+path.Base(mirrorPath)+suffix)
+}
+
+// baseDir is the directory the repositories of all mirrors are stored in
+func (m *Mirror) baseDir() string {
+	return path.Dir(path.Dir(m.path))
+}
+
 // Destroy removes local data and jobs
 func (m *Mirror) Destroy() gmm.ApplicationError {
 	m.Cron.Stop()
+	m.mutex.Lock()
+	if m.maintenanceCron != nil {
+		m.maintenanceCron.Stop()
+	}
+	if m.bundleCron != nil {
+		m.bundleCron.Stop()
+	}
+	m.mutex.Unlock()
 	return m.removeData()
 }
 
@@ -101,43 +206,286 @@ func (m *Mirror) Path() string {
 	return m.path
 }
 
-// Update updates the local mirror with the remote
+// URI returns the upstream URI
+func (m *Mirror) URI() string {
+	return m.uri
+}
+
+// Upstreams returns the uri followed by any fallback upstreams
+func (m *Mirror) Upstreams() []string {
+	return append([]string{m.uri}, m.Options().Upstreams...)
+}
+
+// Options returns a copy of the mirror's settings
+func (m *Mirror) Options() *Options {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.options == nil {
+		return &Options{}
+	}
+	options := *m.options
+	return &options
+}
+
+// SetOptions changes and persists the mirror's settings
+func (m *Mirror) SetOptions(options *Options) gmm.ApplicationError {
+	if err := options.Save(m.cmd, m.path); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	previous := m.options
+	m.options = options
+	for target := range m.status.Push {
+		if !contains(options.PushTargets, target) {
+			delete(m.status.Push, target)
+		}
+	}
+	m.mutex.Unlock()
+
+	if previous == nil || previous.MaintenanceInterval != options.MaintenanceInterval || previous.FsckInterval != options.FsckInterval {
+		if err := m.scheduleMaintenance(); err != nil {
+			return err
+		}
+	}
+	if previous == nil || previous.BundleInterval != options.BundleInterval {
+		return m.scheduleBundles()
+	}
+	return nil
+}
+
+// Status returns a copy of the mirror's status
+func (m *Mirror) Status() *Status {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.status.copy(time.Now())
+}
+
+// MarshalJSON describes the mirror's name, upstream, clone mode, settings and status
+func (m *Mirror) MarshalJSON() ([]byte, error) {
+	options := m.Options()
+	return json.Marshal(struct {
+		Name    string   `json:"name"`
+		URI     string   `json:"uri"`
+		Mode    string   `json:"mode"`
+		Options *Options `json:"options"`
+		Status  *Status  `json:"status"`
+	}{m.Name, m.uri, options.Mode(), options, m.Status()})
+}
+
+// Update updates the local mirror from the first upstream that can be fetched from, then pushes it to any push targets.
+// Only fetch errors are returned, upstream mismatches and push errors are recorded in the status.
+// Changed refs and fetch errors are published as events. Changed refs are recorded in the ref history, and the old
+// objects of refs force-pushed or deleted upstream are preserved, and created or moved tags archived, when the
+// options say so.
+// Suspended mirrors are not updated.
 func (m *Mirror) Update() gmm.ApplicationError {
+	m.operation.Lock()
+	defer m.operation.Unlock()
+
+	if m.Options().Suspended {
+		log.Printf("Not updating suspended mirror '%s'", m.Name)
+		return nil
+	}
 	log.Printf("Updating '%s'", m.Name)
-	if err := m.cmd.FetchPrune(m.path); err != nil {
+	before := m.snapshotRefs()
+	upstream, err := m.fetch()
+	m.mutex.Lock()
+	m.status.fetched(time.Now(), upstream, err)
+	m.mutex.Unlock()
+	if err != nil {
+		m.publishUpdateFailed(err)
 		return err
 	}
+	m.publishActivity(events.MirrorFetched, upstream)
+	changes := m.recordUpdate(before, upstream)
+	options := m.Options()
+	if options.Preserve {
+		m.preserveRefs(changes)
+	}
+	if options.PreserveDays > 0 || options.PreserveCount > 0 {
+		m.expirePreservedRefs(options, time.Now())
+	}
+	m.createDists(changes)
 
-	log.Printf("Updating '%s' completed", m.Name)
+	log.Printf("Updating '%s' from '%s' completed", m.Name, upstream)
+	if m.Options().VerifyUpstreams {
+		m.verifyUpstreams(upstream)
+	}
+	m.push()
+	m.updated()
 	return nil
 }
 
-func (m *Mirror) clone() gmm.ApplicationError {
-	log.Infof("Cloning '%s'", m.Name)
-	err := m.cmd.CreateMirror(m.uri, m.path)
-	log.Infof("Cloning '%s' completed", m.Name)
-	return err
+func (m *Mirror) fetch() (upstream string, err gmm.ApplicationError) {
+	options := m.Options()
+	for _, upstream = range m.Upstreams() {
+		if err = m.cmd.FetchPrune(m.path, upstream, options); err == nil {
+			if err := m.removeFilteredRefs(options); err != nil {
+				return upstream, err
+			}
+			return upstream, m.fetchLFS(upstream, options)
+		}
+		log.Warnf("Fetching '%s' from '%s' failed: %s", m.Name, upstream, err)
+	}
+	return "", err
 }
 
-func (m *Mirror) createDists() gmm.ApplicationError {
-	output, err := m.cmd.LsRemoteTags(m.uri)
+// fetchLFS downloads the LFS objects of the mirror from upstream, if enabled
+func (m *Mirror) fetchLFS(upstream string, options *Options) gmm.ApplicationError {
+	if !options.LFS {
+		return nil
+	}
+	log.Infof("Fetching LFS objects of '%s' from '%s'", m.Name, upstream)
+	return m.cmd.FetchLFS(m.path, upstream)
+}
+
+// removeFilteredRefs deletes refs fetched before the ref filters excluded them
+func (m *Mirror) removeFilteredRefs(options *Options) gmm.ApplicationError {
+	if !options.FiltersRefs() {
+		return nil
+	}
+	output, err := m.cmd.ListRefs(m.path)
 	if err != nil {
 		return err
 	}
-	for _, tag := range strings.Split("\n", string(output)) {
-		err := m.cmd.CreateTagArchive(tag, m.path)
-		if err != nil {
+	for ref := range parseRefs(output) {
+		if options.MatchesRef(ref) || strings.HasPrefix(ref, managedRefPrefix) {
+			continue
+		}
+		log.Infof("Removing filtered ref '%s' from '%s'", ref, m.Name)
+		if err := m.cmd.DeleteRef(m.path, ref); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// verifyUpstreams compares the branches and tags of all upstreams but the one fetched from with the local refs
+func (m *Mirror) verifyUpstreams(fetchedFrom string) {
+	output, err := m.cmd.ListRefs(m.path)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	options := m.Options()
+	expected := filterRefs(parseRefs(output), options)
+
+	var mismatches []string
+	for _, upstream := range m.Upstreams() {
+		if upstream == fetchedFrom {
+			continue
+		}
+		output, err := m.cmd.LsRemote(upstream)
+		if err != nil {
+			mismatches = append(mismatches, upstream+": "+err.Error())
+			continue
+		}
+		mismatches = append(mismatches, diffRefs(upstream, expected, filterRefs(parseRefs(output), options))...)
+	}
+	if len(mismatches) > 0 {
+		log.Warnf("Upstreams of '%s' disagree: %s", m.Name, strings.Join(mismatches, ", "))
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.status.UpstreamMismatches = mismatches
+}
+
+func (m *Mirror) push() {
+	options := m.Options()
+	for _, target := range options.PushTargets {
+		log.Printf("Pushing '%s' to '%s'", m.Name, target)
+		err := m.cmd.Push(m.path, target, options.PushRefspec)
+		m.mutex.Lock()
+		m.status.pushed(target, time.Now(), err)
+		m.mutex.Unlock()
+		if err != nil {
+			log.Errorf("Pushing '%s' to '%s' failed: %s", m.Name, target, err)
+			continue
+		}
+		log.Printf("Pushing '%s' to '%s' completed", m.Name, target)
+	}
+}
+
+// clone creates the repository. Refs are recorded in the ref history as changed since its last update.
+func (m *Mirror) clone() (err gmm.ApplicationError) {
+	before, historyErr := m.history.Refs()
+	if historyErr != nil {
+		log.Errorf("Reading ref history of '%s' failed: %s", m.Name, historyErr)
+	}
+	upstream, err := m.cloneTo(m.path)
+	if err != nil {
+		m.publishUpdateFailed(err)
+		return err
+	}
+	m.cloned(before, upstream)
+	return nil
+}
+
+// cloneTo clones the mirror into directory from the first upstream that can be cloned from, with its options
+func (m *Mirror) cloneTo(directory string) (upstream string, err gmm.ApplicationError) {
+	options := m.Options()
+	for _, upstream = range m.Upstreams() {
+		log.Infof("Cloning '%s' from '%s'", m.Name, upstream)
+		m.publishActivity(events.MirrorCloneStarted, upstream)
+		if err = m.cmd.CreateMirror(upstream, directory, options, m.cloneProgress(upstream)); err == nil {
+			if upstream != m.uri {
+				err = m.cmd.SetConfig(directory, "remote.origin.url", m.uri)
+			}
+			break
+		}
+		log.Warnf("Cloning '%s' from '%s' failed: %s", m.Name, upstream, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	return upstream, options.Save(m.cmd, directory)
+}
+
+// cloned completes a clone from upstream, recording refs changed since before in the ref history, so replacing
+// a corrupt repository only records what changed upstream meanwhile, and archiving its tags if the options say so
+func (m *Mirror) cloned(before map[string]string, upstream string) {
+	// Missing LFS objects are fetched again by the next update, the repository itself is complete
+	lfsErr := m.fetchLFS(upstream, m.Options())
+	m.mutex.Lock()
+	m.status.fetched(time.Now(), upstream, lfsErr)
+	m.mutex.Unlock()
+	if lfsErr != nil {
+		log.Errorf("Fetching LFS objects of '%s' failed: %s", m.Name, lfsErr)
+		m.publishUpdateFailed(lfsErr)
+	}
+	log.Infof("Cloning '%s' completed", m.Name)
+	m.publishActivity(events.MirrorCloneFinished, upstream)
+	m.recordUpdate(before, upstream)
+	m.archiveTags()
+	m.updated()
+}
+
 func (m *Mirror) removeData() gmm.ApplicationError {
 	log.Infof("Removing directory '%s'", m.path)
 	if err := os.RemoveAll(m.path); err != nil {
 		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
 	}
+	if m.history != nil {
+		if err := m.history.Remove(); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(bundlesPath(m.path)); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	if err := os.RemoveAll(distPath(m.path)); err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
 	log.Infof("Done removing '%s'", m.path)
 	return nil
 }
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package git_test
 
 import (
+	"encoding/json"
 	"github.com/kleijnweb/git-mirror-manager/gmm"
 	"github.com/kleijnweb/git-mirror-manager/gmm/git"
 	"github.com/kleijnweb/git-mirror-manager/mocks"
@@ -46,20 +47,26 @@ var updateCronFactoryStub = func(mirror *git.Mirror, interval string) (git.Cron,
 func NewTestMirror(uri string, baseDir string) *git.Mirror {
 	mirror, _ := git.NewMirror(
 		uri,
+		nil,
 		baseDir,
 		updateInterval,
 		func() *mocks.CommandRunner {
 			// Stubs
 			gitCommandRunnerMock.On("LsRemoteTags", mock.Anything).Return("", nil)
-			gitCommandRunnerMock.On("CreateMirror", mock.Anything, mock.Anything).Return(nil)
+			gitCommandRunnerMock.On("CreateMirror", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+			gitCommandRunnerMock.On("SetConfig", mock.Anything, "gmm.options", mock.Anything).Return(nil)
+			gitCommandRunnerMock.On("ListRefs", mock.Anything).Return("", nil)
 			return gitCommandRunnerMock
 		}(),
 		func() *mocks.FileSystemUtil {
 			// Stubs
 			fsUtilMock.On("DirectoryExists", mock.Anything).Return(false)
+			fsUtilMock.On("DirectorySize", mock.Anything).Return(int64(0), nil)
 			return fsUtilMock
 		}(),
 		updateCronFactoryStub,
+		nil,
+		nil,
 	)
 
 	return mirror
@@ -87,11 +94,14 @@ func TestAssertValidRemote(t *testing.T) {
 func TestInitWillFailWhenUriIsEmpty(t *testing.T) {
 	_, err := git.NewMirror(
 		"",
+		nil,
 		"/baseuri",
 		"fauxvalue",
 		gitCommandRunnerMock,
 		fsUtilMock,
 		updateCronFactoryStub,
+		nil,
+		nil,
 	)
 	if err == nil {
 		t.Error("expected errors, got nil")
@@ -128,6 +138,157 @@ func TestRemoveMirrorStopsCron(t *testing.T) {
 
 func TestCanUpdate(t *testing.T) {
   mirror := NewTestMirror("http://example.com/some/repo", "/path")
-  gitCommandRunnerMock.On("FetchPrune", "/path/some/repo").Return(nil)
+  gitCommandRunnerMock.On("FetchPrune", "/path/some/repo", "http://example.com/some/repo", mock.Anything).Return(nil)
   mirror.Update()
 }
+
+func newExistingTestMirror(uri string, options *git.Options) (*git.Mirror, *mocks.CommandRunner) {
+	cmd := &mocks.CommandRunner{}
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(true)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	cmd.On("GetConfig", mock.Anything, "gmm.options").Return(`{"pushTargets":["https://gitea.example.com/ns/repo"]}`, nil)
+	cmd.On("SetConfig", mock.Anything, "gmm.options", mock.Anything).Return(nil)
+	mirror, err := git.NewMirror(uri, options, "/path", updateInterval, cmd, fs, updateCronFactoryStub, nil, nil)
+	if err != nil {
+		panic(err)
+	}
+	return mirror, cmd
+}
+
+func TestExistingMirrorLoadsOptions(t *testing.T) {
+	mirror, _ := newExistingTestMirror("http://example.com/ns/repo", nil)
+	assert.New(t).Equal([]string{"https://gitea.example.com/ns/repo"}, mirror.Options().PushTargets)
+}
+
+func TestExistingMirrorSavesGivenOptions(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", &git.Options{PushRefspec: "refs/heads/*"})
+	assert.New(t).Equal("refs/heads/*", mirror.Options().PushRefspec)
+	cmd.AssertCalled(t, "SetConfig", "/path/ns/repo", "gmm.options", `{"pushRefspec":"refs/heads/*"}`)
+}
+
+func TestUpdatePushesToTargets(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", nil)
+	mirror.SetOptions(&git.Options{PushTargets: []string{"https://a.example.com/ns/repo", "https://b.example.com/ns/repo"}})
+	cmd.On("ListRefs", "/path/ns/repo").Return("", nil)
+	cmd.On("FetchPrune", "/path/ns/repo", "http://example.com/ns/repo", mock.Anything).Return(nil)
+	cmd.On("Push", "/path/ns/repo", "https://a.example.com/ns/repo", "").Return(nil)
+	cmd.On("Push", "/path/ns/repo", "https://b.example.com/ns/repo", "").Return(gmm.NewError("rejected", gmm.ErrGitCommand))
+
+	assertions := assert.New(t)
+	assertions.Nil(mirror.Update())
+
+	status := mirror.Status()
+	assertions.NotNil(status.LastFetch)
+	assertions.Equal("", status.LastFetchError)
+	assertions.NotNil(status.Push["https://a.example.com/ns/repo"].LastPush)
+	assertions.Equal("", status.Push["https://a.example.com/ns/repo"].LastError)
+	assertions.Nil(status.Push["https://b.example.com/ns/repo"].LastPush)
+	assertions.Equal("rejected [2]", status.Push["https://b.example.com/ns/repo"].LastError)
+}
+
+func TestFailedUpdateDoesNotPush(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", nil)
+	cmd.On("ListRefs", "/path/ns/repo").Return("", nil)
+	cmd.On("FetchPrune", "/path/ns/repo", "http://example.com/ns/repo", mock.Anything).Return(gmm.NewError("unreachable", gmm.ErrGitCommand))
+
+	assertions := assert.New(t)
+	assertions.Error(mirror.Update())
+	assertions.Equal("unreachable [2]", mirror.Status().LastFetchError)
+	cmd.AssertNotCalled(t, "Push", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestUpdateFailsOverToNextUpstream(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", &git.Options{
+		Upstreams: []string{"https://b.example.com/ns/repo", "https://c.example.com/ns/repo"},
+	})
+	cmd.On("ListRefs", "/path/ns/repo").Return("", nil)
+	cmd.On("FetchPrune", "/path/ns/repo", "http://example.com/ns/repo", mock.Anything).Return(gmm.NewError("unreachable", gmm.ErrGitCommand))
+	cmd.On("FetchPrune", "/path/ns/repo", "https://b.example.com/ns/repo", mock.Anything).Return(nil)
+
+	assertions := assert.New(t)
+	assertions.Nil(mirror.Update())
+	assertions.Equal("https://b.example.com/ns/repo", mirror.Status().LastFetchUpstream)
+	cmd.AssertNotCalled(t, "FetchPrune", "/path/ns/repo", "https://c.example.com/ns/repo", mock.Anything)
+}
+
+func TestUpdateFailsWhenAllUpstreamsFail(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", &git.Options{
+		Upstreams: []string{"https://b.example.com/ns/repo"},
+	})
+	cmd.On("ListRefs", "/path/ns/repo").Return("", nil)
+	cmd.On("FetchPrune", "/path/ns/repo", mock.Anything, mock.Anything).Return(gmm.NewError("unreachable", gmm.ErrGitCommand))
+
+	assertions := assert.New(t)
+	assertions.Error(mirror.Update())
+	assertions.Equal("unreachable [2]", mirror.Status().LastFetchError)
+}
+
+func TestUpdateVerifiesUpstreams(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", &git.Options{
+		Upstreams:       []string{"https://b.example.com/ns/repo"},
+		VerifyUpstreams: true,
+	})
+	cmd.On("FetchPrune", "/path/ns/repo", "http://example.com/ns/repo", mock.Anything).Return(nil)
+	cmd.On("ListRefs", "/path/ns/repo").Return("aaa refs/heads/main\nbbb refs/tags/v1\nccc refs/pull/1/head", nil)
+	cmd.On("LsRemote", "https://b.example.com/ns/repo").Return("aaa\tHEAD\naaa\trefs/heads/main\nddd\trefs/tags/v1\neee\trefs/tags/v1^{}", nil)
+
+	assertions := assert.New(t)
+	assertions.Nil(mirror.Update())
+	assertions.Equal(
+		[]string{"https://b.example.com/ns/repo refs/tags/v1 is ddd, expected bbb"},
+		mirror.Status().UpstreamMismatches,
+	)
+}
+
+func TestUpdateRemovesFilteredRefs(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", &git.Options{ExcludeRefs: []string{"refs/pull/*"}})
+	cmd.On("FetchPrune", "/path/ns/repo", "http://example.com/ns/repo", mock.Anything).Return(nil)
+	cmd.On("ListRefs", "/path/ns/repo").Return("aaa refs/heads/main\nbbb refs/pull/1/head\nccc refs/gmm/preserved/20240102T030405.000Z/refs/pull/2/head", nil)
+	cmd.On("DeleteRef", "/path/ns/repo", "refs/pull/1/head").Return(nil)
+
+	assert.New(t).Nil(mirror.Update())
+	cmd.AssertCalled(t, "DeleteRef", "/path/ns/repo", "refs/pull/1/head")
+	cmd.AssertNumberOfCalls(t, "DeleteRef", 1)
+}
+
+func TestUpdateFetchesLFSObjects(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", &git.Options{
+		Upstreams: []string{"https://b.example.com/ns/repo"},
+		LFS:       true,
+	})
+	cmd.On("ListRefs", "/path/ns/repo").Return("", nil)
+	cmd.On("FetchPrune", "/path/ns/repo", "http://example.com/ns/repo", mock.Anything).Return(gmm.NewError("unreachable", gmm.ErrGitCommand))
+	cmd.On("FetchPrune", "/path/ns/repo", "https://b.example.com/ns/repo", mock.Anything).Return(nil)
+	cmd.On("FetchLFS", "/path/ns/repo", "https://b.example.com/ns/repo").Return(gmm.NewError("smudge failed", gmm.ErrGitCommand))
+
+	assertions := assert.New(t)
+	assertions.Error(mirror.Update())
+	assertions.Equal("smudge failed [2]", mirror.Status().LastFetchError)
+}
+
+func TestLFSObjectPath(t *testing.T) {
+	mirror, _ := newExistingTestMirror("http://example.com/ns/repo", nil)
+	oid := "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+	assertions := assert.New(t)
+
+	path, err := mirror.LFSObjectPath(oid)
+	assertions.Nil(err)
+	assertions.Equal("/path/ns/repo/lfs/objects/4d/7a/"+oid, path)
+
+	_, err = mirror.LFSObjectPath("../../../etc/passwd")
+	if assertions.Error(err) {
+		assertions.Equal(gmm.ErrUser, err.Code())
+	}
+}
+
+func TestMirrorMarshalsToJSON(t *testing.T) {
+	mirror, _ := newExistingTestMirror("http://example.com/ns/repo", nil)
+	data, err := json.Marshal(mirror)
+	assertions := assert.New(t)
+	assertions.Nil(err)
+	assertions.Contains(string(data), `"name":"ns/repo"`)
+	assertions.Contains(string(data), `"uri":"http://example.com/ns/repo"`)
+	assertions.Contains(string(data), `"mode":"full"`)
+	assertions.Contains(string(data), `"pushTargets":["https://gitea.example.com/ns/repo"]`)
+}
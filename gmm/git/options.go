@@ -0,0 +1,265 @@
+package git
+
+import (
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/robfig/cron"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// CloneModeFull mirrors all objects
+	CloneModeFull = "full"
+	// CloneModeBlobless is a partial clone without blobs, which are fetched on demand
+	CloneModeBlobless = "blobless"
+	// CloneModeTreeless is a partial clone without trees and blobs, which are fetched on demand
+	CloneModeTreeless = "treeless"
+	// CloneModeShallow mirrors a limited number of commits, or the commits after a date
+	CloneModeShallow = "shallow"
+)
+
+const (
+	// TagSignaturesFlag archives tags without a valid signature, recording that they are unverified
+	TagSignaturesFlag = "flag"
+	// TagSignaturesRequire refuses to archive tags without a valid signature
+	TagSignaturesRequire = "require"
+)
+
+// optionsConfigKey is the git config key under which Options are stored in the bare repository
+const optionsConfigKey = "gmm.options"
+
+// Options are per-mirror settings
+type Options struct {
+	// Upstreams are fallbacks for the mirror's uri, tried in order when fetching from it fails
+	Upstreams []string `json:"upstreams,omitempty"`
+	// VerifyUpstreams compares the branches and tags of all upstreams after each update
+	VerifyUpstreams bool `json:"verifyUpstreams,omitempty"`
+	// IncludeRefs limits the mirrored refs to those matching these patterns, eg. "refs/heads/*"
+	IncludeRefs []string `json:"includeRefs,omitempty"`
+	// ExcludeRefs are never mirrored, eg. "refs/pull/*"
+	ExcludeRefs []string `json:"excludeRefs,omitempty"`
+	// CloneMode is one of the CloneMode constants, full if empty
+	CloneMode string `json:"cloneMode,omitempty"`
+	// Depth limits the number of commits of a shallow mirror
+	Depth int `json:"depth,omitempty"`
+	// ShallowSince limits a shallow mirror to commits after a date, eg. "2020-01-01"
+	ShallowSince string `json:"shallowSince,omitempty"`
+	// LFS fetches all Git LFS objects referenced by mirrored refs after each clone and update
+	LFS bool `json:"lfs,omitempty"`
+	// Submodules mirrors the submodules found at the mirrored branches and tags as dependent mirrors
+	Submodules bool `json:"submodules,omitempty"`
+	// SubmoduleOf names the mirrors this dependent mirror was added for, it is removed when none of them reference it anymore
+	SubmoduleOf []string `json:"submoduleOf,omitempty"`
+	// DiscoveredBy names the discovery source that added this mirror, which keeps its settings in sync
+	DiscoveredBy string `json:"discoveredBy,omitempty"`
+	// MaintenanceInterval overrides the default schedule of maintenance tasks, "false" disables them
+	MaintenanceInterval string `json:"maintenanceInterval,omitempty"`
+	// FsckInterval overrides the default schedule of integrity checks, "false" disables them
+	FsckInterval string `json:"fsckInterval,omitempty"`
+	// RecloneOnCorruption replaces the local repository by a fresh clone when an integrity check fails
+	RecloneOnCorruption bool `json:"recloneOnCorruption,omitempty"`
+	// Pinned mirrors are never evicted for being idle
+	Pinned bool `json:"pinned,omitempty"`
+	// Suspended mirrors are not updated until they are accessed again
+	Suspended bool `json:"suspended,omitempty"`
+	// PushTargets are downstream remotes the mirror is pushed to after each update
+	PushTargets []string `json:"pushTargets,omitempty"`
+	// PushRefspec is pushed instead of all refs ("push --mirror"), when not empty
+	PushRefspec string `json:"pushRefspec,omitempty"`
+	// Preserve keeps the old object of refs force-pushed or deleted upstream under a hidden ref
+	Preserve bool `json:"preserve,omitempty"`
+	// PreserveDays removes preserved refs older than this many days, zero keeps them forever
+	PreserveDays int `json:"preserveDays,omitempty"`
+	// PreserveCount limits the preserved refs per ref to the newest ones, zero keeps all
+	PreserveCount int `json:"preserveCount,omitempty"`
+	// BundleInterval overrides the default schedule of bundles, "false" disables them
+	BundleInterval string `json:"bundleInterval,omitempty"`
+	// BundleIncremental makes scheduled bundles contain only what changed since the previous bundle
+	BundleIncremental bool `json:"bundleIncremental,omitempty"`
+	// BundleKeep limits the bundles to the newest ones, zero keeps all
+	BundleKeep int `json:"bundleKeep,omitempty"`
+	// ArchiveFormats are the formats tags are archived in after updates creating or moving them, none if empty
+	ArchiveFormats []string `json:"archiveFormats,omitempty"`
+	// ArchivePrefix is the directory archived files are put in, in which "{name}" and "{tag}" are replaced
+	ArchivePrefix string `json:"archivePrefix,omitempty"`
+	// ArchiveSubmodules includes the content of submodules in archives, which must be mirrored
+	ArchiveSubmodules bool `json:"archiveSubmodules,omitempty"`
+	// DistReleasesOnly archives only tags naming semantic version releases, eg. "v1.2.3", removing other archives
+	DistReleasesOnly bool `json:"distReleasesOnly,omitempty"`
+	// DistKeep limits dist archives to those of the newest tags, by semantic version or else by date, zero keeps all
+	DistKeep int `json:"distKeep,omitempty"`
+	// DistDays removes dist archives older than this many days, zero keeps them forever
+	DistDays int `json:"distDays,omitempty"`
+	// TagSignatures verifies the signatures of tags, or of the commits of lightweight tags, before archiving them,
+	// against the configured keyring and allowed SSH signers: "flag" or "require", empty doesn't verify
+	TagSignatures string `json:"tagSignatures,omitempty"`
+	// FromBundle is a bundle file to create a new mirror from instead of cloning the upstream, it is not stored
+	FromBundle string `json:"-"`
+}
+
+// Validate rejects options git would not accept
+func (o *Options) Validate() gmm.ApplicationError {
+	switch o.Mode() {
+	case CloneModeFull, CloneModeBlobless, CloneModeTreeless:
+		if o.Depth != 0 || o.ShallowSince != "" {
+			return gmm.NewError("depth and shallowSince require clone mode '"+CloneModeShallow+"'", gmm.ErrUser)
+		}
+	case CloneModeShallow:
+		if o.Depth < 0 || (o.Depth == 0 && o.ShallowSince == "") {
+			return gmm.NewError("clone mode '"+CloneModeShallow+"' requires a positive depth or shallowSince", gmm.ErrUser)
+		}
+		if strings.HasPrefix(o.ShallowSince, "-") {
+			return gmm.NewError("shallowSince '"+o.ShallowSince+"' is invalid", gmm.ErrUser)
+		}
+	default:
+		return gmm.NewError("clone mode '"+o.CloneMode+"' is not supported", gmm.ErrUser)
+	}
+	for _, interval := range []string{o.MaintenanceInterval, o.FsckInterval, o.BundleInterval} {
+		if interval == "" || strings.ToLower(interval) == "false" {
+			continue
+		}
+		if _, err := cron.Parse(interval); err != nil {
+			return gmm.NewError("interval '"+interval+"' is invalid: "+err.Error(), gmm.ErrUser)
+		}
+	}
+	if o.PreserveDays < 0 || o.PreserveCount < 0 {
+		return gmm.NewError("preserveDays and preserveCount cannot be negative", gmm.ErrUser)
+	}
+	if o.BundleKeep < 0 {
+		return gmm.NewError("bundleKeep cannot be negative", gmm.ErrUser)
+	}
+	for _, format := range o.ArchiveFormats {
+		if !contains(ArchiveFormats, format) {
+			return gmm.NewError("archive format '"+format+"' is not one of "+strings.Join(ArchiveFormats, ", "), gmm.ErrUser)
+		}
+	}
+	if prefix := path.Clean("/" + o.ArchivePrefix); o.ArchivePrefix != "" && prefix[1:] != strings.TrimSuffix(o.ArchivePrefix, "/") {
+		return gmm.NewError("archive prefix '"+o.ArchivePrefix+"' must be a relative path", gmm.ErrUser)
+	}
+	if o.DistKeep < 0 || o.DistDays < 0 {
+		return gmm.NewError("distKeep and distDays cannot be negative", gmm.ErrUser)
+	}
+	if o.TagSignatures != "" && o.TagSignatures != TagSignaturesFlag && o.TagSignatures != TagSignaturesRequire {
+		return gmm.NewError("tagSignatures must be '"+TagSignaturesFlag+"' or '"+TagSignaturesRequire+"'", gmm.ErrUser)
+	}
+	for _, pattern := range append(o.IncludeRefs, o.ExcludeRefs...) {
+		if !strings.HasPrefix(pattern, "refs/") || strings.Count(pattern, "*") > 1 || strings.ContainsAny(pattern, " :^~?[\\") {
+			return gmm.NewError("ref pattern '"+pattern+"' must start with 'refs/' and contain at most one '*'", gmm.ErrUser)
+		}
+	}
+	return nil
+}
+
+// Mode returns the clone mode, defaulting to full
+func (o *Options) Mode() string {
+	if o.CloneMode == "" {
+		return CloneModeFull
+	}
+	return o.CloneMode
+}
+
+// ModeArgs returns the clone and fetch arguments implementing the clone mode
+func (o *Options) ModeArgs() []string {
+	if filter := o.PartialCloneFilter(); filter != "" {
+		return []string{"--filter=" + filter}
+	}
+	var args []string
+	if o.Mode() == CloneModeShallow {
+		if o.Depth > 0 {
+			args = append(args, "--depth="+strconv.Itoa(o.Depth))
+		}
+		if o.ShallowSince != "" {
+			args = append(args, "--shallow-since="+o.ShallowSince)
+		}
+	}
+	return args
+}
+
+// PartialCloneFilter returns the object filter of partial clone modes, or an empty string
+func (o *Options) PartialCloneFilter() string {
+	switch o.Mode() {
+	case CloneModeBlobless:
+		return "blob:none"
+	case CloneModeTreeless:
+		return "tree:0"
+	}
+	return ""
+}
+
+// FiltersRefs tells whether only some of the upstream's refs are mirrored
+func (o *Options) FiltersRefs() bool {
+	return len(o.IncludeRefs) > 0 || len(o.ExcludeRefs) > 0
+}
+
+// Refspecs returns the fetch refspecs implementing the ref filters
+func (o *Options) Refspecs() []string {
+	if len(o.IncludeRefs) == 0 {
+		return append([]string{"+refs/*:refs/*"}, o.negativeRefspecs()...)
+	}
+	var refspecs []string
+	for _, pattern := range o.IncludeRefs {
+		refspecs = append(refspecs, "+"+pattern+":"+pattern)
+	}
+	return append(refspecs, o.negativeRefspecs()...)
+}
+
+// MatchesRef tells whether ref passes the ref filters
+func (o *Options) MatchesRef(ref string) bool {
+	for _, pattern := range o.ExcludeRefs {
+		if matchRefPattern(pattern, ref) {
+			return false
+		}
+	}
+	if len(o.IncludeRefs) == 0 {
+		return true
+	}
+	for _, pattern := range o.IncludeRefs {
+		if matchRefPattern(pattern, ref) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Options) negativeRefspecs() []string {
+	// Refs managed by the mirror itself are neither fetched nor pruned
+	refspecs := []string{"^" + managedRefPrefix + "*"}
+	for _, pattern := range o.ExcludeRefs {
+		refspecs = append(refspecs, "^"+pattern)
+	}
+	return refspecs
+}
+
+// matchRefPattern matches like git refspecs do, where a single "*" may also match "/"
+func matchRefPattern(pattern string, ref string) bool {
+	i := strings.Index(pattern, "*")
+	if i == -1 {
+		return pattern == ref
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return len(ref) >= len(prefix)+len(suffix) && strings.HasPrefix(ref, prefix) && strings.HasSuffix(ref, suffix)
+}
+
+// LoadOptions reads Options from the config of the repository at directory
+func LoadOptions(cmd CommandRunner, directory string) (*Options, gmm.ApplicationError) {
+	options := &Options{}
+	value, err := cmd.GetConfig(directory, optionsConfigKey)
+	if err != nil || value == "" {
+		return options, err
+	}
+	if err := json.Unmarshal([]byte(value), options); err != nil {
+		return nil, gmm.NewError("invalid options in '"+directory+"': "+err.Error(), gmm.ErrFilesystem)
+	}
+	return options, nil
+}
+
+// Save writes Options to the config of the repository at directory
+func (o *Options) Save(cmd CommandRunner, directory string) gmm.ApplicationError {
+	value, err := json.Marshal(o)
+	if err != nil {
+		return gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	return cmd.SetConfig(directory, optionsConfigKey, string(value))
+}
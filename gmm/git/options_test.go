@@ -0,0 +1,116 @@
+package git_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var invalidRefPatternTestData = []string{
+	"heads/*",
+	"refs/*/pull/*",
+	"refs/heads/a:refs/heads/b",
+	"refs/heads/[ab]",
+}
+
+func TestValidateRejectsInvalidRefPatterns(t *testing.T) {
+	for _, pattern := range invalidRefPatternTestData {
+		t.Run(pattern, func(t *testing.T) {
+			err := (&git.Options{ExcludeRefs: []string{pattern}}).Validate()
+			if assert.New(t).Error(err) {
+				assert.New(t).Equal(gmm.ErrUser, err.Code())
+			}
+		})
+	}
+	assert.New(t).Nil((&git.Options{IncludeRefs: []string{"refs/heads/*", "refs/tags/v*"}}).Validate())
+}
+
+func TestValidateArchiveOptions(t *testing.T) {
+	assertions := assert.New(t)
+	assertions.Nil((&git.Options{ArchiveFormats: []string{"zip", "tar.zst"}, ArchivePrefix: "{name}-{tag}/", TagSignatures: git.TagSignaturesRequire}).Validate())
+	for _, options := range []*git.Options{
+		{ArchiveFormats: []string{"tar.bz2"}},
+		{ArchivePrefix: "../{name}"},
+		{ArchivePrefix: "/{name}"},
+		{TagSignatures: "warn"},
+		{DistKeep: -1},
+	} {
+		err := options.Validate()
+		if assertions.Error(err) {
+			assertions.Equal(gmm.ErrUser, err.Code())
+		}
+	}
+}
+
+func TestRefspecs(t *testing.T) {
+	assertions := assert.New(t)
+	assertions.Equal([]string{"+refs/*:refs/*", "^refs/gmm/*"}, (&git.Options{}).Refspecs())
+	assertions.Equal(
+		[]string{"+refs/*:refs/*", "^refs/gmm/*", "^refs/pull/*"},
+		(&git.Options{ExcludeRefs: []string{"refs/pull/*"}}).Refspecs(),
+	)
+	assertions.Equal(
+		[]string{"+refs/heads/*:refs/heads/*", "^refs/gmm/*", "^refs/heads/wip"},
+		(&git.Options{IncludeRefs: []string{"refs/heads/*"}, ExcludeRefs: []string{"refs/heads/wip"}}).Refspecs(),
+	)
+}
+
+var matchesRefTestData = []struct {
+	ref     string
+	matches bool
+}{
+	{"refs/heads/main", true},
+	{"refs/heads/feature/nested", true},
+	{"refs/heads/wip-1", false},
+	{"refs/tags/v1.0.0", true},
+	{"refs/tags/nightly", false},
+	{"refs/pull/1/head", false},
+}
+
+func TestMatchesRef(t *testing.T) {
+	options := &git.Options{
+		IncludeRefs: []string{"refs/heads/*", "refs/tags/v*"},
+		ExcludeRefs: []string{"refs/heads/wip-*"},
+	}
+	for _, tt := range matchesRefTestData {
+		t.Run(tt.ref, func(t *testing.T) {
+			assert.New(t).Equal(tt.matches, options.MatchesRef(tt.ref))
+		})
+	}
+}
+
+var invalidCloneModeTestData = []struct {
+	name    string
+	options *git.Options
+}{
+	{"unknown mode", &git.Options{CloneMode: "sparse"}},
+	{"shallow without limit", &git.Options{CloneMode: git.CloneModeShallow}},
+	{"negative depth", &git.Options{CloneMode: git.CloneModeShallow, Depth: -1}},
+	{"depth without shallow", &git.Options{CloneMode: git.CloneModeBlobless, Depth: 1}},
+	{"option-like date", &git.Options{CloneMode: git.CloneModeShallow, ShallowSince: "--upload-pack=x"}},
+	{"invalid maintenance interval", &git.Options{MaintenanceInterval: "sometimes"}},
+}
+
+func TestValidateRejectsInvalidModesAndIntervals(t *testing.T) {
+	for _, tt := range invalidCloneModeTestData {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.options.Validate()
+			if assert.New(t).Error(err) {
+				assert.New(t).Equal(gmm.ErrUser, err.Code())
+			}
+		})
+	}
+}
+
+func TestModeArgs(t *testing.T) {
+	assertions := assert.New(t)
+	assertions.Nil((&git.Options{}).ModeArgs())
+	assertions.Equal(git.CloneModeFull, (&git.Options{}).Mode())
+	assertions.Equal([]string{"--filter=blob:none"}, (&git.Options{CloneMode: git.CloneModeBlobless}).ModeArgs())
+	assertions.Equal([]string{"--filter=tree:0"}, (&git.Options{CloneMode: git.CloneModeTreeless}).ModeArgs())
+	assertions.Equal(
+		[]string{"--depth=10", "--shallow-since=2020-01-01"},
+		(&git.Options{CloneMode: git.CloneModeShallow, Depth: 10, ShallowSince: "2020-01-01"}).ModeArgs(),
+	)
+}
@@ -0,0 +1,134 @@
+package git
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// managedRefPrefix is the namespace of refs managed by the mirror itself, which fetching neither updates nor prunes
+	managedRefPrefix = "refs/gmm/"
+	// preservedRefPrefix is followed by the time a ref was preserved and the ref, eg.
+	// "refs/gmm/preserved/20240102T030405.000Z/refs/heads/main". Preserved refs are not advertised to clients.
+	preservedRefPrefix = managedRefPrefix + "preserved/"
+	// restoredRefPrefix is followed by the part of a preserved ref after preservedRefPrefix
+	restoredRefPrefix = managedRefPrefix + "restored/"
+	// preservedTimeFormat has millisecond precision, so refs preserved by consecutive updates don't collide
+	preservedTimeFormat = "20060102T150405.000Z"
+)
+
+// PreservedRef is the old object of a ref that was force-pushed or deleted upstream
+type PreservedRef struct {
+	// Ref is the hidden ref the object is preserved under
+	Ref string `json:"ref"`
+	// Original is the ref that was force-pushed or deleted
+	Original string    `json:"original"`
+	Object   string    `json:"object"`
+	Time     time.Time `json:"time"`
+}
+
+// PreservedRefs lists the preserved refs of the mirror, oldest first
+func (m *Mirror) PreservedRefs() ([]*PreservedRef, gmm.ApplicationError) {
+	output, err := m.cmd.ListRefs(m.path)
+	if err != nil {
+		return nil, err
+	}
+	preserved := []*PreservedRef{}
+	for ref, object := range parseRefs(output) {
+		if p := parsePreservedRef(ref, object); p != nil {
+			preserved = append(preserved, p)
+		}
+	}
+	sort.Slice(preserved, func(i, j int) bool {
+		if preserved[i].Time.Equal(preserved[j].Time) {
+			return preserved[i].Original < preserved[j].Original
+		}
+		return preserved[i].Time.Before(preserved[j].Time)
+	})
+	return preserved, nil
+}
+
+// RestorePreservedRef makes a preserved ref available to clients, under restoredRefPrefix.
+// Restoring it as the original ref would be undone by the next update. Returns the restored ref.
+func (m *Mirror) RestorePreservedRef(ref string) (string, gmm.ApplicationError) {
+	preserved, err := m.PreservedRefs()
+	if err != nil {
+		return "", err
+	}
+	for _, p := range preserved {
+		if p.Ref != ref {
+			continue
+		}
+		restored := restoredRefPrefix + strings.TrimPrefix(ref, preservedRefPrefix)
+		log.Infof("Restoring '%s' of '%s' as '%s'", ref, m.Name, restored)
+		if err := m.cmd.UpdateRef(m.path, restored, p.Object); err != nil {
+			return "", err
+		}
+		return restored, nil
+	}
+	return "", gmm.NewError("mirror '"+m.Name+"' has no preserved ref '"+ref+"'", gmm.ErrNotFound)
+}
+
+// preserveRefs keeps the old objects of refs force-pushed or deleted by an update.
+// Fetching does not collect garbage, so the objects are still there until maintenance.
+func (m *Mirror) preserveRefs(changes []*events.RefChange) {
+	prefix := preservedRefPrefix + time.Now().UTC().Format(preservedTimeFormat) + "/"
+	hidden := false
+	for _, change := range changes {
+		if change.Kind != events.RefForced && change.Kind != events.RefDeleted {
+			continue
+		}
+		if !hidden {
+			if err := m.cmd.SetConfig(m.path, "transfer.hideRefs", preservedRefPrefix); err != nil {
+				log.Errorf("Hiding preserved refs of '%s' failed: %s", m.Name, err)
+			}
+			hidden = true
+		}
+		log.Infof("Preserving %s ref '%s' of '%s' at %s", change.Kind, change.Ref, m.Name, change.Old)
+		if err := m.cmd.UpdateRef(m.path, prefix+change.Ref, change.Old); err != nil {
+			log.Errorf("Preserving '%s' of '%s' failed: %s", change.Ref, m.Name, err)
+		}
+	}
+}
+
+// expirePreservedRefs removes preserved refs older than PreserveDays, and those exceeding PreserveCount per ref
+func (m *Mirror) expirePreservedRefs(options *Options, now time.Time) {
+	preserved, err := m.PreservedRefs()
+	if err != nil {
+		log.Errorf("Listing preserved refs of '%s' failed: %s", m.Name, err)
+		return
+	}
+	kept := make(map[string]int)
+	for i := len(preserved) - 1; i >= 0; i-- {
+		p := preserved[i]
+		kept[p.Original]++
+		expired := options.PreserveDays > 0 && now.Sub(p.Time) > time.Duration(options.PreserveDays)*24*time.Hour
+		if !expired && (options.PreserveCount == 0 || kept[p.Original] <= options.PreserveCount) {
+			continue
+		}
+		log.Infof("Removing expired preserved ref '%s' of '%s'", p.Ref, m.Name)
+		if err := m.cmd.DeleteRef(m.path, p.Ref); err != nil {
+			log.Errorf("Removing '%s' of '%s' failed: %s", p.Ref, m.Name, err)
+		}
+	}
+}
+
+// parsePreservedRef returns the PreservedRef described by ref, or nil if ref is not a preserved ref
+func parsePreservedRef(ref string, object string) *PreservedRef {
+	if !strings.HasPrefix(ref, preservedRefPrefix) {
+		return nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(ref, preservedRefPrefix), "/", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	preservedAt, err := time.Parse(preservedTimeFormat, parts[0])
+	if err != nil {
+		return nil
+	}
+	return &PreservedRef{Ref: ref, Original: parts[1], Object: object, Time: preservedAt}
+}
@@ -0,0 +1,84 @@
+package git_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"strings"
+	"testing"
+	"time"
+)
+
+const preservedTimeLayout = "20060102T150405.000Z"
+
+func TestUpdatePreservesForcePushedAndDeletedRefs(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	assertions := assert.New(t)
+	assertions.Nil(mirror.SetOptions(&git.Options{Preserve: true}))
+	expectRefs(cmd, "aaa refs/heads/main\nbbb refs/heads/feature\nccc refs/tags/v1", "ddd refs/heads/main\neee refs/heads/feature")
+	cmd.On("IsAncestor", mock.Anything, "aaa", "ddd").Return(true, nil)
+	cmd.On("IsAncestor", mock.Anything, "bbb", "eee").Return(false, nil)
+	cmd.On("SetConfig", mock.Anything, "transfer.hideRefs", "refs/gmm/preserved/").Return(nil)
+	preserved := make(map[string]string)
+	cmd.On("UpdateRef", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		preserved[args.String(1)] = args.String(2)
+	}).Return(nil)
+
+	assertions.Nil(mirror.Update())
+	if assertions.Len(preserved, 2) {
+		for ref, object := range preserved {
+			assertions.True(strings.HasPrefix(ref, "refs/gmm/preserved/"), ref)
+			if strings.HasSuffix(ref, "/refs/heads/feature") {
+				assertions.Equal("bbb", object)
+			} else {
+				assertions.True(strings.HasSuffix(ref, "/refs/tags/v1"), ref)
+				assertions.Equal("ccc", object)
+			}
+		}
+	}
+	cmd.AssertCalled(t, "SetConfig", mock.Anything, "transfer.hideRefs", "refs/gmm/preserved/")
+}
+
+func TestPreservedRefsAreListedAndRestored(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", nil)
+	cmd.On("ListRefs", "/path/ns/repo").Return(
+		"aaa refs/heads/main\nbbb refs/gmm/preserved/20240102T030405.000Z/refs/heads/feature\nccc refs/gmm/preserved/invalid", nil,
+	)
+	cmd.On("UpdateRef", "/path/ns/repo", "refs/gmm/restored/20240102T030405.000Z/refs/heads/feature", "bbb").Return(nil)
+	assertions := assert.New(t)
+
+	preserved, err := mirror.PreservedRefs()
+	assertions.Nil(err)
+	if assertions.Len(preserved, 1) {
+		assertions.Equal("refs/heads/feature", preserved[0].Original)
+		assertions.Equal("bbb", preserved[0].Object)
+		assertions.Equal("2024-01-02T03:04:05Z", preserved[0].Time.Format(time.RFC3339))
+	}
+
+	restored, err := mirror.RestorePreservedRef("refs/gmm/preserved/20240102T030405.000Z/refs/heads/feature")
+	assertions.Nil(err)
+	assertions.Equal("refs/gmm/restored/20240102T030405.000Z/refs/heads/feature", restored)
+
+	_, err = mirror.RestorePreservedRef("refs/heads/main")
+	if assertions.Error(err) {
+		assertions.Equal(gmm.ErrNotFound, err.Code())
+	}
+}
+
+func TestUpdateExpiresPreservedRefs(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("http://example.com/ns/repo", &git.Options{PreserveDays: 30, PreserveCount: 1})
+	cmd.On("FetchPrune", "/path/ns/repo", "http://example.com/ns/repo", mock.Anything).Return(nil)
+	now := time.Now().UTC()
+	expired := "refs/gmm/preserved/" + now.AddDate(0, 0, -31).Format(preservedTimeLayout) + "/refs/heads/main"
+	older := "refs/gmm/preserved/" + now.Add(-2*time.Hour).Format(preservedTimeLayout) + "/refs/heads/feature"
+	newer := "refs/gmm/preserved/" + now.Add(-time.Hour).Format(preservedTimeLayout) + "/refs/heads/feature"
+	cmd.On("ListRefs", "/path/ns/repo").Return("aaa refs/heads/main\nbbb "+expired+"\nccc "+older+"\nddd "+newer, nil)
+	cmd.On("DeleteRef", "/path/ns/repo", mock.Anything).Return(nil)
+
+	assert.New(t).Nil(mirror.Update())
+	cmd.AssertCalled(t, "DeleteRef", "/path/ns/repo", expired)
+	cmd.AssertCalled(t, "DeleteRef", "/path/ns/repo", older)
+	cmd.AssertNumberOfCalls(t, "DeleteRef", 2)
+}
@@ -0,0 +1,223 @@
+package git
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RefTypeBranch is the type of refs under refs/heads/
+	RefTypeBranch = "branch"
+	// RefTypeTag is the type of refs under refs/tags/
+	RefTypeTag = "tag"
+
+	// RefSortName orders refs by name
+	RefSortName = "name"
+	// RefSortDate orders refs by the date they were created, newest first
+	RefSortDate = "date"
+	// RefSortSemver orders refs by semantic version, highest first, followed by those that aren't versions by name
+	RefSortSemver = "semver"
+)
+
+// Ref is a branch or tag of a mirror
+type Ref struct {
+	// Name is the short name of the ref, eg. "main" or "v1.2.3"
+	Name string `json:"name"`
+	Ref  string `json:"ref"`
+	Type string `json:"type"`
+	// Object is what the ref points to, which is a tag object for annotated tags
+	Object string `json:"object"`
+	// Commit is the commit the ref points to, through the tag object for annotated tags
+	Commit string `json:"commit"`
+	// Date is when an annotated tag was tagged, or when the commit was committed
+	Date time.Time `json:"date"`
+}
+
+// RefQuery selects and orders the refs listed by Mirror.Refs, its zero value lists all branches and tags by name
+type RefQuery struct {
+	// Type limits the refs to branches or tags, RefTypeBranch or RefTypeTag
+	Type string
+	// Match is a shell pattern names must match, eg. "v2.*"
+	Match string
+	// Semver is a comma separated list of comparisons versions must satisfy, eg. ">=2.1,<3"
+	Semver string
+	// Contains is a revision refs must contain
+	Contains string
+	// Sort is RefSortName, RefSortDate or RefSortSemver
+	Sort string
+	// Limit limits the number of refs, zero lists all
+	Limit int
+}
+
+// Commit is a commit in the log of a mirror
+type Commit struct {
+	ID        string   `json:"id"`
+	Parents   []string `json:"parents"`
+	Author    Person   `json:"author"`
+	Committer Person   `json:"committer"`
+	Subject   string   `json:"subject"`
+	Body      string   `json:"body,omitempty"`
+}
+
+// Person is the author or committer of a commit
+type Person struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+// LogPage is a page of the commits reachable from a revision, newest first
+type LogPage struct {
+	Revision string    `json:"revision"`
+	Commit   string    `json:"commit"`
+	Page     int       `json:"page"`
+	Commits  []*Commit `json:"commits"`
+	// NextPage is the next page, zero when this is the last one
+	NextPage int `json:"nextPage,omitempty"`
+}
+
+// Refs lists the branches and tags of the mirror selected by query
+func (m *Mirror) Refs(query *RefQuery) ([]*Ref, gmm.ApplicationError) {
+	if query.Type != "" && query.Type != RefTypeBranch && query.Type != RefTypeTag {
+		return nil, gmm.NewError("ref type must be '"+RefTypeBranch+"' or '"+RefTypeTag+"'", gmm.ErrUser)
+	}
+	if _, err := path.Match(query.Match, ""); err != nil {
+		return nil, gmm.NewError("invalid pattern '"+query.Match+"'", gmm.ErrUser)
+	}
+	constraints, err := parseSemverConstraints(query.Semver)
+	if err != nil {
+		return nil, err
+	}
+	contains := ""
+	if query.Contains != "" {
+		if contains, err = m.resolveCommit(query.Contains); err != nil {
+			return nil, err
+		}
+	}
+	output, err := m.cmd.DescribeRefs(m.path, contains)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []*Ref{}
+	for _, ref := range parseRefDescriptions(output) {
+		if query.Type != "" && ref.Type != query.Type {
+			continue
+		}
+		if matched, _ := path.Match(query.Match, ref.Name); query.Match != "" && !matched {
+			continue
+		}
+		if len(constraints) > 0 && !satisfiesSemver(ref.Name, constraints) {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	if err := sortRefs(refs, query.Sort); err != nil {
+		return nil, err
+	}
+	if query.Limit > 0 && len(refs) > query.Limit {
+		refs = refs[:query.Limit]
+	}
+	return refs, nil
+}
+
+// Log lists a page of perPage commits reachable from revision, a ref or commit id, newest first.
+// Only commits committed after since are listed when it is not zero.
+func (m *Mirror) Log(revision string, since time.Time, page int, perPage int) (*LogPage, gmm.ApplicationError) {
+	if page < 1 || perPage < 1 {
+		return nil, gmm.NewError("page and page size must be positive", gmm.ErrUser)
+	}
+	commit, err := m.resolveCommit(revision)
+	if err != nil {
+		return nil, err
+	}
+	// One more commit than fits the page tells whether there is a next page
+	output, err := m.cmd.Log(m.path, commit, since, (page-1)*perPage, perPage+1)
+	if err != nil {
+		return nil, err
+	}
+	logPage := &LogPage{Revision: revision, Commit: commit, Page: page, Commits: parseLog(output)}
+	if len(logPage.Commits) > perPage {
+		logPage.Commits = logPage.Commits[:perPage]
+		logPage.NextPage = page + 1
+	}
+	return logPage, nil
+}
+
+// parseRefDescriptions parses the output of DescribeRefs
+func parseRefDescriptions(output string) []*Ref {
+	var refs []*Ref
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 4 {
+			continue
+		}
+		ref := &Ref{Ref: fields[0], Object: fields[1], Commit: fields[1]}
+		if fields[2] != "" {
+			ref.Commit = fields[2]
+		}
+		if strings.HasPrefix(ref.Ref, "refs/heads/") {
+			ref.Name, ref.Type = strings.TrimPrefix(ref.Ref, "refs/heads/"), RefTypeBranch
+		} else {
+			ref.Name, ref.Type = strings.TrimPrefix(ref.Ref, "refs/tags/"), RefTypeTag
+		}
+		if seconds, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
+			ref.Date = time.Unix(seconds, 0).UTC()
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// parseLog parses the output of Log
+func parseLog(output string) []*Commit {
+	commits := []*Commit{}
+	for _, record := range strings.Split(output, "\x00") {
+		fields := strings.Split(strings.TrimLeft(record, "\n"), "\x1f")
+		if len(fields) != 10 {
+			continue
+		}
+		commits = append(commits, &Commit{
+			ID:        fields[0],
+			Parents:   strings.Fields(fields[1]),
+			Author:    Person{Name: fields[2], Email: fields[3], Date: parseUnixTime(fields[4])},
+			Committer: Person{Name: fields[5], Email: fields[6], Date: parseUnixTime(fields[7])},
+			Subject:   fields[8],
+			Body:      strings.TrimSpace(fields[9]),
+		})
+	}
+	return commits
+}
+
+func parseUnixTime(value string) time.Time {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0).UTC()
+}
+
+// sortRefs orders refs as RefQuery.Sort says
+func sortRefs(refs []*Ref, order string) gmm.ApplicationError {
+	sort.SliceStable(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	switch order {
+	case "", RefSortName:
+	case RefSortDate:
+		sort.SliceStable(refs, func(i, j int) bool { return refs[i].Date.After(refs[j].Date) })
+	case RefSortSemver:
+		sort.SliceStable(refs, func(i, j int) bool {
+			a, b := parseSemver(refs[i].Name), parseSemver(refs[j].Name)
+			if a == nil || b == nil {
+				return a != nil
+			}
+			return compareSemver(a, b) > 0
+		})
+	default:
+		return gmm.NewError("sort must be '"+RefSortName+"', '"+RefSortDate+"' or '"+RefSortSemver+"'", gmm.ErrUser)
+	}
+	return nil
+}
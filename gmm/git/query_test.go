@@ -0,0 +1,122 @@
+package git_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"strings"
+	"testing"
+	"time"
+)
+
+const refDescriptions = "refs/heads/main\x00aaa\x00\x001700000300\n" +
+	"refs/tags/nightly\x00bbb\x00\x001700000200\n" +
+	"refs/tags/v1.10.0\x00ccc\x00\x001700000100\n" +
+	"refs/tags/v1.9.0\x00ddd\x00\x001700000000\n" +
+	"refs/tags/v2.0.0\x00eee\x00fff\x001700000050\n" +
+	"refs/tags/v2.0.0-rc.1\x00ggg\x00\x001700000040\n" +
+	"refs/tags/v2.0.0-rc.2\x00hhh\x00\x001700000045"
+
+func refNames(refs []*git.Ref) []string {
+	names := []string{}
+	for _, ref := range refs {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+func TestRefsSortsAndFiltersVersions(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	cmd.On("DescribeRefs", mock.Anything, "").Return(refDescriptions, nil)
+	assertions := assert.New(t)
+
+	refs, err := mirror.Refs(&git.RefQuery{})
+	assertions.Nil(err)
+	assertions.Equal([]string{"main", "nightly", "v1.10.0", "v1.9.0", "v2.0.0", "v2.0.0-rc.1", "v2.0.0-rc.2"}, refNames(refs))
+	assertions.Equal(&git.Ref{
+		Name: "v2.0.0", Ref: "refs/tags/v2.0.0", Type: git.RefTypeTag, Object: "eee", Commit: "fff",
+		Date: time.Unix(1700000050, 0).UTC(),
+	}, refs[4])
+
+	refs, err = mirror.Refs(&git.RefQuery{Type: git.RefTypeTag, Sort: git.RefSortSemver})
+	assertions.Nil(err)
+	assertions.Equal([]string{"v2.0.0", "v2.0.0-rc.2", "v2.0.0-rc.1", "v1.10.0", "v1.9.0", "nightly"}, refNames(refs))
+
+	refs, err = mirror.Refs(&git.RefQuery{Match: "v1.*", Sort: git.RefSortSemver, Limit: 1})
+	assertions.Nil(err)
+	assertions.Equal([]string{"v1.10.0"}, refNames(refs))
+
+	// Pre-releases only satisfy constraints naming a pre-release of their version
+	refs, err = mirror.Refs(&git.RefQuery{Semver: ">=1.10, <2.0.0", Sort: git.RefSortSemver})
+	assertions.Nil(err)
+	assertions.Equal([]string{"v1.10.0"}, refNames(refs))
+
+	refs, err = mirror.Refs(&git.RefQuery{Semver: "<3", Sort: git.RefSortSemver})
+	assertions.Nil(err)
+	assertions.Equal([]string{"v2.0.0", "v1.10.0", "v1.9.0"}, refNames(refs))
+
+	refs, err = mirror.Refs(&git.RefQuery{Semver: ">=2.0.0-rc.2", Sort: git.RefSortSemver})
+	assertions.Nil(err)
+	assertions.Equal([]string{"v2.0.0", "v2.0.0-rc.2"}, refNames(refs))
+
+	refs, err = mirror.Refs(&git.RefQuery{Type: git.RefTypeBranch, Sort: git.RefSortDate})
+	assertions.Nil(err)
+	assertions.Equal([]string{"main"}, refNames(refs))
+
+	for _, query := range []*git.RefQuery{{Type: "remote"}, {Sort: "size"}, {Semver: "~1.2"}, {Match: "["}} {
+		_, err = mirror.Refs(query)
+		assertions.Equal(gmm.ErrUser, err.Code())
+	}
+}
+
+func TestRefsContainingCommit(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	cmd.On("ResolveRevision", mock.Anything, "abc^{commit}").Return("abcdef", nil)
+	cmd.On("DescribeRefs", mock.Anything, "abcdef").Return("refs/tags/v2.0.0\x00eee\x00fff\x001700000050", nil)
+
+	refs, err := mirror.Refs(&git.RefQuery{Contains: "abc"})
+	assertions := assert.New(t)
+	assertions.Nil(err)
+	assertions.Equal([]string{"v2.0.0"}, refNames(refs))
+}
+
+func TestLogPages(t *testing.T) {
+	mirror, cmd, cleanup := newHistoryTestMirror(t)
+	defer cleanup()
+	since := time.Unix(1700000000, 0)
+	commit := func(id string, parents string, subject string, body string) string {
+		return strings.Join([]string{id, parents, "Ann", "ann@example.com", "1700000100", "Bob", "bob@example.com", "1700000200", subject, body}, "\x1f")
+	}
+	cmd.On("ResolveRevision", mock.Anything, "main^{commit}").Return("ccc", nil)
+	cmd.On("Log", mock.Anything, "ccc", since, 2, 3).Return(
+		commit("ccc", "bbb", "Third", "")+"\x00\n"+commit("bbb", "aaa zzz", "Merge", "Details\n\n")+"\x00\n"+commit("aaa", "", "First", ""), nil,
+	)
+	cmd.On("Log", mock.Anything, "ccc", since, 4, 3).Return(commit("aaa", "", "First", ""), nil)
+	assertions := assert.New(t)
+
+	page, err := mirror.Log("main", since, 2, 2)
+	if assertions.Nil(err) {
+		assertions.Equal("ccc", page.Commit)
+		assertions.Equal(3, page.NextPage)
+		if assertions.Len(page.Commits, 2) {
+			assertions.Equal(&git.Commit{
+				ID:        "bbb",
+				Parents:   []string{"aaa", "zzz"},
+				Author:    git.Person{Name: "Ann", Email: "ann@example.com", Date: time.Unix(1700000100, 0).UTC()},
+				Committer: git.Person{Name: "Bob", Email: "bob@example.com", Date: time.Unix(1700000200, 0).UTC()},
+				Subject:   "Merge",
+				Body:      "Details",
+			}, page.Commits[1])
+		}
+	}
+	page, err = mirror.Log("main", since, 3, 2)
+	if assertions.Nil(err) {
+		assertions.Len(page.Commits, 1)
+		assertions.Zero(page.NextPage)
+	}
+	_, err = mirror.Log("main", since, 0, 2)
+	assertions.Equal(gmm.ErrUser, err.Code())
+}
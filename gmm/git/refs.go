@@ -0,0 +1,59 @@
+package git
+
+import (
+	"sort"
+	"strings"
+)
+
+// parseRefs reads "<sha> <ref>" lines as output by ls-remote and for-each-ref, skipping peeled tags
+func parseRefs(output string) map[string]string {
+	refs := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasSuffix(fields[1], "^{}") {
+			continue
+		}
+		refs[fields[1]] = fields[0]
+	}
+	return refs
+}
+
+// filterRefs keeps the branches and tags that pass the ref filters of options
+func filterRefs(refs map[string]string, options *Options) map[string]string {
+	filtered := make(map[string]string)
+	for ref, sha := range refs {
+		if (strings.HasPrefix(ref, "refs/heads/") || strings.HasPrefix(ref, "refs/tags/")) && options.MatchesRef(ref) {
+			filtered[ref] = sha
+		}
+	}
+	return filtered
+}
+
+// diffRefs describes each ref for which actual differs from expected
+func diffRefs(source string, expected map[string]string, actual map[string]string) []string {
+	var names []string
+	for name := range expected {
+		names = append(names, name)
+	}
+	for name := range actual {
+		if _, ok := expected[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []string
+	for _, name := range names {
+		if expected[name] != actual[name] {
+			diffs = append(diffs, source+" "+name+" is "+describeSha(actual[name])+", expected "+describeSha(expected[name]))
+		}
+	}
+	return diffs
+}
+
+func describeSha(sha string) string {
+	if sha == "" {
+		return "missing"
+	}
+	return sha
+}
@@ -0,0 +1,32 @@
+package git
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRefsSkipsPeeledTags(t *testing.T) {
+	refs := parseRefs("aaa\tHEAD\naaa\trefs/heads/main\nbbb\trefs/tags/v1\nccc\trefs/tags/v1^{}\n")
+	assert.New(t).Equal(map[string]string{"HEAD": "aaa", "refs/heads/main": "aaa", "refs/tags/v1": "bbb"}, refs)
+}
+
+func TestFilterRefsKeepsMatchingBranchesAndTags(t *testing.T) {
+	refs := filterRefs(
+		map[string]string{"HEAD": "aaa", "refs/heads/main": "aaa", "refs/heads/wip": "bbb", "refs/tags/v1": "ccc", "refs/pull/1/head": "ddd"},
+		&Options{ExcludeRefs: []string{"refs/heads/wip"}},
+	)
+	assert.New(t).Equal(map[string]string{"refs/heads/main": "aaa", "refs/tags/v1": "ccc"}, refs)
+}
+
+func TestDiffRefs(t *testing.T) {
+	diffs := diffRefs(
+		"upstream",
+		map[string]string{"refs/heads/main": "aaa", "refs/heads/gone": "bbb", "refs/tags/v1": "ccc"},
+		map[string]string{"refs/heads/main": "aaa", "refs/heads/new": "ddd", "refs/tags/v1": "eee"},
+	)
+	assert.New(t).Equal([]string{
+		"upstream refs/heads/gone is missing, expected bbb",
+		"upstream refs/heads/new is ddd, expected missing",
+		"upstream refs/tags/v1 is eee, expected ccc",
+	}, diffs)
+}
@@ -0,0 +1,150 @@
+package git
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// semverTag matches tags naming semantic versions, optionally prefixed with "v"
+var semverTag = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// semverConstraint matches a comparison in a constraint on semantic versions, eg. ">=2.1"
+var semverConstraint = regexp.MustCompile(`^(>=|<=|>|<|=)?\s*v?([0-9]+)(?:\.([0-9]+))?(?:\.([0-9]+))?(?:-([0-9A-Za-z.-]+))?$`)
+
+// semver is a parsed semantic version, build metadata is left out as it doesn't affect precedence
+type semver struct {
+	numbers    [3]int64
+	prerelease string
+}
+
+// parseSemver parses name as a semantic version, or returns nil when it isn't one
+func parseSemver(name string) *semver {
+	match := semverTag.FindStringSubmatch(name)
+	if match == nil {
+		return nil
+	}
+	version := &semver{prerelease: match[4]}
+	for i := range version.numbers {
+		version.numbers[i], _ = strconv.ParseInt(match[i+1], 10, 64)
+	}
+	return version
+}
+
+// isRelease tells whether tag names a semantic version that isn't a pre-release, eg. "v1.2.3" but not "v1.2.3-rc.1"
+func isRelease(tag string) bool {
+	version := parseSemver(tag)
+	return version != nil && version.prerelease == ""
+}
+
+// compareSemver returns a negative number when a precedes b, a positive one when it follows b, and zero otherwise
+func compareSemver(a *semver, b *semver) int {
+	for i := range a.numbers {
+		if a.numbers[i] != b.numbers[i] {
+			if a.numbers[i] < b.numbers[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	// A pre-release precedes the release
+	if a.prerelease == "" || b.prerelease == "" {
+		return len(b.prerelease) - len(a.prerelease)
+	}
+	aIdentifiers, bIdentifiers := strings.Split(a.prerelease, "."), strings.Split(b.prerelease, ".")
+	for i := 0; i < len(aIdentifiers) && i < len(bIdentifiers); i++ {
+		if result := compareIdentifiers(aIdentifiers[i], bIdentifiers[i]); result != 0 {
+			return result
+		}
+	}
+	return len(aIdentifiers) - len(bIdentifiers)
+}
+
+// compareIdentifiers compares pre-release identifiers, numeric ones numerically and before alphanumeric ones
+func compareIdentifiers(a string, b string) int {
+	aNumber, aErr := strconv.ParseInt(a, 10, 64)
+	bNumber, bErr := strconv.ParseInt(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		if aNumber == bNumber {
+			return 0
+		}
+		if aNumber < bNumber {
+			return -1
+		}
+		return 1
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// semverComparison is a comparison in a constraint on semantic versions
+type semverComparison struct {
+	operator string
+	version  *semver
+}
+
+// parseSemverConstraints parses a comma separated list of comparisons, in which missing minor and patch numbers
+// are zero, eg. ">=2.1,<3"
+func parseSemverConstraints(constraint string) ([]*semverComparison, gmm.ApplicationError) {
+	var comparisons []*semverComparison
+	for _, item := range gmm.SplitList(constraint) {
+		match := semverConstraint.FindStringSubmatch(item)
+		if match == nil {
+			return nil, gmm.NewError("invalid semver constraint '"+item+"'", gmm.ErrUser)
+		}
+		version := &semver{prerelease: match[5]}
+		for i := range version.numbers {
+			version.numbers[i], _ = strconv.ParseInt(match[i+2], 10, 64)
+		}
+		operator := match[1]
+		if operator == "" {
+			operator = "="
+		}
+		comparisons = append(comparisons, &semverComparison{operator: operator, version: version})
+	}
+	return comparisons, nil
+}
+
+// satisfiesSemver tells whether name is a semantic version satisfying all comparisons. Pre-releases only satisfy
+// comparisons of which one names a pre-release of the same version, so ">=2.1" doesn't select "2.5.0-beta".
+func satisfiesSemver(name string, comparisons []*semverComparison) bool {
+	version := parseSemver(name)
+	if version == nil || (version.prerelease != "" && !namesPrerelease(comparisons, version)) {
+		return false
+	}
+	for _, comparison := range comparisons {
+		result := compareSemver(version, comparison.version)
+		satisfied := false
+		switch comparison.operator {
+		case "=":
+			satisfied = result == 0
+		case ">":
+			satisfied = result > 0
+		case ">=":
+			satisfied = result >= 0
+		case "<":
+			satisfied = result < 0
+		case "<=":
+			satisfied = result <= 0
+		}
+		if !satisfied {
+			return false
+		}
+	}
+	return true
+}
+
+// namesPrerelease tells whether one of comparisons names a pre-release with the numbers of version
+func namesPrerelease(comparisons []*semverComparison, version *semver) bool {
+	for _, comparison := range comparisons {
+		if comparison.version.prerelease != "" && comparison.version.numbers == version.numbers {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package git
+
+import (
+	"time"
+)
+
+// Status describes the outcome of recent operations on a mirror
+type Status struct {
+	LastFetch      *time.Time `json:"lastFetch,omitempty"`
+	LastFetchError string     `json:"lastFetchError,omitempty"`
+	// LastFetchUpstream is the upstream that served the last successful fetch
+	LastFetchUpstream string `json:"lastFetchUpstream,omitempty"`
+	// UpstreamMismatches lists the refs upstreams disagreed on when last verified
+	UpstreamMismatches []string `json:"upstreamMismatches,omitempty"`
+	// Submodules are the submodule URIs found at the mirrored branches and tags
+	Submodules []string `json:"submodules,omitempty"`
+	// LastMaintenance is when maintenance tasks last completed
+	LastMaintenance      *time.Time `json:"lastMaintenance,omitempty"`
+	LastMaintenanceError string     `json:"lastMaintenanceError,omitempty"`
+	// LastFsck is when the integrity of the repository was last checked
+	LastFsck *time.Time `json:"lastFsck,omitempty"`
+	// Corrupt is set when the last integrity check found errors, LastFsckError tells why it failed
+	Corrupt       bool   `json:"corrupt,omitempty"`
+	LastFsckError string `json:"lastFsckError,omitempty"`
+	// LastReclone is when a corrupt repository was last replaced by a fresh clone
+	LastReclone *time.Time `json:"lastReclone,omitempty"`
+	// DiskUsage is the disk space used by the mirror when last measured
+	DiskUsage *DiskUsage `json:"diskUsage,omitempty"`
+	// Push is the replication state per push target
+	Push map[string]*PushStatus `json:"push,omitempty"`
+}
+
+// DiskUsage is the disk space used by a mirror, in bytes
+type DiskUsage struct {
+	Repository int64     `json:"repository"`
+	Dist       int64     `json:"dist"`
+	Bundles    int64     `json:"bundles"`
+	MeasuredAt time.Time `json:"measuredAt"`
+}
+
+// Total returns the disk space used by the repository, dist archives and bundles together
+func (u *DiskUsage) Total() int64 {
+	return u.Repository + u.Dist + u.Bundles
+}
+
+// PushStatus describes the replication state of a single push target
+type PushStatus struct {
+	LastPush   *time.Time `json:"lastPush,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+	LagSeconds int64      `json:"lagSeconds"`
+	// pendingSince is the time of the first fetch that has not been pushed yet
+	pendingSince *time.Time
+}
+
+func (s *Status) copy(now time.Time) *Status {
+	c := *s
+	c.Push = make(map[string]*PushStatus, len(s.Push))
+	for target, push := range s.Push {
+		p := *push
+		if p.pendingSince != nil {
+			p.LagSeconds = int64(now.Sub(*p.pendingSince).Seconds())
+		}
+		c.Push[target] = &p
+	}
+	return &c
+}
+
+func (s *Status) fetched(now time.Time, upstream string, err error) {
+	if err != nil {
+		s.LastFetchError = err.Error()
+		return
+	}
+	s.LastFetch = &now
+	s.LastFetchError = ""
+	s.LastFetchUpstream = upstream
+	for _, push := range s.Push {
+		if push.pendingSince == nil {
+			push.pendingSince = &now
+		}
+	}
+}
+
+func (s *Status) pushed(target string, now time.Time, err error) {
+	if s.Push == nil {
+		s.Push = make(map[string]*PushStatus)
+	}
+	push, ok := s.Push[target]
+	if !ok {
+		push = &PushStatus{pendingSince: s.LastFetch}
+		s.Push[target] = push
+	}
+	if err != nil {
+		push.LastError = err.Error()
+		return
+	}
+	push.LastPush = &now
+	push.LastError = ""
+	push.pendingSince = nil
+}
+
+func (s *Status) maintained(now time.Time, err error) {
+	if err != nil {
+		s.LastMaintenanceError = err.Error()
+		return
+	}
+	s.LastMaintenance = &now
+	s.LastMaintenanceError = ""
+}
+
+func (s *Status) checked(now time.Time, corrupt bool, err error) {
+	s.LastFsck = &now
+	s.Corrupt = corrupt
+	s.LastFsckError = ""
+	if err != nil {
+		s.LastFsckError = err.Error()
+	}
+}
+
+func (s *Status) recloned(now time.Time) {
+	s.LastReclone = &now
+	s.Corrupt = false
+}
@@ -0,0 +1,39 @@
+package git
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPushLagCoversUnpushedFetches(t *testing.T) {
+	assertions := assert.New(t)
+	start := time.Now()
+	status := &Status{}
+
+	status.fetched(start, "https://a", nil)
+	status.pushed("target", start, nil)
+	assertions.Equal(int64(0), status.copy(start.Add(time.Hour)).Push["target"].LagSeconds)
+
+	status.fetched(start.Add(time.Minute), "https://a", nil)
+	status.pushed("target", start.Add(time.Minute), errors.New("failed"))
+	status.fetched(start.Add(2*time.Minute), "https://b", nil)
+	lagging := status.copy(start.Add(3 * time.Minute)).Push["target"]
+	assertions.Equal(int64(120), lagging.LagSeconds)
+	assertions.Equal("failed", lagging.LastError)
+
+	status.pushed("target", start.Add(4*time.Minute), nil)
+	assertions.Equal(int64(0), status.copy(start.Add(5 * time.Minute)).Push["target"].LagSeconds)
+}
+
+func TestFailedFetchKeepsLastFetch(t *testing.T) {
+	assertions := assert.New(t)
+	start := time.Now()
+	status := &Status{}
+	status.fetched(start, "https://a", nil)
+	status.fetched(start.Add(time.Minute), "", errors.New("failed"))
+	assertions.Equal(start, *status.LastFetch)
+	assertions.Equal("https://a", status.LastFetchUpstream)
+	assertions.Equal("failed", status.LastFetchError)
+}
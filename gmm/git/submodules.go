@@ -0,0 +1,118 @@
+package git
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"sort"
+	"strings"
+)
+
+// UpdateHook is called after a mirror was cloned or updated successfully
+type UpdateHook func(mirror *Mirror)
+
+// OnUpdate registers a hook to call after each successful clone and update
+func (m *Mirror) OnUpdate(hook UpdateHook) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hooks = append(m.hooks, hook)
+}
+
+// Submodules returns the submodule URIs found at the mirrored branches and tags when last updated
+func (m *Mirror) Submodules() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string(nil), m.status.Submodules...)
+}
+
+// updated measures disk usage and discovers submodules if enabled, then calls the update hooks
+func (m *Mirror) updated() {
+	m.measureDiskUsage()
+
+	var submodules []string
+	if m.Options().Submodules {
+		var err gmm.ApplicationError
+		if submodules, err = m.discoverSubmodules(); err != nil {
+			log.Errorf("Discovering submodules of '%s' failed: %s", m.Name, err)
+			return
+		}
+	}
+	m.mutex.Lock()
+	m.status.Submodules = submodules
+	hooks := append([]UpdateHook(nil), m.hooks...)
+	m.mutex.Unlock()
+
+	for _, hook := range hooks {
+		hook(m)
+	}
+}
+
+// discoverSubmodules reads .gitmodules at each mirrored branch and tag, and resolves the submodule URLs against the mirror's uri
+func (m *Mirror) discoverSubmodules() ([]string, gmm.ApplicationError) {
+	output, err := m.cmd.ListRefs(m.path)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	uris := make(map[string]bool)
+	for _, sha := range filterRefs(parseRefs(output), m.Options()) {
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+		// Fails when there is no .gitmodules at this commit
+		output, err := m.cmd.GetSubmoduleURLs(m.path, sha)
+		if err != nil {
+			continue
+		}
+		for _, url := range parseSubmoduleURLs(output) {
+			uri, err := ResolveSubmoduleURL(m.uri, url)
+			if err == nil {
+				_, err = ParseMirrorName(m.baseDir(), uri)
+			}
+			if err != nil {
+				log.Warn(err)
+				continue
+			}
+			uris[uri] = true
+		}
+	}
+
+	var list []string
+	for uri := range uris {
+		list = append(list, uri)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// parseSubmoduleURLs reads the values of "git config -z --get-regexp" output
+func parseSubmoduleURLs(output string) []string {
+	var urls []string
+	for _, item := range strings.Split(output, "\x00") {
+		if i := strings.Index(item, "\n"); i != -1 && strings.TrimSpace(item[i+1:]) != "" {
+			urls = append(urls, strings.TrimSpace(item[i+1:]))
+		}
+	}
+	return urls
+}
+
+// ResolveSubmoduleURL resolves a submodule URL relative to the superproject's uri, like git does for "./" and "../" URLs
+func ResolveSubmoduleURL(base string, url string) (string, gmm.ApplicationError) {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url, nil
+	}
+	prefix, dir := base, ""
+	if i := strings.Index(base, "://"); i != -1 {
+		if j := strings.Index(base[i+3:], "/"); j != -1 {
+			prefix, dir = base[:i+3+j], base[i+3+j:]
+		}
+	} else if i := strings.Index(base, ":"); i != -1 {
+		prefix, dir = base[:i+1], base[i+1:]
+	}
+	resolved := path.Join(strings.TrimSuffix(dir, "/"), url)
+	if dir == "" || resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return "", gmm.NewError("cannot resolve submodule url '"+url+"' relative to '"+base+"'", gmm.ErrUser)
+	}
+	return prefix + resolved, nil
+}
@@ -0,0 +1,68 @@
+package git_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+)
+
+var resolveSubmoduleURLTestData = []struct {
+	base     string
+	url      string
+	expected string
+}{
+	{"https://github.com/ns/name.git", "https://gitlab.com/other/lib.git", "https://gitlab.com/other/lib.git"},
+	{"https://github.com/ns/name.git", "../lib.git", "https://github.com/ns/lib.git"},
+	{"https://github.com/ns/name/", "../../other/lib", "https://github.com/other/lib"},
+	{"https://github.com/ns/name", "./lib", "https://github.com/ns/name/lib"},
+	{"git@github.com:ns/name.git", "../lib.git", "git@github.com:ns/lib.git"},
+}
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	for _, tt := range resolveSubmoduleURLTestData {
+		t.Run(tt.base+" "+tt.url, func(t *testing.T) {
+			uri, err := git.ResolveSubmoduleURL(tt.base, tt.url)
+			assertions := assert.New(t)
+			assertions.Nil(err)
+			assertions.Equal(tt.expected, uri)
+		})
+	}
+	_, err := git.ResolveSubmoduleURL("git@github.com:ns/name.git", "../../../lib.git")
+	if assert.New(t).Error(err) {
+		assert.New(t).Equal(gmm.ErrUser, err.Code())
+	}
+}
+
+func TestParseMirrorName(t *testing.T) {
+	assertions := assert.New(t)
+	name, err := git.ParseMirrorName("/path/", "https://github.com/ns/Name.git")
+	assertions.Nil(err)
+	assertions.Equal("ns/name.git", name)
+
+	for _, uri := range []string{"lib", "https://github.com/ns/..", "https://github.com/../x", "https://github.com/ns/", "ns//x", "https://github.com/./x"} {
+		_, err := git.ParseMirrorName("/path", uri)
+		if assertions.Error(err, uri) {
+			assertions.Equal(gmm.ErrUser, err.Code(), uri)
+		}
+	}
+}
+
+func TestUpdateDiscoversSubmodules(t *testing.T) {
+	mirror, cmd := newExistingTestMirror("https://example.com/ns/repo", &git.Options{Submodules: true})
+	cmd.On("FetchPrune", "/path/ns/repo", "https://example.com/ns/repo", mock.Anything).Return(nil)
+	cmd.On("ListRefs", "/path/ns/repo").Return("aaa refs/heads/main\naaa refs/tags/v1\nbbb refs/heads/old\nccc refs/pull/1/head", nil)
+	cmd.On("GetSubmoduleURLs", "/path/ns/repo", "aaa").Return("submodule.lib.url\n../lib.git\x00submodule.vendor/x.url\nhttps://gitlab.com/x/x\x00"+
+		"submodule.up.url\nhttps://gitlab.com/x/..\x00submodule.bare.url\nlib\x00", nil)
+	cmd.On("GetSubmoduleURLs", "/path/ns/repo", "bbb").Return("", gmm.NewError("unable to resolve config blob", gmm.ErrFilesystem))
+
+	var hooked *git.Mirror
+	mirror.OnUpdate(func(m *git.Mirror) { hooked = m })
+
+	assertions := assert.New(t)
+	assertions.Nil(mirror.Update())
+	assertions.Equal([]string{"https://example.com/ns/lib.git", "https://gitlab.com/x/x"}, mirror.Submodules())
+	assertions.Equal(mirror, hooked)
+	cmd.AssertNumberOfCalls(t, "GetSubmoduleURLs", 2)
+}
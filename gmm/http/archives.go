@@ -0,0 +1,96 @@
+package http
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// archiveContentTypes are the content types of the archive formats
+var archiveContentTypes = map[string]string{
+	"zip":     "application/zip",
+	"tar.gz":  "application/gzip",
+	"tar.zst": "application/zstd",
+}
+
+// getArchive serves an archive of a ref or commit of a mirror, named "{ref}.{format}" by the path.
+// Archives are generated while they are served when not cached, and identified by their ETag.
+func (s *Server) getArchive(w http.ResponseWriter, r *http.Request) {
+	if s.archives == nil {
+		s.handleServingError(w, gmm.NewError("no archive cache configured", gmm.ErrNotFound))
+		return
+	}
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	revision, format := splitArchiveFormat(mux.Vars(r)["ref"])
+	if format == "" {
+		s.handleServingError(w, gmm.NewError("archive format must be one of "+strings.Join(git.ArchiveFormats, ", "), gmm.ErrNotFound))
+		return
+	}
+	source, err := mirror.ArchiveSource(revision)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+
+	mirror.RecordAccess()
+	key := source.Key(format)
+	etag := `"` + key + `"`
+	w.Header().Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match == "*" || strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	name := mux.Vars(r)["name"] + "-" + strings.Replace(revision, "/", "-", -1) + "." + format
+	w.Header().Set("Content-Type", archiveContentTypes[format])
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+	stream := &responseStream{w: w}
+	file, err := s.archives.Open(key, stream, func(w io.Writer) gmm.ApplicationError {
+		return source.Write(format, w)
+	})
+	if err != nil {
+		if stream.written {
+			// The status has been sent, aborting tells the client the archive is incomplete
+			log.Error(err)
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Del("Content-Disposition")
+		s.handleServingError(w, err)
+		return
+	}
+	if file == nil {
+		return
+	}
+	defer file.Close()
+	http.ServeContent(w, r, name, time.Time{}, file)
+}
+
+// splitArchiveFormat splits the format from the name of an archive, which is empty when not supported
+func splitArchiveFormat(name string) (string, string) {
+	for _, format := range git.ArchiveFormats {
+		if revision := strings.TrimSuffix(name, "."+format); revision != name {
+			return revision, format
+		}
+	}
+	return name, ""
+}
+
+// responseStream records whether anything was written to the response
+type responseStream struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (s *responseStream) Write(p []byte) (int, error) {
+	s.written = true
+	return s.w.Write(p)
+}
@@ -0,0 +1,58 @@
+package http
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// getTree lists a directory of a mirror at a branch, tag or commit, the path being "{ref}/{path}"
+func (s *Server) getTree(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	tree, err := mirror.Tree(mux.Vars(r)["path"])
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	mirror.RecordAccess()
+	s.writeJSON(w, tree)
+}
+
+// getBlob serves a file of a mirror at a branch, tag or commit, the path being "{ref}/{path}".
+// The content type is derived from the name or content of the file, and files beyond the size limit are refused.
+func (s *Server) getBlob(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	blob, err := mirror.Blob(mux.Vars(r)["path"])
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	if blob.Size > s.maxBlobSize {
+		s.handleServingError(w, gmm.NewError("file '"+blob.Path+"' is larger than "+strconv.FormatInt(s.maxBlobSize, 10)+" bytes", gmm.ErrUser))
+		return
+	}
+	// Blobs are small enough to be read into memory, which lets ranges be served
+	var content bytes.Buffer
+	if err := mirror.WriteBlob(blob, &content); err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	mirror.RecordAccess()
+	w.Header().Set("ETag", `"`+blob.Object+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Files are not meant to be rendered as part of this service, such as HTML with scripts
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	http.ServeContent(w, r, path.Base(blob.Path), time.Time{}, bytes.NewReader(content.Bytes()))
+}
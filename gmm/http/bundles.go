@@ -0,0 +1,129 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func (s *Server) listBundles(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	bundles, err := mirror.Bundles()
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, bundles)
+}
+
+// createBundle bundles a mirror, incrementally when the body names a "base" bundle or a "since" time.
+// It responds with no content when nothing changed since.
+func (s *Server) createBundle(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	request := &struct {
+		Base  string     `json:"base"`
+		Since *time.Time `json:"since"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil && err != io.EOF {
+		s.handleServingError(w, gmm.NewError("failed decoding request body: "+err.Error(), gmm.ErrUser))
+		return
+	}
+	bundle, err := mirror.CreateBundle(request.Base, request.Since)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	if bundle == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(bundle); err != nil {
+		log.Error(err)
+	}
+}
+
+// downloadBundle serves a bundle file, with its SHA-256 checksum in the X-Checksum-Sha256 header
+func (s *Server) downloadBundle(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	file, bundle, err := mirror.OpenBundle(mux.Vars(r)["id"])
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	defer file.Close()
+	mirror.RecordAccess()
+	name := strings.Replace(mirror.Name, "/", "-", -1) + "-" + bundle.ID + ".bundle"
+	w.Header().Set("Content-Type", "application/x-git-bundle")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("X-Checksum-Sha256", bundle.SHA256)
+	http.ServeContent(w, r, name, bundle.Time, file)
+}
+
+func (s *Server) removeBundle(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	if err := mirror.RemoveBundle(mux.Vars(r)["id"]); err != nil {
+		s.handleServingError(w, err)
+	}
+}
+
+// importBundle updates or creates the mirror of the "uri" parameter from the bundle in the body.
+// When the "sha256" parameter is given, the bundle is rejected if its checksum differs. Bundles are stored next to the
+// mirrors while they are imported, and rejected beyond the size limit.
+func (s *Server) importBundle(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		s.handleServingError(w, gmm.NewError("parameter 'uri' is required", gmm.ErrUser))
+		return
+	}
+	// Hidden, so that it is not taken for a mirror
+	file, err := ioutil.TempFile(s.baseDir, ".import-")
+	if err != nil {
+		s.handleServingError(w, gmm.NewErrorUsingError(err, gmm.ErrFilesystem))
+		return
+	}
+	defer os.Remove(file.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), http.MaxBytesReader(w, r.Body, s.maxBundle))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.handleServingError(w, gmm.NewError("failed reading request body: "+err.Error(), gmm.ErrUser))
+		return
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if expected := r.URL.Query().Get("sha256"); expected != "" && !strings.EqualFold(expected, checksum) {
+		s.handleServingError(w, gmm.NewError("bundle checksum '"+checksum+"' does not match '"+expected+"'", gmm.ErrUser))
+		return
+	}
+	if err := s.manager.ImportBundle(uri, nil, file.Name()); err != nil {
+		s.handleServingError(w, err)
+	}
+}
@@ -0,0 +1,64 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connections tracks the open connections of the server by remote address, so that handlers streaming their
+// requests or responses can lift the timeouts of their connection
+type connections struct {
+	mutex sync.Mutex
+	conns map[string]net.Conn
+}
+
+func newConnections() *connections {
+	return &connections{conns: map[string]net.Conn{}}
+}
+
+// track records new connections and forgets closed ones, it is the ConnState hook of the server
+func (c *connections) track(conn net.Conn, state http.ConnState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	addr := conn.RemoteAddr().String()
+	switch state {
+	case http.StateNew:
+		c.conns[addr] = conn
+	case http.StateHijacked, http.StateClosed:
+		if c.conns[addr] == conn {
+			delete(c.conns, addr)
+		}
+	}
+}
+
+// withoutWriteTimeout lifts the write timeout of the server for the responses of handler, which may take longer
+// than any sensible one. The server sets the timeout again for the next request on the connection.
+func (c *connections) withoutWriteTimeout(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conn := c.conn(r); conn != nil {
+			conn.SetWriteDeadline(time.Time{})
+		}
+		handler(w, r)
+	}
+}
+
+// withoutTimeouts lifts the read and write timeouts of the server for handler, which reads request bodies
+// that may take longer to upload, and to process, than any sensible timeout
+func (c *connections) withoutTimeouts(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conn := c.conn(r); conn != nil {
+			conn.SetDeadline(time.Time{})
+		}
+		handler(w, r)
+	}
+}
+
+// conn returns the connection r was received on, or nil if it is not tracked
+func (c *connections) conn(r *http.Request) net.Conn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conns[r.RemoteAddr]
+}
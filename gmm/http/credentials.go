@@ -0,0 +1,44 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/credentials"
+	"io/ioutil"
+	"net/http"
+)
+
+func (s *Server) listCredentials(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, s.credentials.List())
+}
+
+func (s *Server) addCredential(w http.ResponseWriter, r *http.Request) {
+	credential := &credentials.Credential{}
+	if err := json.NewDecoder(r.Body).Decode(credential); err != nil {
+		s.handleServingError(w, gmm.NewError("failed decoding credential: "+err.Error(), gmm.ErrUser))
+		return
+	}
+	if err := s.credentials.Add(credential); err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) removeCredential(w http.ResponseWriter, r *http.Request) {
+	if err := s.credentials.Remove(mux.Vars(r)["name"]); err != nil {
+		s.handleServingError(w, err)
+	}
+}
+
+func (s *Server) addKnownHosts(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.handleServingError(w, gmm.NewError("failed reading request body", gmm.ErrUser))
+		return
+	}
+	if err := s.credentials.AddKnownHosts(string(body)); err != nil {
+		s.handleServingError(w, err)
+	}
+}
@@ -0,0 +1,57 @@
+package http
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestListCredentials(t *testing.T) {
+	handler, vault := newTestServer()
+	vault.On("List").Return([]*credentials.Credential{{Name: "gh", Type: credentials.TypeToken}})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/credentials", nil))
+
+	assertions := assert.New(t)
+	assertions.Equal(http.StatusOK, w.Code)
+	assertions.Equal("application/json", w.Header().Get("Content-Type"))
+	assertions.Contains(w.Body.String(), `"name":"gh"`)
+}
+
+func TestAddCredential(t *testing.T) {
+	handler, vault := newTestServer()
+	vault.On("Add", mock.MatchedBy(func(c *credentials.Credential) bool {
+		return c.Name == "gh" && c.Secret == "t0k3n"
+	})).Return(nil)
+
+	w := httptest.NewRecorder()
+	body := `{"name":"gh","type":"token","secret":"t0k3n","hosts":["github.com"]}`
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/credentials", strings.NewReader(body)))
+
+	assert.New(t).Equal(http.StatusCreated, w.Code)
+}
+
+func TestAddCredentialRejectsInvalidJSON(t *testing.T) {
+	handler, _ := newTestServer()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/credentials", strings.NewReader("{")))
+
+	assert.New(t).Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestRemoveUnknownCredential(t *testing.T) {
+	handler, vault := newTestServer()
+	vault.On("Remove", "nope").Return(gmm.NewError("credential 'nope' does not exist", gmm.ErrNotFound))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/credentials/nope", nil))
+
+	assert.New(t).Equal(http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+// getDists serves the manifest listing the dist archives of a mirror
+func (s *Server) getDists(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	manifest, err := mirror.Dists()
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, manifest)
+}
+
+// createDist archives the tag named in the body, in the formats configured for the mirror
+func (s *Server) createDist(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	request := &struct {
+		Tag string `json:"tag"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil || request.Tag == "" {
+		s.handleServingError(w, gmm.NewError("request body must name a tag", gmm.ErrUser))
+		return
+	}
+	archives, err := mirror.CreateDist(request.Tag)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(archives); err != nil {
+		log.Error(err)
+	}
+}
+
+// downloadDist serves a dist archive or its checksum or signature file, with the checksum in the X-Checksum-Sha256 header
+func (s *Server) downloadDist(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	name := mux.Vars(r)["file"]
+	file, archive, err := mirror.OpenDist(name)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	defer file.Close()
+	mirror.RecordAccess()
+	if strings.HasSuffix(name, ".sha256") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else if strings.HasSuffix(name, ".asc") {
+		w.Header().Set("Content-Type", "application/pgp-signature")
+	} else {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		w.Header().Set("X-Checksum-Sha256", archive.SHA256)
+	}
+	http.ServeContent(w, r, name, archive.Time, file)
+}
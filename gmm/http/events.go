@@ -0,0 +1,137 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// historySize is the number of events kept to replay to clients reconnecting to the event stream
+const historySize = 1000
+
+// streamBuffer is the number of events buffered per event stream, further events are dropped
+const streamBuffer = 256
+
+// keepAliveInterval is how often a comment is written to an idle event stream, so proxies keep it open
+const keepAliveInterval = 15 * time.Second
+
+// streamSink passes the events of an event stream's subscription to its handler
+type streamSink chan *events.Event
+
+func (s streamSink) Send(event *events.Event) {
+	select {
+	case s <- event:
+	default:
+		log.Warnf("Dropping event '%s' of '%s', event stream is not keeping up", event.Type, event.Mirror)
+	}
+}
+
+// eventFilter selects the events of an event stream by mirror name or namespace, and by type
+type eventFilter struct {
+	mirrors    []string
+	namespaces []string
+	types      []string
+}
+
+func newEventFilter(query url.Values) *eventFilter {
+	return &eventFilter{mirrors: query["mirror"], namespaces: query["namespace"], types: query["type"]}
+}
+
+func (f *eventFilter) accepts(event *events.Event) bool {
+	if len(f.types) > 0 && !contains(f.types, event.Type) {
+		return false
+	}
+	if len(f.mirrors) == 0 && len(f.namespaces) == 0 {
+		return true
+	}
+	if contains(f.mirrors, event.Mirror) {
+		return true
+	}
+	for _, namespace := range f.namespaces {
+		if strings.HasPrefix(event.Mirror, namespace+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// streamEvents streams events as server-sent events until the client disconnects.
+// Clients reconnecting with a Last-Event-ID header first receive the events they missed, as far as they are kept.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.handleServingError(w, gmm.NewError("streaming is not supported", gmm.ErrNet))
+		return
+	}
+	filter := newEventFilter(r.URL.Query())
+
+	// Subscribing before replaying ensures no event is missed, events both replayed and received are skipped
+	sink := make(streamSink, streamBuffer)
+	s.events.Subscribe(sink)
+	defer s.events.Unsubscribe(sink)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	replayed := make(map[string]bool)
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		for _, event := range s.history.Since(id) {
+			replayed[event.ID] = true
+			if !filter.accepts(event) {
+				continue
+			}
+			if err := writeServerSentEvent(w, event); err != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event := <-sink:
+			if replayed[event.ID] || !filter.accepts(event) {
+				continue
+			}
+			if err := writeServerSentEvent(w, event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeServerSentEvent(w io.Writer, event *events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"bufio"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/kleijnweb/git-mirror-manager/gmm/manager"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// readServerSentEvent reads the next event from stream, returning its fields
+func readServerSentEvent(t *testing.T, stream *bufio.Reader) map[string]string {
+	fields := make(map[string]string)
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream failed: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fields
+		}
+		if parts := strings.SplitN(line, ": ", 2); len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+}
+
+func TestStreamEventsReplaysAndFilters(t *testing.T) {
+	bus := events.NewBus()
+	server := NewServer(manager.NewManager(nil, &mocks.CommandRunner{}, &mocks.FileSystemUtil{}, &mocks.Policy{}, nil, nil, nil), &mocks.Vault{}, bus)
+	router, _ := server.configure(&gmm.Config{})
+	httpServer := httptest.NewServer(router.Handler)
+	defer httpServer.Close()
+
+	seen := events.NewEvent(events.MirrorAdded, "ns/a")
+	missed := events.NewEvent(events.MirrorUpdated, "ns/b")
+	server.history.Send(seen)
+	server.history.Send(events.NewEvent(events.MirrorUpdated, "other/c"))
+	server.history.Send(missed)
+
+	request, _ := http.NewRequest("GET", httpServer.URL+"/events?namespace=ns", nil)
+	request.Header.Set("Last-Event-ID", seen.ID)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	stream := bufio.NewReader(response.Body)
+
+	assertions := assert.New(t)
+	assertions.Equal("text/event-stream", response.Header.Get("Content-Type"))
+	event := readServerSentEvent(t, stream)
+	assertions.Equal(missed.ID, event["id"])
+	assertions.Equal(events.MirrorUpdated, event["event"])
+	assertions.Contains(event["data"], `"mirror":"ns/b"`)
+
+	bus.Publish(events.NewEvent(events.MirrorCloneStarted, "other/d"))
+	live := events.NewEvent(events.MirrorCloneStarted, "ns/d")
+	bus.Publish(live)
+	assertions.Equal(live.ID, readServerSentEvent(t, stream)["id"])
+}
+
+func TestEventFilter(t *testing.T) {
+	query, _ := url.ParseQuery("mirror=ns/a&namespace=team&type=mirror.updated")
+	filter := newEventFilter(query)
+	assertions := assert.New(t)
+	assertions.True(filter.accepts(events.NewEvent(events.MirrorUpdated, "ns/a")))
+	assertions.True(filter.accepts(events.NewEvent(events.MirrorUpdated, "team/b")))
+	assertions.False(filter.accepts(events.NewEvent(events.MirrorUpdated, "ns/b")))
+	assertions.False(filter.accepts(events.NewEvent(events.MirrorUpdated, "teams/b")))
+	assertions.False(filter.accepts(events.NewEvent(events.MirrorAdded, "ns/a")))
+	assertions.True(newEventFilter(url.Values{}).accepts(events.NewEvent(events.MirrorAdded, "ns/a")))
+}
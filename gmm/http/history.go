@@ -0,0 +1,157 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"net/http"
+	"time"
+)
+
+type refAt struct {
+	Ref string    `json:"ref"`
+	At  time.Time `json:"at"`
+	// Object is empty when the ref did not exist
+	Object string `json:"object"`
+}
+
+// getRefHistory lists the ref updates of a mirror since the "since" parameter, limited to those changing
+// the "ref" parameter if given. With an "at" parameter, it reports what ref pointed to at that time instead.
+func (s *Server) getRefHistory(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	ref := r.URL.Query().Get("ref")
+	if r.URL.Query().Get("at") != "" {
+		s.getRefAt(w, r, mirror, ref)
+		return
+	}
+	since, err := s.timeParameter(r, "since")
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	updates, err := mirror.RefHistory(since)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	if ref != "" {
+		filtered := []*git.RefUpdate{}
+		for _, update := range updates {
+			for _, change := range update.Refs {
+				if change.Ref == ref {
+					filtered = append(filtered, update)
+					break
+				}
+			}
+		}
+		updates = filtered
+	}
+	s.writeJSON(w, updates)
+}
+
+func (s *Server) getRefAt(w http.ResponseWriter, r *http.Request, mirror *git.Mirror, ref string) {
+	if ref == "" {
+		s.handleServingError(w, gmm.NewError("parameter 'at' requires parameter 'ref'", gmm.ErrUser))
+		return
+	}
+	at, err := s.timeParameter(r, "at")
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	object, err := mirror.RefAt(ref, at)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, &refAt{Ref: ref, At: at, Object: object})
+}
+
+func (s *Server) getForcePushes(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	since, err := s.timeParameter(r, "since")
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	forcePushes, err := mirror.ForcePushes(since)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, forcePushes)
+}
+
+// getAllForcePushes lists the force-pushes to any mirror, for audits
+func (s *Server) getAllForcePushes(w http.ResponseWriter, r *http.Request) {
+	since, err := s.timeParameter(r, "since")
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	forcePushes, err := s.manager.ForcePushes(since)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, forcePushes)
+}
+
+func (s *Server) listPreservedRefs(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	preserved, err := mirror.PreservedRefs()
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, preserved)
+}
+
+// restorePreservedRef makes the preserved ref in the body available to clients, responding with the restored ref
+func (s *Server) restorePreservedRef(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	request := &struct {
+		Ref string `json:"ref"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		s.handleServingError(w, gmm.NewError("invalid restore request: "+err.Error(), gmm.ErrUser))
+		return
+	}
+	restored, err := mirror.RestorePreservedRef(request.Ref)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, &struct {
+		Ref string `json:"ref"`
+	}{restored})
+}
+
+// timeParameter parses an RFC 3339 query parameter, returning the zero time when it is not given
+func (s *Server) timeParameter(r *http.Request, name string) (time.Time, gmm.ApplicationError) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, gmm.NewError("parameter '"+name+"' is not an RFC 3339 time: "+value, gmm.ErrUser)
+	}
+	return parsed, nil
+}
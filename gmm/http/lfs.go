@@ -0,0 +1,136 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+)
+
+// lfsContentType is the media type of Git LFS API requests and responses
+const lfsContentType = "application/vnd.git-lfs+json"
+
+// lfsBatchPath is the route of the batch API, which only reads though clients post to it
+const lfsBatchPath = "/repo/{namespace}/{name}/info/lfs/objects/batch"
+
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Objects   []*lfsObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string       `json:"transfer"`
+	Objects  []*lfsObject `json:"objects"`
+}
+
+type lfsObject struct {
+	OID     string                `json:"oid"`
+	Size    int64                 `json:"size"`
+	Actions map[string]*lfsAction `json:"actions,omitempty"`
+	Error   *lfsError             `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href string `json:"href"`
+}
+
+type lfsError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// lfsBatch implements the download operation of the Git LFS batch API, using the basic transfer adapter
+func (s *Server) lfsBatch(w http.ResponseWriter, r *http.Request) {
+	mirror := s.lfsMirror(w, r)
+	if mirror == nil {
+		return
+	}
+	request := &lfsBatchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		s.writeLFSError(w, http.StatusUnprocessableEntity, "failed decoding batch request: "+err.Error())
+		return
+	}
+	if request.Operation != "download" {
+		s.writeLFSError(w, http.StatusForbidden, "mirrors are read-only")
+		return
+	}
+
+	response := &lfsBatchResponse{Transfer: "basic", Objects: []*lfsObject{}}
+	for _, object := range request.Objects {
+		result := &lfsObject{OID: object.OID, Size: object.Size}
+		path, err := mirror.LFSObjectPath(object.OID)
+		if err != nil {
+			result.Error = &lfsError{Code: http.StatusUnprocessableEntity, Message: err.Error()}
+		} else if info, err := os.Stat(path); err != nil || info.Size() != object.Size {
+			result.Error = &lfsError{Code: http.StatusNotFound, Message: "object not found"}
+		} else {
+			href := s.baseURL(r) + "/repo/" + mirror.Name + "/info/lfs/objects/" + object.OID
+			result.Actions = map[string]*lfsAction{"download": {Href: href}}
+		}
+		response.Objects = append(response.Objects, result)
+	}
+
+	w.Header().Set("Content-Type", lfsContentType)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Error(err)
+	}
+}
+
+// lfsDownload serves a single LFS object
+func (s *Server) lfsDownload(w http.ResponseWriter, r *http.Request) {
+	mirror := s.lfsMirror(w, r)
+	if mirror == nil {
+		return
+	}
+	path, err := mirror.LFSObjectPath(mux.Vars(r)["oid"])
+	if err != nil {
+		s.writeLFSError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		s.writeLFSError(w, http.StatusNotFound, "object not found")
+		return
+	}
+	defer f.Close()
+	info, statErr := f.Stat()
+	if statErr != nil {
+		s.writeLFSError(w, http.StatusInternalServerError, statErr.Error())
+		return
+	}
+	mirror.RecordAccess()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// lfsMirror returns the mirror addressed by the request if it mirrors LFS objects, or writes an error and returns nil
+func (s *Server) lfsMirror(w http.ResponseWriter, r *http.Request) *git.Mirror {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil || !mirror.Options().LFS {
+		s.writeLFSError(w, http.StatusNotFound, "mirror '"+s.mirrorName(r)+"' does not mirror LFS objects")
+		return nil
+	}
+	return mirror
+}
+
+func (s *Server) writeLFSError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", lfsContentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"message": message}); err != nil {
+		log.Error(err)
+	}
+}
+
+// baseURL returns the scheme and host the request was sent to
+func (s *Server) baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,119 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/gmm/manager"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testLFSObjectID = "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+
+// newLFSTestServer serves a mirror "ns/repo" with LFS enabled and a single LFS object stored in baseDir
+func newLFSTestServer(t *testing.T) (http.Handler, string) {
+	baseDir, err := ioutil.TempDir(os.TempDir(), "lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objectDir := path.Join(baseDir, "ns/repo/lfs/objects/4d/7a")
+	os.MkdirAll(objectDir, 0755)
+	ioutil.WriteFile(path.Join(objectDir, testLFSObjectID), []byte("binary"), 0644)
+
+	cmd := &mocks.CommandRunner{}
+	cmd.On("SetConfig", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	return newMirrorTestServer(t, baseDir, cmd, &git.Options{LFS: true}), baseDir
+}
+
+// newMirrorTestServer serves a mirror "ns/repo" in baseDir, running git commands with cmd
+func newMirrorTestServer(t *testing.T, baseDir string, cmd *mocks.CommandRunner, options *git.Options) http.Handler {
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(true)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	policyMock := &mocks.Policy{}
+	policyMock.On("Assert", mock.Anything).Return(nil)
+	m := manager.NewManager(
+		func(uri string, options *git.Options) (*git.Mirror, gmm.ApplicationError) {
+			return git.NewMirror(uri, options, baseDir, "", cmd, fs, func(mirror *git.Mirror, interval string) (git.Cron, gmm.ApplicationError) {
+				cron := &mocks.Cron{}
+				cron.On("Start")
+				return cron, nil
+			}, nil, nil)
+		},
+		cmd,
+		fs,
+		policyMock,
+		nil,
+		nil,
+		nil,
+	)
+	if err := m.AddByURI("https://example.com/ns/repo", options); err != nil {
+		t.Fatal(err)
+	}
+	router, _ := NewServer(m, &mocks.Vault{}, events.NewBus()).configure(&gmm.Config{})
+	return router.Handler
+}
+
+func TestLFSBatch(t *testing.T) {
+	handler, baseDir := newLFSTestServer(t)
+	defer os.RemoveAll(baseDir)
+
+	body := `{"operation":"download","objects":[{"oid":"` + testLFSObjectID + `","size":6},{"oid":"` + strings.Repeat("0", 64) + `","size":1}]}`
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "http://mirror.local/repo/ns/repo/info/lfs/objects/batch", strings.NewReader(body)))
+
+	assertions := assert.New(t)
+	assertions.Equal(http.StatusOK, w.Code)
+	assertions.Equal(lfsContentType, w.Header().Get("Content-Type"))
+	response := &lfsBatchResponse{}
+	assertions.Nil(json.Unmarshal(w.Body.Bytes(), response))
+	if assertions.Len(response.Objects, 2) {
+		assertions.Equal(
+			"http://mirror.local/repo/ns/repo/info/lfs/objects/"+testLFSObjectID,
+			response.Objects[0].Actions["download"].Href,
+		)
+		assertions.Equal(http.StatusNotFound, response.Objects[1].Error.Code)
+	}
+}
+
+func TestLFSBatchRejectsUploads(t *testing.T) {
+	handler, baseDir := newLFSTestServer(t)
+	defer os.RemoveAll(baseDir)
+
+	w := httptest.NewRecorder()
+	body := `{"operation":"upload","objects":[]}`
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/repo/ns/repo/info/lfs/objects/batch", strings.NewReader(body)))
+	assert.New(t).Equal(http.StatusForbidden, w.Code)
+}
+
+func TestLFSDownload(t *testing.T) {
+	handler, baseDir := newLFSTestServer(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/repo/ns/repo/info/lfs/objects/"+testLFSObjectID, nil))
+	assertions.Equal(http.StatusOK, w.Code)
+	assertions.Equal("binary", w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/repo/ns/repo/info/lfs/objects/"+strings.Repeat("0", 64), nil))
+	assertions.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestLFSRequiresLFSMirror(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/repo/ns/repo/info/lfs/objects/"+testLFSObjectID, nil))
+	assert.New(t).Equal(http.StatusNotFound, w.Code)
+}
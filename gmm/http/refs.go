@@ -0,0 +1,93 @@
+package http
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultPerPage is the number of commits in a page of a log, unless asked otherwise
+	defaultPerPage = 30
+	// maxPerPage is the most commits in a page of a log
+	maxPerPage = 100
+)
+
+// getRefs lists the branches and tags of a mirror, selected and ordered by the "type", "match", "semver",
+// "contains", "sort" and "limit" parameters, see git.RefQuery
+func (s *Server) getRefs(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	limit, err := s.intParameter(r, "limit", 0)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	refs, err := mirror.Refs(&git.RefQuery{
+		Type:     query.Get("type"),
+		Match:    query.Get("match"),
+		Semver:   query.Get("semver"),
+		Contains: query.Get("contains"),
+		Sort:     query.Get("sort"),
+		Limit:    limit,
+	})
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	mirror.RecordAccess()
+	s.writeJSON(w, refs)
+}
+
+// getLog lists a page of the commits reachable from a ref or commit of a mirror, committed after the "since"
+// parameter if given. Pages are selected by the "page" and "perPage" parameters.
+func (s *Server) getLog(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	since, err := s.timeParameter(r, "since")
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	page, err := s.intParameter(r, "page", 1)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	perPage, err := s.intParameter(r, "perPage", defaultPerPage)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	logPage, err := mirror.Log(mux.Vars(r)["ref"], since, page, perPage)
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	mirror.RecordAccess()
+	s.writeJSON(w, logPage)
+}
+
+func (s *Server) intParameter(r *http.Request, name string, fallback int) (int, gmm.ApplicationError) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return 0, gmm.NewError("parameter '"+name+"' is not a positive number: "+value, gmm.ErrUser)
+	}
+	return parsed, nil
+}
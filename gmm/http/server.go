@@ -2,24 +2,48 @@ package http
 
 import (
 	"bufio"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/credentials"
+	"github.com/kleijnweb/git-mirror-manager/gmm/discovery"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
 	"github.com/kleijnweb/git-mirror-manager/gmm/manager"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Server handles request/responses and delegates to the manager
 type Server struct {
-	manager *manager.Manager
-	addr    string
+	manager     *manager.Manager
+	credentials credentials.Vault
+	events      *events.Bus
+	history     *events.History
+	reconciler  *manager.Reconciler
+	discoverer  *manager.Discoverer
+	archives    *git.ArchiveCache
+	maxBlobSize int64
+	maxBundle   int64
+	baseDir     string
+	adminToken  string
+	connections *connections
+	addr        string
+	// updating holds the names of mirrors with an update requested through the API pending or running
+	updating      map[string]bool
+	updatingMutex sync.Mutex
 }
 
-// NewServer creates a new Server
-func NewServer(manager *manager.Manager) *Server {
-	return &Server{manager: manager}
+// NewServer creates a new Server, keeping the latest events published on bus to replay them to event streams
+func NewServer(manager *manager.Manager, credentials credentials.Vault, bus *events.Bus) *Server {
+	history := events.NewHistory(historySize)
+	bus.Subscribe(history)
+	return &Server{manager: manager, credentials: credentials, events: bus, history: history, connections: newConnections(), updating: map[string]bool{}}
 }
 
 // Start initializes the server and makes it listen for connections
@@ -30,10 +54,49 @@ func (s *Server) Start(config *gmm.Config) {
 		s.handleStartupError(err)
 	}
 
+	if err := s.credentials.Load(); err != nil {
+		s.handleStartupError(err)
+	}
+
 	if err := s.manager.LoadFromDisk(config.MirrorBaseDir); err != nil {
 		s.handleStartupError(err)
 	}
 
+	if s.reconciler != nil {
+		if _, err := s.reconciler.Reconcile(); err != nil {
+			s.handleStartupError(err)
+		}
+		reconcileCron, err := manager.CreateReconcileCron(s.reconciler, config.MirrorsFileInterval)
+		if err != nil {
+			s.handleStartupError(err)
+		}
+		if reconcileCron != nil {
+			reconcileCron.Start()
+		}
+	}
+
+	if s.discoverer != nil {
+		// Forges being unavailable should not prevent serving the mirrors already known
+		if _, err := s.discoverer.Sync(); err != nil {
+			log.Error(err)
+		}
+		discoveryCron, err := manager.CreateDiscoveryCron(s.discoverer, config.DiscoveryInterval)
+		if err != nil {
+			s.handleStartupError(err)
+		}
+		if discoveryCron != nil {
+			discoveryCron.Start()
+		}
+	}
+
+	evictionCron, err := manager.CreateEvictionCron(s.manager, config.EvictionInterval)
+	if err != nil {
+		s.handleStartupError(err)
+	}
+	if evictionCron != nil {
+		evictionCron.Start()
+	}
+
 	if err := srv.ListenAndServe(); err != nil {
 		s.handleStartupError(gmm.NewErrorUsingError(err, gmm.ErrNet))
 	}
@@ -46,18 +109,117 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// authMiddleware requires requests changing anything to present the admin token as bearer token, when configured
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" || r.Method == "GET" || r.Method == "HEAD" || s.isReadOnly(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if !strings.HasPrefix(header, "Bearer ") || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			log.Printf("Rejected unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isReadOnly tells whether a request that is not a GET only reads, as Git LFS clients post to list objects
+func (s *Server) isReadOnly(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	template, err := route.GetPathTemplate()
+	return err == nil && template == lfsBatchPath
+}
+
 func (s *Server) configure(config *gmm.Config) (*http.Server, gmm.ApplicationError) {
+	if config.MirrorsFile != "" {
+		s.reconciler = manager.NewReconciler(s.manager, config.MirrorsFile)
+	}
+	if config.DiscoveryFile != "" {
+		s.discoverer = manager.NewDiscoverer(s.manager, discovery.NewClient(s.credentials.Token), config.DiscoveryFile)
+	}
+
+	if config.ArchiveCacheDir != "" {
+		size, err := gmm.ParseSize(config.ArchiveCacheSize)
+		if err != nil {
+			return nil, err
+		}
+		if s.archives, err = git.NewArchiveCache(config.ArchiveCacheDir, size); err != nil {
+			return nil, err
+		}
+	}
+
+	maxBlobSize, err := gmm.ParseSize(config.MaxBlobSize)
+	if err != nil {
+		return nil, err
+	}
+	s.maxBlobSize = maxBlobSize
+	if s.maxBundle, err = gmm.ParseSize(config.MaxBundleSize); err != nil {
+		return nil, err
+	}
+	s.baseDir = config.MirrorBaseDir
+	s.adminToken = config.AdminToken
+
 	router := mux.NewRouter()
+	router.HandleFunc("/", s.getUI).Methods("GET")
+	router.HandleFunc("/ui/{asset}", s.getUI).Methods("GET")
 	router.HandleFunc("/ping", s.ping).Methods("GET")
+	router.HandleFunc("/repo", s.listMirrors).Methods("GET")
 	router.HandleFunc("/repo", s.createMirror).Methods("POST")
+	router.HandleFunc("/repo/{namespace}/{name}", s.getMirror).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}", s.configureMirror).Methods("PUT")
 	router.HandleFunc("/repo/{namespace}/{name}", s.deleteMirror).Methods("DELETE")
+	router.HandleFunc(lfsBatchPath, s.lfsBatch).Methods("POST")
+	router.HandleFunc("/repo/{namespace}/{name}/info/lfs/objects/{oid}", s.connections.withoutWriteTimeout(s.lfsDownload)).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}/access", s.recordAccess).Methods("POST")
+	router.HandleFunc("/repo/{namespace}/{name}/update", s.updateMirror).Methods("POST")
+	router.HandleFunc("/repo/{namespace}/{name}/history", s.getRefHistory).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}/force-pushes", s.getForcePushes).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}/preserved", s.listPreservedRefs).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}/preserved/restore", s.restorePreservedRef).Methods("POST")
+	router.HandleFunc("/repo/{namespace}/{name}/bundles", s.listBundles).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}/bundles", s.createBundle).Methods("POST")
+	router.HandleFunc("/repo/{namespace}/{name}/bundles/{id}", s.connections.withoutWriteTimeout(s.downloadBundle)).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}/bundles/{id}", s.removeBundle).Methods("DELETE")
+	router.HandleFunc("/repo/{namespace}/{name}/dist", s.getDists).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}/dist", s.createDist).Methods("POST")
+	router.HandleFunc("/repo/{namespace}/{name}/dist/{file}", s.connections.withoutWriteTimeout(s.downloadDist)).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}/refs", s.getRefs).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}/log/{ref:.+}", s.getLog).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}/tree/{path:.+}", s.getTree).Methods("GET")
+	router.HandleFunc("/repo/{namespace}/{name}/blob/{path:.+}", s.getBlob).Methods("GET")
+	router.HandleFunc("/archive/{namespace}/{name}/{ref:.+}", s.connections.withoutWriteTimeout(s.getArchive)).Methods("GET")
+	router.HandleFunc("/import", s.connections.withoutTimeouts(s.importBundle)).Methods("POST")
+	router.HandleFunc("/force-pushes", s.getAllForcePushes).Methods("GET")
+	router.HandleFunc("/usage", s.getUsage).Methods("GET")
+	router.HandleFunc("/events", s.connections.withoutWriteTimeout(s.streamEvents)).Methods("GET")
+	router.HandleFunc("/eviction", s.getEviction).Methods("GET")
+	router.HandleFunc("/plan", s.getPlan).Methods("GET")
+	router.HandleFunc("/reconcile", s.reconcile).Methods("POST")
+	router.HandleFunc("/discovery", s.planDiscovery).Methods("GET")
+	router.HandleFunc("/discovery", s.syncDiscovery).Methods("POST")
+	router.HandleFunc("/credentials", s.listCredentials).Methods("GET")
+	router.HandleFunc("/credentials", s.addCredential).Methods("POST")
+	router.HandleFunc("/credentials/{name}", s.removeCredential).Methods("DELETE")
+	router.HandleFunc("/known_hosts", s.addKnownHosts).Methods("POST")
 	router.Use(s.loggingMiddleware)
+	router.Use(s.authMiddleware)
 
+	// Event streams and downloads of LFS objects, bundles, dists and archives lift the write timeout
 	srv := &http.Server{
 		Handler:      router,
 		Addr:         config.ManagerAddr,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+		ConnState:    s.connections.track,
 	}
 
 	log.Println("Listening on " + config.ManagerAddr)
@@ -70,10 +232,19 @@ func (s *Server) ping(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "pong\n")
 }
 
+func (s *Server) listMirrors(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, s.manager.List())
+}
+
 func (s *Server) createMirror(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		s.createMirrorsFromJSON(w, r)
+		return
+	}
+
 	scanner := bufio.NewScanner(r.Body)
 	for scanner.Scan() {
-		if err := s.manager.AddByURI(scanner.Text()); err != nil {
+		if err := s.manager.AddByURI(scanner.Text(), nil); err != nil {
 			s.handleServingError(w, err)
 		}
 	}
@@ -83,10 +254,164 @@ func (s *Server) createMirror(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) createMirrorsFromJSON(w http.ResponseWriter, r *http.Request) {
+	var requests []struct {
+		URI     string       `json:"uri"`
+		Options *git.Options `json:"options"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requests); err != nil {
+		s.handleServingError(w, gmm.NewError("failed decoding request body: "+err.Error(), gmm.ErrUser))
+		return
+	}
+	for _, request := range requests {
+		if err := s.manager.AddByURI(request.URI, request.Options); err != nil {
+			s.handleServingError(w, err)
+			return
+		}
+	}
+}
+
+func (s *Server) getMirror(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, mirror)
+}
+
+func (s *Server) configureMirror(w http.ResponseWriter, r *http.Request) {
+	options := &git.Options{}
+	if err := json.NewDecoder(r.Body).Decode(options); err != nil {
+		s.handleServingError(w, gmm.NewError("failed decoding options: "+err.Error(), gmm.ErrUser))
+		return
+	}
+	if err := s.manager.Configure(s.mirrorName(r), options); err != nil {
+		s.handleServingError(w, err)
+	}
+}
+
 func (s *Server) deleteMirror(w http.ResponseWriter, r *http.Request) {
-	name := mux.Vars(r)["namespace"] + "/" + mux.Vars(r)["name"]
-	if err := s.manager.RemoveByName(name); err != nil {
+	if err := s.manager.RemoveByName(s.mirrorName(r)); err != nil {
+		s.handleServingError(w, err)
+	}
+}
+
+func (s *Server) recordAccess(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	mirror.RecordAccess()
+}
+
+// updateMirror starts updating a mirror from its upstreams, the outcome is recorded in its status.
+// Requests made while an update of the mirror is pending or running are accepted without starting another.
+func (s *Server) updateMirror(w http.ResponseWriter, r *http.Request) {
+	mirror, err := s.manager.Get(s.mirrorName(r))
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.startUpdate(mirror.Name, func() {
+		if err := mirror.Update(); err != nil {
+			log.Error(err)
+		}
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// startUpdate runs update in the background, unless an update of the named mirror is pending or running already
+func (s *Server) startUpdate(name string, update func()) bool {
+	s.updatingMutex.Lock()
+	defer s.updatingMutex.Unlock()
+	if s.updating[name] {
+		return false
+	}
+	s.updating[name] = true
+	go func() {
+		defer func() {
+			s.updatingMutex.Lock()
+			delete(s.updating, name)
+			s.updatingMutex.Unlock()
+		}()
+		update()
+	}()
+	return true
+}
+
+// getEviction reports the mirrors the eviction policy would evict now
+func (s *Server) getEviction(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, s.manager.Evict(true))
+}
+
+// getPlan reports the changes reconciling the mirrors with the mirrors file would make
+func (s *Server) getPlan(w http.ResponseWriter, r *http.Request) {
+	if s.reconciler == nil {
+		s.handleServingError(w, gmm.NewError("no mirrors file configured", gmm.ErrNotFound))
+		return
+	}
+	changes, err := s.reconciler.Plan()
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, changes)
+}
+
+func (s *Server) reconcile(w http.ResponseWriter, r *http.Request) {
+	if s.reconciler == nil {
+		s.handleServingError(w, gmm.NewError("no mirrors file configured", gmm.ErrNotFound))
+		return
+	}
+	changes, err := s.reconciler.Reconcile()
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, changes)
+}
+
+// planDiscovery reports the changes syncing the mirrors with the discovery sources would make
+func (s *Server) planDiscovery(w http.ResponseWriter, r *http.Request) {
+	if s.discoverer == nil {
+		s.handleServingError(w, gmm.NewError("no discovery file configured", gmm.ErrNotFound))
+		return
+	}
+	changes, err := s.discoverer.Plan()
+	if err != nil {
 		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, changes)
+}
+
+func (s *Server) syncDiscovery(w http.ResponseWriter, r *http.Request) {
+	if s.discoverer == nil {
+		s.handleServingError(w, gmm.NewError("no discovery file configured", gmm.ErrNotFound))
+		return
+	}
+	changes, err := s.discoverer.Sync()
+	if err != nil {
+		s.handleServingError(w, err)
+		return
+	}
+	s.writeJSON(w, changes)
+}
+
+func (s *Server) getUsage(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, s.manager.Usage())
+}
+
+func (s *Server) mirrorName(r *http.Request) string {
+	return mux.Vars(r)["namespace"] + "/" + mux.Vars(r)["name"]
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Error(err)
 	}
 }
 
@@ -95,6 +420,10 @@ func (s *Server) handleServingError(w http.ResponseWriter, err gmm.ApplicationEr
 		w.WriteHeader(http.StatusBadRequest)
 	} else if err.Code() == gmm.ErrNotFound {
 		w.WriteHeader(http.StatusNotFound)
+	} else if err.Code() == gmm.ErrQuota || err.Code() == gmm.ErrDiskSpace {
+		w.WriteHeader(http.StatusInsufficientStorage)
+	} else if err.Code() == gmm.ErrConflict {
+		w.WriteHeader(http.StatusConflict)
 	} else {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
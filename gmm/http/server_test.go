@@ -0,0 +1,407 @@
+package http
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/gmm/manager"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer() (http.Handler, *mocks.Vault) {
+	return newConfiguredTestServer(&gmm.Config{})
+}
+
+func newConfiguredTestServer(config *gmm.Config) (http.Handler, *mocks.Vault) {
+	vault := &mocks.Vault{}
+	policyMock := &mocks.Policy{}
+	policyMock.On("Assert", mock.Anything).Return(nil)
+	m := manager.NewManager(
+		func(uri string, options *git.Options) (*git.Mirror, gmm.ApplicationError) {
+			return nil, gmm.NewError("unreachable upstream", gmm.ErrGitCommand)
+		},
+		&mocks.CommandRunner{},
+		&mocks.FileSystemUtil{},
+		policyMock,
+		nil,
+		nil,
+		nil,
+	)
+	server := NewServer(m, vault, events.NewBus())
+	router, _ := server.configure(config)
+	return router.Handler, vault
+}
+
+func TestPing(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ping", nil))
+	assert.New(t).Equal("pong\n", w.Body.String())
+}
+
+func TestListMirrors(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/repo", nil))
+	assertions := assert.New(t)
+	assertions.Equal(http.StatusOK, w.Code)
+	assertions.Equal("[]\n", w.Body.String())
+}
+
+func TestGetUnknownMirror(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/repo/ns/name", nil))
+	assert.New(t).Equal(http.StatusNotFound, w.Code)
+}
+
+func TestCreateMirrorsFromInvalidJSON(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/repo", strings.NewReader(`{"uri": "https://github.com/ns/name"}`))
+	r.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(w, r)
+	assert.New(t).Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestCreateMirrorsFromJSONReportsFailure(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	body := `[{"uri": "https://github.com/ns/name", "options": {"pushTargets": ["https://gitea.example.com/ns/name"]}}]`
+	r := httptest.NewRequest("POST", "/repo", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(w, r)
+	assert.New(t).Equal(http.StatusInternalServerError, w.Code)
+}
+
+func TestRecordAccessOfUnknownMirror(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/repo/ns/name/access", nil))
+	assert.New(t).Equal(http.StatusNotFound, w.Code)
+}
+
+func TestGetEviction(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/eviction", nil))
+	assertions := assert.New(t)
+	assertions.Equal(http.StatusOK, w.Code)
+	assertions.Equal("[]\n", w.Body.String())
+}
+
+func TestPlanRequiresMirrorsFile(t *testing.T) {
+	handler, _ := newTestServer()
+	assertions := assert.New(t)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/plan", nil))
+	assertions.Equal(http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/reconcile", nil))
+	assertions.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestDiscoveryRequiresDiscoveryFile(t *testing.T) {
+	handler, _ := newTestServer()
+	assertions := assert.New(t)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/discovery", nil))
+	assertions.Equal(http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/discovery", nil))
+	assertions.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestListForcePushes(t *testing.T) {
+	handler, _ := newTestServer()
+	assertions := assert.New(t)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/force-pushes?since=2020-01-02T03:04:05Z", nil))
+	assertions.Equal(http.StatusOK, w.Code)
+	assertions.Equal("[]\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/force-pushes?since=yesterday", nil))
+	assertions.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestRefHistoryOfUnknownMirror(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/repo/ns/name/history", nil))
+	assert.New(t).Equal(http.StatusNotFound, w.Code)
+}
+
+func TestRestorePreservedRefOfUnknownMirror(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/repo/ns/name/preserved/restore", strings.NewReader(`{"ref": "refs/gmm/preserved/x"}`)))
+	assert.New(t).Equal(http.StatusNotFound, w.Code)
+}
+
+func TestBundlesOfUnknownMirror(t *testing.T) {
+	handler, _ := newTestServer()
+	assertions := assert.New(t)
+	for _, request := range []*http.Request{
+		httptest.NewRequest("GET", "/repo/ns/name/bundles", nil),
+		httptest.NewRequest("POST", "/repo/ns/name/bundles", nil),
+		httptest.NewRequest("GET", "/repo/ns/name/bundles/20240102T030405.000Z", nil),
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+		assertions.Equal(http.StatusNotFound, w.Code, request.URL.Path)
+	}
+}
+
+func TestImportBundleVerifiesChecksum(t *testing.T) {
+	handler, _ := newConfiguredTestServer(&gmm.Config{MaxBundleSize: "1K"})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/import?uri=https://example.com/ns/name&sha256=abc", strings.NewReader("bundle")))
+	assertions := assert.New(t)
+	assertions.Equal(http.StatusBadRequest, w.Code)
+
+	// The checksum of "bundle" matches, so the mirror factory gets to fail
+	w = httptest.NewRecorder()
+	checksum := "1e6ed65d77d6364eeaed5a745ba5c4985ae2b700dd85d7cf7f027bdf294a33fc"
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/import?uri=https://example.com/ns/name&sha256="+checksum, strings.NewReader("bundle")))
+	assertions.Equal(http.StatusInternalServerError, w.Code)
+}
+
+func TestImportBundleRejectsLargeBundles(t *testing.T) {
+	handler, _ := newConfiguredTestServer(&gmm.Config{MaxBundleSize: "1K"})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/import?uri=https://example.com/ns/name", strings.NewReader(strings.Repeat("b", 1025))))
+	assert.New(t).Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestDistsOfUnknownMirror(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/repo/ns/name/dist/name-v1.zip", nil))
+	assert.New(t).Equal(http.StatusNotFound, w.Code)
+}
+
+func TestArchiveOfUnknownMirror(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/archive/ns/name/feature/x.tar.gz", nil))
+	assert.New(t).Equal(http.StatusNotFound, w.Code)
+}
+
+func TestSplitArchiveFormat(t *testing.T) {
+	assertions := assert.New(t)
+	for name, expected := range map[string][2]string{
+		"v1.2.tar.gz":    {"v1.2", "tar.gz"},
+		"feature/x.zip":  {"feature/x", "zip"},
+		"abc123.tar.zst": {"abc123", "tar.zst"},
+		"v1.2.tar.bz2":   {"v1.2.tar.bz2", ""},
+	} {
+		revision, format := splitArchiveFormat(name)
+		assertions.Equal(expected, [2]string{revision, format}, name)
+	}
+}
+
+func TestBrowseUnknownMirror(t *testing.T) {
+	handler, _ := newTestServer()
+	assertions := assert.New(t)
+	for _, url := range []string{"/repo/ns/name/tree/main/src", "/repo/ns/name/blob/main/go.mod"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		assertions.Equal(http.StatusNotFound, w.Code, url)
+	}
+}
+
+func TestRefsAndLogOfUnknownMirror(t *testing.T) {
+	handler, _ := newTestServer()
+	assertions := assert.New(t)
+	for _, url := range []string{"/repo/ns/name/refs?type=tag&sort=semver", "/repo/ns/name/log/feature/x?page=2"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		assertions.Equal(http.StatusNotFound, w.Code, url)
+	}
+}
+
+func TestServingRefsRecordsAccess(t *testing.T) {
+	baseDir, err := ioutil.TempDir(os.TempDir(), "refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	cmd := &mocks.CommandRunner{}
+	cmd.On("SetConfig", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	cmd.On("DescribeRefs", baseDir+"/ns/repo", "").Return("", nil)
+	handler := newMirrorTestServer(t, baseDir, cmd, &git.Options{})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/repo/ns/repo/refs", nil))
+	assert.New(t).Equal(http.StatusOK, w.Code)
+	cmd.AssertCalled(t, "SetConfig", baseDir+"/ns/repo", "gmm.lastAccess", mock.Anything)
+}
+
+func TestUpdateUnknownMirror(t *testing.T) {
+	handler, _ := newTestServer()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/repo/ns/name/update", nil))
+	assert.New(t).Equal(http.StatusNotFound, w.Code)
+}
+
+func TestStartUpdateCoalescesUpdates(t *testing.T) {
+	server := NewServer(nil, &mocks.Vault{}, events.NewBus())
+	assertions := assert.New(t)
+	release := make(chan struct{})
+	done := make(chan struct{})
+	assertions.True(server.startUpdate("ns/repo", func() {
+		<-release
+		close(done)
+	}))
+	assertions.False(server.startUpdate("ns/repo", func() { t.Error("unexpected concurrent update") }))
+	other := make(chan struct{})
+	assertions.True(server.startUpdate("ns/other", func() { close(other) }))
+	<-other
+
+	// Once the update completed, the next one is started
+	close(release)
+	<-done
+	started := false
+	for i := 0; i < 100 && !started; i++ {
+		started = server.startUpdate("ns/repo", func() {})
+		time.Sleep(time.Millisecond)
+	}
+	assertions.True(started)
+}
+
+func TestServeUI(t *testing.T) {
+	handler, _ := newTestServer()
+	assertions := assert.New(t)
+	for url, contentType := range map[string]string{
+		"/":             "text/html; charset=utf-8",
+		"/ui/app.js":    "application/javascript; charset=utf-8",
+		"/ui/style.css": "text/css; charset=utf-8",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		assertions.Equal(http.StatusOK, w.Code, url)
+		assertions.Equal(contentType, w.Header().Get("Content-Type"), url)
+		assertions.NotEmpty(w.Body.String(), url)
+
+		cached := httptest.NewRequest("GET", url, nil)
+		cached.Header.Set("If-None-Match", w.Header().Get("ETag"))
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, cached)
+		assertions.Equal(http.StatusNotModified, w.Code, url)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ui/missing.js", nil))
+	assertions.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestAdminTokenRequiredForChanges(t *testing.T) {
+	handler, _ := newConfiguredTestServer(&gmm.Config{AdminToken: "s3cret"})
+	assertions := assert.New(t)
+	request := func(method string, url string, authorization string) int {
+		r := httptest.NewRequest(method, url, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assertions.Equal(http.StatusUnauthorized, request("POST", "/repo/ns/name/update", ""))
+	assertions.Equal(http.StatusUnauthorized, request("DELETE", "/repo/ns/name", "Bearer wrong"))
+	assertions.Equal(http.StatusUnauthorized, request("DELETE", "/repo/ns/name", "s3cret"))
+	assertions.Equal(http.StatusUnauthorized, request("DELETE", "/repo/ns/name", "Basic s3cret"))
+	assertions.Equal(http.StatusNotFound, request("POST", "/repo/ns/name/update", "Bearer s3cret"))
+	assertions.Equal(http.StatusNotFound, request("DELETE", "/repo/ns/name", "Bearer s3cret"))
+	assertions.Equal(http.StatusOK, request("GET", "/repo", ""))
+	assertions.Equal(http.StatusOK, request("GET", "/", ""))
+	// Listing LFS objects only reads, though it is a POST
+	assertions.NotEqual(http.StatusUnauthorized, request("POST", "/repo/ns/name/info/lfs/objects/batch", ""))
+}
+
+func TestWithoutWriteTimeout(t *testing.T) {
+	connections := newConnections()
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/slow", slow)
+	router.HandleFunc("/stream", connections.withoutWriteTimeout(slow))
+	server := httptest.NewUnstartedServer(router)
+	server.Config.WriteTimeout = 20 * time.Millisecond
+	server.Config.ConnState = connections.track
+	server.Start()
+	defer server.Close()
+	assertions := assert.New(t)
+
+	_, err := http.Get(server.URL + "/slow")
+	assertions.NotNil(err)
+
+	response, err := http.Get(server.URL + "/stream")
+	if assertions.Nil(err) {
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assertions.Equal("done", string(body))
+	}
+}
+
+func TestWithoutTimeouts(t *testing.T) {
+	connections := newConnections()
+	upload := func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(body)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/limited", upload)
+	router.HandleFunc("/upload", connections.withoutTimeouts(upload))
+	server := httptest.NewUnstartedServer(router)
+	server.Config.ReadTimeout = 50 * time.Millisecond
+	server.Config.ConnState = connections.track
+	server.Start()
+	defer server.Close()
+	assertions := assert.New(t)
+
+	post := func(path string) (int, string) {
+		body, writer := io.Pipe()
+		go func() {
+			writer.Write([]byte("slow "))
+			time.Sleep(150 * time.Millisecond)
+			writer.Write([]byte("body"))
+			writer.Close()
+		}()
+		response, err := http.Post(server.URL+path, "application/octet-stream", body)
+		if err != nil {
+			return 0, ""
+		}
+		defer response.Body.Close()
+		content, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(content)
+	}
+	status, _ := post("/limited")
+	assertions.NotEqual(http.StatusOK, status)
+	status, content := post("/upload")
+	assertions.Equal(http.StatusOK, status)
+	assertions.Equal("slow body", content)
+}
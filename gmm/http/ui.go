@@ -0,0 +1,50 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gorilla/mux"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// uiAsset is a file of the web UI, compiled into the binary so that it is served without any external resources
+type uiAsset struct {
+	contentType string
+	content     string
+	etag        string
+}
+
+func newUIAsset(contentType string, content string) *uiAsset {
+	sum := sha256.Sum256([]byte(content))
+	return &uiAsset{contentType: contentType, content: content, etag: `"` + hex.EncodeToString(sum[:8]) + `"`}
+}
+
+// uiAssets are the files of the web UI by name
+var uiAssets = map[string]*uiAsset{
+	"index.html": newUIAsset("text/html; charset=utf-8", uiIndex),
+	"app.js":     newUIAsset("application/javascript; charset=utf-8", uiScript),
+	"style.css":  newUIAsset("text/css; charset=utf-8", uiStyle),
+}
+
+// getUI serves the web UI, its page at "/" and the files it loads at "/ui/{asset}"
+func (s *Server) getUI(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["asset"]
+	if name == "" {
+		name = "index.html"
+	}
+	asset, ok := uiAssets[name]
+	if !ok {
+		s.handleServingError(w, gmm.NewError("no such file '"+name+"'", gmm.ErrNotFound))
+		return
+	}
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("ETag", asset.etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// The UI only loads its own files and talks to this API, and may not be framed by other sites
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'; form-action 'self'")
+	http.ServeContent(w, r, name, time.Time{}, strings.NewReader(asset.content))
+}
@@ -0,0 +1,431 @@
+package http
+
+// uiIndex is the page of the web UI
+const uiIndex = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Git Mirror Manager</title>
+<link rel="stylesheet" href="/ui/style.css">
+<script src="/ui/app.js" defer></script>
+</head>
+<body>
+<header>
+  <h1>Git Mirror Manager</h1>
+  <form id="token-form">
+    <input id="token" type="password" placeholder="Admin token" autocomplete="off" aria-label="Admin token">
+    <button type="submit">Use token</button>
+  </form>
+</header>
+<main>
+  <p id="message" role="status" hidden></p>
+  <section>
+    <div class="toolbar">
+      <input id="filter" type="search" placeholder="Filter mirrors" aria-label="Filter mirrors">
+      <span id="summary"></span>
+      <button id="refresh" type="button">Refresh</button>
+    </div>
+    <table id="mirrors">
+      <thead>
+        <tr><th>Mirror</th><th>State</th><th>Last fetch</th><th>Disk usage</th><th></th></tr>
+      </thead>
+      <tbody></tbody>
+    </table>
+  </section>
+  <section id="details" hidden>
+    <h2 id="details-name"></h2>
+    <dl id="details-fields"></dl>
+    <h3>Options</h3>
+    <pre id="details-options"></pre>
+    <div class="actions">
+      <button id="details-update" type="button">Update now</button>
+      <button id="details-resume" type="button">Resume</button>
+      <button id="details-remove" type="button" class="danger">Remove</button>
+      <button id="details-close" type="button">Close</button>
+    </div>
+  </section>
+  <section>
+    <h2>Add mirrors</h2>
+    <form id="add-form">
+      <textarea id="uris" rows="3" required aria-label="Upstream URIs"
+        placeholder="One upstream URI per line, eg. https://github.com/some/repo-name.git"></textarea>
+      <button type="submit">Add</button>
+    </form>
+  </section>
+</main>
+</body>
+</html>
+`
+
+// uiStyle is the style sheet of the web UI
+const uiStyle = `* { box-sizing: border-box; }
+body { margin: 0; font: 14px/1.4 system-ui, -apple-system, "Segoe UI", sans-serif; color: #1f2328; background: #f6f8fa; }
+header { display: flex; align-items: center; justify-content: space-between; gap: 1em; padding: .75em 1.5em; background: #24292f; color: #fff; }
+header h1 { margin: 0; font-size: 1.2em; }
+main { max-width: 1100px; margin: 0 auto; padding: 1em 1.5em; }
+section { background: #fff; border: 1px solid #d0d7de; border-radius: 6px; padding: 1em; margin-bottom: 1em; }
+h2 { margin-top: 0; font-size: 1.1em; }
+h3 { font-size: 1em; }
+input, textarea, button { font: inherit; }
+input, textarea { padding: .3em .5em; border: 1px solid #d0d7de; border-radius: 4px; }
+textarea { width: 100%; margin-bottom: .5em; }
+button { padding: .3em .8em; border: 1px solid #d0d7de; border-radius: 4px; background: #f6f8fa; cursor: pointer; }
+button:hover { background: #eaeef2; }
+button.danger { color: #cf222e; }
+.toolbar { display: flex; align-items: center; gap: 1em; margin-bottom: .5em; }
+.toolbar input { flex: 1; }
+table { width: 100%; border-collapse: collapse; }
+th, td { text-align: left; padding: .4em .5em; border-bottom: 1px solid #d0d7de; }
+td:last-child { text-align: right; white-space: nowrap; }
+a { color: #0969da; text-decoration: none; cursor: pointer; }
+.state { display: inline-block; padding: 0 .5em; border-radius: 1em; font-size: .85em; }
+.state-ok { background: #dafbe1; color: #116329; }
+.state-cloning, .state-suspended { background: #eaeef2; color: #57606a; }
+.state-push-failing { background: #fff8c5; color: #7d4e00; }
+.state-failing, .state-corrupt { background: #ffebe9; color: #cf222e; }
+.error { color: #cf222e; white-space: pre-wrap; }
+dl { display: grid; grid-template-columns: max-content 1fr; gap: .3em 1em; }
+dt { color: #57606a; }
+dd { margin: 0; word-break: break-all; }
+pre { background: #f6f8fa; padding: .5em; overflow: auto; }
+.actions { display: flex; gap: .5em; }
+#message { padding: .5em 1em; border-radius: 6px; background: #ddf4ff; }
+#message.failure { background: #ffebe9; color: #cf222e; }
+`
+
+// uiScript is the script of the web UI, which uses the API of the manager
+const uiScript = `(function () {
+  'use strict';
+
+  var tokenKey = 'gmm.adminToken';
+  var mirrors = [];
+  var selected = null;
+
+  function $(id) {
+    return document.getElementById(id);
+  }
+
+  function element(tag, text, className) {
+    var node = document.createElement(tag);
+    if (text !== undefined && text !== null) {
+      node.textContent = text;
+    }
+    if (className) {
+      node.className = className;
+    }
+    return node;
+  }
+
+  function mirrorURL(name) {
+    return '/repo/' + name.split('/').map(encodeURIComponent).join('/');
+  }
+
+  function request(method, url, body, contentType) {
+    var headers = {};
+    var token = sessionStorage.getItem(tokenKey);
+    if (token) {
+      headers['Authorization'] = 'Bearer ' + token;
+    }
+    if (contentType) {
+      headers['Content-Type'] = contentType;
+    }
+    return fetch(url, {method: method, headers: headers, body: body, credentials: 'same-origin'}).then(function (response) {
+      if (response.status === 401) {
+        throw new Error('Not authorised, enter the admin token');
+      }
+      if (!response.ok) {
+        throw new Error(method + ' ' + url + ' failed with status ' + response.status);
+      }
+      return response;
+    });
+  }
+
+  function notify(text, failure) {
+    var message = $('message');
+    message.textContent = text;
+    message.className = failure ? 'failure' : '';
+    message.hidden = !text;
+  }
+
+  function fail(error) {
+    notify(error.message, true);
+  }
+
+  function formatBytes(bytes) {
+    var units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+    var i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+      bytes /= 1024;
+      i++;
+    }
+    return (i === 0 ? bytes : bytes.toFixed(1)) + ' ' + units[i];
+  }
+
+  function formatAge(time) {
+    if (!time) {
+      return 'never';
+    }
+    var seconds = Math.max(0, Math.round((Date.now() - new Date(time).getTime()) / 1000));
+    var steps = [[86400, 'd'], [3600, 'h'], [60, 'min'], [1, 's']];
+    for (var i = 0; i < steps.length; i++) {
+      if (seconds >= steps[i][0] || steps[i][0] === 1) {
+        return Math.floor(seconds / steps[i][0]) + ' ' + steps[i][1] + ' ago';
+      }
+    }
+  }
+
+  function diskUsage(status) {
+    var usage = status.diskUsage;
+    return usage ? usage.repository + usage.dist + usage.bundles : 0;
+  }
+
+  // state sums up the status of a mirror, the worst condition first
+  function state(mirror) {
+    var status = mirror.status || {};
+    if (status.corrupt) {
+      return 'corrupt';
+    }
+    if (status.lastFetchError) {
+      return 'failing';
+    }
+    if (mirror.options && mirror.options.suspended) {
+      return 'suspended';
+    }
+    if (!status.lastFetch) {
+      return 'cloning';
+    }
+    for (var target in status.push || {}) {
+      if (status.push[target].lastError) {
+        return 'push failing';
+      }
+    }
+    return 'ok';
+  }
+
+  function stateBadge(mirror) {
+    var value = state(mirror);
+    return element('span', value, 'state state-' + value.replace(' ', '-'));
+  }
+
+  function actionButton(text, action, className) {
+    var button = element('button', text, className);
+    button.type = 'button';
+    button.addEventListener('click', function (event) {
+      event.stopPropagation();
+      action();
+    });
+    return button;
+  }
+
+  function renderMirrors() {
+    var filter = $('filter').value.toLowerCase();
+    var body = $('mirrors').tBodies[0];
+    var counts = {};
+    body.textContent = '';
+    mirrors.forEach(function (mirror) {
+      var value = state(mirror);
+      counts[value] = (counts[value] || 0) + 1;
+      if (filter && mirror.name.toLowerCase().indexOf(filter) === -1 && mirror.uri.toLowerCase().indexOf(filter) === -1) {
+        return;
+      }
+      var row = element('tr');
+      var name = element('td');
+      var link = element('a', mirror.name);
+      link.title = mirror.uri;
+      link.addEventListener('click', function () {
+        select(mirror.name);
+      });
+      name.appendChild(link);
+      row.appendChild(name);
+      var badge = element('td');
+      badge.appendChild(stateBadge(mirror));
+      row.appendChild(badge);
+      var fetched = element('td', formatAge(mirror.status.lastFetch));
+      fetched.title = mirror.status.lastFetch || '';
+      row.appendChild(fetched);
+      row.appendChild(element('td', formatBytes(diskUsage(mirror.status))));
+      var actions = element('td');
+      actions.appendChild(actionButton('Update', function () {
+        update(mirror.name);
+      }));
+      actions.appendChild(document.createTextNode(' '));
+      actions.appendChild(actionButton('Remove', function () {
+        remove(mirror.name);
+      }, 'danger'));
+      row.appendChild(actions);
+      body.appendChild(row);
+    });
+    $('summary').textContent = mirrors.length + ' mirrors' + Object.keys(counts).sort().map(function (value) {
+      return ', ' + counts[value] + ' ' + value;
+    }).join('');
+  }
+
+  function field(list, name, value, error) {
+    if (!value && !error) {
+      return;
+    }
+    list.appendChild(element('dt', name));
+    var description = element('dd', value || '');
+    if (error) {
+      description.appendChild(element('div', error, 'error'));
+    }
+    list.appendChild(description);
+  }
+
+  function timeField(list, name, time, error) {
+    field(list, name, time ? time + ' (' + formatAge(time) + ')' : '', error);
+  }
+
+  function renderDetails() {
+    var mirror = mirrors.filter(function (mirror) {
+      return mirror.name === selected;
+    })[0];
+    $('details').hidden = !mirror;
+    if (!mirror) {
+      return;
+    }
+    var status = mirror.status;
+    var list = $('details-fields');
+    list.textContent = '';
+    $('details-name').textContent = mirror.name;
+    field(list, 'Upstream', mirror.uri);
+    field(list, 'Mode', mirror.mode);
+    list.appendChild(element('dt', 'State'));
+    var badge = element('dd');
+    badge.appendChild(stateBadge(mirror));
+    list.appendChild(badge);
+    timeField(list, 'Last fetch', status.lastFetch, status.lastFetchError);
+    field(list, 'Fetched from', status.lastFetchUpstream);
+    field(list, 'Upstream mismatches', (status.upstreamMismatches || []).join(', '));
+    timeField(list, 'Last maintenance', status.lastMaintenance, status.lastMaintenanceError);
+    timeField(list, 'Last integrity check', status.lastFsck, status.lastFsckError);
+    timeField(list, 'Last re-clone', status.lastReclone);
+    if (status.diskUsage) {
+      field(list, 'Disk usage', formatBytes(status.diskUsage.repository) + ' repository, ' +
+        formatBytes(status.diskUsage.dist) + ' archives, ' + formatBytes(status.diskUsage.bundles) + ' bundles');
+    }
+    Object.keys(status.push || {}).sort().forEach(function (target) {
+      var push = status.push[target];
+      field(list, 'Push to ' + target, (push.lastPush ? push.lastPush + ', ' : '') + 'lag ' + push.lagSeconds + ' s', push.lastError);
+    });
+    field(list, 'Submodules', (status.submodules || []).join(', '));
+    $('details-options').textContent = JSON.stringify(mirror.options, null, 2);
+    $('details-resume').hidden = !(mirror.options && mirror.options.suspended);
+  }
+
+  function select(name) {
+    selected = name;
+    renderDetails();
+    $('details').scrollIntoView();
+  }
+
+  function refresh() {
+    return request('GET', '/repo').then(function (response) {
+      return response.json();
+    }).then(function (list) {
+      mirrors = (list || []).sort(function (a, b) {
+        return a.name < b.name ? -1 : a.name > b.name ? 1 : 0;
+      });
+      renderMirrors();
+      renderDetails();
+    }).catch(fail);
+  }
+
+  function update(name) {
+    request('POST', mirrorURL(name) + '/update').then(function () {
+      notify('Updating ' + name + ', the list refreshes when done');
+    }).catch(fail);
+  }
+
+  function resume(name) {
+    request('POST', mirrorURL(name) + '/access').then(function () {
+      notify('Resumed ' + name);
+      return refresh();
+    }).catch(fail);
+  }
+
+  function remove(name) {
+    if (!confirm('Remove the mirror ' + name + ' and all of its data?')) {
+      return;
+    }
+    request('DELETE', mirrorURL(name)).then(function () {
+      notify('Removed ' + name);
+      if (selected === name) {
+        selected = null;
+      }
+      return refresh();
+    }).catch(fail);
+  }
+
+  function add(event) {
+    event.preventDefault();
+    var uris = $('uris').value.split('\n').map(function (uri) {
+      return uri.trim();
+    }).filter(Boolean);
+    if (uris.length === 0) {
+      return;
+    }
+    request('POST', '/repo', uris.join('\n'), 'text/plain').then(function () {
+      $('uris').value = '';
+      notify('Added ' + uris.length + (uris.length === 1 ? ' mirror, it is being cloned' : ' mirrors, they are being cloned'));
+      return refresh();
+    }).catch(fail);
+  }
+
+  function useToken(event) {
+    event.preventDefault();
+    var token = $('token').value;
+    if (token) {
+      sessionStorage.setItem(tokenKey, token);
+    } else {
+      sessionStorage.removeItem(tokenKey);
+    }
+    $('token').value = '';
+    $('token').placeholder = token ? 'Admin token set' : 'Admin token';
+    notify(token ? 'Using the admin token for changes' : 'No longer using an admin token');
+  }
+
+  // listen refreshes the mirrors whenever events about them are published
+  function listen() {
+    if (!window.EventSource) {
+      return;
+    }
+    var pending = null;
+    var source = new EventSource('/events');
+    ['mirror.added', 'mirror.removed', 'mirror.updated', 'mirror.update_failed', 'mirror.fetched', 'mirror.clone_finished'].forEach(function (type) {
+      source.addEventListener(type, function () {
+        clearTimeout(pending);
+        pending = setTimeout(refresh, 500);
+      });
+    });
+  }
+
+  document.addEventListener('DOMContentLoaded', function () {
+    if (sessionStorage.getItem(tokenKey)) {
+      $('token').placeholder = 'Admin token set';
+    }
+    $('token-form').addEventListener('submit', useToken);
+    $('add-form').addEventListener('submit', add);
+    $('filter').addEventListener('input', renderMirrors);
+    $('refresh').addEventListener('click', refresh);
+    $('details-update').addEventListener('click', function () {
+      update(selected);
+    });
+    $('details-resume').addEventListener('click', function () {
+      resume(selected);
+    });
+    $('details-remove').addEventListener('click', function () {
+      remove(selected);
+    });
+    $('details-close').addEventListener('click', function () {
+      selected = null;
+      renderDetails();
+    });
+    refresh();
+    listen();
+    // Keeps the ages of fetches current, and the list when events are missed
+    setInterval(refresh, 60000);
+  });
+})();
+`
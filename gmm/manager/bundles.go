@@ -0,0 +1,23 @@
+package manager
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+)
+
+// ImportBundle updates the mirror of uri from a bundle file. When there is no such mirror yet, it is added
+// with options and created from the bundle, see AddByURI, without contacting the upstream.
+func (m *Manager) ImportBundle(uri string, options *git.Options, file string) gmm.ApplicationError {
+	if err := m.policy.Assert(uri); err != nil {
+		return err
+	}
+	if mirror, err := m.Get(git.MirrorNameFromURI(uri)); err == nil {
+		return mirror.ImportBundle(file)
+	}
+	imported := &git.Options{}
+	if options != nil {
+		*imported = *options
+	}
+	imported.FromBundle = file
+	return m.AddByURI(uri, imported)
+}
@@ -0,0 +1,256 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/robfig/cron"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+const (
+	// ChangeAdd adds a declared mirror
+	ChangeAdd = "add"
+	// ChangeConfigure changes the settings of a mirror to the declared ones
+	ChangeConfigure = "configure"
+	// ChangeRemove removes a mirror that is not declared
+	ChangeRemove = "remove"
+)
+
+// Declaration is the desired set of mirrors
+type Declaration struct {
+	// Prune removes mirrors that are not declared, except dependent and discovered mirrors
+	Prune   bool              `json:"prune"`
+	Mirrors []*DeclaredMirror `json:"mirrors"`
+}
+
+// DeclaredMirror is a mirror with its settings
+type DeclaredMirror struct {
+	URI     string       `json:"uri"`
+	Options *git.Options `json:"options"`
+}
+
+// ParseDeclaration reads a Declaration from YAML or JSON, rejecting unknown fields
+func ParseDeclaration(data []byte) (*Declaration, gmm.ApplicationError) {
+	declaration := &Declaration{}
+	if err := decodeDocument(data, declaration); err != nil {
+		return nil, gmm.NewError("invalid mirrors file: "+err.Error(), gmm.ErrUser)
+	}
+	return declaration, nil
+}
+
+// decodeDocument decodes YAML or JSON into value, rejecting unknown fields.
+// Decoding through JSON applies the json tags the API uses as well.
+func decodeDocument(data []byte, value interface{}) error {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	converted, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(converted))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(value)
+}
+
+// Change describes a difference between the declared and the current mirrors
+type Change struct {
+	Action   string       `json:"action"`
+	Name     string       `json:"name"`
+	URI      string       `json:"uri"`
+	Options  *git.Options `json:"options,omitempty"`
+	Previous *git.Options `json:"previous,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// Plan lists the changes needed to reconcile the mirrors with declaration, or fails if it can't be applied.
+// The clone mode and uri of existing mirrors cannot change. Whether a mirror is suspended, the mirrors
+// a dependent mirror is a submodule of and the discovery source that added a mirror are not declared
+// and therefore kept.
+func (m *Manager) Plan(declaration *Declaration) ([]*Change, gmm.ApplicationError) {
+	changes := []*Change{}
+	declared := make(map[string]bool)
+	for _, d := range declaration.Mirrors {
+		if err := m.policy.Assert(d.URI); err != nil {
+			return nil, err
+		}
+		name := git.MirrorNameFromURI(d.URI)
+		if declared[name] {
+			return nil, gmm.NewError("mirror '"+name+"' is declared more than once", gmm.ErrUser)
+		}
+		declared[name] = true
+
+		options := &git.Options{}
+		if d.Options != nil {
+			copied := *d.Options
+			options = &copied
+		}
+		if err := m.assertOptions(options); err != nil {
+			return nil, err
+		}
+
+		mirror, err := m.Get(name)
+		if err != nil {
+			changes = append(changes, &Change{Action: ChangeAdd, Name: name, URI: d.URI, Options: options})
+			continue
+		}
+		if mirror.URI() != d.URI {
+			return nil, gmm.NewError("mirror '"+name+"' is declared with uri '"+d.URI+"' but mirrors '"+mirror.URI()+"'", gmm.ErrUser)
+		}
+		previous := mirror.Options()
+		if previous.Mode() != options.Mode() {
+			return nil, gmm.NewError("clone mode of '"+name+"' cannot be changed, remove and add the mirror instead", gmm.ErrUser)
+		}
+		options.Suspended = previous.Suspended
+		options.SubmoduleOf = previous.SubmoduleOf
+		options.DiscoveredBy = previous.DiscoveredBy
+		if !equalOptions(previous, options) {
+			changes = append(changes, &Change{Action: ChangeConfigure, Name: name, URI: d.URI, Options: options, Previous: previous})
+		}
+	}
+
+	if declaration.Prune {
+		for _, mirror := range m.List() {
+			options := mirror.Options()
+			if !declared[mirror.Name] && len(options.SubmoduleOf) == 0 && options.DiscoveredBy == "" {
+				changes = append(changes, &Change{Action: ChangeRemove, Name: mirror.Name, URI: mirror.URI()})
+			}
+		}
+	}
+	return changes, nil
+}
+
+// Reconcile applies the changes planned for declaration, see apply
+func (m *Manager) Reconcile(declaration *Declaration) ([]*Change, gmm.ApplicationError) {
+	changes, err := m.Plan(declaration)
+	if err != nil {
+		return nil, err
+	}
+	m.apply(changes)
+	return changes, nil
+}
+
+// apply makes changes, removing mirrors first to free up disk space.
+// Changes failing to apply are logged, and the error recorded in the change.
+func (m *Manager) apply(changes []*Change) {
+	for _, action := range []string{ChangeRemove, ChangeAdd, ChangeConfigure} {
+		for _, change := range changes {
+			if change.Action != action {
+				continue
+			}
+			log.Infof("Applying change: %s '%s'", change.Action, change.Name)
+			var err gmm.ApplicationError
+			switch change.Action {
+			case ChangeRemove:
+				err = m.RemoveByName(change.Name)
+			case ChangeAdd:
+				err = m.AddByURI(change.URI, change.Options)
+			case ChangeConfigure:
+				err = m.Configure(change.Name, change.Options)
+			}
+			if err != nil {
+				log.Errorf("Applying change: %s '%s' failed: %s", change.Action, change.Name, err)
+				change.Error = err.Error()
+			}
+		}
+	}
+}
+
+func equalOptions(a *git.Options, b *git.Options) bool {
+	encodedA, _ := json.Marshal(a)
+	encodedB, _ := json.Marshal(b)
+	return bytes.Equal(encodedA, encodedB)
+}
+
+// Reconciler reconciles the mirrors with a mirrors file
+type Reconciler struct {
+	manager *Manager
+	path    string
+	// checksum is that of the file content last reconciled without errors
+	checksum [sha256.Size]byte
+	mutex    sync.Mutex
+}
+
+// NewReconciler creates a new Reconciler for the mirrors file at path
+func NewReconciler(manager *Manager, path string) *Reconciler {
+	return &Reconciler{manager: manager, path: path}
+}
+
+// Plan lists the changes needed to reconcile the mirrors with the mirrors file
+func (r *Reconciler) Plan() ([]*Change, gmm.ApplicationError) {
+	declaration, _, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r.manager.Plan(declaration)
+}
+
+// Reconcile applies the mirrors file, also when it did not change
+func (r *Reconciler) Reconcile() ([]*Change, gmm.ApplicationError) {
+	return r.reconcile(true)
+}
+
+// ReconcileIfChanged applies the mirrors file if it changed since it was last applied without errors
+func (r *Reconciler) ReconcileIfChanged() ([]*Change, gmm.ApplicationError) {
+	return r.reconcile(false)
+}
+
+func (r *Reconciler) reconcile(force bool) ([]*Change, gmm.ApplicationError) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	declaration, checksum, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	if !force && checksum == r.checksum {
+		return []*Change{}, nil
+	}
+	log.Infof("Reconciling mirrors with '%s'", r.path)
+	changes, err := r.manager.Reconcile(declaration)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		if change.Error != "" {
+			return changes, nil
+		}
+	}
+	r.checksum = checksum
+	return changes, nil
+}
+
+func (r *Reconciler) load() (*Declaration, [sha256.Size]byte, gmm.ApplicationError) {
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	declaration, parseErr := ParseDeclaration(data)
+	return declaration, sha256.Sum256(data), parseErr
+}
+
+// CreateReconcileCron creates a Cron that reconciles the mirrors when the mirrors file changed,
+// or nil when interval is "false"
+func CreateReconcileCron(reconciler *Reconciler, interval string) (git.Cron, gmm.ApplicationError) {
+	if strings.ToLower(interval) == "false" {
+		return nil, nil
+	}
+	c := cron.New()
+	err := c.AddFunc(interval, func() {
+		if _, err := reconciler.ReconcileIfChanged(); err != nil {
+			log.Error(err)
+		}
+	})
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrCron)
+	}
+	return c, nil
+}
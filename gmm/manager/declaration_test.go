@@ -0,0 +1,217 @@
+package manager_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/gmm/manager"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// newDeclarationTestManager creates a manager with the mirrors "ns/a" (lfs), "ns/b" and "ns/dep", a submodule of "ns/b"
+func newDeclarationTestManager(t *testing.T) (*manager.Manager, string) {
+	baseDir, err := ioutil.TempDir(os.TempDir(), "declaration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := &mocks.CommandRunner{}
+	cmd.On("SetConfig", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(true)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	policyMock.On("Assert", mock.Anything).Return(nil)
+	m := manager.NewManager(
+		func(uri string, options *git.Options) (*git.Mirror, gmm.ApplicationError) {
+			return git.NewMirror(uri, options, baseDir, "", cmd, fs, func(mirror *git.Mirror, interval string) (git.Cron, gmm.ApplicationError) {
+				cron := &mocks.Cron{}
+				cron.On("Start")
+				cron.On("Stop")
+				return cron, nil
+			}, nil, nil)
+		},
+		cmd,
+		fs,
+		policyMock,
+		nil,
+		nil,
+		nil,
+	)
+	m.AddByURI("https://example.com/ns/a", &git.Options{LFS: true})
+	m.AddByURI("https://example.com/ns/b", nil)
+	m.AddByURI("https://example.com/ns/dep", &git.Options{SubmoduleOf: []string{"ns/b"}})
+	return m, baseDir
+}
+
+func TestParseDeclaration(t *testing.T) {
+	assertions := assert.New(t)
+	expected := &manager.Declaration{
+		Prune: true,
+		Mirrors: []*manager.DeclaredMirror{
+			{URI: "https://example.com/ns/a", Options: &git.Options{LFS: true, IncludeRefs: []string{"refs/heads/*"}}},
+			{URI: "https://example.com/ns/b"},
+		},
+	}
+
+	declaration, err := manager.ParseDeclaration([]byte(`
+prune: true
+mirrors:
+  - uri: https://example.com/ns/a
+    options:
+      lfs: true
+      includeRefs: ["refs/heads/*"]
+  - uri: https://example.com/ns/b
+`))
+	assertions.Nil(err)
+	assertions.Equal(expected, declaration)
+
+	declaration, err = manager.ParseDeclaration([]byte(`{"prune": true, "mirrors": [
+		{"uri": "https://example.com/ns/a", "options": {"lfs": true, "includeRefs": ["refs/heads/*"]}},
+		{"uri": "https://example.com/ns/b"}
+	]}`))
+	assertions.Nil(err)
+	assertions.Equal(expected, declaration)
+}
+
+func TestParseDeclarationRejectsInvalidFiles(t *testing.T) {
+	assertions := assert.New(t)
+	for _, data := range []string{
+		"mirrors: [",
+		"mirrors:\n  - uri: https://example.com/ns/a\n    options:\n      lsf: true\n",
+		"mirror: []",
+	} {
+		_, err := manager.ParseDeclaration([]byte(data))
+		if assertions.Error(err, data) {
+			assertions.Equal(gmm.ErrUser, err.Code())
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	m, baseDir := newDeclarationTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	changes, err := m.Plan(&manager.Declaration{Mirrors: []*manager.DeclaredMirror{
+		{URI: "https://example.com/ns/a", Options: &git.Options{LFS: true}},
+		{URI: "https://example.com/ns/b", Options: &git.Options{Submodules: true}},
+		{URI: "https://example.com/ns/c"},
+	}})
+	assertions.Nil(err)
+	assertions.Equal([]*manager.Change{
+		{Action: manager.ChangeConfigure, Name: "ns/b", URI: "https://example.com/ns/b", Options: &git.Options{Submodules: true}, Previous: &git.Options{}},
+		{Action: manager.ChangeAdd, Name: "ns/c", URI: "https://example.com/ns/c", Options: &git.Options{}},
+	}, changes)
+}
+
+func TestPlanPrunesUndeclaredMirrorsExceptDependents(t *testing.T) {
+	m, baseDir := newDeclarationTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	changes, err := m.Plan(&manager.Declaration{Prune: true, Mirrors: []*manager.DeclaredMirror{
+		{URI: "https://example.com/ns/b"},
+	}})
+	assertions.Nil(err)
+	assertions.Equal([]*manager.Change{
+		{Action: manager.ChangeRemove, Name: "ns/a", URI: "https://example.com/ns/a"},
+	}, changes)
+}
+
+func TestPlanKeepsUndeclaredState(t *testing.T) {
+	m, baseDir := newDeclarationTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+	mirror, _ := m.Get("ns/b")
+	mirror.SetOptions(&git.Options{Suspended: true})
+
+	changes, err := m.Plan(&manager.Declaration{Mirrors: []*manager.DeclaredMirror{
+		{URI: "https://example.com/ns/b"},
+		{URI: "https://example.com/ns/dep"},
+	}})
+	assertions.Nil(err)
+	assertions.Len(changes, 0)
+}
+
+func TestPlanRejectsInvalidDeclarations(t *testing.T) {
+	m, baseDir := newDeclarationTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	for _, mirrors := range [][]*manager.DeclaredMirror{
+		{{URI: "https://example.com/ns/c"}, {URI: "https://example.com/ns/c"}},
+		{{URI: "https://example.org/ns/a"}},
+		{{URI: "https://example.com/ns/a", Options: &git.Options{CloneMode: git.CloneModeBlobless}}},
+		{{URI: "https://example.com/ns/c", Options: &git.Options{CloneMode: "sparse"}}},
+	} {
+		_, err := m.Plan(&manager.Declaration{Mirrors: mirrors})
+		if assertions.Error(err) {
+			assertions.Equal(gmm.ErrUser, err.Code())
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	m, baseDir := newDeclarationTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	changes, err := m.Reconcile(&manager.Declaration{Prune: true, Mirrors: []*manager.DeclaredMirror{
+		{URI: "https://example.com/ns/b", Options: &git.Options{Pinned: true}},
+		{URI: "https://example.com/ns/c"},
+	}})
+	assertions.Nil(err)
+	assertions.Len(changes, 3)
+	for _, change := range changes {
+		assertions.Empty(change.Error)
+	}
+	assertions.False(m.HasName("ns/a"))
+	assertions.True(m.HasName("ns/c"))
+	assertions.True(m.HasName("ns/dep"))
+	mirror, _ := m.Get("ns/b")
+	assertions.True(mirror.Options().Pinned)
+
+	changes, err = m.Plan(&manager.Declaration{Prune: true, Mirrors: []*manager.DeclaredMirror{
+		{URI: "https://example.com/ns/b", Options: &git.Options{Pinned: true}},
+		{URI: "https://example.com/ns/c"},
+	}})
+	assertions.Nil(err)
+	assertions.Len(changes, 0)
+}
+
+func TestReconcilerOnlyReconcilesChangedFiles(t *testing.T) {
+	m, baseDir := newDeclarationTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+	file := path.Join(baseDir, "mirrors.yaml")
+	reconciler := manager.NewReconciler(m, file)
+
+	_, err := reconciler.ReconcileIfChanged()
+	assertions.Error(err)
+
+	ioutil.WriteFile(file, []byte("mirrors:\n  - uri: https://example.com/ns/c\n"), 0644)
+	changes, err := reconciler.Plan()
+	assertions.Nil(err)
+	assertions.Len(changes, 1)
+	assertions.False(m.HasName("ns/c"))
+
+	changes, err = reconciler.ReconcileIfChanged()
+	assertions.Nil(err)
+	assertions.Len(changes, 1)
+	assertions.True(m.HasName("ns/c"))
+
+	m.RemoveByName("ns/c")
+	changes, err = reconciler.ReconcileIfChanged()
+	assertions.Nil(err)
+	assertions.Len(changes, 0)
+	assertions.False(m.HasName("ns/c"))
+
+	changes, err = reconciler.Reconcile()
+	assertions.Nil(err)
+	assertions.Len(changes, 1)
+	assertions.True(m.HasName("ns/c"))
+}
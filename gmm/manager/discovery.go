@@ -0,0 +1,161 @@
+package manager
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/discovery"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/robfig/cron"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// ParseSources reads the discovery sources from the "sources" list of a YAML or JSON document
+func ParseSources(data []byte) ([]*discovery.Source, gmm.ApplicationError) {
+	document := &struct {
+		Sources []*discovery.Source `json:"sources"`
+	}{}
+	if err := decodeDocument(data, document); err != nil {
+		return nil, gmm.NewError("invalid discovery file: "+err.Error(), gmm.ErrUser)
+	}
+	names := make(map[string]bool)
+	for _, source := range document.Sources {
+		if err := source.Validate(); err != nil {
+			return nil, err
+		}
+		if names[source.Name] {
+			return nil, gmm.NewError("source '"+source.Name+"' is declared more than once", gmm.ErrUser)
+		}
+		names[source.Name] = true
+	}
+	return document.Sources, nil
+}
+
+// PlanDiscovery lists the changes needed to mirror the repositories discovered by source.
+// Repositories rejected by policy are skipped, as are those already mirrored unless source added them,
+// in which case their settings are kept in sync with the source's options.
+// When the source prunes, mirrors it added for repositories no longer discovered are removed.
+func (m *Manager) PlanDiscovery(source *discovery.Source, repositories []*discovery.Repository) ([]*Change, gmm.ApplicationError) {
+	options := &git.Options{}
+	if source.Options != nil {
+		copied := *source.Options
+		options = &copied
+	}
+	options.DiscoveredBy = source.Name
+	if err := m.assertOptions(options); err != nil {
+		return nil, err
+	}
+
+	changes := []*Change{}
+	discovered := make(map[string]bool)
+	for _, repository := range repositories {
+		uri := source.URI(repository)
+		if err := m.policy.Assert(uri); err != nil {
+			log.Warnf("Not mirroring '%s' discovered by source '%s': %s", uri, source.Name, err)
+			continue
+		}
+		name := git.MirrorNameFromURI(uri)
+		if discovered[name] {
+			continue
+		}
+		discovered[name] = true
+
+		mirror, err := m.Get(name)
+		if err != nil {
+			desired := *options
+			changes = append(changes, &Change{Action: ChangeAdd, Name: name, URI: uri, Options: &desired})
+			continue
+		}
+		previous := mirror.Options()
+		if previous.DiscoveredBy != source.Name || previous.Mode() != options.Mode() {
+			continue
+		}
+		desired := *options
+		desired.Suspended = previous.Suspended
+		desired.SubmoduleOf = previous.SubmoduleOf
+		if !equalOptions(previous, &desired) {
+			changes = append(changes, &Change{Action: ChangeConfigure, Name: name, URI: mirror.URI(), Options: &desired, Previous: previous})
+		}
+	}
+
+	if source.Prune {
+		for _, mirror := range m.List() {
+			if !discovered[mirror.Name] && mirror.Options().DiscoveredBy == source.Name {
+				changes = append(changes, &Change{Action: ChangeRemove, Name: mirror.Name, URI: mirror.URI()})
+			}
+		}
+	}
+	return changes, nil
+}
+
+// Discoverer mirrors the repositories discovered by the sources in a discovery file
+type Discoverer struct {
+	manager *Manager
+	client  *discovery.Client
+	path    string
+	mutex   sync.Mutex
+}
+
+// NewDiscoverer creates a new Discoverer for the discovery file at path
+func NewDiscoverer(manager *Manager, client *discovery.Client, path string) *Discoverer {
+	return &Discoverer{manager: manager, client: client, path: path}
+}
+
+// Plan lists the changes needed to mirror the repositories discovered by all sources.
+// Sources failing to list their repositories are skipped, and the last of their errors returned.
+func (d *Discoverer) Plan() ([]*Change, gmm.ApplicationError) {
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrFilesystem)
+	}
+	sources, parseErr := ParseSources(data)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	var lastErr gmm.ApplicationError
+	changes := []*Change{}
+	for _, source := range sources {
+		repositories, err := d.client.Discover(source)
+		if err == nil {
+			var planned []*Change
+			if planned, err = d.manager.PlanDiscovery(source, repositories); err == nil {
+				changes = append(changes, planned...)
+				continue
+			}
+		}
+		log.Errorf("Discovery of source '%s' failed: %s", source.Name, err)
+		lastErr = err
+	}
+	return changes, lastErr
+}
+
+// Sync applies the changes planned for all sources, see Plan
+func (d *Discoverer) Sync() ([]*Change, gmm.ApplicationError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	changes, err := d.Plan()
+	if changes != nil {
+		d.manager.apply(changes)
+	}
+	return changes, err
+}
+
+// CreateDiscoveryCron creates a Cron that syncs the mirrors with the discovery sources, or nil when interval is "false"
+func CreateDiscoveryCron(discoverer *Discoverer, interval string) (git.Cron, gmm.ApplicationError) {
+	if strings.ToLower(interval) == "false" {
+		return nil, nil
+	}
+	c := cron.New()
+	err := c.AddFunc(interval, func() {
+		if _, err := discoverer.Sync(); err != nil {
+			log.Error(err)
+		}
+	})
+	if err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrCron)
+	}
+	return c, nil
+}
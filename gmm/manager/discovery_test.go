@@ -0,0 +1,135 @@
+package manager_test
+
+import (
+	"fmt"
+	"github.com/kleijnweb/git-mirror-manager/gmm/discovery"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/gmm/manager"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseSources(t *testing.T) {
+	assertions := assert.New(t)
+	sources, err := manager.ParseSources([]byte(`
+sources:
+  - name: gh
+    forge: github
+    owner: some-org
+    include: ["service-*"]
+    prune: true
+    options:
+      lfs: true
+`))
+	assertions.Nil(err)
+	assertions.Equal([]*discovery.Source{{
+		Name: "gh", Forge: discovery.ForgeGitHub, Owner: "some-org", Include: []string{"service-*"}, Prune: true,
+		Options: &git.Options{LFS: true},
+	}}, sources)
+
+	for _, data := range []string{
+		"sources:\n  - name: gh\n    forge: github\n",
+		"sources:\n  - name: gh\n    forge: github\n    owner: x\n    owners: y\n",
+		"sources:\n  - {name: gh, forge: github, owner: x}\n  - {name: gh, forge: github, owner: y}\n",
+	} {
+		_, err := manager.ParseSources([]byte(data))
+		assertions.Error(err, data)
+	}
+}
+
+func discoveredRepositories(names ...string) []*discovery.Repository {
+	var repositories []*discovery.Repository
+	for _, name := range names {
+		repositories = append(repositories, &discovery.Repository{Name: name, CloneURL: "https://example.com/ns/" + name})
+	}
+	return repositories
+}
+
+func TestPlanDiscovery(t *testing.T) {
+	m, baseDir := newDeclarationTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+	source := &discovery.Source{Name: "gh", Options: &git.Options{Pinned: true}}
+
+	changes, err := m.PlanDiscovery(source, discoveredRepositories("a", "c"))
+	assertions.Nil(err)
+	assertions.Equal([]*manager.Change{
+		{Action: manager.ChangeAdd, Name: "ns/c", URI: "https://example.com/ns/c", Options: &git.Options{Pinned: true, DiscoveredBy: "gh"}},
+	}, changes)
+}
+
+func TestPlanDiscoverySyncsAndPrunesOwnMirrors(t *testing.T) {
+	m, baseDir := newDeclarationTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+	m.AddByURI("https://example.com/ns/c", &git.Options{DiscoveredBy: "gh"})
+	m.AddByURI("https://example.com/ns/d", &git.Options{DiscoveredBy: "gh"})
+	m.AddByURI("https://example.com/ns/e", &git.Options{DiscoveredBy: "other"})
+	source := &discovery.Source{Name: "gh", Prune: true, Options: &git.Options{Pinned: true}}
+
+	changes, err := m.PlanDiscovery(source, discoveredRepositories("c"))
+	assertions.Nil(err)
+	assertions.Equal([]*manager.Change{
+		{
+			Action: manager.ChangeConfigure, Name: "ns/c", URI: "https://example.com/ns/c",
+			Options:  &git.Options{Pinned: true, DiscoveredBy: "gh"},
+			Previous: &git.Options{DiscoveredBy: "gh"},
+		},
+		{Action: manager.ChangeRemove, Name: "ns/d", URI: "https://example.com/ns/d"},
+	}, changes)
+}
+
+func TestDeclarationDoesNotPruneDiscoveredMirrors(t *testing.T) {
+	m, baseDir := newDeclarationTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+	m.AddByURI("https://example.com/ns/c", &git.Options{DiscoveredBy: "gh"})
+
+	changes, err := m.Plan(&manager.Declaration{Prune: true, Mirrors: []*manager.DeclaredMirror{
+		{URI: "https://example.com/ns/a", Options: &git.Options{LFS: true}},
+		{URI: "https://example.com/ns/b"},
+	}})
+	assertions.Nil(err)
+	assertions.Len(changes, 0)
+}
+
+func TestDiscovererSync(t *testing.T) {
+	m, baseDir := newDeclarationTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/orgs/ns/repos" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `[{"name": "c", "clone_url": "https://example.com/ns/c"}, {"name": "d", "clone_url": "https://example.com/ns/d", "archived": true}]`)
+	}))
+	defer server.Close()
+	file := path.Join(baseDir, "discovery.yaml")
+	ioutil.WriteFile(file, []byte(`
+sources:
+  - {name: tea, forge: gitea, url: "`+server.URL+`", owner: ns}
+  - {name: broken, forge: gitea, url: "`+server.URL+`", owner: missing}
+`), 0644)
+	discoverer := manager.NewDiscoverer(m, discovery.NewClient(nil), file)
+
+	changes, err := discoverer.Plan()
+	assertions.Error(err)
+	assertions.Len(changes, 1)
+	assertions.False(m.HasName("ns/c"))
+
+	changes, err = discoverer.Sync()
+	assertions.Error(err)
+	assertions.Len(changes, 1)
+	if assertions.True(m.HasName("ns/c")) {
+		mirror, _ := m.Get("ns/c")
+		assertions.Equal("tea", mirror.Options().DiscoveredBy)
+	}
+	assertions.False(m.HasName("ns/d"))
+}
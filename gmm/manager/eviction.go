@@ -0,0 +1,96 @@
+package manager
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/robfig/cron"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// EvictionSuspend stops updating idle mirrors until they are accessed again
+	EvictionSuspend = "suspend"
+	// EvictionDelete removes idle mirrors
+	EvictionDelete = "delete"
+)
+
+// EvictionPolicy evicts mirrors nobody accessed for IdleDays, zero disabling eviction
+type EvictionPolicy struct {
+	IdleDays int
+	Action   string
+}
+
+// NewEvictionPolicy reads an EvictionPolicy from config
+func NewEvictionPolicy(config *gmm.Config) (*EvictionPolicy, gmm.ApplicationError) {
+	days, err := strconv.Atoi(config.EvictAfterDays)
+	if err != nil || days < 0 {
+		return nil, gmm.NewError("invalid number of days '"+config.EvictAfterDays+"'", gmm.ErrUser)
+	}
+	action := strings.ToLower(config.EvictionAction)
+	if action != EvictionSuspend && action != EvictionDelete {
+		return nil, gmm.NewError("eviction action '"+config.EvictionAction+"' is not supported", gmm.ErrUser)
+	}
+	return &EvictionPolicy{IdleDays: days, Action: action}, nil
+}
+
+// Eviction describes an idle mirror and what is done to it
+type Eviction struct {
+	Name       string    `json:"name"`
+	LastAccess time.Time `json:"lastAccess"`
+	IdleDays   int       `json:"idleDays"`
+	Action     string    `json:"action"`
+}
+
+// Evict suspends or removes the mirrors idle for longer than the eviction policy allows, and describes them.
+// Pinned and dependent mirrors are skipped, the latter are removed along with the mirrors they are a submodule of.
+// When dryRun is set, the mirrors are only described.
+func (m *Manager) Evict(dryRun bool) []*Eviction {
+	evictions := []*Eviction{}
+	if m.eviction == nil || m.eviction.IdleDays == 0 {
+		return evictions
+	}
+	now := time.Now()
+	for _, mirror := range m.List() {
+		options := mirror.Options()
+		if options.Pinned || len(options.SubmoduleOf) > 0 || (options.Suspended && m.eviction.Action == EvictionSuspend) {
+			continue
+		}
+		lastAccess := mirror.LastAccess()
+		idleDays := int(now.Sub(lastAccess).Hours() / 24)
+		if idleDays < m.eviction.IdleDays {
+			continue
+		}
+		evictions = append(evictions, &Eviction{mirror.Name, lastAccess, idleDays, m.eviction.Action})
+		if dryRun {
+			continue
+		}
+
+		log.Infof("Evicting '%s', idle for %d days", mirror.Name, idleDays)
+		var err gmm.ApplicationError
+		if m.eviction.Action == EvictionDelete {
+			err = m.RemoveByName(mirror.Name)
+		} else {
+			options.Suspended = true
+			err = mirror.SetOptions(options)
+		}
+		if err != nil {
+			log.Errorf("Evicting '%s' failed: %s", mirror.Name, err)
+		}
+	}
+	return evictions
+}
+
+// CreateEvictionCron creates a Cron that evicts idle mirrors, or nil when interval is "false"
+func CreateEvictionCron(manager *Manager, interval string) (git.Cron, gmm.ApplicationError) {
+	if strings.ToLower(interval) == "false" {
+		return nil, nil
+	}
+	c := cron.New()
+	if err := c.AddFunc(interval, func() { manager.Evict(false) }); err != nil {
+		return nil, gmm.NewErrorUsingError(err, gmm.ErrCron)
+	}
+	return c, nil
+}
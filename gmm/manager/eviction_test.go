@@ -0,0 +1,104 @@
+package manager_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/gmm/manager"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewEvictionPolicy(t *testing.T) {
+	assertions := assert.New(t)
+	eviction, err := manager.NewEvictionPolicy(&gmm.Config{EvictAfterDays: "30", EvictionAction: "Delete"})
+	assertions.Nil(err)
+	assertions.Equal(&manager.EvictionPolicy{IdleDays: 30, Action: manager.EvictionDelete}, eviction)
+
+	_, err = manager.NewEvictionPolicy(&gmm.Config{EvictAfterDays: "-1", EvictionAction: "suspend"})
+	assertions.Error(err)
+	_, err = manager.NewEvictionPolicy(&gmm.Config{EvictAfterDays: "30", EvictionAction: "archive"})
+	assertions.Error(err)
+}
+
+// newEvictionTestManager creates mirrors below baseDir that were last accessed 40 days ago, except "ns/recent"
+func newEvictionTestManager(t *testing.T, eviction *manager.EvictionPolicy) (*manager.Manager, string) {
+	baseDir, err := ioutil.TempDir(os.TempDir(), "eviction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := &mocks.CommandRunner{}
+	cmd.On("SetConfig", mock.Anything, "gmm.options", mock.Anything).Return(nil)
+	cmd.On("GetConfig", baseDir+"/ns/recent", "gmm.lastAccess").Return(time.Now().Format(time.RFC3339), nil)
+	cmd.On("GetConfig", mock.Anything, "gmm.lastAccess").Return(time.Now().Add(-40*24*time.Hour).Format(time.RFC3339), nil)
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(true)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	policyMock.On("Assert", mock.Anything).Return(nil)
+	m := manager.NewManager(
+		func(uri string, options *git.Options) (*git.Mirror, gmm.ApplicationError) {
+			return git.NewMirror(uri, options, baseDir, "", cmd, fs, func(mirror *git.Mirror, interval string) (git.Cron, gmm.ApplicationError) {
+				cron := &mocks.Cron{}
+				cron.On("Start")
+				cron.On("Stop")
+				return cron, nil
+			}, nil, nil)
+		},
+		cmd,
+		fs,
+		policyMock,
+		nil,
+		eviction,
+		nil,
+	)
+	m.AddByURI("https://example.com/ns/idle", nil)
+	m.AddByURI("https://example.com/ns/recent", nil)
+	m.AddByURI("https://example.com/ns/pinned", &git.Options{Pinned: true})
+	return m, baseDir
+}
+
+func TestEvictDryRun(t *testing.T) {
+	m, baseDir := newEvictionTestManager(t, &manager.EvictionPolicy{IdleDays: 30, Action: manager.EvictionDelete})
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	evictions := m.Evict(true)
+	if assertions.Len(evictions, 1) {
+		assertions.Equal("ns/idle", evictions[0].Name)
+		assertions.Equal(40, evictions[0].IdleDays)
+		assertions.Equal(manager.EvictionDelete, evictions[0].Action)
+	}
+	assertions.True(m.HasName("ns/idle"))
+}
+
+func TestEvictDeletesIdleMirrors(t *testing.T) {
+	m, baseDir := newEvictionTestManager(t, &manager.EvictionPolicy{IdleDays: 30, Action: manager.EvictionDelete})
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	assertions.Len(m.Evict(false), 1)
+	assertions.False(m.HasName("ns/idle"))
+	assertions.True(m.HasName("ns/recent"))
+	assertions.True(m.HasName("ns/pinned"))
+}
+
+func TestEvictSuspendsIdleMirrors(t *testing.T) {
+	m, baseDir := newEvictionTestManager(t, &manager.EvictionPolicy{IdleDays: 30, Action: manager.EvictionSuspend})
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	assertions.Len(m.Evict(false), 1)
+	mirror, _ := m.Get("ns/idle")
+	assertions.True(mirror.Options().Suspended)
+	assertions.Len(m.Evict(false), 0)
+}
+
+func TestEvictIsDisabledByDefault(t *testing.T) {
+	m, baseDir := newEvictionTestManager(t, nil)
+	defer os.RemoveAll(baseDir)
+	assert.New(t).Len(m.Evict(false), 0)
+}
@@ -0,0 +1,22 @@
+package manager
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"sort"
+	"time"
+)
+
+// ForcePushes returns the refs force-pushed since given time to any mirror, oldest first
+func (m *Manager) ForcePushes(since time.Time) ([]*git.ForcePush, gmm.ApplicationError) {
+	forcePushes := []*git.ForcePush{}
+	for _, mirror := range m.List() {
+		found, err := mirror.ForcePushes(since)
+		if err != nil {
+			return nil, err
+		}
+		forcePushes = append(forcePushes, found...)
+	}
+	sort.SliceStable(forcePushes, func(i, j int) bool { return forcePushes[i].Time.Before(forcePushes[j].Time) })
+	return forcePushes, nil
+}
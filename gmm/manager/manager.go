@@ -2,53 +2,174 @@ package manager
 
 import (
 	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
 	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/gmm/policy"
 	"github.com/kleijnweb/git-mirror-manager/gmm/util"
 	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
 )
 
+// MirrorFactory creates a Mirror for an upstream URI
+type MirrorFactory func(uri string, options *git.Options) (*git.Mirror, gmm.ApplicationError)
+
 // Manager provides a simple interface to mirror management
 type Manager struct {
-	mirrorFactory func(uri string) (*git.Mirror, gmm.ApplicationError)
+	mirrorFactory MirrorFactory
 	mirrors       map[string]*git.Mirror
+	mutex         sync.RWMutex
 	cmd           git.CommandRunner
 	fs            util.FileSystemUtil
+	policy        policy.Policy
+	quotas        *Quotas
+	eviction      *EvictionPolicy
+	events        events.Publisher
+	// submodulesMutex serializes the bookkeeping of dependent mirrors
+	submodulesMutex sync.Mutex
+	// adding holds the names of mirrors being created, which may take long as upstreams are contacted
+	adding map[string]bool
 }
 
-// NewManager creates a new Manager struct
-func NewManager(mirrorFactory func(uri string) (*git.Mirror, gmm.ApplicationError), cmd git.CommandRunner, fs util.FileSystemUtil) *Manager {
+// NewManager creates a new Manager struct, quotas, eviction and events may be nil
+func NewManager(
+	mirrorFactory MirrorFactory,
+	cmd git.CommandRunner,
+	fs util.FileSystemUtil,
+	policy policy.Policy,
+	quotas *Quotas,
+	eviction *EvictionPolicy,
+	events events.Publisher,
+) *Manager {
 	return &Manager{
 		mirrorFactory: mirrorFactory,
 		mirrors:       make(map[string]*git.Mirror),
+		adding:        make(map[string]bool),
 		cmd:           cmd,
 		fs:            fs,
+		policy:        policy,
+		quotas:        quotas,
+		eviction:      eviction,
+		events:        events,
 	}
 }
 
 // HasName tests whether name corresponds to a known mirror
 func (m *Manager) HasName(name string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	_, ok := m.mirrors[name]
 	return ok
 }
 
-// AddByURI adds a new mirror, or fails if the name was already used
-func (m *Manager) AddByURI(uri string) gmm.ApplicationError {
+// Get returns a mirror by name, or fails if the name is unknown
+func (m *Manager) Get(name string) (*git.Mirror, gmm.ApplicationError) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	mirror, ok := m.mirrors[name]
+	if !ok {
+		return nil, gmm.NewError("mirror '"+name+"' does not exist", gmm.ErrNotFound)
+	}
+	return mirror, nil
+}
+
+// List returns all mirrors sorted by name
+func (m *Manager) List() []*git.Mirror {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	list := make([]*git.Mirror, 0, len(m.mirrors))
+	for _, mirror := range m.mirrors {
+		list = append(list, mirror)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// AddByURI adds a new mirror, or fails if the uri or options are rejected by policy, a disk quota was reached
+// or the name was already used. When options is nil, the defaults are used.
+func (m *Manager) AddByURI(uri string, options *git.Options) gmm.ApplicationError {
+	if err := m.policy.Assert(uri); err != nil {
+		return err
+	}
+	if options == nil {
+		options = &git.Options{}
+	}
+	if err := m.assertOptions(options); err != nil {
+		return err
+	}
+
 	name := git.MirrorNameFromURI(uri)
 
-	if m.HasName(name) {
+	if err := m.assertQuota(namespaceOf(name)); err != nil {
+		return err
+	}
+
+	// The name is reserved while the mirror is created, which checks the upstream or clones a bundle,
+	// so that other requests are not blocked meanwhile
+	m.mutex.Lock()
+	if _, ok := m.mirrors[name]; ok || m.adding[name] {
+		m.mutex.Unlock()
 		return gmm.NewError("mirror '"+name+"' already exists", gmm.ErrUser)
 	}
+	m.adding[name] = true
+	m.mutex.Unlock()
 
-	if err := m.setByURI(uri); err != nil {
+	mirror, err := m.mirrorFactory(uri, options)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.adding, name)
+	if err != nil {
 		return err
 	}
+	m.register(uri, mirror)
+	m.publish(events.MirrorAdded, name)
+
+	return nil
+}
 
+// Configure changes the settings of a mirror, or fails if the name is unknown, options are rejected by policy
+// or the clone mode would change. The mirrors a dependent mirror is a submodule of, and the discovery source
+// that added the mirror, are kept. Existing tags are archived in the background when archiving gets enabled.
+func (m *Manager) Configure(name string, options *git.Options) gmm.ApplicationError {
+	mirror, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+	if err := m.assertOptions(options); err != nil {
+		return err
+	}
+	if mirror.Options().Mode() != options.Mode() {
+		return gmm.NewError("clone mode of '"+name+"' cannot be changed, remove and add the mirror instead", gmm.ErrUser)
+	}
+	previous := mirror.Options()
+	options.SubmoduleOf = previous.SubmoduleOf
+	options.DiscoveredBy = previous.DiscoveredBy
+	if err := mirror.SetOptions(options); err != nil {
+		return err
+	}
+	if len(previous.ArchiveFormats) == 0 && len(options.ArchiveFormats) > 0 {
+		go mirror.ArchiveTags()
+	}
 	return nil
 }
 
-// RemoveByName unregisters and destroys a mirror, or fails if the name is unknown
+// RemoveByName unregisters and destroys a mirror, or fails if the name is unknown.
+// Dependent mirrors no longer referenced by any mirror are removed too.
 func (m *Manager) RemoveByName(name string) gmm.ApplicationError {
-	if !m.HasName(name) {
+	if err := m.remove(name); err != nil {
+		return err
+	}
+	m.releaseDependents(name, nil)
+	return nil
+}
+
+func (m *Manager) remove(name string) gmm.ApplicationError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.mirrors[name]; !ok {
 		return gmm.NewError("mirror '"+name+"' does not exist", gmm.ErrNotFound)
 	}
 	log.Printf("Removing '%s'", name)
@@ -58,12 +179,15 @@ func (m *Manager) RemoveByName(name string) gmm.ApplicationError {
 	}
 
 	delete(m.mirrors, name)
+	m.publish(events.MirrorRemoved, name)
 
 	return nil
 }
 
 // LoadFromDisk loads existing mirrors from disk
 func (m *Manager) LoadFromDisk(baseDir string) gmm.ApplicationError {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
 	namespaceDirs, err := m.fs.ReadDir(baseDir)
 
@@ -73,6 +197,9 @@ func (m *Manager) LoadFromDisk(baseDir string) gmm.ApplicationError {
 
 	for _, nf := range namespaceDirs {
 		nsName := nf.Name()
+		if strings.HasPrefix(nsName, ".") {
+			continue
+		}
 		nsPath := baseDir + "/" + nsName
 		log.Printf("Handling namespace '%s'", nsName)
 		repoDirs, err := m.fs.ReadDir(nsPath)
@@ -81,8 +208,12 @@ func (m *Manager) LoadFromDisk(baseDir string) gmm.ApplicationError {
 		}
 
 		for _, f := range repoDirs {
+			// Hidden files hold data kept next to mirrors, such as their ref history
+			if strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
 			if remote, err := m.cmd.GetRemote(nsPath + "/" + f.Name()); err == nil {
-				if err := m.setByURI(remote); err != nil {
+				if err := m.setByURI(remote, nil); err != nil {
 					return err
 				}
 			} else {
@@ -94,16 +225,40 @@ func (m *Manager) LoadFromDisk(baseDir string) gmm.ApplicationError {
 	return nil
 }
 
-func (m *Manager) setByURI(uri string) gmm.ApplicationError {
+func (m *Manager) publish(eventType string, name string) {
+	if m.events != nil {
+		m.events.Publish(events.NewEvent(eventType, name))
+	}
+}
 
-	mirror, err := m.mirrorFactory(uri)
+func (m *Manager) assertOptions(options *git.Options) gmm.ApplicationError {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	for _, uri := range append(options.Upstreams, options.PushTargets...) {
+		if err := m.policy.Assert(uri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) setByURI(uri string, options *git.Options) gmm.ApplicationError {
+
+	mirror, err := m.mirrorFactory(uri, options)
 
 	if err != nil {
 		return err
 	}
 
-	m.mirrors[mirror.Name] = mirror
-	log.Printf("Set remote '%s' using alias '%s'", uri, mirror.Name)
+	m.register(uri, mirror)
 
 	return nil
 }
+
+// register makes a created mirror known, the caller holds the lock
+func (m *Manager) register(uri string, mirror *git.Mirror) {
+	mirror.OnUpdate(m.syncSubmodules)
+	m.mirrors[mirror.Name] = mirror
+	log.Printf("Set remote '%s' using alias '%s'", uri, mirror.Name)
+}
@@ -2,11 +2,14 @@ package manager_test
 
 import (
 	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
 	"github.com/kleijnweb/git-mirror-manager/gmm/git"
 	"github.com/kleijnweb/git-mirror-manager/gmm/manager"
+	"github.com/kleijnweb/git-mirror-manager/gmm/policy"
 	"github.com/kleijnweb/git-mirror-manager/gmm/util"
 	"github.com/kleijnweb/git-mirror-manager/mocks"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"os"
 	"testing"
 )
@@ -23,10 +26,16 @@ func (f *mockedFileInfo) Name() string {
 var mirrorFactoryCalled = false
 var fsUtilMock = &mocks.FileSystemUtil{}
 var gitCommandRunnerMock = &mocks.CommandRunner{}
+var policyMock = &mocks.Policy{}
 
 func NewTestManager(mirrorNames ...string) *manager.Manager {
+	policyMock.On("Assert", mock.Anything).Return(nil)
+	return newTestManagerWithPolicy(policyMock, mirrorNames...)
+}
+
+func newTestManagerWithPolicy(policy policy.Policy, mirrorNames ...string) *manager.Manager {
 	return manager.NewManager(
-		func(uri string) (*git.Mirror, gmm.ApplicationError) {
+		func(uri string, options *git.Options) (*git.Mirror, gmm.ApplicationError) {
 			mirrorName := mirrorNames[0]
 			mirrorNames = mirrorNames[1:]
 			mirrorFactoryCalled = true
@@ -43,29 +52,120 @@ func NewTestManager(mirrorNames ...string) *manager.Manager {
 		func() util.FileSystemUtil {
 			return fsUtilMock
 		}(),
+		policy,
+		nil,
+		nil,
+		nil,
 	)
 }
 
 func TestCannotAddSameNameMoreThanOnce(t *testing.T) {
 	assertions := assert.New(t)
 	m := NewTestManager("ns/a", "ns/a", "ns/b", "ns/a")
-	assertions.Nil(m.AddByURI("http://example.com/ns/a"))
-	assertions.Error(m.AddByURI("http://example.com/ns/a"))
-	assertions.Nil(m.AddByURI("http://example.com/ns/b"))
-	assertions.Error(m.AddByURI("http://example.com/ns/a"))
+	assertions.Nil(m.AddByURI("http://example.com/ns/a", nil))
+	assertions.Error(m.AddByURI("http://example.com/ns/a", nil))
+	assertions.Nil(m.AddByURI("http://example.com/ns/b", nil))
+	assertions.Error(m.AddByURI("http://example.com/ns/a", nil))
+}
+
+func TestAddByUriDoesNotBlockOtherRequestsWhileCreating(t *testing.T) {
+	assertions := assert.New(t)
+	entered, release := make(chan struct{}), make(chan struct{})
+	m := manager.NewManager(
+		func(uri string, options *git.Options) (*git.Mirror, gmm.ApplicationError) {
+			close(entered)
+			<-release
+			cronMock := &mocks.Cron{}
+			cronMock.On("Start")
+			return &git.Mirror{Name: "ns/slow", Cron: cronMock}, nil
+		},
+		gitCommandRunnerMock, fsUtilMock, policyMock, nil, nil, nil,
+	)
+	policyMock.On("Assert", mock.Anything).Return(nil)
+	added := make(chan gmm.ApplicationError)
+	go func() { added <- m.AddByURI("http://example.com/ns/slow", nil) }()
+	<-entered
+
+	assertions.Len(m.List(), 0)
+	assertions.False(m.HasName("ns/slow"))
+	err := m.AddByURI("http://example.com/ns/slow", nil)
+	if assertions.Error(err) {
+		assertions.Equal(gmm.ErrUser, err.Code())
+	}
+
+	close(release)
+	assertions.Nil(<-added)
+	assertions.True(m.HasName("ns/slow"))
+}
+
+func TestAddByUriIsRejectedByPolicy(t *testing.T) {
+	assertions := assert.New(t)
+	rejectingPolicy := &mocks.Policy{}
+	rejectingPolicy.On("Assert", mock.Anything).Return(gmm.NewError("rejected", gmm.ErrUser))
+	m := manager.NewManager(nil, gitCommandRunnerMock, fsUtilMock, rejectingPolicy, nil, nil, nil)
+	err := m.AddByURI("file:///ns/c", nil)
+	assertions.Error(err)
+	assertions.Equal(gmm.ErrUser, err.Code())
+	assertions.False(m.HasName("ns/c"))
 }
 
 func TestAddByUriInvokesMirrorFactory(t *testing.T) {
 	assertions := assert.New(t)
 	m := NewTestManager("ns/a")
-	m.AddByURI("http://example.com/ns/a")
+	m.AddByURI("http://example.com/ns/a", nil)
 	assertions.True(mirrorFactoryCalled)
 }
 
+func TestAddByUriRejectsPushTargetsByPolicy(t *testing.T) {
+	assertions := assert.New(t)
+	target := "https://127.0.0.1/ns/d"
+	targetRejectingPolicy := &mocks.Policy{}
+	targetRejectingPolicy.On("Assert", target).Return(gmm.NewError("rejected", gmm.ErrUser))
+	targetRejectingPolicy.On("Assert", mock.Anything).Return(nil)
+	m := newTestManagerWithPolicy(targetRejectingPolicy, "ns/d")
+	err := m.AddByURI("http://example.com/ns/d", &git.Options{PushTargets: []string{target}})
+	assertions.Error(err)
+	assertions.False(m.HasName("ns/d"))
+}
+
+func TestCanGetAndListMirrors(t *testing.T) {
+	assertions := assert.New(t)
+	m := NewTestManager("ns/b", "ns/a")
+	m.AddByURI("http://example.com/ns/b", nil)
+	m.AddByURI("http://example.com/ns/a", nil)
+
+	mirror, err := m.Get("ns/a")
+	assertions.Nil(err)
+	assertions.Equal("ns/a", mirror.Name)
+
+	_, err = m.Get("ns/c")
+	assertions.Equal(gmm.ErrNotFound, err.Code())
+
+	list := m.List()
+	assertions.Len(list, 2)
+	assertions.Equal("ns/a", list[0].Name)
+	assertions.Equal("ns/b", list[1].Name)
+}
+
+func TestCannotConfigureNonExistentMirror(t *testing.T) {
+	m := NewTestManager()
+	err := m.Configure("ns/x", &git.Options{})
+	assert.New(t).Equal(gmm.ErrNotFound, err.Code())
+}
+
+func TestCannotChangeCloneMode(t *testing.T) {
+	m := NewTestManager("ns/a")
+	m.AddByURI("http://example.com/ns/a", nil)
+	err := m.Configure("ns/a", &git.Options{CloneMode: git.CloneModeShallow, Depth: 1})
+	if assert.New(t).Error(err) {
+		assert.New(t).Equal(gmm.ErrUser, err.Code())
+	}
+}
+
 func TestCanRemoveMirror(t *testing.T) {
 	assertions := assert.New(t)
 	m := NewTestManager("ns/a")
-	m.AddByURI("http://example.com/ns/a")
+	m.AddByURI("http://example.com/ns/a", nil)
 	err := m.RemoveByName("ns/a")
 	assertions.Nil(err)
 }
@@ -90,3 +190,35 @@ func TestCanLoadFromDisk(t *testing.T) {
 	assertions.Nil(err)
 	assertions.True(m.HasName(mirrorName))
 }
+
+func TestAddAndRemoveArePublished(t *testing.T) {
+	var published []*events.Event
+	publisher := &mocks.Publisher{}
+	publisher.On("Publish", mock.Anything).Run(func(args mock.Arguments) {
+		published = append(published, args.Get(0).(*events.Event))
+	})
+	policyMock.On("Assert", mock.Anything).Return(nil)
+	m := manager.NewManager(
+		func(uri string, options *git.Options) (*git.Mirror, gmm.ApplicationError) {
+			cronMock := &mocks.Cron{}
+			cronMock.On("Start")
+			cronMock.On("Stop")
+			return &git.Mirror{Name: git.MirrorNameFromURI(uri), Cron: cronMock}, nil
+		},
+		gitCommandRunnerMock,
+		fsUtilMock,
+		policyMock,
+		nil,
+		nil,
+		publisher,
+	)
+	assertions := assert.New(t)
+
+	assertions.Nil(m.AddByURI("http://example.com/ns/a", nil))
+	assertions.Nil(m.RemoveByName("ns/a"))
+	if assertions.Len(published, 2) {
+		assertions.Equal(events.MirrorAdded, published[0].Type)
+		assertions.Equal(events.MirrorRemoved, published[1].Type)
+		assertions.Equal("ns/a", published[1].Mirror)
+	}
+}
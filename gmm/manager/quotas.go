@@ -0,0 +1,88 @@
+package manager
+
+import (
+	"fmt"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"strings"
+)
+
+// Quotas limit the disk space used by mirrors in bytes, zero meaning unlimited
+type Quotas struct {
+	// Total limits all mirrors together
+	Total int64
+	// Namespace limits each namespace not listed in Namespaces
+	Namespace  int64
+	Namespaces map[string]int64
+}
+
+// NewQuotas reads Quotas from config, where namespace quotas are "<namespace>=<size>" pairs and "*" sets the default
+func NewQuotas(config *gmm.Config) (*Quotas, gmm.ApplicationError) {
+	total, err := gmm.ParseSize(config.Quota)
+	if err != nil {
+		return nil, err
+	}
+	quotas := &Quotas{Total: total, Namespaces: make(map[string]int64)}
+	for _, item := range gmm.SplitList(config.NamespaceQuotas) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, gmm.NewError("invalid namespace quota '"+item+"'", gmm.ErrUser)
+		}
+		size, err := gmm.ParseSize(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if namespace := strings.TrimSpace(parts[0]); namespace == "*" {
+			quotas.Namespace = size
+		} else {
+			quotas.Namespaces[strings.ToLower(namespace)] = size
+		}
+	}
+	return quotas, nil
+}
+
+func (q *Quotas) namespace(namespace string) int64 {
+	if size, ok := q.Namespaces[namespace]; ok {
+		return size
+	}
+	return q.Namespace
+}
+
+// Usage is the disk space used by mirrors in bytes, as last measured
+type Usage struct {
+	Total      int64            `json:"total"`
+	Namespaces map[string]int64 `json:"namespaces"`
+}
+
+// Usage sums the disk space used by all mirrors, and per namespace
+func (m *Manager) Usage() *Usage {
+	usage := &Usage{Namespaces: make(map[string]int64)}
+	for _, mirror := range m.List() {
+		if diskUsage := mirror.Status().DiskUsage; diskUsage != nil {
+			usage.Total += diskUsage.Total()
+			usage.Namespaces[namespaceOf(mirror.Name)] += diskUsage.Total()
+		}
+	}
+	return usage
+}
+
+// assertQuota fails with ErrQuota when the disk space used by all mirrors, or those in namespace, has reached its quota
+func (m *Manager) assertQuota(namespace string) gmm.ApplicationError {
+	if m.quotas == nil {
+		return nil
+	}
+	usage := m.Usage()
+	if m.quotas.Total > 0 && usage.Total >= m.quotas.Total {
+		return gmm.NewError(fmt.Sprintf("mirrors use %d bytes, reaching the quota of %d", usage.Total, m.quotas.Total), gmm.ErrQuota)
+	}
+	if limit := m.quotas.namespace(namespace); limit > 0 && usage.Namespaces[namespace] >= limit {
+		return gmm.NewError(
+			fmt.Sprintf("mirrors in '%s' use %d bytes, reaching the quota of %d", namespace, usage.Namespaces[namespace], limit),
+			gmm.ErrQuota,
+		)
+	}
+	return nil
+}
+
+func namespaceOf(name string) string {
+	return strings.SplitN(name, "/", 2)[0]
+}
@@ -0,0 +1,80 @@
+package manager_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/gmm/manager"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+)
+
+func TestNewQuotas(t *testing.T) {
+	quotas, err := manager.NewQuotas(&gmm.Config{Quota: "1T", NamespaceQuotas: "*=10G, Big=100G"})
+	assertions := assert.New(t)
+	assertions.Nil(err)
+	assertions.Equal(int64(1<<40), quotas.Total)
+	assertions.Equal(int64(10<<30), quotas.Namespace)
+	assertions.Equal(map[string]int64{"big": 100 << 30}, quotas.Namespaces)
+
+	_, err = manager.NewQuotas(&gmm.Config{NamespaceQuotas: "big"})
+	assertions.Error(err)
+}
+
+// newQuotaTestManager creates a manager whose mirrors each use 100 bytes
+func newQuotaTestManager(quotas *manager.Quotas) *manager.Manager {
+	cmd := &mocks.CommandRunner{}
+	cmd.On("SetConfig", mock.Anything, "gmm.options", mock.Anything).Return(nil)
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(true)
+	fs.On("DirectorySize", "/path/ns/a").Return(int64(100), nil)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	policyMock.On("Assert", mock.Anything).Return(nil)
+	return manager.NewManager(
+		func(uri string, options *git.Options) (*git.Mirror, gmm.ApplicationError) {
+			return git.NewMirror(uri, options, "/path", "", cmd, fs, func(mirror *git.Mirror, interval string) (git.Cron, gmm.ApplicationError) {
+				cron := &mocks.Cron{}
+				cron.On("Start")
+				return cron, nil
+			}, nil, nil)
+		},
+		cmd,
+		fs,
+		policyMock,
+		quotas,
+		nil,
+		nil,
+	)
+}
+
+func TestUsage(t *testing.T) {
+	m := newQuotaTestManager(nil)
+	m.AddByURI("https://example.com/ns/a", nil)
+	m.AddByURI("https://example.com/other/b", nil)
+	usage := m.Usage()
+	assertions := assert.New(t)
+	assertions.Equal(int64(100), usage.Total)
+	assertions.Equal(map[string]int64{"ns": 100, "other": 0}, usage.Namespaces)
+}
+
+func TestAddByURIEnforcesNamespaceQuota(t *testing.T) {
+	m := newQuotaTestManager(&manager.Quotas{Namespaces: map[string]int64{"ns": 100}})
+	assertions := assert.New(t)
+	assertions.Nil(m.AddByURI("https://example.com/ns/a", nil))
+	assertions.Nil(m.AddByURI("https://example.com/other/b", nil))
+	err := m.AddByURI("https://example.com/ns/c", nil)
+	if assertions.Error(err) {
+		assertions.Equal(gmm.ErrQuota, err.Code())
+	}
+}
+
+func TestAddByURIEnforcesTotalQuota(t *testing.T) {
+	m := newQuotaTestManager(&manager.Quotas{Total: 50})
+	assertions := assert.New(t)
+	assertions.Nil(m.AddByURI("https://example.com/ns/a", nil))
+	err := m.AddByURI("https://example.com/other/b", nil)
+	if assertions.Error(err) {
+		assertions.Equal(gmm.ErrQuota, err.Code())
+	}
+}
@@ -0,0 +1,82 @@
+package manager
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	log "github.com/sirupsen/logrus"
+	"path"
+)
+
+// syncSubmodules adds the submodules of mirror as dependent mirrors, and releases the dependents it no longer references
+func (m *Manager) syncSubmodules(mirror *git.Mirror) {
+	m.submodulesMutex.Lock()
+	defer m.submodulesMutex.Unlock()
+
+	referenced := make(map[string]bool)
+	for _, uri := range mirror.Submodules() {
+		name, err := git.ParseMirrorName(path.Dir(path.Dir(mirror.Path())), uri)
+		if err == nil {
+			err = m.policy.Assert(uri)
+		}
+		if err != nil {
+			log.Warnf("Not mirroring submodule '%s' of '%s': %s", uri, mirror.Name, err)
+			continue
+		}
+		referenced[name] = true
+
+		dependent, err := m.Get(name)
+		if err != nil {
+			log.Infof("Adding submodule '%s' of '%s'", uri, mirror.Name)
+			options := &git.Options{Submodules: true, SubmoduleOf: []string{mirror.Name}}
+			if err := m.AddByURI(uri, options); err != nil {
+				log.Warnf("Adding submodule '%s' of '%s' failed: %s", uri, mirror.Name, err)
+			}
+			continue
+		}
+		options := dependent.Options()
+		// Mirrors added explicitly are never removed automatically, so they don't track references
+		if name == mirror.Name || len(options.SubmoduleOf) == 0 || contains(options.SubmoduleOf, mirror.Name) {
+			continue
+		}
+		options.SubmoduleOf = append(options.SubmoduleOf, mirror.Name)
+		if err := dependent.SetOptions(options); err != nil {
+			log.Error(err)
+		}
+	}
+	m.releaseDependents(mirror.Name, referenced)
+}
+
+// releaseDependents removes parent from the dependents not in keep, removing the dependents no longer referenced by any mirror
+func (m *Manager) releaseDependents(parent string, keep map[string]bool) {
+	for _, dependent := range m.List() {
+		options := dependent.Options()
+		if keep[dependent.Name] || !contains(options.SubmoduleOf, parent) {
+			continue
+		}
+		var remaining []string
+		for _, name := range options.SubmoduleOf {
+			if name != parent {
+				remaining = append(remaining, name)
+			}
+		}
+		if len(remaining) == 0 {
+			log.Infof("Removing '%s', it is no longer a submodule of any mirror", dependent.Name)
+			if err := m.RemoveByName(dependent.Name); err != nil {
+				log.Error(err)
+			}
+			continue
+		}
+		options.SubmoduleOf = remaining
+		if err := dependent.SetOptions(options); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
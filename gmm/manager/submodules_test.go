@@ -0,0 +1,96 @@
+package manager_test
+
+import (
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/git"
+	"github.com/kleijnweb/git-mirror-manager/gmm/manager"
+	"github.com/kleijnweb/git-mirror-manager/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// newSubmoduleTestManager creates mirrors below baseDir where "ns/parent" has a single submodule "ns/lib.git", until it is updated again
+func newSubmoduleTestManager(t *testing.T) (*manager.Manager, *mocks.CommandRunner, string) {
+	baseDir, err := ioutil.TempDir(os.TempDir(), "submodules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := &mocks.CommandRunner{}
+	cmd.On("SetConfig", mock.Anything, "gmm.options", mock.Anything).Return(nil)
+	cmd.On("FetchPrune", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	cmd.On("ListRefs", mock.Anything).Return("aaa refs/heads/main", nil)
+	cmd.On("GetSubmoduleURLs", baseDir+"/ns/parent", "aaa").Return("submodule.lib.url\n../lib.git\x00", nil).Once()
+	cmd.On("GetSubmoduleURLs", mock.Anything, "aaa").Return("", gmm.NewError("no .gitmodules", gmm.ErrFilesystem))
+	fs := &mocks.FileSystemUtil{}
+	fs.On("DirectoryExists", mock.Anything).Return(true)
+	fs.On("DirectorySize", mock.Anything).Return(int64(0), nil)
+	policyMock.On("Assert", mock.Anything).Return(nil)
+
+	m := manager.NewManager(
+		func(uri string, options *git.Options) (*git.Mirror, gmm.ApplicationError) {
+			return git.NewMirror(uri, options, baseDir, "", cmd, fs, func(mirror *git.Mirror, interval string) (git.Cron, gmm.ApplicationError) {
+				cron := &mocks.Cron{}
+				cron.On("Start")
+				cron.On("Stop")
+				return cron, nil
+			}, nil, nil)
+		},
+		cmd,
+		fs,
+		policyMock,
+		nil,
+		nil,
+		nil,
+	)
+	return m, cmd, baseDir
+}
+
+func TestSubmodulesAreAddedAsDependentMirrors(t *testing.T) {
+	m, _, baseDir := newSubmoduleTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	assertions.Nil(m.AddByURI("https://example.com/ns/parent", &git.Options{Submodules: true}))
+	parent, _ := m.Get("ns/parent")
+	assertions.Nil(parent.Update())
+
+	dependent, err := m.Get("ns/lib.git")
+	if assertions.Nil(err) {
+		assertions.Equal([]string{"ns/parent"}, dependent.Options().SubmoduleOf)
+		assertions.True(dependent.Options().Submodules)
+	}
+
+	// The submodule is gone after the next update
+	assertions.Nil(parent.Update())
+	assertions.False(m.HasName("ns/lib.git"))
+}
+
+func TestRemovingMirrorRemovesDependentMirrors(t *testing.T) {
+	m, _, baseDir := newSubmoduleTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	m.AddByURI("https://example.com/ns/parent", &git.Options{Submodules: true})
+	m.AddByURI("https://example.com/ns/other", nil)
+	parent, _ := m.Get("ns/parent")
+	parent.Update()
+	assertions.True(m.HasName("ns/lib.git"))
+
+	assertions.Nil(m.RemoveByName("ns/parent"))
+	assertions.False(m.HasName("ns/lib.git"))
+	assertions.True(m.HasName("ns/other"))
+}
+
+func TestConfigureKeepsSubmoduleOf(t *testing.T) {
+	m, _, baseDir := newSubmoduleTestManager(t)
+	defer os.RemoveAll(baseDir)
+	assertions := assert.New(t)
+
+	m.AddByURI("https://example.com/ns/lib.git", &git.Options{SubmoduleOf: []string{"ns/parent"}})
+	assertions.Nil(m.Configure("ns/lib.git", &git.Options{VerifyUpstreams: true}))
+	mirror, _ := m.Get("ns/lib.git")
+	assertions.Equal([]string{"ns/parent"}, mirror.Options().SubmoduleOf)
+}
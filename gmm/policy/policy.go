@@ -0,0 +1,205 @@
+package policy
+
+import (
+	"fmt"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Policy decides which upstream URIs may be mirrored
+type Policy interface {
+	Assert(uri string) gmm.ApplicationError
+	Protocols() []string
+}
+
+// Resolver resolves a host name to its IP addresses
+type Resolver func(host string) ([]net.IP, error)
+
+// URIPolicy checks upstream URIs against scheme, host and network rules
+type URIPolicy struct {
+	Schemes      []string
+	AllowedHosts []string
+	DeniedHosts  []string
+	BlockPrivate bool
+	Resolver     Resolver
+}
+
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// NewURIPolicy creates a URIPolicy from application config
+func NewURIPolicy(config *gmm.Config) *URIPolicy {
+	return &URIPolicy{
+		Schemes:      gmm.SplitList(config.AllowedSchemes),
+		AllowedHosts: gmm.SplitList(config.AllowedHosts),
+		DeniedHosts:  gmm.SplitList(config.DeniedHosts),
+		BlockPrivate: strings.ToLower(config.BlockPrivateNetworks) != "false",
+		Resolver:     net.LookupIP,
+	}
+}
+
+// Assert rejects uri with an ErrUser naming the first rule it violates
+func (p *URIPolicy) Assert(uri string) gmm.ApplicationError {
+	scheme, host, err := ParseURI(uri)
+	if err != nil {
+		return reject(uri, "syntax", err.Error())
+	}
+
+	if !contains(p.Schemes, scheme) {
+		return reject(uri, "scheme", fmt.Sprintf("'%s' is not an allowed scheme", scheme))
+	}
+
+	if host == "" {
+		return reject(uri, "host", "no host could be determined")
+	}
+
+	if pattern, ok := matchHost(p.DeniedHosts, host); ok {
+		return reject(uri, "denied-hosts:"+pattern, "host '"+host+"' is denied")
+	}
+
+	allowed := ""
+	if len(p.AllowedHosts) > 0 {
+		pattern, ok := matchHost(p.AllowedHosts, host)
+		if !ok {
+			return reject(uri, "allowed-hosts", "host '"+host+"' is not allowed")
+		}
+		allowed = pattern
+	}
+
+	// Hosts allowed explicitly may be on private networks, eg. an internal forge to push to
+	if p.BlockPrivate && (allowed == "" || allowed == "*") {
+		ips, err := p.resolve(host)
+		if err != nil {
+			return gmm.NewError("upstream '"+uri+"' could not be resolved: "+err.Error(), gmm.ErrNet)
+		}
+		for _, ip := range ips {
+			if network := privateNetwork(ip); network != "" {
+				return reject(uri, "private-network:"+network, "host '"+host+"' resolves to "+ip.String())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Protocols returns the git transport protocols matching the allowed schemes
+func (p *URIPolicy) Protocols() []string {
+	var protocols []string
+	for _, scheme := range p.Schemes {
+		protocol := gitProtocol(scheme)
+		if !contains(protocols, protocol) {
+			protocols = append(protocols, protocol)
+		}
+	}
+	return protocols
+}
+
+// ParseURI determines the scheme and host of any URI syntax git accepts,
+// including scp-like "user@host:path", "transport::address" and local paths.
+// URIs and hosts starting with "-" are refused, as git or ssh would take them for options.
+func ParseURI(uri string) (scheme string, host string, err error) {
+	if uri == "" {
+		return "", "", fmt.Errorf("uri is empty")
+	}
+	if strings.HasPrefix(uri, "-") {
+		return "", "", fmt.Errorf("uri starts with '-'")
+	}
+	scheme, host, err = parseURI(uri)
+	if err == nil && strings.HasPrefix(host, "-") {
+		return "", "", fmt.Errorf("host '%s' starts with '-'", host)
+	}
+	return scheme, host, err
+}
+
+func parseURI(uri string) (scheme string, host string, err error) {
+	if i := strings.Index(uri, "::"); i > 0 && !strings.Contains(uri[:i], "/") {
+		return strings.ToLower(uri[:i]), "", nil
+	}
+	if strings.Contains(uri, "://") {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", "", err
+		}
+		return strings.ToLower(u.Scheme), strings.ToLower(u.Hostname()), nil
+	}
+	colon := strings.Index(uri, ":")
+	slash := strings.Index(uri, "/")
+	if colon > 0 && (slash == -1 || colon < slash) {
+		host = uri[:colon]
+		if at := strings.LastIndex(host, "@"); at != -1 {
+			host = host[at+1:]
+		}
+		return "ssh", strings.ToLower(strings.Trim(host, "[]")), nil
+	}
+	return "file", "", nil
+}
+
+func (p *URIPolicy) resolve(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return p.Resolver(host)
+}
+
+func privateNetwork(ip net.IP) string {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return network.String()
+		}
+	}
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return ip.String()
+	}
+	return ""
+}
+
+func gitProtocol(scheme string) string {
+	scheme = strings.ToLower(scheme)
+	switch scheme {
+	case "ssh+git", "git+ssh":
+		return "ssh"
+	}
+	return scheme
+}
+
+func matchHost(patterns []string, host string) (string, bool) {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if strings.ToLower(item) == value {
+			return true
+		}
+	}
+	return false
+}
+
+func reject(uri string, rule string, reason string) gmm.ApplicationError {
+	return gmm.NewError("upstream '"+uri+"' rejected by rule '"+rule+"': "+reason, gmm.ErrUser)
+}
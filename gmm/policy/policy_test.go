@@ -0,0 +1,150 @@
+package policy_test
+
+import (
+	"errors"
+	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/policy"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+var parseURITestData = []struct {
+	uri    string
+	scheme string
+	host   string
+}{
+	{"https://github.com/moby/moby.git", "https", "github.com"},
+	{"HTTPS://GitHub.com:443/moby/moby", "https", "github.com"},
+	{"ssh://git@github.com/moby/moby.git", "ssh", "github.com"},
+	{"git@github.com:moby/moby.git", "ssh", "github.com"},
+	{"git://example.org/ns/name", "git", "example.org"},
+	{"file:///etc", "file", ""},
+	{"/etc/passwd", "file", ""},
+	{"git@github.com/some/repo", "file", ""},
+	{"ext::sh -c touch% /tmp/pwned", "ext", ""},
+}
+
+func newTestPolicy() *policy.URIPolicy {
+	return &policy.URIPolicy{
+		Schemes:      []string{"https", "ssh"},
+		DeniedHosts:  []string{"*.internal", "evil.example.com"},
+		BlockPrivate: true,
+		Resolver: func(host string) ([]net.IP, error) {
+			switch host {
+			case "intranet.example.com":
+				return []net.IP{net.ParseIP("10.1.2.3")}, nil
+			case "unresolvable.example.com":
+				return nil, errors.New("no such host")
+			}
+			return []net.IP{net.ParseIP("140.82.121.4")}, nil
+		},
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	for _, tt := range parseURITestData {
+		t.Run(tt.uri, func(t *testing.T) {
+			scheme, host, err := policy.ParseURI(tt.uri)
+			assertions := assert.New(t)
+			assertions.Nil(err)
+			assertions.Equal(tt.scheme, scheme)
+			assertions.Equal(tt.host, host)
+		})
+	}
+}
+
+var assertTestData = []struct {
+	uri  string
+	rule string
+}{
+	{"https://github.com/moby/moby.git", ""},
+	{"git@github.com:moby/moby.git", ""},
+	{"file:///etc", "'scheme'"},
+	{"ext::sh -c touch% /tmp/pwned", "'scheme'"},
+	{"git://github.com/moby/moby", "'scheme'"},
+	{"https://git.internal/ns/name", "'denied-hosts:*.internal'"},
+	{"https://evil.example.com/ns/name", "'denied-hosts:evil.example.com'"},
+	{"https://intranet.example.com/ns/name", "'private-network:10.0.0.0/8'"},
+	{"https://127.0.0.1/ns/name", "'private-network:127.0.0.0/8'"},
+	{"https://169.254.169.254/latest/meta-data", "'private-network:169.254.0.0/16'"},
+	{"ssh://[::1]/ns/name", "'private-network:::1/128'"},
+	{"-oProxyCommand=touch /tmp/pwned", "'syntax'"},
+	{"git@-oProxyCommand=pwned:ns/name", "'syntax'"},
+	{"ssh://-oProxyCommand=pwned/ns/name", "'syntax'"},
+}
+
+func TestAssert(t *testing.T) {
+	p := newTestPolicy()
+	for _, tt := range assertTestData {
+		t.Run(tt.uri, func(t *testing.T) {
+			err := p.Assert(tt.uri)
+			assertions := assert.New(t)
+			if tt.rule == "" {
+				assertions.Nil(err)
+				return
+			}
+			if assertions.Error(err) {
+				assertions.Equal(gmm.ErrUser, err.Code())
+				assertions.Contains(err.Error(), tt.rule)
+			}
+		})
+	}
+}
+
+func TestAssertAllowedHosts(t *testing.T) {
+	p := newTestPolicy()
+	p.AllowedHosts = []string{"github.com", "*.example.org"}
+	assertions := assert.New(t)
+	assertions.Nil(p.Assert("https://github.com/moby/moby"))
+	assertions.Nil(p.Assert("https://git.example.org/ns/name"))
+	err := p.Assert("https://gitlab.com/ns/name")
+	if assertions.Error(err) {
+		assertions.Contains(err.Error(), "'allowed-hosts'")
+	}
+}
+
+func TestAssertAllowedHostsMayBePrivate(t *testing.T) {
+	p := newTestPolicy()
+	p.AllowedHosts = []string{"github.com", "intranet.example.com"}
+	assertions := assert.New(t)
+	assertions.Nil(p.Assert("https://intranet.example.com/ns/name"))
+
+	p.AllowedHosts = []string{"*"}
+	err := p.Assert("https://intranet.example.com/ns/name")
+	if assertions.Error(err) {
+		assertions.Contains(err.Error(), "'private-network:10.0.0.0/8'")
+	}
+}
+
+func TestAssertReportsResolutionFailure(t *testing.T) {
+	err := newTestPolicy().Assert("https://unresolvable.example.com/ns/name")
+	assertions := assert.New(t)
+	if assertions.Error(err) {
+		assertions.Equal(gmm.ErrNet, err.Code())
+	}
+}
+
+func TestAssertCanAllowPrivateNetworks(t *testing.T) {
+	p := newTestPolicy()
+	p.BlockPrivate = false
+	assert.New(t).Nil(p.Assert("https://intranet.example.com/ns/name"))
+}
+
+func TestProtocols(t *testing.T) {
+	p := &policy.URIPolicy{Schemes: []string{"https", "SSH", "git+ssh"}}
+	assert.New(t).Equal([]string{"https", "ssh"}, p.Protocols())
+}
+
+func TestNewURIPolicy(t *testing.T) {
+	p := policy.NewURIPolicy(&gmm.Config{
+		AllowedSchemes:       "https, ssh",
+		DeniedHosts:          "*.internal",
+		BlockPrivateNetworks: "false",
+	})
+	assertions := assert.New(t)
+	assertions.Equal([]string{"https", "ssh"}, p.Schemes)
+	assertions.Nil(p.AllowedHosts)
+	assertions.Equal([]string{"*.internal"}, p.DeniedHosts)
+	assertions.False(p.BlockPrivate)
+}
@@ -1,6 +1,11 @@
 package util
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"strings"
 )
@@ -8,6 +13,9 @@ import (
 // CommandExecutor executes commands in a directory
 type CommandExecutor interface {
 	Exec(name string, directory string, args ...string) (string, error)
+	ExecEnv(name string, directory string, env []string, args ...string) (string, error)
+	ExecProgress(name string, directory string, env []string, progress func(line string), args ...string) (string, error)
+	ExecWriter(name string, directory string, env []string, stdout io.Writer, args ...string) error
 }
 
 // OsCommandExecutor executes commands using the OS CLI
@@ -15,10 +23,18 @@ type OsCommandExecutor struct{}
 
 // Exec invokes the a binary using CLI and returns STDOUT and STDERR as a string.
 func (m *OsCommandExecutor) Exec(name string, directory string, args ...string) (string, error) {
+	return m.ExecEnv(name, directory, nil, args...)
+}
+
+// ExecEnv is like Exec, adding env to the environment inherited from the current process
+func (m *OsCommandExecutor) ExecEnv(name string, directory string, env []string, args ...string) (string, error) {
 	cmd := exec.Command(name, args...)
 	if directory != "" {
 		cmd.Dir = directory
 	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 
 	output, err := cmd.CombinedOutput()
 	stringOutput := strings.TrimSpace(string(output))
@@ -29,3 +45,77 @@ func (m *OsCommandExecutor) Exec(name string, directory string, args ...string)
 
 	return stringOutput, nil
 }
+
+// ExecProgress is like ExecEnv, passing each line written to STDERR to progress as it is written.
+// The output is STDOUT followed by STDERR.
+// Lines ending in a carriage return, which git uses to redraw its progress meter, are not part of the output.
+func (m *OsCommandExecutor) ExecProgress(name string, directory string, env []string, progress func(line string), args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	if directory != "" {
+		cmd.Dir = directory
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	var output, errors bytes.Buffer
+	cmd.Stdout = &output
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(stderr)
+	scanner.Split(scanProgressLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasSuffix(line, "\r") {
+			errors.WriteString(line)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			progress(line)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return "", err
+	}
+
+	output.Write(errors.Bytes())
+	return strings.TrimSpace(output.String()), nil
+}
+
+// ExecWriter is like ExecEnv, writing STDOUT to stdout as it is written instead of returning it.
+// STDERR is part of the error, if any.
+func (m *OsCommandExecutor) ExecWriter(name string, directory string, env []string, stdout io.Writer, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if directory != "" {
+		cmd.Dir = directory
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	var errors bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &errors
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(errors.String()); message != "" {
+			return fmt.Errorf("%s: %s", err, message)
+		}
+		return err
+	}
+	return nil
+}
+
+// scanProgressLines is a bufio.SplitFunc splitting after each carriage return or newline
+func scanProgressLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
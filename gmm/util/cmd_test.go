@@ -1,6 +1,7 @@
 package util_test
 
 import (
+	"bytes"
 	"github.com/kleijnweb/git-mirror-manager/gmm/util"
   "github.com/stretchr/testify/assert"
   "testing"
@@ -22,3 +23,38 @@ func TestExecFailure(t *testing.T) {
   assertions.Error(err)
   assertions.Equal("", output)
 }
+
+func TestExecEnv(t *testing.T) {
+  command := &util.OsCommandExecutor{}
+  output, err := command.ExecEnv("sh", "/", []string{"GMM_TEST_VALUE=expected"}, "-c", "echo $GMM_TEST_VALUE")
+
+  assertions := assert.New(t)
+  assertions.Nil(err)
+  assertions.Equal("expected", output)
+}
+
+func TestExecProgress(t *testing.T) {
+  command := &util.OsCommandExecutor{}
+  var lines []string
+  output, err := command.ExecProgress("sh", "/", nil, func(line string) {
+    lines = append(lines, line)
+  }, "-c", `echo out; printf 'Receiving:  50%%\rReceiving: 100%%, done.\n' >&2`)
+
+  assertions := assert.New(t)
+  assertions.Nil(err)
+  assertions.Equal([]string{"Receiving:  50%", "Receiving: 100%, done."}, lines)
+  assertions.Equal("out\nReceiving: 100%, done.", output)
+}
+
+func TestExecWriter(t *testing.T) {
+  command := &util.OsCommandExecutor{}
+  var stdout bytes.Buffer
+  err := command.ExecWriter("sh", "/", nil, &stdout, "-c", "printf 'out\\n'; echo ignored >&2")
+
+  assertions := assert.New(t)
+  assertions.Nil(err)
+  assertions.Equal("out\n", stdout.String())
+
+  err = command.ExecWriter("sh", "/", nil, &stdout, "-c", "echo failed >&2; exit 1")
+  assertions.EqualError(err, "exit status 1: failed")
+}
@@ -3,6 +3,8 @@ package util
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"syscall"
 )
 
 // FileSystemUtil wraps some common filesystem operations
@@ -10,6 +12,9 @@ type FileSystemUtil interface {
 	DirectoryExists(path string) bool
 	Mkdir(path string) error
 	ReadDir(path string) ([]os.FileInfo, error)
+	RemoveAll(path string) error
+	DirectorySize(path string) (int64, error)
+	FreeSpace(path string) (uint64, error)
 }
 
 // OsFileSystemUtil delegates to standard librarys functions
@@ -33,3 +38,42 @@ func (u OsFileSystemUtil) Mkdir(path string) error {
 func (u OsFileSystemUtil) ReadDir(path string) ([]os.FileInfo, error) {
 	return ioutil.ReadDir(path)
 }
+
+// RemoveAll removes a path and anything it contains
+func (u OsFileSystemUtil) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// DirectorySize returns the total size of the files in a directory tree, which is zero if it doesn't exist
+func (u OsFileSystemUtil) DirectorySize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return size, err
+}
+
+// FreeSpace returns the disk space available to unprivileged users on the filesystem holding path,
+// or the nearest existing parent directory if path doesn't exist
+func (u OsFileSystemUtil) FreeSpace(path string) (uint64, error) {
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(path, &stat)
+		if err == nil {
+			return stat.Bavail * uint64(stat.Bsize), nil
+		}
+		if !os.IsNotExist(err) || filepath.Dir(path) == path {
+			return 0, err
+		}
+		path = filepath.Dir(path)
+	}
+}
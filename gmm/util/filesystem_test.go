@@ -42,3 +42,38 @@ func TestOsFileSystemUtil_ReadDir(t *testing.T) {
 
   assertions.Equal(slice[0].Name(), "test.txt")
 }
+
+func TestOsFileSystemUtil_RemoveAll(t *testing.T) {
+  dir, _ := ioutil.TempDir(os.TempDir(), "prefix")
+  assertions := assert.New(t)
+  u := OsFileSystemUtil{}
+  assertions.Nil(u.Mkdir(dir + "/subdir"))
+  assertions.Nil(u.RemoveAll(dir))
+  assertions.False(u.DirectoryExists(dir))
+}
+
+func TestOsFileSystemUtil_DirectorySize(t *testing.T) {
+  dir, _ := ioutil.TempDir(os.TempDir(), "prefix")
+  defer os.RemoveAll(dir)
+  assertions := assert.New(t)
+  u := OsFileSystemUtil{}
+  u.Mkdir(dir + "/subdir")
+  ioutil.WriteFile(dir+"/a", []byte("12345"), 0644)
+  ioutil.WriteFile(dir+"/subdir/b", []byte("123"), 0644)
+
+  size, err := u.DirectorySize(dir)
+  assertions.Nil(err)
+  assertions.Equal(int64(8), size)
+
+  size, err = u.DirectorySize(dir + "/missing")
+  assertions.Nil(err)
+  assertions.Equal(int64(0), size)
+}
+
+func TestOsFileSystemUtil_FreeSpace(t *testing.T) {
+  assertions := assert.New(t)
+  u := OsFileSystemUtil{}
+  free, err := u.FreeSpace(os.TempDir() + "/does/not/exist")
+  assertions.Nil(err)
+  assertions.True(free > 0)
+}
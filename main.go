@@ -2,19 +2,28 @@ package main
 
 import (
 	"github.com/kleijnweb/git-mirror-manager/gmm"
+	"github.com/kleijnweb/git-mirror-manager/gmm/credentials"
+	"github.com/kleijnweb/git-mirror-manager/gmm/events"
 	"github.com/kleijnweb/git-mirror-manager/gmm/git"
 	"github.com/kleijnweb/git-mirror-manager/gmm/http"
 	"github.com/kleijnweb/git-mirror-manager/gmm/manager"
+	"github.com/kleijnweb/git-mirror-manager/gmm/policy"
 	"github.com/kleijnweb/git-mirror-manager/gmm/util"
+	log "github.com/sirupsen/logrus"
 )
 
 // Container is a dead-simple DI container
 type Container struct {
-	config  *gmm.Config
-	git     git.CommandRunner
-	fs      util.FileSystemUtil
-	server  *http.Server
-	manager *manager.Manager
+	config      *gmm.Config
+	git         git.CommandRunner
+	fs          util.FileSystemUtil
+	policy      policy.Policy
+	credentials credentials.Vault
+	quotas      *manager.Quotas
+	eviction    *manager.EvictionPolicy
+	events      *events.Bus
+	server      *http.Server
+	manager     *manager.Manager
 }
 
 // Config creates and/or returns a new Config object
@@ -28,7 +37,20 @@ func (c *Container) Config() *gmm.Config {
 // Git creates and/or returns a new Git object
 func (c *Container) Git() git.CommandRunner {
 	if nil == c.git {
-		c.git = &git.DefaultCommandRunner{}
+		minFreeSpace, err := gmm.ParseSize(c.Config().MinFreeSpace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.git = &git.DefaultCommandRunner{
+			Fs:             c.Fs(),
+			Executor:       &util.OsCommandExecutor{},
+			Protocols:      c.Policy().Protocols(),
+			Credentials:    c.Credentials(),
+			MinFreeSpace:   uint64(minFreeSpace),
+			KeyringDir:     c.Config().KeyringDir,
+			AllowedSigners: c.Config().AllowedSigners,
+			SigningKey:     c.Config().SigningKey,
+		}
 	}
 	return c.git
 }
@@ -41,10 +63,62 @@ func (c *Container) Fs() util.FileSystemUtil {
 	return c.fs
 }
 
+// Policy creates and/or returns a new Policy object
+func (c *Container) Policy() policy.Policy {
+	if nil == c.policy {
+		c.policy = policy.NewURIPolicy(c.Config())
+	}
+	return c.policy
+}
+
+// Credentials creates and/or returns a new Credentials object
+func (c *Container) Credentials() credentials.Vault {
+	if nil == c.credentials {
+		c.credentials = credentials.NewDirectoryVault(c.Config().CredentialsDir)
+	}
+	return c.credentials
+}
+
+// Quotas creates and/or returns a new Quotas object
+func (c *Container) Quotas() *manager.Quotas {
+	if nil == c.quotas {
+		quotas, err := manager.NewQuotas(c.Config())
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.quotas = quotas
+	}
+	return c.quotas
+}
+
+// Eviction creates and/or returns a new EvictionPolicy object
+func (c *Container) Eviction() *manager.EvictionPolicy {
+	if nil == c.eviction {
+		eviction, err := manager.NewEvictionPolicy(c.Config())
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.eviction = eviction
+	}
+	return c.eviction
+}
+
+// Events creates and/or returns a new Bus object
+func (c *Container) Events() *events.Bus {
+	if nil == c.events {
+		bus, err := events.NewBusFromConfig(c.Config())
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.events = bus
+	}
+	return c.events
+}
+
 // Server creates and/or returns a new Server object
 func (c *Container) Server() *http.Server {
 	if nil == c.server {
-		c.server = http.NewServer(c.Manager())
+		c.server = http.NewServer(c.Manager(), c.Credentials(), c.Events())
 	}
 	return c.server
 }
@@ -53,18 +127,31 @@ func (c *Container) Server() *http.Server {
 func (c *Container) Manager() *manager.Manager {
 	if nil == c.manager {
 		c.manager = manager.NewManager(
-			func(uri string) (*git.Mirror, gmm.ApplicationError) {
+			func(uri string, options *git.Options) (*git.Mirror, gmm.ApplicationError) {
 				return git.NewMirror(
 					uri,
+					options,
 					c.Config().MirrorBaseDir,
 					c.Config().MirrorUpdateInterval,
 					c.Git(),
 					c.Fs(),
 					git.CreateUpdateCron,
+					&git.MaintenanceSchedule{
+						Interval:          c.Config().MaintenanceInterval,
+						FsckInterval:      c.Config().FsckInterval,
+						CronFactory:       git.CreateMaintenanceCron,
+						BundleInterval:    c.Config().BundleInterval,
+						BundleCronFactory: git.CreateBundleCron,
+					},
+					c.Events(),
 				)
 			},
 			c.Git(),
 			c.Fs(),
+			c.Policy(),
+			c.Quotas(),
+			c.Eviction(),
+			c.Events(),
 		)
 	}
 	return c.manager
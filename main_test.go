@@ -2,9 +2,12 @@ package main
 
 import (
   "github.com/kleijnweb/git-mirror-manager/gmm"
+  "github.com/kleijnweb/git-mirror-manager/gmm/credentials"
+  "github.com/kleijnweb/git-mirror-manager/gmm/events"
   "github.com/kleijnweb/git-mirror-manager/gmm/git"
   "github.com/kleijnweb/git-mirror-manager/gmm/http"
   "github.com/kleijnweb/git-mirror-manager/gmm/manager"
+  "github.com/kleijnweb/git-mirror-manager/gmm/policy"
   "github.com/kleijnweb/git-mirror-manager/gmm/util"
   "github.com/stretchr/testify/assert"
   "testing"
@@ -16,6 +19,22 @@ func TestContainer_Config(t *testing.T) {
   assert.New(t).IsType(&gmm.Config{}, container.Config())
 }
 
+func TestContainer_Credentials(t *testing.T) {
+  assert.New(t).IsType(&credentials.DirectoryVault{}, container.Credentials())
+}
+
+func TestContainer_Quotas(t *testing.T) {
+  assert.New(t).IsType(&manager.Quotas{}, container.Quotas())
+}
+
+func TestContainer_Eviction(t *testing.T) {
+  assert.New(t).IsType(&manager.EvictionPolicy{}, container.Eviction())
+}
+
+func TestContainer_Events(t *testing.T) {
+  assert.New(t).IsType(&events.Bus{}, container.Events())
+}
+
 func TestContainer_Fs(t *testing.T) {
   assert.New(t).IsType(&util.OsFileSystemUtil{}, container.Fs())
 }
@@ -28,6 +47,10 @@ func TestContainer_Manager(t *testing.T) {
   assert.New(t).IsType(&manager.Manager{}, container.Manager())
 }
 
+func TestContainer_Policy(t *testing.T) {
+  assert.New(t).IsType(&policy.URIPolicy{}, container.Policy())
+}
+
 func TestContainer_Server(t *testing.T) {
   assert.New(t).IsType(&http.Server{}, container.Server())
 }